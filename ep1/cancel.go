@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+/**
+A client whose excel sheet turns out to have the wrong salaries wants the batches they already submitted stopped
+before anyone gets paid.
+
+The pool's queue is a channel, and a channel can't be searched or have a batch taken out of its middle, so
+CancelClient leaves the queue alone. SubmitBatch numbers every client's batches as they come in, and CancelClient
+marks every batch of the client numbered so far as cancelled. A manager getting hold of one of them drops it instead
+of processing it and answers ErrCancelled on the batch's result channel, the batches the client submits afterwards go
+through as usual. CancelClient waits for the managers to get to the cancelled batches, so once it returns every one of
+them was answered.
+
+A batch a manager already started on can't be cancelled, some of its payments may be out already. A batch waiting for
+the client's lock behind another batch of the same client hasn't started yet, so it can. That is also why CancelClient
+may wait a while: a cancelled batch is only dropped once the manager holding it gets the client's lock.
+
+Dropped batches still count as done for WithOnClientComplete, their number is in ClientProcessingStats.CancelledBatches.
+*/
+
+// answered on the result channel of a batch dropped by CancelClient
+var ErrCancelled = errors.New("batch cancelled")
+
+// a client's batches as far as cancelling them goes
+type clientQueue struct {
+	// batches submitted so far, the next one gets this number
+	submitted int
+	// batches numbered below this are cancelled
+	cancelledBefore int
+	// batches no manager started on or dropped yet (in the queue or waiting for the client's lock), and how many of
+	// them are cancelled
+	waiting   int
+	cancelled int
+	// closed once the cancelled batches are all dropped, nil while none are cancelled
+	dropped chan struct{}
+}
+
+// cancels every batch of the client that no manager started on yet, returning how many got cancelled. Batches
+// submitted afterwards aren't affected.
+// Waits until every cancelled batch was dropped and answered ErrCancelled. If ctx is done first, the batches stay
+// cancelled and ctx's error is returned with their number.
+func (p *ProcessorPool) CancelClient(ctx context.Context, clientID int) (int, error) {
+	p.pendingMutex.Lock()
+	queue, exists := p.clientQueues[clientID]
+	if !exists {
+		p.pendingMutex.Unlock()
+		return 0, nil
+	}
+	cancelled := queue.waiting - queue.cancelled
+	queue.cancelledBefore = queue.submitted
+	queue.cancelled = queue.waiting
+	if queue.cancelled > 0 && queue.dropped == nil {
+		queue.dropped = make(chan struct{})
+	}
+	dropped := queue.dropped
+	p.pendingMutex.Unlock()
+
+	if dropped == nil {
+		return cancelled, nil
+	}
+	select {
+	case <-dropped:
+		return cancelled, nil
+	case <-ctx.Done():
+		return cancelled, ctx.Err()
+	}
+}
+
+// numbers a newly submitted batch (must be called with pendingMutex held)
+func (p *ProcessorPool) queueBatch(batch *TransactionBatch) {
+	queue, exists := p.clientQueues[batch.clientID]
+	if !exists {
+		queue = &clientQueue{}
+		p.clientQueues[batch.clientID] = queue
+	}
+	batch.seq = queue.submitted
+	queue.submitted++
+	queue.waiting++
+}
+
+// called by the manager holding the client's lock, before processing the batch. Returns false if the batch was
+// cancelled, the manager drops it then and calls dropBatch.
+func (p *ProcessorPool) startBatch(batch TransactionBatch) bool {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	queue := p.clientQueues[batch.clientID]
+	if batch.seq < queue.cancelledBefore {
+		return false
+	}
+	p.leaveQueue(batch.clientID, queue)
+	return true
+}
+
+// answers ErrCancelled for a batch startBatch turned down, letting CancelClient know once it was the last one
+func (p *ProcessorPool) dropBatch(batch TransactionBatch) {
+	batch.answer(ErrCancelled)
+
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	queue := p.clientQueues[batch.clientID]
+	queue.cancelled--
+	if queue.cancelled == 0 {
+		close(queue.dropped)
+		queue.dropped = nil
+	}
+	p.leaveQueue(batch.clientID, queue)
+}
+
+// counts a batch out of the client's waiting ones, forgetting the client once none are left (must be called with
+// pendingMutex held)
+func (p *ProcessorPool) leaveQueue(clientID int, queue *clientQueue) {
+	queue.waiting--
+	if queue.waiting == 0 {
+		delete(p.clientQueues, clientID)
+	}
+}
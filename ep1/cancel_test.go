@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCancelClient(t *testing.T) {
+	// enough managers for client 1's batches to all be waiting for its lock with one left for client 2
+	complete, done := completions()
+	p := startPool(t, WithManagers(5), complete)
+	release := holdClient(t, p, 1)
+
+	results := make(chan error, 4)
+	for batchID := 1; batchID <= 3; batchID++ {
+		p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: batchID, result: results})
+	}
+	p.SubmitBatch(TransactionBatch{clientID: 2, transactionID: 4})
+	if stats := <-done; stats.TotalBatches != 1 || stats.CancelledBatches != 0 {
+		t.Fatalf("client 2: %+v, expected its batch processed", stats)
+	}
+
+	// the batches are cancelled even though ctx is done before they are dropped
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	if cancelled, err := p.CancelClient(expired, 1); cancelled != 3 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled %d of the 3 batches waiting for the client's lock (%v), expected all of them and the "+
+			"ctx's error", cancelled, err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("batch answered %v while the client's lock is held", <-results)
+	}
+	if cancelled, _ := p.CancelClient(expired, 1); cancelled != 0 {
+		t.Fatalf("cancelled %d batches again", cancelled)
+	}
+	if cancelled, err := p.CancelClient(context.Background(), 2); cancelled != 0 || err != nil {
+		t.Fatalf("cancelled %d batches (%v) of a client with none pending", cancelled, err)
+	}
+
+	// submitted after the cancellation, processed
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 5, result: results})
+	release()
+	if counts := awaitResults(t, results, 4); counts[ErrCancelled] != 3 || counts[nil] != 1 {
+		t.Fatalf("client 1's batches answered %v, expected 3 cancelled and the one submitted after processed", counts)
+	}
+	if stats := <-done; stats.TotalBatches != 1 || stats.CancelledBatches != 3 {
+		t.Fatalf("client 1: %+v, expected 3 batches cancelled and the one submitted after processed", stats)
+	}
+}
+
+func TestCancelClientWaitsForTheDrops(t *testing.T) {
+	p := startPool(t)
+	release := holdClient(t, p, 1)
+	results := make(chan error, 2)
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 1, result: results})
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 2, result: results})
+
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.CancelClient(expired, 1)
+	release()
+	if cancelled, err := p.CancelClient(context.Background(), 1); cancelled != 0 || err != nil {
+		t.Fatalf("cancelled %d batches (%v) already cancelled", cancelled, err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("CancelClient returned with %d of the 2 cancelled batches answered", len(results))
+	}
+	for range 2 {
+		if err := <-results; !errors.Is(err, ErrCancelled) {
+			t.Fatalf("cancelled batch answered %v, expected ErrCancelled", err)
+		}
+	}
+}
+
+func TestCancelledClientStartsOver(t *testing.T) {
+	p := startPool(t, WithManagers(2))
+	results := make(chan error, 1)
+
+	release := holdClient(t, p, 1)
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 1, result: results})
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.CancelClient(expired, 1)
+	release()
+	if err := <-results; !errors.Is(err, ErrCancelled) {
+		t.Fatalf("batch answered %v, expected it cancelled", err)
+	}
+
+	// the client's next submission isn't held to the old cancellation
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 2, result: results})
+	if err := <-results; err != nil {
+		t.Fatalf("batch answered %v, expected it processed", err)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+
+Episode 1 keeps its vault in memory: VaultKeyMap and VaultKeyMutex only work because every manager is a goroutine of
+the same process. Episode 1 itself says the managers would really be separate nodes, locking clients with Redis. Nodes
+share no memory, so there is no mutex to share: a node asks a lock service over the network and waits for the answer.
+
+This simulation does just that, with goroutines for nodes and channels for the network. The MessageBroker plays Redis:
+it owns every lock, and the only way to get one is to send it a message.
+
+- AcquireLock(clientID) asks for the client's lock. The broker grants it right away if it is free, otherwise the node
+  waits in line (first come, first served) until the holder releases it.
+- ReleaseLock hands the lock to the next node in line.
+
+Only the broker's goroutine ever touches the locks, so the broker needs no mutex either, it handles one message at a
+time, like Redis runs one command at a time.
+
+That gives the same guarantee as episode 1's client mutex: a client's batches are never processed by two nodes at once,
+which main checks. What episode 1 gets for free and a distributed lock doesn't is knowing the holder is alive. A
+goroutine holding a mutex can't crash without the whole process going down. A node can, taking its lock with it, and
+every node waiting on that client waits forever.
+
+So locks are leases, as Redis locks are keys with an expiry: a lease the holder doesn't release within LockTTL expires
+and goes to the next node in line. main has a node crash while holding a lock to show it.
+
+Gotcha: expiry cuts both ways. A node that is merely slow (a long GC pause, a retry backing off) can lose its lease
+while still working, and then two nodes work on the same client. Every lease carries a fencing token, increasing with
+every grant, ReleaseLock refuses a lease that has been handed to someone else since. A payment service checking the token
+on every write would refuse the stale node's writes too, this simulation only reports it.
+
+*/
+
+// represents a batch of transactions for a client
+type TransactionBatch struct {
+	clientID      int
+	transactionID int
+	transactions  []string
+}
+
+// simulated time it takes to process a single transaction
+const transactionCost = 50 * time.Millisecond
+
+// how long a lease lasts unless released, long enough for the longest batch
+const LockTTL = time.Second
+
+// returned by ReleaseLock for a lease that expired and may have been granted to another node
+var ErrLeaseExpired = errors.New("lease expired before it was released")
+
+// the right to work on a client, granted by the broker
+type Lease struct {
+	ClientID int
+	NodeID   int
+	// increases with every lease granted, a lease with a lower token than the current one is stale
+	Token     uint64
+	ExpiresAt time.Time
+}
+
+// the messages the broker handles, only acquire and release are sent by nodes
+type acquireMessage struct {
+	clientID int
+	nodeID   int
+	// gets the lease once granted
+	reply chan Lease
+}
+
+type releaseMessage struct {
+	lease Lease
+	reply chan error
+}
+
+// sent by a node that gave up waiting, so the broker doesn't grant it a lock nobody will release
+type cancelMessage struct {
+	acquire *acquireMessage
+}
+
+// the state of a client's lock, only touched by the broker's goroutine
+type lockState struct {
+	// zero Token when nobody holds the lock
+	holder Lease
+	// nodes waiting for the lock, in the order they asked
+	waiters []*acquireMessage
+}
+
+// hands out locks, see above
+type MessageBroker struct {
+	inbox chan any
+	ttl   time.Duration
+
+	// read only by the broker's goroutine
+	locks     map[int]*lockState
+	lastToken uint64
+}
+
+func NewMessageBroker(ttl time.Duration) *MessageBroker {
+	return &MessageBroker{inbox: make(chan any), ttl: ttl, locks: make(map[int]*lockState)}
+}
+
+// handles messages until ctx is done
+func (b *MessageBroker) Run(ctx context.Context) {
+	// expired leases are found by checking every now and then, as Redis does with expiring keys
+	sweep := time.NewTicker(b.ttl / 10)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-sweep.C:
+			b.expire(now)
+		case msg := <-b.inbox:
+			switch msg := msg.(type) {
+			case *acquireMessage:
+				b.acquire(msg)
+			case *releaseMessage:
+				msg.reply <- b.release(msg.lease)
+			case *cancelMessage:
+				b.cancel(msg.acquire)
+			}
+		}
+	}
+}
+
+func (b *MessageBroker) lock(clientID int) *lockState {
+	state, exists := b.locks[clientID]
+	if !exists {
+		state = &lockState{}
+		b.locks[clientID] = state
+	}
+	return state
+}
+
+func (b *MessageBroker) acquire(msg *acquireMessage) {
+	state := b.lock(msg.clientID)
+	if state.holder.Token == 0 {
+		b.grant(state, msg)
+		return
+	}
+	state.waiters = append(state.waiters, msg)
+}
+
+// makes the node of msg the holder of the lock
+func (b *MessageBroker) grant(state *lockState, msg *acquireMessage) {
+	b.lastToken++
+	state.holder = Lease{ClientID: msg.clientID, NodeID: msg.nodeID, Token: b.lastToken, ExpiresAt: time.Now().Add(b.ttl)}
+	// buffered, the node may be gone (see cancel)
+	msg.reply <- state.holder
+}
+
+// hands the lock to the next node in line, if any
+func (b *MessageBroker) handOver(clientID int) {
+	state := b.locks[clientID]
+	if len(state.waiters) == 0 {
+		delete(b.locks, clientID)
+		return
+	}
+	next := state.waiters[0]
+	state.waiters = state.waiters[1:]
+	b.grant(state, next)
+}
+
+func (b *MessageBroker) release(lease Lease) error {
+	state, exists := b.locks[lease.ClientID]
+	if !exists || state.holder.Token != lease.Token {
+		return ErrLeaseExpired
+	}
+	b.handOver(lease.ClientID)
+	return nil
+}
+
+func (b *MessageBroker) cancel(msg *acquireMessage) {
+	state, exists := b.locks[msg.clientID]
+	if !exists {
+		return
+	}
+	for i, waiter := range state.waiters {
+		if waiter == msg {
+			state.waiters = append(state.waiters[:i], state.waiters[i+1:]...)
+			return
+		}
+	}
+	// granted before the cancel arrived, the lease is in msg.reply
+	select {
+	case lease := <-msg.reply:
+		b.release(lease)
+	default:
+	}
+}
+
+// takes the lock away from holders that didn't release it in time
+func (b *MessageBroker) expire(now time.Time) {
+	for clientID, state := range b.locks {
+		if now.After(state.holder.ExpiresAt) {
+			fmt.Printf("Broker: lease %d of node %d on client %d expired\n", state.holder.Token, state.holder.NodeID, clientID)
+			b.handOver(clientID)
+		}
+	}
+}
+
+// waits for the client's lock, until ctx is done
+func (b *MessageBroker) AcquireLock(ctx context.Context, nodeID, clientID int) (Lease, error) {
+	msg := &acquireMessage{clientID: clientID, nodeID: nodeID, reply: make(chan Lease, 1)}
+	select {
+	case b.inbox <- msg:
+	case <-ctx.Done():
+		return Lease{}, ctx.Err()
+	}
+
+	select {
+	case lease := <-msg.reply:
+		return lease, nil
+	case <-ctx.Done():
+		// the broker may be gone too, in which case there is nobody to tell
+		select {
+		case b.inbox <- &cancelMessage{acquire: msg}:
+		case <-time.After(b.ttl):
+		}
+		return Lease{}, ctx.Err()
+	}
+}
+
+// gives the lock back, failing with ErrLeaseExpired if it was taken away in the meantime
+func (b *MessageBroker) ReleaseLock(ctx context.Context, lease Lease) error {
+	msg := &releaseMessage{lease: lease, reply: make(chan error, 1)}
+	select {
+	case b.inbox <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-msg.reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// counts the nodes working on each client, to check no two ever do at once. Instrumentation only, the nodes don't
+// coordinate through it.
+type overlapChecker struct {
+	working  sync.Map // client ID -> *atomic.Int32
+	overlaps atomic.Int32
+}
+
+func (c *overlapChecker) start(clientID int) {
+	counter, _ := c.working.LoadOrStore(clientID, &atomic.Int32{})
+	if counter.(*atomic.Int32).Add(1) > 1 {
+		c.overlaps.Add(1)
+	}
+}
+
+func (c *overlapChecker) stop(clientID int) {
+	counter, _ := c.working.Load(clientID)
+	counter.(*atomic.Int32).Add(-1)
+}
+
+// a node processing batches, the distributed counterpart of episode 1's AccountManager. With crashAfter > 0 the
+// node crashes after that many batches, before releasing the lock.
+func Node(ctx context.Context, nodeID int, broker *MessageBroker, queue <-chan TransactionBatch, checker *overlapChecker, crashAfter int) {
+	processed := 0
+	for batch := range queue {
+		lease, err := broker.AcquireLock(ctx, nodeID, batch.clientID)
+		if err != nil {
+			fmt.Printf("Node %d could not lock client %d: %v\n", nodeID, batch.clientID, err)
+			return
+		}
+		fmt.Printf("Node %d holds lease %d on client %d, processing batch %d\n", nodeID, lease.Token, batch.clientID, batch.transactionID)
+
+		checker.start(batch.clientID)
+		for range batch.transactions {
+			time.Sleep(transactionCost)
+		}
+		checker.stop(batch.clientID)
+
+		processed++
+		if processed == crashAfter {
+			fmt.Printf("Node %d crashed holding the lock on client %d, it expires within %s\n", nodeID, batch.clientID, LockTTL)
+			return
+		}
+
+		if err := broker.ReleaseLock(ctx, lease); err != nil {
+			// another node may have worked on the client while this one still did, see the gotcha above
+			fmt.Printf("Node %d lost its lease on client %d while processing batch %d: %v\n", nodeID, batch.clientID, batch.transactionID, err)
+			continue
+		}
+		fmt.Printf("Node %d finished batch %d for client %d\n", nodeID, batch.transactionID, batch.clientID)
+	}
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := NewMessageBroker(LockTTL)
+	go broker.Run(ctx)
+
+	// the work queue, a Redis list or a message queue topic between real nodes
+	queue := make(chan TransactionBatch, 10)
+	checker := &overlapChecker{}
+
+	var wg sync.WaitGroup
+	numNodes := 3
+	for nodeID := 1; nodeID <= numNodes; nodeID++ {
+		// node 3 crashes after its first batch
+		crashAfter := 0
+		if nodeID == numNodes {
+			crashAfter = 1
+		}
+		wg.Go(func() { Node(ctx, nodeID, broker, queue, checker, crashAfter) })
+	}
+
+	// the batches of episode 1, with a few more for the same clients
+	transactionBatches := []TransactionBatch{
+		{clientID: 1, transactionID: 1, transactions: []string{"Salary A", "Salary B", "Salary C"}},
+		{clientID: 2, transactionID: 2, transactions: []string{"Salary D", "Salary E", "Salary F"}},
+		{clientID: 1, transactionID: 3, transactions: []string{"Salary G", "Salary H", "Salary I"}},
+		{clientID: 3, transactionID: 4, transactions: []string{"Salary J", "Salary K", "Salary L"}},
+		{clientID: 2, transactionID: 5, transactions: []string{"Salary M", "Salary N", "Salary O"}},
+		{clientID: 3, transactionID: 6, transactions: []string{"Salary P", "Salary Q", "Salary R"}},
+		{clientID: 1, transactionID: 7, transactions: []string{"Salary S", "Salary T", "Salary U"}},
+	}
+
+	start := time.Now()
+	for _, batch := range transactionBatches {
+		queue <- batch
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf("Processed in %s, batches of the same client processed at the same time: %d\n",
+		time.Since(start).Round(time.Millisecond), checker.overlaps.Load())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+/**
+Compliance wants every payment attempt of a period in a spreadsheet. The journal (see journal.go) has all of them, but
+it grows with every batch ever processed, so ExportTransactionLog never holds more than one event: it reads the log
+one event at a time and writes each one out as a CSV row right away. csv.Writer buffers a few KB on its way to w and
+quotes the fields that need it (a comma, a quote or a line break in an error message doesn't break the row).
+*/
+
+// the columns of the export, in order
+var transactionLogHeader = []string{"batch_id", "transaction_id", "manager_id", "status", "timestamp", "error"}
+
+// writes the events of the log from from (included) to to (excluded) to w as CSV, with a header row.
+// transaction_id is only set for the events of a single transaction, manager_id for the events of a manager.
+func ExportTransactionLog(log WAL, from, to time.Time, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(transactionLogHeader); err != nil {
+		return err
+	}
+
+	err := log.Replay(func(event ProcessingEvent) error {
+		if event.Timestamp.Before(from) || !event.Timestamp.Before(to) {
+			return nil
+		}
+		managerID := ""
+		if event.ManagerID != 0 {
+			managerID = strconv.Itoa(event.ManagerID)
+		}
+		return writer.Write([]string{
+			strconv.Itoa(event.BatchID),
+			event.TransactionID,
+			managerID,
+			string(event.Status),
+			event.Timestamp.UTC().Format(time.RFC3339Nano),
+			event.Error,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var exportStart = time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+
+func TestExportTransactionLog(t *testing.T) {
+	log := &memWAL{events: []ProcessingEvent{
+		{BatchID: 1, ClientID: 1, Status: StatusPending, Timestamp: exportStart.Add(-time.Second)},
+		{BatchID: 1, ClientID: 1, ManagerID: 2, Status: StatusProcessing, Timestamp: exportStart},
+		{BatchID: 1, ClientID: 1, TransactionID: "1-1", ManagerID: 2, Status: StatusCommitted,
+			Timestamp: exportStart.Add(time.Second)},
+		{BatchID: 1, ClientID: 1, TransactionID: "1-2", ManagerID: 2, Status: StatusFailed,
+			Timestamp: exportStart.Add(2 * time.Second), Error: `bank said "no", twice` + "\nthen hung up"},
+		{BatchID: 1, ClientID: 1, ManagerID: 2, Status: StatusDone, Timestamp: exportStart.Add(time.Hour)},
+	}}
+
+	var out strings.Builder
+	if err := ExportTransactionLog(log, exportStart, exportStart.Add(time.Hour), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// whatever the quoting, the rows read back as written
+	rows, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, out.String())
+	}
+	expected := [][]string{
+		{"batch_id", "transaction_id", "manager_id", "status", "timestamp", "error"},
+		{"1", "", "2", "processing", "2024-01-01T09:00:00Z", ""},
+		{"1", "1-1", "2", "committed", "2024-01-01T09:00:01Z", ""},
+		{"1", "1-2", "2", "failed", "2024-01-01T09:00:02Z", "bank said \"no\", twice\nthen hung up"},
+	}
+	if !slices.EqualFunc(rows, expected, slices.Equal) {
+		t.Fatalf("exported %q, expected %q", rows, expected)
+	}
+}
+
+// a Writer out of a function
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestExportTransactionLogStreams(t *testing.T) {
+	log := &memWAL{}
+	for i := range 100000 {
+		log.events = append(log.events, ProcessingEvent{
+			BatchID: i, TransactionID: transactionKey(i, 0), ManagerID: 1, Status: StatusCommitted, Timestamp: exportStart,
+		})
+	}
+	replayed := 0
+	counting := walFunc(func(fn func(event ProcessingEvent) error) error {
+		return log.Replay(func(event ProcessingEvent) error {
+			replayed++
+			return fn(event)
+		})
+	})
+
+	// the first rows go out long before the log is read to the end, and a failing writer stops the export
+	full := errors.New("disk full")
+	var replayedAtFirstWrite int
+	err := ExportTransactionLog(counting, exportStart, exportStart.Add(time.Hour), writerFunc(func(p []byte) (int, error) {
+		replayedAtFirstWrite = replayed
+		return 0, full
+	}))
+	if !errors.Is(err, full) {
+		t.Fatalf("export returned %v, expected the writer's error", err)
+	}
+	if replayedAtFirstWrite >= len(log.events) || replayed >= len(log.events) {
+		t.Fatalf("%d of %d events read before the first write, %d before giving up", replayedAtFirstWrite,
+			len(log.events), replayed)
+	}
+}
+
+// a WAL that can only be replayed
+type walFunc func(fn func(event ProcessingEvent) error) error
+
+func (f walFunc) Append(event ProcessingEvent) error {
+	return errors.New("read only")
+}
+
+func (f walFunc) Replay(fn func(event ProcessingEvent) error) error {
+	return f(fn)
+}
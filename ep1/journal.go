@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+/**
+The pool's queue only lives in memory. When the process crashes every batch in it is gone, and so is what the
+managers were in the middle of: some payments of a batch went out, the rest didn't, and nobody knows which.
+
+The journal (WithJournal) is a write-ahead log of what happens to the batches. SubmitBatch writes a batch down
+(transactions included) before queueing it, and a manager writes down when it starts on a batch, every transaction it
+commits or gives up on, and when it is done with the batch (or dropped it, see cancel.go). Each entry is written
+before what it describes goes ahead.
+
+After a crash NewProcessorPoolFromLog reads the log back and starts a pool that submits again, in the order they were
+first submitted, the batches that weren't done or cancelled. The transactions of those batches that were already
+committed aren't paid again: every transaction has an idempotency key (its batch's ID and its position in the batch),
+and a manager skips a transaction whose key the journal has as committed. Batch IDs (transactionID) must be unique for
+that to work.
+
+Every transaction a manager processes asks whether its key was committed before the crash, and for nearly all of them
+the answer is no. A bloom filter of the committed keys answers those without taking the lock on the map. It is sized
+for 10M keys at 0.1% false positives, about 18MB. A false positive is the filter taking a key for committed when it
+isn't, and all it costs is the locked map lookup the filter was meant to save: the map has the last word, so a false
+positive never skips a payment. Dropping the map and trusting the filter alone would turn 1 in 1000 of those lookups
+into a salary silently never paid. The filter also can't forget a key the way the map does once its transaction is
+replayed, a key asked about again goes to the map again.
+
+The gotcha: a crash after a payment went out but before its committed entry was written still pays it twice on
+replay. The journal narrows that down to the one transaction in flight, closing it for good needs the payment side to
+take the idempotency key too, and recognise a payment it already made.
+*/
+
+// what happened to a batch, or to one of its transactions
+type BatchStatus string
+
+const (
+	// submitted, waiting in the queue
+	StatusPending BatchStatus = "pending"
+	// a manager started on the batch
+	StatusProcessing BatchStatus = "processing"
+	// a transaction of the batch was paid
+	StatusCommitted BatchStatus = "committed"
+	// a transaction of the batch failed every retry
+	StatusFailed BatchStatus = "failed"
+	// the manager is done with the batch
+	StatusDone BatchStatus = "done"
+	// dropped by CancelClient
+	StatusCancelled BatchStatus = "cancelled"
+)
+
+// an entry of the journal
+type ProcessingEvent struct {
+	BatchID  int `json:"batch_id"`
+	ClientID int `json:"client_id"`
+	// idempotency key of the transaction, for committed and failed events
+	TransactionID string `json:"transaction_id,omitempty"`
+	// 0 for pending events, written before any manager sees the batch
+	ManagerID int         `json:"manager_id,omitempty"`
+	Status    BatchStatus `json:"status"`
+	Timestamp time.Time   `json:"timestamp"`
+	Error     string      `json:"error,omitempty"`
+	// the batch's transactions, for pending events
+	Transactions []string `json:"transactions,omitempty"`
+}
+
+// an append-only log of ProcessingEvents
+type WAL interface {
+	// returns once the event is stored
+	Append(event ProcessingEvent) error
+	// calls fn with every event in the order they were appended, one at a time rather than loading the whole log.
+	// Stops at the first error fn returns, and returns it.
+	Replay(fn func(event ProcessingEvent) error) error
+}
+
+// writes the event to the journal, if there is one
+func (p *ProcessorPool) journal(event ProcessingEvent) {
+	if p.wal == nil {
+		return
+	}
+	event.Timestamp = time.Now()
+	if err := p.wal.Append(event); err != nil {
+		fmt.Printf("Writing %s of batch %d to the journal failed: %v\n", event.Status, event.BatchID, err)
+	}
+}
+
+const (
+	// the number of committed keys the filter in front of replayedCommits is sized for, and its false positive rate
+	// at that number
+	replayedFilterKeys           = 10_000_000
+	replayedFilterFalsePositives = 0.001
+)
+
+// the idempotency key of the batch's i-th transaction
+func transactionKey(batchID, i int) string {
+	return fmt.Sprintf("%d-%d", batchID, i+1)
+}
+
+// reports whether the transaction was committed before the crash, forgetting it: a transaction is only replayed once
+func (p *ProcessorPool) committedBeforeReplay(key string) bool {
+	// never committed, see above
+	if p.replayedFilter == nil || !p.replayedFilter.TestString(key) {
+		return false
+	}
+
+	p.replayedCommitsMutex.Lock()
+	defer p.replayedCommitsMutex.Unlock()
+
+	committed := p.replayedCommits[key]
+	delete(p.replayedCommits, key)
+	return committed
+}
+
+// starts a pool (see NewProcessorPool) picking up where the one writing the log left off: it submits the batches of
+// the log that weren't done or cancelled again, in the order they were first submitted, and goes on writing to the
+// log. Their transactions committed already are skipped by the managers, see above.
+// Returns once every batch is back in the queue.
+func NewProcessorPoolFromLog(log WAL, opts ...Option) (*ProcessorPool, error) {
+	batches := make(map[int]TransactionBatch)
+	var order []int
+	resolved := make(map[int]bool)
+	commits := make(map[int][]string)
+	err := log.Replay(func(event ProcessingEvent) error {
+		switch event.Status {
+		case StatusPending:
+			if _, exists := batches[event.BatchID]; !exists {
+				batches[event.BatchID] = TransactionBatch{
+					clientID:      event.ClientID,
+					transactionID: event.BatchID,
+					transactions:  event.Transactions,
+				}
+				order = append(order, event.BatchID)
+			}
+		case StatusCommitted:
+			commits[event.BatchID] = append(commits[event.BatchID], event.TransactionID)
+		case StatusDone, StatusCancelled:
+			resolved[event.BatchID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("replaying the journal: %w", err)
+	}
+
+	p := newProcessorPool(opts)
+	p.wal = log
+	// only what the resubmitted batches need, the rest of the log is history
+	for batchID, keys := range commits {
+		if resolved[batchID] {
+			continue
+		}
+		for _, key := range keys {
+			p.replayedCommits[key] = true
+		}
+	}
+	if len(p.replayedCommits) > 0 {
+		p.replayedFilter = bloom.NewWithEstimates(replayedFilterKeys, replayedFilterFalsePositives)
+		for key := range p.replayedCommits {
+			p.replayedFilter.AddString(key)
+		}
+	}
+
+	p.start()
+	for _, batchID := range order {
+		if resolved[batchID] {
+			continue
+		}
+		// already in the journal as pending
+		p.submitBatch(batches[batchID])
+	}
+	return p, nil
+}
+
+// a WAL kept in a file, one JSON event per line
+type FileWAL struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// opens (or creates) the log file, appending to what is already in it
+func OpenFileWAL(path string) (*FileWAL, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	// a line cut short by a crash would otherwise swallow the next event appended
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if last[0] != '\n' {
+			if _, err := file.Write([]byte("\n")); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+	return &FileWAL{path: path, file: file}, nil
+}
+
+// writes the event and syncs the file, so the event survives a crash once Append returned
+func (w *FileWAL) Append(event ProcessingEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(line); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// reads the file line by line. A line that doesn't parse is skipped, most likely one cut short by a crash.
+func (w *FileWAL) Replay(fn func(event ProcessingEvent) error) error {
+	file, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// a pending event holds a whole batch, longer than a bufio.Scanner takes by default
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event ProcessingEvent
+			if json.Unmarshal(line, &event) == nil {
+				if err := fn(event); err != nil {
+					return err
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *FileWAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
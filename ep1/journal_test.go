@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a WAL in memory
+type memWAL struct {
+	mu     sync.Mutex
+	events []ProcessingEvent
+}
+
+func (w *memWAL) Append(event ProcessingEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.events = append(w.events, event)
+	return nil
+}
+
+func (w *memWAL) Replay(fn func(event ProcessingEvent) error) error {
+	w.mu.Lock()
+	events := slices.Clone(w.events)
+	w.mu.Unlock()
+
+	for _, event := range events {
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the events appended after the first n
+func (w *memWAL) since(n int) []ProcessingEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return slices.Clone(w.events[n:])
+}
+
+// a WAL failing every read with err
+type failingWAL struct {
+	err error
+}
+
+func (w failingWAL) Append(event ProcessingEvent) error {
+	return w.err
+}
+
+func (w failingWAL) Replay(fn func(event ProcessingEvent) error) error {
+	return w.err
+}
+
+// what was in the journal when the process crashed half way through batch 1
+func crashedJournal() *memWAL {
+	return &memWAL{events: []ProcessingEvent{
+		{BatchID: 1, ClientID: 1, Status: StatusPending, Transactions: []string{"Salary A", "Salary B", "Salary C"}},
+		{BatchID: 2, ClientID: 2, Status: StatusPending, Transactions: []string{"Salary D"}},
+		{BatchID: 3, ClientID: 1, Status: StatusPending},
+		{BatchID: 4, ClientID: 3, Status: StatusPending, Transactions: []string{"Salary E"}},
+		{BatchID: 1, ClientID: 1, ManagerID: 1, Status: StatusProcessing},
+		{BatchID: 2, ClientID: 2, ManagerID: 2, Status: StatusProcessing},
+		{BatchID: 1, ClientID: 1, TransactionID: "1-1", ManagerID: 1, Status: StatusCommitted},
+		{BatchID: 2, ClientID: 2, TransactionID: "2-1", ManagerID: 2, Status: StatusCommitted},
+		{BatchID: 2, ClientID: 2, ManagerID: 2, Status: StatusDone},
+		{BatchID: 4, ClientID: 3, ManagerID: 2, Status: StatusCancelled},
+		{BatchID: 1, ClientID: 1, TransactionID: "1-2", ManagerID: 1, Status: StatusFailed, Error: "failed after 3 retries"},
+	}}
+}
+
+func TestNewProcessorPoolFromLog(t *testing.T) {
+	log := crashedJournal()
+	before := len(log.events)
+
+	// one manager, so the batches are processed in the order they are resubmitted
+	p, err := NewProcessorPoolFromLog(log, WithManagers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	var started []int
+	attempted := make(map[string]int)
+	for _, event := range log.since(before) {
+		switch event.Status {
+		case StatusPending:
+			t.Fatalf("batch %d written down as pending again", event.BatchID)
+		case StatusProcessing:
+			started = append(started, event.BatchID)
+		case StatusCommitted, StatusFailed:
+			attempted[event.TransactionID]++
+		}
+	}
+	// batch 1 was interrupted and 3 never started, 2 is done and 4 cancelled
+	if !slices.Equal(started, []int{1, 3}) {
+		t.Fatalf("batches %v processed after the replay, expected 1 then 3", started)
+	}
+	// 1-1 was paid before the crash, 1-2 failed and is tried again
+	if len(attempted) != 2 || attempted["1-2"] != 1 || attempted["1-3"] != 1 {
+		t.Fatalf("transactions attempted after the replay: %v, expected 1-2 and 1-3 once", attempted)
+	}
+
+	// everything is resolved now
+	before = len(log.events)
+	p, err = NewProcessorPoolFromLog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if replayed := log.since(before); len(replayed) != 0 {
+		t.Fatalf("replaying again wrote %d events, expected nothing left to resubmit", len(replayed))
+	}
+}
+
+func TestNewProcessorPoolFromLogFails(t *testing.T) {
+	broken := errors.New("disk on fire")
+	if _, err := NewProcessorPoolFromLog(failingWAL{broken}); !errors.Is(err, broken) {
+		t.Fatalf("replaying a log failing to read returned %v, expected its error", err)
+	}
+}
+
+func TestReplayedCommitsFilter(t *testing.T) {
+	// no managers, the resubmitted batches stay in the queue
+	p, err := NewProcessorPoolFromLog(crashedJournal(), WithManagers(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if !p.replayedFilter.TestString("1-1") {
+		t.Fatal("1-1 committed before the crash, missing from the filter")
+	}
+	// 2-1 of a batch done before the crash isn't replayed, 9-9 stands in for a false positive of the filter
+	p.replayedFilter.AddString("9-9")
+	for _, tc := range []struct {
+		key       string
+		committed bool
+	}{
+		{"1-1", true},
+		// only replayed once
+		{"1-1", false},
+		{"1-2", false},
+		{"2-1", false},
+		{"9-9", false},
+	} {
+		if committed := p.committedBeforeReplay(tc.key); committed != tc.committed {
+			t.Fatalf("%s committed before the replay: %v, expected %v", tc.key, committed, tc.committed)
+		}
+	}
+
+	// a pool not started from a log has nothing to filter
+	if fresh := startPool(t); fresh.replayedFilter != nil || fresh.committedBeforeReplay("1-1") {
+		t.Fatal("a fresh pool has replayed commits")
+	}
+}
+
+func TestFileWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.journal")
+	wal, err := OpenFileWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// longer than a line bufio.Scanner takes by default
+	big := strings.Repeat("Salary ", 20000)
+	events := []ProcessingEvent{
+		{BatchID: 1, ClientID: 1, Status: StatusPending, Transactions: []string{big}},
+		{BatchID: 1, ClientID: 1, ManagerID: 2, Status: StatusProcessing},
+	}
+	for _, event := range events {
+		if err := wal.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close()
+
+	// crashed half way through the next event
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"batch_id":1,"client_id":1,"transa`)
+	file.Close()
+
+	wal, err = OpenFileWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	done := ProcessingEvent{BatchID: 1, ClientID: 1, ManagerID: 2, Status: StatusDone}
+	if err := wal.Append(done); err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []ProcessingEvent
+	if err := wal.Replay(func(event ProcessingEvent) error {
+		replayed = append(replayed, event)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 3 || replayed[0].Transactions[0] != big || replayed[2].Status != StatusDone {
+		t.Fatalf("replayed %d events, expected the 2 written, the cut short one skipped, and the one after", len(replayed))
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/bits-and-blooms/bloom/v3"
 )
 
 /**
@@ -65,20 +69,232 @@ type TransactionBatch struct {
 	clientID      int
 	transactionID int
 	transactions  []string // Example: list of transaction records (like salary payments)
+	// numbers the client's batches in the order they were submitted, see cancel.go
+	seq int
+	// answered nil once the batch is processed, or ErrCancelled once it was dropped (see cancel.go). nil means nobody
+	// is answered. Needs room for the answer, the manager waits for it to be taken otherwise.
+	result chan<- error
+}
+
+// tells whoever submitted the batch how it went, if they asked
+func (b TransactionBatch) answer(err error) {
+	if b.result != nil {
+		b.result <- err
+	}
+}
+
+// returned by SubmitBatch once the pool is closed
+var ErrPoolClosed = errors.New("processor pool closed")
+
+// the number of account managers hired unless WithManagers says otherwise
+const defaultManagers = 3
+
+// the account managers and everything they share: the queue they take the batches from, the vault and the
+// bookkeeping of the clients' batches. Pools share nothing with each other, see tenant.go.
+type ProcessorPool struct {
+	//	a channel for submitting transaction batches
+	//
+	// intentionally buffered (size 10) because the test case here has less than transactions
+	// what if we have more than 10 transactions ? well, for this oversimplified  case, the calling go routine is blocked after
+	// 10 entries except of course our managers do their job fast enough
+	queue chan TransactionBatch
+
+	// this is like a vault holding the locks (keys) for each client's account, see vault.go
+	vault VaultKeyStore
+
+	managers int
+	wg       sync.WaitGroup
+
+	// the log the managers write to, nil means nothing is written down (see journal.go)
+	wal WAL
+	// transactions of the replayed batches the journal has as committed, by idempotency key, see journal.go
+	replayedCommits map[string]bool
+	// the keys of replayedCommits, asked before the map. nil without any, see journal.go
+	replayedFilter *bloom.BloomFilter
+	// to control access to replayedCommits
+	replayedCommitsMutex sync.Mutex
+
+	// called once the last pending batch of a client is done (successfully or not), e.g to notify the client.
+	// nil means nobody is notified.
+	onClientComplete func(clientID int, stats ClientProcessingStats)
+	// a channel can't be searched for a client's batches, so every client's batches are counted instead: up when a
+	// batch is submitted, down once a manager is done with it. A batch being processed still counts, so a client isn't
+	// "complete" while one manager finishes a batch and another is still working on the next.
+	pendingBatches map[int]int
+	// stats of the batches finished so far, per client with pending batches
+	clientStats map[int]*ClientProcessingStats
+	// per client with batches no manager started on yet, see cancel.go
+	clientQueues map[int]*clientQueue
+	// to control access to pendingBatches, clientStats and clientQueues
+	pendingMutex sync.Mutex
+
+	// the last hour of the managers' work, see rolling.go
+	rolling *RollingStats
+
+	// held by SubmitBatch while it sends to the queue, so Close doesn't close the queue under it
+	closeMutex sync.RWMutex
+	closed     bool
 }
 
-//	a channel for submitting transaction batches
-//
-// intentionally buffered (size 10) because the test case here has less than transactions
-// what if we have more than 10 transactions ? well, for this oversimplified  case, the calling go routine is blocked after
-// 10 entries except of course our managers do their job fast enough
-var TransactionQueue = make(chan TransactionBatch, 10)
+// configures a ProcessorPool
+type Option func(*ProcessorPool)
 
-// this is like a vault holding the locks (keys) for each client's account
-var VaultKeyMap = make(map[int]*sync.Mutex)
+// hires n account managers instead of 3
+func WithManagers(n int) Option {
+	return func(p *ProcessorPool) {
+		p.managers = n
+	}
+}
 
-// to control access to the vault itself (to avoid conflicts), we don't want more than one manager looking into the vault for key
-var VaultKeyMutex = sync.Mutex{}
+// writes what happens to the batches down in log, see journal.go
+func WithJournal(log WAL) Option {
+	return func(p *ProcessorPool) {
+		p.wal = log
+	}
+}
+
+// calls fn with a client's stats once the last pending batch of the client is done (successfully or not), e.g to
+// notify the client. fn is called by the manager that finished the batch, a slow fn holds that manager up.
+func WithOnClientComplete(fn func(clientID int, stats ClientProcessingStats)) Option {
+	return func(p *ProcessorPool) {
+		p.onClientComplete = fn
+	}
+}
+
+// keeps the keys to the clients' accounts in store, instead of a vault of the pool's own
+func WithVaultKeyStore(store VaultKeyStore) Option {
+	return func(p *ProcessorPool) {
+		p.vault = store
+	}
+}
+
+// hires the account managers, who take batches from the queue until Close
+func NewProcessorPool(opts ...Option) *ProcessorPool {
+	p := newProcessorPool(opts)
+	p.start()
+	return p
+}
+
+// a pool without its managers yet
+func newProcessorPool(opts []Option) *ProcessorPool {
+	p := &ProcessorPool{
+		queue:           make(chan TransactionBatch, 10),
+		vault:           newVaultKeyMap(),
+		managers:        defaultManagers,
+		replayedCommits: make(map[string]bool),
+		pendingBatches:  make(map[int]int),
+		clientStats:     make(map[int]*ClientProcessingStats),
+		clientQueues:    make(map[int]*clientQueue),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// starts the managers and the rolling stats
+func (p *ProcessorPool) start() {
+	p.rolling = NewRollingStats()
+	for i := 1; i <= p.managers; i++ {
+		p.wg.Go(func() { p.accountManager(i) })
+	}
+}
+
+// stops taking batches and waits for the managers to finish the ones in the queue. SubmitBatch returns ErrPoolClosed
+// from now on.
+func (p *ProcessorPool) Close() {
+	p.closeMutex.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.closeMutex.Unlock()
+
+	p.wg.Wait()
+	p.rolling.Stop()
+}
+
+// submits a batch to the queue, counting it as pending for its client. Blocks while the queue is full.
+func (p *ProcessorPool) SubmitBatch(batch TransactionBatch) error {
+	p.closeMutex.RLock()
+	defer p.closeMutex.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+	p.journal(ProcessingEvent{
+		BatchID: batch.transactionID, ClientID: batch.clientID, Status: StatusPending, Transactions: batch.transactions,
+	})
+	p.submitBatch(batch)
+	return nil
+}
+
+// SubmitBatch without writing the batch to the journal, for batches replayed from it
+func (p *ProcessorPool) submitBatch(batch TransactionBatch) {
+	p.pendingMutex.Lock()
+	p.pendingBatches[batch.clientID]++
+	p.queueBatch(&batch)
+	p.pendingMutex.Unlock()
+
+	p.queue <- batch
+}
+
+// summarizes the processing of all of a client's batches
+type ClientProcessingStats struct {
+	TotalBatches           int
+	SuccessfulTransactions int
+	FailedTransactions     int
+	// batches dropped by CancelClient, not part of TotalBatches
+	CancelledBatches int
+	// time spent processing the batches (not waiting in the queue)
+	TotalDuration time.Duration
+}
+
+// records a finished batch and notifies onClientComplete if it was the client's last pending one
+func (p *ProcessorPool) batchDone(clientID, succeeded, failed int, took time.Duration) {
+	p.finishBatch(clientID, func(stats *ClientProcessingStats) {
+		stats.TotalBatches++
+		stats.SuccessfulTransactions += succeeded
+		stats.FailedTransactions += failed
+		stats.TotalDuration += took
+	})
+}
+
+// records a batch dropped by CancelClient, notifying onClientComplete just like batchDone
+func (p *ProcessorPool) batchCancelled(clientID int) {
+	p.finishBatch(clientID, func(stats *ClientProcessingStats) {
+		stats.CancelledBatches++
+	})
+}
+
+// adds a batch to the client's stats with record, notifying onClientComplete if it was the client's last pending one
+func (p *ProcessorPool) finishBatch(clientID int, record func(stats *ClientProcessingStats)) {
+	p.pendingMutex.Lock()
+	stats, exists := p.clientStats[clientID]
+	if !exists {
+		stats = &ClientProcessingStats{}
+		p.clientStats[clientID] = stats
+	}
+	record(stats)
+
+	p.pendingBatches[clientID]--
+	complete := p.pendingBatches[clientID] == 0
+	if complete {
+		delete(p.pendingBatches, clientID)
+		delete(p.clientStats, clientID)
+	}
+	p.pendingMutex.Unlock()
+
+	// called without the lock, a slow callback shouldn't hold up other managers
+	if complete && p.onClientComplete != nil {
+		p.onClientComplete(clientID, *stats)
+	}
+}
+
+// the last hour of the managers' work, for dashboards
+func (p *ProcessorPool) RollingStats() RollingStatsSnapshot {
+	return p.rolling.Snapshot()
+}
 
 // defines the number of times to retry a failed transaction
 const maxRetries = 3
@@ -87,43 +303,69 @@ const maxRetries = 3
 const retryBackoff = time.Second
 
 // simulates an account manager processing transactions
-func AccountManager(managerID int, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	for batch := range TransactionQueue {
+func (p *ProcessorPool) accountManager(managerID int) {
+	for batch := range p.queue {
 		fmt.Printf("Account Manager %d received transaction batch %d for client %d\n", managerID, batch.transactionID, batch.clientID)
 
-		// Lock the vault to get the key for this client's account
-		VaultKeyMutex.Lock()
-		clientLock, exists := VaultKeyMap[batch.clientID]
-		if !exists {
-			clientLock = &sync.Mutex{}
-			VaultKeyMap[batch.clientID] = clientLock
-		}
-		VaultKeyMutex.Unlock()
+		// get the key for this client's account from the vault
+		clientLock := p.vault.Key(batch.clientID)
 
 		// Lock the client's account to make sure only this manager processes their transactions
 		clientLock.Lock()
+		if !p.startBatch(batch) {
+			clientLock.Unlock()
+			fmt.Printf("Account Manager %d dropped cancelled transaction batch %d for client %d\n", managerID, batch.transactionID, batch.clientID)
+			p.journal(ProcessingEvent{BatchID: batch.transactionID, ClientID: batch.clientID, ManagerID: managerID, Status: StatusCancelled})
+			p.batchCancelled(batch.clientID)
+			p.dropBatch(batch)
+			continue
+		}
 		fmt.Printf("Account Manager %d is processing transaction batch %d for client %d\n", managerID, batch.transactionID, batch.clientID)
 
+		p.journal(ProcessingEvent{BatchID: batch.transactionID, ClientID: batch.clientID, ManagerID: managerID, Status: StatusProcessing})
+
 		// Process each transaction with retry logic in case of failure
-		for _, transaction := range batch.transactions {
-			success := processWithRetries(managerID, batch.clientID, batch.transactionID, transaction)
+		start := time.Now()
+		succeeded, failed := 0, 0
+		for i, transaction := range batch.transactions {
+			event := ProcessingEvent{
+				BatchID: batch.transactionID, ClientID: batch.clientID, TransactionID: transactionKey(batch.transactionID, i), ManagerID: managerID,
+			}
+			// paid before a crash, see journal.go
+			if p.committedBeforeReplay(event.TransactionID) {
+				succeeded++
+				fmt.Printf("Account Manager %d skipped transaction %s for client %d (batch %d), paid before the restart\n", managerID, transaction, batch.clientID, batch.transactionID)
+				continue
+			}
+
+			success := p.processWithRetries(managerID, batch.clientID, batch.transactionID, transaction)
 			if !success {
+				failed++
 				fmt.Printf("Failed to process transaction %s for client %d (batch %d) after %d retries\n", transaction, batch.clientID, batch.transactionID, maxRetries)
+				event.Status, event.Error = StatusFailed, fmt.Sprintf("failed after %d retries", maxRetries)
+			} else {
+				succeeded++
+				event.Status = StatusCommitted
 			}
+			p.journal(event)
 		}
+		p.journal(ProcessingEvent{BatchID: batch.transactionID, ClientID: batch.clientID, ManagerID: managerID, Status: StatusDone})
 
 		// Unlock the client's account once all transactions are processed
 		clientLock.Unlock()
 		fmt.Printf("Account Manager %d finished processing transaction batch %d for client %d\n", managerID, batch.transactionID, batch.clientID)
+
+		p.batchDone(batch.clientID, succeeded, failed, time.Since(start))
+		batch.answer(nil)
 	}
 }
 
-// processes a transaction and retries on failure
-func processWithRetries(managerID, clientID, transactionID int, transaction string) bool {
+// processes a transaction and retries on failure, recording it in the rolling stats
+func (p *ProcessorPool) processWithRetries(managerID, clientID, transactionID int, transaction string) bool {
+	start := time.Now()
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		if processTransaction(managerID, clientID, transactionID, transaction) {
+			p.rolling.Record(true, attempt-1, time.Since(start))
 			return true
 		}
 
@@ -133,53 +375,106 @@ func processWithRetries(managerID, clientID, transactionID int, transaction stri
 		// Wait before retrying (backoff)
 		time.Sleep(retryBackoff * time.Duration(attempt))
 	}
+	p.rolling.Record(false, maxRetries-1, time.Since(start))
 	return false
 }
 
-// simulates the processing of a single transaction ()
+// processes a single transaction in two phases, rolling the deduction back if the credit fails
 // returns true if successful, false on failure (simulated failure)
 func processTransaction(managerID, clientID, transactionID int, transaction string) bool {
 	fmt.Printf("Account Manager %d processing transaction %s for client %d (batch %d)\n", managerID, transaction, clientID, transactionID)
 
-	// Simulate random failure (e.g network or system issue)
-	if rand.Float32() < 0.3 { // 30% chance of failure
-		fmt.Printf("Account Manager %d encountered an error processing transaction %s for client %d (batch %d)\n", managerID, transaction, clientID, transactionID)
+	txID, err := Payments.Prepare(transaction)
+	if err != nil {
+		fmt.Printf("Account Manager %d encountered an error processing transaction %s for client %d (batch %d): %v\n", managerID, transaction, clientID, transactionID, err)
+		return false
+	}
+
+	if err := Payments.Commit(txID); err != nil {
+		fmt.Printf("Account Manager %d failed to commit transaction %s for client %d (batch %d): %v, rolling back %s\n", managerID, transaction, clientID, transactionID, err, txID)
+		if err := Payments.Rollback(txID); err != nil {
+			fmt.Printf("Account Manager %d failed to roll back %s: %v\n", managerID, txID, err)
+		}
 		return false
 	}
 
-	// Simulate successful processing
-	time.Sleep(100 * time.Millisecond) // Simulate processing time
 	fmt.Printf("Account Manager %d successfully processed transaction %s for client %d (batch %d)\n", managerID, transaction, clientID, transactionID)
 	return true
 }
 
 func main() {
-	var wg sync.WaitGroup
-
-	// Start multiple account managers
-	numManagers := 3
-	for i := 1; i <= numManagers; i++ {
-		wg.Add(1)
-		go AccountManager(i, &wg)
+	opts := []Option{
+		WithManagers(3),
+		WithOnClientComplete(func(clientID int, stats ClientProcessingStats) {
+			fmt.Printf("All batches for client %d are done: %d batches, %d transactions succeeded, %d failed, %d batches cancelled, took %s\n",
+				clientID, stats.TotalBatches, stats.SuccessfulTransactions, stats.FailedTransactions, stats.CancelledBatches,
+				stats.TotalDuration.Round(time.Millisecond))
+		}),
 	}
 
-	// Simulate submitting transaction batches for different clients
-	transactionBatches := []TransactionBatch{
-		{clientID: 1, transactionID: 1, transactions: []string{"Salary A", "Salary B", "Salary C"}},
-		{clientID: 2, transactionID: 2, transactions: []string{"Salary D", "Salary E", "Salary F"}},
-		{clientID: 1, transactionID: 3, transactions: []string{"Salary G", "Salary H", "Salary I"}},
-		{clientID: 3, transactionID: 4, transactions: []string{"Salary J", "Salary K", "Salary L"}},
-		{clientID: 2, transactionID: 5, transactions: []string{"Salary M", "Salary N", "Salary O"}},
+	// with a journal file (go run ./ep1 payments.journal), a run interrupted half way picks up where it left off the
+	// next time instead of starting over, see journal.go
+	var wal *FileWAL
+	resumed := false
+	if len(os.Args) > 1 {
+		info, err := os.Stat(os.Args[1])
+		resumed = err == nil && info.Size() > 0
+		wal, err = OpenFileWAL(os.Args[1])
+		if err != nil {
+			fmt.Printf("Opening the journal failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer wal.Close()
 	}
 
-	// Submit the transaction batches into the TransactionQueue
-	for _, batch := range transactionBatches {
-		TransactionQueue <- batch
+	var pool *ProcessorPool
+	if resumed {
+		var err error
+		pool, err = NewProcessorPoolFromLog(wal, opts...)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Resubmitted the transaction batches left in the journal")
+	} else {
+		if wal != nil {
+			opts = append(opts, WithJournal(wal))
+		}
+		pool = NewProcessorPool(opts...)
+
+		// Simulate submitting transaction batches for different clients
+		transactionBatches := []TransactionBatch{
+			{clientID: 1, transactionID: 1, transactions: []string{"Salary A", "Salary B", "Salary C"}},
+			{clientID: 2, transactionID: 2, transactions: []string{"Salary D", "Salary E", "Salary F"}},
+			{clientID: 1, transactionID: 3, transactions: []string{"Salary G", "Salary H", "Salary I"}},
+			{clientID: 3, transactionID: 4, transactions: []string{"Salary J", "Salary K", "Salary L"}},
+			{clientID: 2, transactionID: 5, transactions: []string{"Salary M", "Salary N", "Salary O"}},
+		}
+
+		// Submit the transaction batches into the pool's queue
+		for _, batch := range transactionBatches {
+			pool.SubmitBatch(batch)
+		}
+
+		// client 2's sheet had the wrong salaries, whatever of it hasn't started yet is stopped
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		cancelled, err := pool.CancelClient(ctx, 2)
+		cancel()
+		if err != nil {
+			fmt.Printf("Gave up waiting for client 2's batches to be dropped: %v\n", err)
+		}
+		fmt.Printf("Cancelled %d transaction batches of client 2\n", cancelled)
 	}
 
-	// Close the queue after submitting all transaction batches
-	close(TransactionQueue)
+	// Close the queue and wait for all account managers to finish
+	pool.Close()
+
+	// every payment was either committed or rolled back
+	fmt.Printf("Payments left half way: %d\n", Payments.Pending())
 
-	// Wait for all account managers to finish
-	wg.Wait()
+	// what a dashboard would show for the last hour
+	stats := pool.RollingStats()
+	fmt.Printf("Last %d minute(s): %d transactions, %.0f%% failed, %.2f retries per transaction, p99 %s this minute\n",
+		len(stats.Minutes), stats.Total.Processed, stats.Total.ErrorRate()*100, stats.Total.RetryRate(),
+		stats.P99ProcessingTime.Round(time.Millisecond))
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCloseFinishesTheQueue(t *testing.T) {
+	log := &memWAL{}
+	p := NewProcessorPool(WithManagers(2), WithJournal(log))
+	for batchID := 1; batchID <= 15; batchID++ {
+		if err := p.SubmitBatch(TransactionBatch{clientID: batchID % 3, transactionID: batchID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+
+	done := 0
+	for _, event := range log.since(0) {
+		if event.Status == StatusDone {
+			done++
+		}
+	}
+	if done != 15 {
+		t.Fatalf("%d of the 15 batches submitted done once Close returned", done)
+	}
+	if err := p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 16}); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("SubmitBatch after Close returned %v, expected ErrPoolClosed", err)
+	}
+}
+
+func TestOnClientCompleteAfterTheLastBatch(t *testing.T) {
+	complete, done := completions()
+	p := startPool(t, complete)
+	release := holdClient(t, p, 1)
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 1})
+	p.SubmitBatch(TransactionBatch{clientID: 1, transactionID: 2})
+
+	select {
+	case stats := <-done:
+		t.Fatalf("client complete with %+v while its batches wait for its lock", stats)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if stats := <-done; stats.TotalBatches != 2 {
+		t.Fatalf("client complete with %+v, expected both batches", stats)
+	}
+}
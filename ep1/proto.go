@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/**
+Batches are handed between services, and JSON spends most of its bytes on field names and quotes.
+MarshalProto writes a TransactionBatch in the protobuf wire format described by transaction_batch.proto, so any
+protobuf implementation can read it.
+
+The codec is written by hand with encoding/binary rather than generated by protoc-gen-go, the message is tiny and
+this keeps the episode free of dependencies. Unknown fields are skipped when reading, which is what lets newer
+writers add fields without breaking older readers.
+
+go test -bench TransactionBatch ./ep1 compares the size of a batch in protobuf, JSON and encoding/binary.
+*/
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("proto: truncated message")
+
+// encodes the batch in the protobuf wire format
+func (b *TransactionBatch) MarshalProto() ([]byte, error) {
+	var buf []byte
+	if b.clientID != 0 {
+		buf = binary.AppendUvarint(buf, 1<<3|wireVarint)
+		buf = binary.AppendUvarint(buf, uint64(b.clientID))
+	}
+	if b.transactionID != 0 {
+		buf = binary.AppendUvarint(buf, 2<<3|wireVarint)
+		buf = binary.AppendUvarint(buf, uint64(b.transactionID))
+	}
+	for _, transaction := range b.transactions {
+		buf = binary.AppendUvarint(buf, 3<<3|wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(len(transaction)))
+		buf = append(buf, transaction...)
+	}
+	return buf, nil
+}
+
+// decodes a batch written by MarshalProto (or any protobuf implementation), replacing the batch's content
+func (b *TransactionBatch) UnmarshalProto(data []byte) error {
+	*b = TransactionBatch{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field, wireType := tag>>3, tag&7
+
+		switch {
+		case field == 1 && wireType == wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			b.clientID = int(int64(v))
+			data = data[n:]
+		case field == 2 && wireType == wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			b.transactionID = int(int64(v))
+			data = data[n:]
+		case field == 3 && wireType == wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			b.transactions = append(b.transactions, string(data[n:n+int(length)]))
+			data = data[n+int(length):]
+		default:
+			rest, err := skipField(data, wireType)
+			if err != nil {
+				return fmt.Errorf("proto: field %d: %w", field, err)
+			}
+			data = rest
+		}
+	}
+	return nil
+}
+
+// skips the value of a field this version doesn't know about
+func skipField(data []byte, wireType uint64) ([]byte, error) {
+	switch wireType {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		return data[n:], nil
+	case wireFixed64:
+		if len(data) < 8 {
+			return nil, errTruncated
+		}
+		return data[8:], nil
+	case wireBytes:
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return nil, errTruncated
+		}
+		return data[n+int(length):], nil
+	case wireFixed32:
+		if len(data) < 4 {
+			return nil, errTruncated
+		}
+		return data[4:], nil
+	}
+	return nil, fmt.Errorf("unsupported wire type %d", wireType)
+}
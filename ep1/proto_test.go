@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// a batch of n salary payments
+func salaryBatch(n int) TransactionBatch {
+	batch := TransactionBatch{clientID: 12, transactionID: 3456}
+	for i := range n {
+		batch.transactions = append(batch.transactions, fmt.Sprintf("Salary %d: 250000", i))
+	}
+	return batch
+}
+
+func TestTransactionBatchProtoRoundTrip(t *testing.T) {
+	for _, in := range []TransactionBatch{salaryBatch(3), {}, {clientID: -1, transactions: []string{"", "Salary A"}}} {
+		data, err := in.MarshalProto()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out TransactionBatch
+		if err := out.UnmarshalProto(data); err != nil {
+			t.Fatal(err)
+		}
+		if out.clientID != in.clientID || out.transactionID != in.transactionID ||
+			!slices.Equal(out.transactions, in.transactions) {
+			t.Fatalf("%+v came back as %+v", in, out)
+		}
+	}
+}
+
+func TestTransactionBatchProtoSkipsUnknownFields(t *testing.T) {
+	in := salaryBatch(2)
+	data, _ := in.MarshalProto()
+	// a newer writer's field 4 (varint) and field 5 (fixed64)
+	data = binary.AppendUvarint(data, 4<<3|wireVarint)
+	data = binary.AppendUvarint(data, 300)
+	data = binary.AppendUvarint(data, 5<<3|wireFixed64)
+	data = append(data, make([]byte, 8)...)
+
+	var out TransactionBatch
+	if err := out.UnmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if out.clientID != in.clientID || !slices.Equal(out.transactions, in.transactions) {
+		t.Fatalf("%+v read as %+v", in, out)
+	}
+
+	// a transaction cut short
+	var cut TransactionBatch
+	if err := cut.UnmarshalProto(data[:len(data)-20]); !errors.Is(err, errTruncated) {
+		t.Fatalf("cut message: %v, expected errTruncated", err)
+	}
+}
+
+// TransactionBatch with exported fields, json only writes those
+type jsonBatch struct {
+	ClientID      int      `json:"client_id"`
+	TransactionID int      `json:"transaction_id"`
+	Transactions  []string `json:"transactions"`
+}
+
+// the batch the way encoding/binary writes it: fixed size ints, each transaction prefixed with its length
+func marshalBinary(batch TransactionBatch) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]int64{
+		int64(batch.clientID), int64(batch.transactionID), int64(len(batch.transactions)),
+	})
+	for _, transaction := range batch.transactions {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(transaction)))
+		buf.WriteString(transaction)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkBatchSize(b *testing.B, marshal func(batch TransactionBatch) []byte) {
+	batch := salaryBatch(100)
+	var size int
+	for b.Loop() {
+		size = len(marshal(batch))
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkTransactionBatchProto(b *testing.B) {
+	benchmarkBatchSize(b, func(batch TransactionBatch) []byte {
+		data, _ := batch.MarshalProto()
+		return data
+	})
+}
+
+func BenchmarkTransactionBatchJSON(b *testing.B) {
+	benchmarkBatchSize(b, func(batch TransactionBatch) []byte {
+		data, _ := json.Marshal(jsonBatch{batch.clientID, batch.transactionID, batch.transactions})
+		return data
+	})
+}
+
+func BenchmarkTransactionBatchBinary(b *testing.B) {
+	benchmarkBatchSize(b, marshalBinary)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+/**
+ClientProcessingStats tell a client how their batches went, once they are all done. A dashboard wants the managers'
+side, as it goes: how many transactions a minute they get through, how many fail, how many needed a retry, and how
+long they take.
+
+RollingStats keeps the last hour of that in a ring of 60 buckets, one per minute. A goroutine moves on to the next
+bucket every minute, clearing the one it lands on (the minute an hour ago), so nothing needs cleaning up and the memory
+never grows. A transaction is counted in the bucket of the minute it finished in.
+
+The processing times of a minute are kept as a sample of at most rollingSampleSize (reservoir sampling: once the
+sample is full, the n-th time replaces a random one with probability size/n), enough for a p99 without keeping every
+time of a busy minute.
+*/
+
+const (
+	// the minutes RollingStats keeps
+	rollingMinutes = 60
+	// the most processing times kept per minute
+	rollingSampleSize = 1000
+)
+
+// what the managers did in one minute
+type MinuteStats struct {
+	Start time.Time
+	// transactions finished, successfully or not
+	Processed int
+	Failed    int
+	// attempts beyond the first
+	Retries int
+}
+
+// the share of the transactions that failed, 0 without any
+func (m MinuteStats) ErrorRate() float64 {
+	if m.Processed == 0 {
+		return 0
+	}
+	return float64(m.Failed) / float64(m.Processed)
+}
+
+// retries per transaction, 0 without any
+func (m MinuteStats) RetryRate() float64 {
+	if m.Processed == 0 {
+		return 0
+	}
+	return float64(m.Retries) / float64(m.Processed)
+}
+
+// a minute of RollingStats
+type rollingBucket struct {
+	MinuteStats
+	// a sample of the processing times, see above
+	times []time.Duration
+	// processing times seen, sampled or not
+	timesSeen int
+}
+
+// the last hour of the managers' work, see above
+type RollingStats struct {
+	mu      sync.Mutex
+	buckets [rollingMinutes]rollingBucket
+	// the bucket of the current minute
+	head int
+	// buckets used so far, up to rollingMinutes
+	used int
+	// closed by Stop
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// starts collecting, the first minute starting now
+func NewRollingStats() *RollingStats {
+	s := &RollingStats{used: 1, stop: make(chan struct{})}
+	s.buckets[0].Start = time.Now()
+	go s.advanceEveryMinute()
+	return s
+}
+
+// stops moving on to new minutes, what was collected can still be read
+func (s *RollingStats) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *RollingStats) advanceEveryMinute() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.advance(now)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// moves on to a new minute starting at now, forgetting the one an hour ago
+func (s *RollingStats) advance(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.head = (s.head + 1) % rollingMinutes
+	s.buckets[s.head] = rollingBucket{MinuteStats: MinuteStats{Start: now}}
+	s.used = min(s.used+1, rollingMinutes)
+}
+
+// records a transaction finished in the current minute, after the given number of retries
+func (s *RollingStats) Record(succeeded bool, retries int, took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := &s.buckets[s.head]
+	bucket.Processed++
+	if !succeeded {
+		bucket.Failed++
+	}
+	bucket.Retries += retries
+
+	bucket.timesSeen++
+	if len(bucket.times) < rollingSampleSize {
+		bucket.times = append(bucket.times, took)
+	} else if i := rand.Intn(bucket.timesSeen); i < rollingSampleSize {
+		bucket.times[i] = took
+	}
+}
+
+// the 99th percentile of the processing times of the current minute, 0 before any transaction finished in it
+func (s *RollingStats) P99ProcessingTime() time.Duration {
+	s.mu.Lock()
+	sorted := slices.Clone(s.buckets[s.head].times)
+	s.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	slices.Sort(sorted)
+	return sorted[(len(sorted)-1)*99/100]
+}
+
+// the last hour of RollingStats as of now
+type RollingStatsSnapshot struct {
+	// the minutes collected so far, the oldest first, the last one being the current minute
+	Minutes []MinuteStats
+	// all minutes together
+	Total             MinuteStats
+	P99ProcessingTime time.Duration
+}
+
+// the stats of every minute collected so far
+func (s *RollingStats) Snapshot() RollingStatsSnapshot {
+	s.mu.Lock()
+	var snapshot RollingStatsSnapshot
+	for i := s.used - 1; i >= 0; i-- {
+		minute := s.buckets[(s.head-i+rollingMinutes)%rollingMinutes].MinuteStats
+		snapshot.Minutes = append(snapshot.Minutes, minute)
+		snapshot.Total.Processed += minute.Processed
+		snapshot.Total.Failed += minute.Failed
+		snapshot.Total.Retries += minute.Retries
+	}
+	snapshot.Total.Start = snapshot.Minutes[0].Start
+	s.mu.Unlock()
+
+	snapshot.P99ProcessingTime = s.P99ProcessingTime()
+	return snapshot
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+/**
+A payroll service runs the salaries of several companies (tenants), and their client IDs overlap: client 1 of one
+tenant has nothing to do with client 1 of another. With one pool they would share the vault, and a batch of one
+tenant's client 1 would wait for the other's client 1 to be done. They would also share the queue, so a tenant
+submitting a big run holds the others up.
+
+MultiTenantPool gives every tenant a ProcessorPool of its own, with its own queue, managers and vault, and routes each
+batch to the pool of its tenant. Tenants come and go while the others keep running.
+*/
+
+var (
+	// returned by AddTenant for a tenant already added
+	ErrTenantExists = errors.New("tenant already exists")
+	// returned by SubmitBatch for a tenant never added or removed since
+	ErrUnknownTenant = errors.New("unknown tenant")
+)
+
+// a ProcessorPool per tenant, see above
+type MultiTenantPool struct {
+	mu      sync.RWMutex
+	tenants map[string]*ProcessorPool
+}
+
+func NewMultiTenantPool() *MultiTenantPool {
+	return &MultiTenantPool{tenants: make(map[string]*ProcessorPool)}
+}
+
+// starts a pool for the tenant configured with opts. Like every pool it has a vault of its own, unless opts say
+// otherwise.
+func (m *MultiTenantPool) AddTenant(tenantID string, opts ...Option) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tenants[tenantID]; exists {
+		return ErrTenantExists
+	}
+	m.tenants[tenantID] = NewProcessorPool(opts...)
+	return nil
+}
+
+// submits the batch to the tenant's pool, blocking while its queue is full (see ProcessorPool.SubmitBatch). A batch
+// submitted while the tenant is being removed gets ErrPoolClosed.
+func (m *MultiTenantPool) SubmitBatch(tenantID string, batch TransactionBatch) error {
+	m.mu.RLock()
+	pool, exists := m.tenants[tenantID]
+	m.mu.RUnlock()
+
+	if !exists {
+		return ErrUnknownTenant
+	}
+	return pool.SubmitBatch(batch)
+}
+
+// stops taking the tenant's batches and waits for its pool to finish the ones it has, the other tenants carry on.
+// Does nothing for an unknown tenant.
+func (m *MultiTenantPool) RemoveTenant(tenantID string) {
+	m.mu.Lock()
+	pool, exists := m.tenants[tenantID]
+	delete(m.tenants, tenantID)
+	m.mu.Unlock()
+
+	if exists {
+		pool.Close()
+	}
+}
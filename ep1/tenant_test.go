@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a MultiTenantPool with the tenants added, removing them at the end of the test
+func startTenants(t *testing.T, tenantIDs ...string) *MultiTenantPool {
+	m := NewMultiTenantPool()
+	for _, tenantID := range tenantIDs {
+		if err := m.AddTenant(tenantID, WithManagers(1)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { m.RemoveTenant(tenantID) })
+	}
+	return m
+}
+
+func TestMultiTenantPoolKeepsTenantsApart(t *testing.T) {
+	m := startTenants(t, "acme", "globex")
+	if err := m.AddTenant("acme"); !errors.Is(err, ErrTenantExists) {
+		t.Fatalf("adding acme again returned %v, expected ErrTenantExists", err)
+	}
+
+	// acme's client 1 is busy, globex's client 1 is someone else
+	release := holdClient(t, m.tenants["acme"], 1)
+	acme, globex := make(chan error, 1), make(chan error, 1)
+	m.SubmitBatch("acme", TransactionBatch{clientID: 1, transactionID: 1, result: acme})
+	m.SubmitBatch("globex", TransactionBatch{clientID: 1, transactionID: 1, result: globex})
+	select {
+	case err := <-globex:
+		if err != nil {
+			t.Fatalf("globex's batch answered %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("globex's batch waited for acme's client")
+	}
+	if len(acme) != 0 {
+		t.Fatalf("acme's batch answered %v while its client's lock is held", <-acme)
+	}
+	release()
+	if err := <-acme; err != nil {
+		t.Fatalf("acme's batch answered %v", err)
+	}
+
+	if err := m.SubmitBatch("initech", TransactionBatch{clientID: 1}); !errors.Is(err, ErrUnknownTenant) {
+		t.Fatalf("submitting for a tenant never added returned %v, expected ErrUnknownTenant", err)
+	}
+}
+
+func TestRemoveTenantFinishesItsBatches(t *testing.T) {
+	m := startTenants(t, "acme", "globex")
+	release := holdClient(t, m.tenants["acme"], 1)
+	results := make(chan error, 2)
+	m.SubmitBatch("acme", TransactionBatch{clientID: 1, transactionID: 1, result: results})
+	m.SubmitBatch("acme", TransactionBatch{clientID: 1, transactionID: 2, result: results})
+
+	time.AfterFunc(50*time.Millisecond, release)
+	m.RemoveTenant("acme")
+	if len(results) != 2 {
+		t.Fatalf("RemoveTenant returned with %d of acme's 2 batches processed", len(results))
+	}
+	if err := m.SubmitBatch("acme", TransactionBatch{clientID: 1}); !errors.Is(err, ErrUnknownTenant) {
+		t.Fatalf("submitting for a removed tenant returned %v, expected ErrUnknownTenant", err)
+	}
+
+	// the other tenants carry on
+	if err := m.SubmitBatch("globex", TransactionBatch{clientID: 1, result: results}); err != nil || <-results != nil {
+		t.Fatalf("globex's batch after acme was removed: %v", err)
+	}
+}
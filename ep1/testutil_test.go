@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// what the tests share
+
+// starts a pool configured with opts, closing it at the end of the test
+func startPool(t *testing.T, opts ...Option) *ProcessorPool {
+	p := NewProcessorPool(opts...)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// an option sending the stats of every client completing to the channel returned
+func completions() (Option, <-chan ClientProcessingStats) {
+	done := make(chan ClientProcessingStats, 10)
+	return WithOnClientComplete(func(clientID int, stats ClientProcessingStats) { done <- stats }), done
+}
+
+// locks the client's account in the pool as if a manager was working on it, returning the unlock. Unlocks at the end
+// of the test at the latest, the pool couldn't be closed otherwise.
+func holdClient(t *testing.T, p *ProcessorPool, clientID int) func() {
+	clientLock := p.vault.Key(clientID)
+	clientLock.Lock()
+	release := sync.OnceFunc(clientLock.Unlock)
+	t.Cleanup(release)
+	return release
+}
+
+// waits for n answers on results, counting them by error
+func awaitResults(t *testing.T, results <-chan error, n int) map[error]int {
+	t.Helper()
+	counts := make(map[error]int)
+	for i := range n {
+		select {
+		case err := <-results:
+			counts[err]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d batches answered, the others never were", i, n)
+		}
+	}
+	return counts
+}
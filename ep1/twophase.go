@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/**
+Paying a salary is really two steps: deduct the amount from the company's account, then credit the employee.
+If the credit fails after the deduction went through, the money is gone from one account without showing up in the other.
+
+The TwoPhaseProcessor splits a payment accordingly:
+
+1. Prepare deducts from the company's account and keeps the payment aside under a transaction ID
+2. Commit credits the employee, or Rollback gives the company its money back
+
+Either way a prepared payment ends up committed or rolled back, never half way. A manager that fails to Commit rolls
+back before retrying, otherwise every retry would deduct the salary again.
+
+In a distributed system the two steps hit different services, and the coordinator (the manager here) crashing between
+Prepare and Commit leaves the deduction hanging. Real implementations persist the prepared transactions so they can be
+resolved on restart, this simulation only keeps them in memory.
+*/
+
+var (
+	// returned by Commit and Rollback for a transaction that isn't prepared (never was, or already resolved)
+	ErrUnknownTransaction = errors.New("unknown or already resolved transaction")
+	// simulated failures of the two steps
+	ErrDeductionFailed = errors.New("deducting from the company account failed")
+	ErrCreditFailed    = errors.New("crediting the employee failed")
+)
+
+// pays salaries in two phases, see above
+type TwoPhaseProcessor struct {
+	mu sync.Mutex
+	// prepared transactions by ID: deducted from the company, not credited to the employee yet
+	prepared map[string]string
+	nextID   int
+}
+
+func NewTwoPhaseProcessor() *TwoPhaseProcessor {
+	return &TwoPhaseProcessor{prepared: make(map[string]string)}
+}
+
+// the processor used by the account managers
+var Payments = NewTwoPhaseProcessor()
+
+// deducts the payment from the company's account (step 1), returning the ID to Commit or Rollback it with
+func (p *TwoPhaseProcessor) Prepare(tx string) (string, error) {
+	// Simulate random failure (e.g network or system issue)
+	if rand.Float32() < 0.3 { // 30% chance of failure
+		return "", ErrDeductionFailed
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	txID := fmt.Sprintf("tx-%d", p.nextID)
+	p.prepared[txID] = tx
+	return txID, nil
+}
+
+// credits the employee (step 2). On failure the transaction stays prepared, it is up to the caller to Rollback.
+// The credit itself happens without the lock, so a slow employee bank doesn't hold up every other payment.
+func (p *TwoPhaseProcessor) Commit(txID string) error {
+	p.mu.Lock()
+	_, exists := p.prepared[txID]
+	p.mu.Unlock()
+	if !exists {
+		return ErrUnknownTransaction
+	}
+
+	// Simulate random failure of the second step
+	if rand.Float32() < 0.2 { // 20% chance of failure
+		return ErrCreditFailed
+	}
+	time.Sleep(100 * time.Millisecond) // Simulate processing time
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// rolled back while the employee was being credited
+	if _, exists := p.prepared[txID]; !exists {
+		return ErrUnknownTransaction
+	}
+	delete(p.prepared, txID)
+	return nil
+}
+
+// gives the deducted amount back to the company's account
+func (p *TwoPhaseProcessor) Rollback(txID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.prepared[txID]; !exists {
+		return ErrUnknownTransaction
+	}
+	delete(p.prepared, txID)
+	return nil
+}
+
+// the number of transactions prepared but neither committed nor rolled back
+func (p *TwoPhaseProcessor) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.prepared)
+}
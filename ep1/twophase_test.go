@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// prepares n payments, retrying the simulated deduction failures
+func preparePayments(t *testing.T, p *TwoPhaseProcessor, n int) []string {
+	t.Helper()
+	var txIDs []string
+	for i := range n {
+		for {
+			txID, err := p.Prepare(fmt.Sprintf("salary-%d", i))
+			if err == nil {
+				txIDs = append(txIDs, txID)
+				break
+			}
+			if !errors.Is(err, ErrDeductionFailed) {
+				t.Fatal(err)
+			}
+		}
+	}
+	return txIDs
+}
+
+func TestTwoPhaseResolvesEveryPayment(t *testing.T) {
+	p := NewTwoPhaseProcessor()
+	txIDs := preparePayments(t, p, 10)
+	if p.Pending() != 10 {
+		t.Fatalf("%d pending after preparing 10 payments", p.Pending())
+	}
+
+	for _, txID := range txIDs {
+		if err := p.Commit(txID); err != nil {
+			if !errors.Is(err, ErrCreditFailed) {
+				t.Fatal(err)
+			}
+			if err := p.Rollback(txID); err != nil {
+				t.Fatalf("rolling back %s: %v", txID, err)
+			}
+		}
+		// resolved either way
+		if err := p.Rollback(txID); !errors.Is(err, ErrUnknownTransaction) {
+			t.Fatalf("rolling back %s again returned %v", txID, err)
+		}
+	}
+	if p.Pending() != 0 {
+		t.Fatalf("%d payments left half way", p.Pending())
+	}
+}
+
+func TestTwoPhaseCommitsRunConcurrently(t *testing.T) {
+	p := NewTwoPhaseProcessor()
+	txIDs := preparePayments(t, p, 20)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, txID := range txIDs {
+		wg.Go(func() {
+			if err := p.Commit(txID); err != nil {
+				p.Rollback(txID)
+			}
+		})
+	}
+	wg.Wait()
+
+	// 100ms of simulated work each, one at a time would take 2s
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("20 concurrent commits took %s, they're waiting on each other", took)
+	}
+	if p.Pending() != 0 {
+		t.Fatalf("%d payments left half way", p.Pending())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+/**
+Every manager looking for a client's key goes through the vault, and with one lock on the whole vault they queue up
+for it even when they are after different clients' keys. ShardedVaultKeyStore splits the vault into shards, each with
+a lock of its own, so managers after keys in different shards don't wait for each other.
+
+Which shard a client's key is in is up to a ShardFunc, clientID % N by default. That is fine for client IDs handed out
+one after the other, but IDs following a pattern (all even, all multiples of N, ...) pile up in a few shards and the
+managers are back to queueing. FNV1aShardFunc hashes the ID first, spreading any IDs evenly.
+*/
+
+// hands out the keys (locks) to the clients' accounts
+type VaultKeyStore interface {
+	// the key to the client's account, the same one every time for the same client
+	Key(clientID int) *sync.Mutex
+}
+
+// a vault with one lock, the pool's own unless WithVaultKeyStore says otherwise
+type vaultKeyMap struct {
+	// to control access to the vault itself (to avoid conflicts), we don't want more than one manager looking into
+	// the vault for key
+	mutex sync.Mutex
+	keys  map[int]*sync.Mutex
+}
+
+func newVaultKeyMap() *vaultKeyMap {
+	return &vaultKeyMap{keys: make(map[int]*sync.Mutex)}
+}
+
+func (v *vaultKeyMap) Key(clientID int) *sync.Mutex {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	key, exists := v.keys[clientID]
+	if !exists {
+		key = &sync.Mutex{}
+		v.keys[clientID] = key
+	}
+	return key
+}
+
+// picks the shard of a client's key. The store takes the result modulo its number of shards, so it may be any int.
+type ShardFunc func(clientID int) int
+
+// shards by the client ID itself, clientID % N
+func identityShardFunc(clientID int) int {
+	return clientID
+}
+
+// hashes the client ID with 64-bit FNV-1a, spreading IDs evenly over the shards whatever pattern they follow
+func FNV1aShardFunc(clientID int) int {
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], uint64(clientID))
+	hash := fnv.New64a()
+	hash.Write(id[:])
+	return int(hash.Sum64())
+}
+
+// a vault split into shards with a lock each, see above
+type ShardedVaultKeyStore struct {
+	shards    []vaultKeyMap
+	shardFunc ShardFunc
+}
+
+// configures a ShardedVaultKeyStore
+type ShardOption func(*ShardedVaultKeyStore)
+
+// picks the shard of a client's key with fn instead of clientID % N
+func WithShardFunc(fn ShardFunc) ShardOption {
+	return func(s *ShardedVaultKeyStore) {
+		s.shardFunc = fn
+	}
+}
+
+// a vault split into n shards (at least 1)
+func NewShardedVaultKeyStore(n int, opts ...ShardOption) *ShardedVaultKeyStore {
+	s := &ShardedVaultKeyStore{shards: make([]vaultKeyMap, max(n, 1)), shardFunc: identityShardFunc}
+	for i := range s.shards {
+		s.shards[i].keys = make(map[int]*sync.Mutex)
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *ShardedVaultKeyStore) Key(clientID int) *sync.Mutex {
+	return s.shards[s.shard(clientID)].Key(clientID)
+}
+
+// the index of the client's shard
+func (s *ShardedVaultKeyStore) shard(clientID int) int {
+	shard := s.shardFunc(clientID) % len(s.shards)
+	// negative client IDs (or hashes) give negative remainders
+	if shard < 0 {
+		shard += len(s.shards)
+	}
+	return shard
+}
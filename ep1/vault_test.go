@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShardFuncSpreadsTheClients(t *testing.T) {
+	const shards, clients = 16, 10000
+	expected := clients / shards
+	for _, tc := range []struct {
+		name string
+		opts []ShardOption
+	}{
+		{"clientID % N", nil},
+		{"FNV-1a", []ShardOption{WithShardFunc(FNV1aShardFunc)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewShardedVaultKeyStore(shards, tc.opts...)
+			counts := make([]int, shards)
+			for clientID := 1; clientID <= clients; clientID++ {
+				counts[store.shard(clientID)]++
+			}
+			for shard, count := range counts {
+				if count < expected*95/100 || count > expected*105/100 {
+					t.Fatalf("shard %d got %d of %d sequential client IDs, expected %d±5%%", shard, count, clients,
+						expected)
+				}
+			}
+		})
+	}
+}
+
+func TestFNV1aShardFuncSpreadsPatterns(t *testing.T) {
+	const shards = 16
+	modulo := NewShardedVaultKeyStore(shards)
+	hashed := NewShardedVaultKeyStore(shards, WithShardFunc(FNV1aShardFunc))
+
+	// client IDs all multiples of the number of shards, all in the same shard with clientID % N
+	used, usedHashed := make(map[int]bool), make(map[int]bool)
+	for i := 1; i <= 1000; i++ {
+		used[modulo.shard(i*shards)] = true
+		usedHashed[hashed.shard(i*shards)] = true
+	}
+	if len(used) != 1 || len(usedHashed) != shards {
+		t.Fatalf("multiples of %d in %d shards with clientID %% N and %d with FNV-1a, expected 1 and all of them",
+			shards, len(used), len(usedHashed))
+	}
+}
+
+func TestShardedVaultKeyStoreKeys(t *testing.T) {
+	store := NewShardedVaultKeyStore(4, WithShardFunc(FNV1aShardFunc))
+	for _, clientID := range []int{1, 2, -3, 1 << 40} {
+		if store.Key(clientID) != store.Key(clientID) {
+			t.Fatalf("client %d got two different keys", clientID)
+		}
+	}
+	if store.Key(1) == store.Key(2) {
+		t.Fatal("clients 1 and 2 got the same key")
+	}
+	// negative IDs still land in a shard
+	if shard := NewShardedVaultKeyStore(4).shard(-3); shard != 1 {
+		t.Fatalf("client -3 in shard %d, expected 1", shard)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/**
+Who gets rate limited, and when, is worth more than a log line: a user hitting the limit every day at 9:00 is a
+customer outgrowing their plan, a thousand users hitting it within a minute is a client bug or an attack. Episode 3's
+aggregator already does time-windowed aggregates of user events, so rate-limited requests are sent there as events
+with Value 1, one per request turned away.
+
+The episodes are separate programs, both main packages that can't import each other, so the rate limiter reaches the
+aggregator through its API (POST /events) rather than calling episode 3's Aggregator.ProcessEvent. Aggregator here is
+that API as seen from this side, with the same ProcessEvent, and RateLimitAnalytics hooks it up to a RateLimiter.
+
+- the aggregator keys users by positive integers, and has no business knowing who they are anyway, so the user ID is
+  hashed (31 bits of FNV-1a). Two users hashing to the same ID have their counts merged, fine for spotting patterns
+  but not for billing anyone.
+- events are sent by a single goroutine, from a buffer of analyticsBuffer events. When the aggregator is slow or down
+  the buffer fills up and new events are dropped: requests never wait on analytics. Dropped tells how many were, and
+  the first drop (then every analyticsDropLogEvery-th) is logged.
+*/
+
+// how many events can wait to be sent to the aggregator before new ones are dropped
+const analyticsBuffer = 10000
+
+// how many events are dropped for a full buffer between two log lines saying so
+const analyticsDropLogEvery = 1000
+
+// called for every request turned away, with the lock released
+type RateLimitHook func(userID string, at time.Time)
+
+// a user activity event, as episode 3's aggregator takes it
+type Event struct {
+	UserID    int       `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     int       `json:"value"`
+}
+
+// episode 3's aggregator, reached through its API, see above
+type Aggregator struct {
+	// where events are POSTed, e.g "http://localhost:8090/events"
+	URL    string
+	client *http.Client
+	events chan Event
+	// events dropped because the buffer was full, or the aggregator refused them
+	dropped atomic.Int64
+}
+
+// starts sending events to the aggregator's events endpoint
+func NewAggregator(url string) *Aggregator {
+	agg := &Aggregator{
+		URL:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		events: make(chan Event, analyticsBuffer),
+	}
+	go agg.send()
+	return agg
+}
+
+// queues the event to be sent, dropping it if the buffer is full
+func (agg *Aggregator) ProcessEvent(event Event) {
+	select {
+	case agg.events <- event:
+	default:
+		if dropped := agg.dropped.Add(1); dropped%analyticsDropLogEvery == 1 {
+			log.Printf("The aggregator isn't keeping up, %d rate limit events dropped so far", dropped)
+		}
+	}
+}
+
+// how many events never made it to the aggregator
+func (agg *Aggregator) Dropped() int64 {
+	return agg.dropped.Load()
+}
+
+func (agg *Aggregator) send() {
+	for event := range agg.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			agg.dropped.Add(1)
+			continue
+		}
+		resp, err := agg.client.Post(agg.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			agg.dropped.Add(1)
+			log.Printf("Sending a rate limit event to the aggregator failed: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			agg.dropped.Add(1)
+			log.Printf("The aggregator refused a rate limit event with status %d", resp.StatusCode)
+		}
+	}
+}
+
+// the ID the aggregator knows the user by, see above
+func analyticsUserID(userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	// the aggregator only takes positive IDs
+	return int(h.Sum32()&0x7fffffff) + 1
+}
+
+// registers a hook called for every request the rate limiter turns away
+func (rl *RateLimiter) OnRateLimited(hook RateLimitHook) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.limitHooks = append(rl.limitHooks, hook)
+}
+
+// sends an event to the aggregator for every request the rate limiter turns away
+func RateLimitAnalytics(rl *RateLimiter, agg *Aggregator) {
+	rl.OnRateLimited(func(userID string, at time.Time) {
+		agg.ProcessEvent(Event{UserID: analyticsUserID(userID), Timestamp: at, Value: 1})
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import "regexp"
+
+/**
+Scrapers and other automated clients send many more requests than a person clicking around, and most of them say
+what they are in their User-Agent. With WithBotDetector, requests whose user agent the detector flags are held to a
+stricter limit of their own.
+
+A bot's requests are counted under "bot:" + the user ID, apart from the user's own: a user running a script doesn't
+use up the quota of their browser, and the other way around. The bot counter is a plain fixed window, the sliding
+window flag, the EMA history and the group quota are left to the human traffic.
+
+The User-Agent is sent by the client, a bot can pass itself off as a browser. Detection keeps the honest ones in
+check, the others are still held to the normal limit.
+*/
+
+// the prefix of the visitor key bot requests are counted under
+const botKeyPrefix = "bot:"
+
+// the strategy of requests from bots, as written to the audit log
+const StrategyBot = "bot"
+
+// tells whether a user agent belongs to an automated client
+type BotDetector func(userAgent string) bool
+
+// user agents of crawlers, scrapers and HTTP libraries
+var botUserAgent = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|scrap|curl|wget|python-requests|python-urllib|` +
+	`go-http-client|java/|okhttp|headless|phantomjs|axios|node-fetch`)
+
+// flags the user agents of well-known crawlers and HTTP libraries, and requests without a user agent (every browser
+// sends one)
+func DefaultBotDetector(userAgent string) bool {
+	return userAgent == "" || botUserAgent.MatchString(userAgent)
+}
+
+// limits requests the detector flags as automated to botRequestLimit per time window, counted apart from the user's
+// own requests, see above
+func WithBotDetector(detector BotDetector, botRequestLimit int) Option {
+	return func(rl *RateLimiter) {
+		rl.botDetector = detector
+		rl.botRequestLimit = botRequestLimit
+	}
+}
+
+// whether the request comes from a bot according to the detector
+func (rl *RateLimiter) isBot(userAgent string) bool {
+	return rl.botDetector != nil && rl.botDetector(userAgent)
+}
+
+// the key the requests of the user are counted under with the strategy
+func visitorKey(userID, strategy string) string {
+	if strategy == StrategyBot {
+		return botKeyPrefix + userID
+	}
+	return userID
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a clock the test moves by hand, see WithTimeFunc
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// sends requests for the user and fails the test if one of them isn't let through
+func mustAllow(t *testing.T, rl *RateLimiter, userID string, requests int) {
+	t.Helper()
+	for i := 1; i <= requests; i++ {
+		limited, err := rl.Limit(userID)
+		if err != nil {
+			t.Fatalf("request %d of %s: unexpected error %v", i, userID, err)
+		}
+		if limited {
+			t.Fatalf("request %d of %s was limited", i, userID)
+		}
+	}
+}
+
+// sends a request for the user and fails the test unless it is turned away
+func mustLimit(t *testing.T, rl *RateLimiter, userID string) {
+	t.Helper()
+	limited, err := rl.Limit(userID)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !limited {
+		t.Fatalf("request of %s over the limit went through", userID)
+	}
+}
+
+// every path through Limit: the fixed window filling up and starting over, and storage going away and coming back
+func TestLimitDecisionPaths(t *testing.T) {
+	t.Run("first request", func(t *testing.T) {
+		rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now))
+		mustAllow(t, rl, "alice", 1)
+	})
+
+	t.Run("up to the limit", func(t *testing.T) {
+		rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now))
+		mustAllow(t, rl, "alice", RequestLimit)
+	})
+
+	t.Run("first request over the limit", func(t *testing.T) {
+		rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now))
+		mustAllow(t, rl, "alice", RequestLimit)
+		mustLimit(t, rl, "alice")
+		// the other users keep their own count
+		mustAllow(t, rl, "bob", 1)
+	})
+
+	t.Run("window reset", func(t *testing.T) {
+		clock := newFakeClock()
+		rl := NewRateLimiter(WithTimeFunc(clock.Now))
+		mustAllow(t, rl, "alice", RequestLimit)
+		mustLimit(t, rl, "alice")
+
+		// a request within the window keeps it open
+		clock.Advance(TimeWindow)
+		mustLimit(t, rl, "alice")
+
+		clock.Advance(TimeWindow + time.Second)
+		mustAllow(t, rl, "alice", RequestLimit)
+		mustLimit(t, rl, "alice")
+	})
+
+	t.Run("storage failure", func(t *testing.T) {
+		rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now))
+		mustAllow(t, rl, "alice", RequestLimit)
+		rl.SimulateStorageFailure(false)
+
+		// AllowAll lets the request through, over the limit or not, and says why it wasn't checked
+		limited, err := rl.Limit("alice")
+		if !errors.Is(err, ErrStorageUnavailable) {
+			t.Fatalf("expected ErrStorageUnavailable, got %v", err)
+		}
+		if limited {
+			t.Fatal("request was limited while storage was unavailable with AllowAll")
+		}
+	})
+
+	t.Run("storage recovery", func(t *testing.T) {
+		rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now))
+		mustAllow(t, rl, "alice", RequestLimit-1)
+		rl.SimulateStorageFailure(false)
+		for i := 0; i < RequestLimit; i++ {
+			if _, err := rl.Limit("alice"); err == nil {
+				t.Fatal("expected an error while storage was unavailable")
+			}
+		}
+		rl.SimulateStorageFailure(true)
+
+		// the requests let through unchecked weren't counted, the count picks up where it was
+		mustAllow(t, rl, "alice", 1)
+		mustLimit(t, rl, "alice")
+	})
+}
+
+// both limits hold, and a user turned away by their own limit doesn't use up the group's
+func TestGroupLimit(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimiter(
+		WithTimeFunc(clock.Now),
+		WithGroupResolver(func(userID string) (string, bool) {
+			return "acme", userID != "carol"
+		}, RequestLimit+2),
+	)
+
+	mustAllow(t, rl, "alice", RequestLimit)
+	for i := 0; i < 10; i++ {
+		mustLimit(t, rl, "alice")
+	}
+	// alice's requests over her own limit weren't counted against acme
+	mustAllow(t, rl, "bob", 2)
+	mustLimit(t, rl, "bob")
+	// carol isn't in the group
+	mustAllow(t, rl, "carol", RequestLimit)
+
+	clock.Advance(TimeWindow + time.Second)
+	mustAllow(t, rl, "bob", RequestLimit)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+/**
+The counts live in central storage (a Redis in reality, see SimulateStorageFailure), when it can't be reached the
+limiter can't know whether a request is over the limit. What it does then is a trade-off between availability and
+protection, and which side matters more depends on what is behind it:
+
+- AllowAll (the default): every request goes through. The API stays up, but unprotected for as long as the outage
+  lasts, a storage outage is the perfect moment for an abuser.
+- DenyAll: every request is turned away as if it were over the limit. Nothing gets past the limiter, nothing
+  legitimate either: a storage outage becomes an outage of the API. For endpoints where a request too many costs more
+  than a request refused (sending SMS, payments).
+- UseCachedDecision: each node remembers the last decision it made for every user and keeps applying it, a user who
+  was turned away stays turned away, the others go through. Users the node has no decision for (or only one older
+  than a TimeWindow, which says nothing about the current window) are let through. The decisions are per node and
+  frozen: a user limited at the last request stays limited until storage is back, even once their window is over.
+- AllowWithAlert: like AllowAll, and the hooks registered with OnStorageFailure are called for every request let
+  through unchecked, e.g to page someone or count the requests that went unchecked.
+
+Limit still returns the storage error along with the decision, so the caller can log the incident whatever the policy.
+*/
+
+// returned when central storage can't be reached, see SimulateStorageFailure
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// what Limit decides when central storage can't be reached, see above
+type StorageFailurePolicy int
+
+const (
+	AllowAll StorageFailurePolicy = iota
+	DenyAll
+	UseCachedDecision
+	AllowWithAlert
+)
+
+// called for a request let through unchecked with AllowWithAlert, err tells what went wrong with storage
+type StorageFailureHook func(userID string, err error)
+
+// a decision Limit made, kept for UseCachedDecision
+type cachedDecision struct {
+	limited bool
+	at      time.Time
+}
+
+// sets what Limit decides when central storage can't be reached, AllowAll by default
+func WithStorageFailurePolicy(policy StorageFailurePolicy) Option {
+	return func(rl *RateLimiter) {
+		rl.storageFailurePolicy = policy
+	}
+}
+
+// registers a hook called for every request let through unchecked with AllowWithAlert
+func (rl *RateLimiter) OnStorageFailure(hook StorageFailureHook) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.storageFailureHooks = append(rl.storageFailureHooks, hook)
+}
+
+// remembers the decision made for the requests counted under key with UseCachedDecision (must be called with rl.mu
+// held)
+func (rl *RateLimiter) cacheDecision(key string, limited bool) {
+	if rl.storageFailurePolicy == UseCachedDecision {
+		rl.decisions[key] = cachedDecision{limited: limited, at: rl.now()}
+	}
+}
+
+// decides on a request that couldn't be checked because of err, as the policy says. key is the one the request
+// would have been counted under, see visitorKey.
+func (rl *RateLimiter) limitUnchecked(userID, key string, err error) bool {
+	rl.mu.Lock()
+	limited, hooks := rl.degrade(key)
+	rl.mu.Unlock()
+
+	// without the lock, a slow hook would hold up every request
+	for _, hook := range hooks {
+		hook(userID, err)
+	}
+	return limited
+}
+
+// the decision for a request that couldn't be checked, along with the hooks to call (must be called with rl.mu held)
+func (rl *RateLimiter) degrade(key string) (limited bool, hooks []StorageFailureHook) {
+	switch rl.storageFailurePolicy {
+	case DenyAll:
+		return true, nil
+	case UseCachedDecision:
+		decision, exists := rl.decisions[key]
+		return exists && rl.now().Sub(decision.at) <= TimeWindow && decision.limited, nil
+	case AllowWithAlert:
+		return false, rl.storageFailureHooks
+	default:
+		return false, nil
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// sends a request for the user while storage is down, returning whether it was limited
+func limitDuringOutage(t *testing.T, rl *RateLimiter, userID string) bool {
+	t.Helper()
+	limited, err := rl.Limit(userID)
+	if !errors.Is(err, ErrStorageUnavailable) {
+		t.Fatalf("request of %s: expected ErrStorageUnavailable, got %v", userID, err)
+	}
+	return limited
+}
+
+// alice is over the limit and bob isn't when storage goes down, carol shows up during the outage
+func TestStorageFailurePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy StorageFailurePolicy
+		// whether the requests of alice, bob and carol are limited during the outage
+		limited [3]bool
+	}{
+		{"AllowAll", AllowAll, [3]bool{false, false, false}},
+		{"DenyAll", DenyAll, [3]bool{true, true, true}},
+		{"UseCachedDecision", UseCachedDecision, [3]bool{true, false, false}},
+		{"AllowWithAlert", AllowWithAlert, [3]bool{false, false, false}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now), WithStorageFailurePolicy(tc.policy))
+			mustAllow(t, rl, "alice", RequestLimit)
+			mustLimit(t, rl, "alice")
+			mustAllow(t, rl, "bob", 1)
+			rl.SimulateStorageFailure(false)
+
+			// the same decision every time, nothing is counted
+			for range 3 {
+				for i, userID := range []string{"alice", "bob", "carol"} {
+					if limited := limitDuringOutage(t, rl, userID); limited != tc.limited[i] {
+						t.Fatalf("request of %s limited: %t, expected %t", userID, limited, tc.limited[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCachedDecisionsExpire(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimiter(WithTimeFunc(clock.Now), WithStorageFailurePolicy(UseCachedDecision))
+	mustAllow(t, rl, "alice", RequestLimit)
+	mustLimit(t, rl, "alice")
+	rl.SimulateStorageFailure(false)
+
+	clock.Advance(TimeWindow)
+	if !limitDuringOutage(t, rl, "alice") {
+		t.Fatal("alice let through within a window of her last decision")
+	}
+	// older than a window, the decision says nothing about the current one
+	clock.Advance(time.Second)
+	if limitDuringOutage(t, rl, "alice") {
+		t.Fatal("alice limited by a decision older than a window")
+	}
+}
+
+func TestStorageFailureAlerts(t *testing.T) {
+	rl := NewRateLimiter(WithTimeFunc(newFakeClock().Now), WithStorageFailurePolicy(AllowWithAlert))
+	var alerts []string
+	rl.OnStorageFailure(func(userID string, err error) {
+		if !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("alert for %s with %v, expected ErrStorageUnavailable", userID, err)
+		}
+		alerts = append(alerts, userID)
+	})
+
+	// checked requests raise nothing
+	mustAllow(t, rl, "alice", 2)
+	rl.SimulateStorageFailure(false)
+	limitDuringOutage(t, rl, "alice")
+	limitDuringOutage(t, rl, "bob")
+	rl.SimulateStorageFailure(true)
+	mustAllow(t, rl, "alice", 1)
+
+	if !slices.Equal(alerts, []string{"alice", "bob"}) {
+		t.Fatalf("alerts for %v, expected one for each request let through unchecked", alerts)
+	}
+}
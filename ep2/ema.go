@@ -0,0 +1,95 @@
+package main
+
+import "time"
+
+/**
+A visitor's request count starts over with every window, so on its own it can't tell a user who has been right under
+the limit for an hour from one who spiked once. The EMA (exponential moving average) of the request counts of the
+last few windows can: every window weighs alpha times the one before it, so recent windows count most but a single
+spike fades out quickly.
+
+The history uses windows aligned to TimeWindow (12:00, 12:01...) rather than the limiter's own windows, which
+only start over once a user has been quiet for a whole TimeWindow and so may never end for a busy user.
+*/
+
+// defaults of WithEMA
+const (
+	defaultEMAWindows = 10
+	defaultEMAAlpha   = 0.3
+)
+
+// keeps the request count of each of the last windows in a ring buffer
+type windowHistory struct {
+	counts []int
+	// slot of the window counted right now
+	head int
+	// start of the window counted right now
+	current time.Time
+}
+
+func newWindowHistory(windows int, now time.Time) *windowHistory {
+	return &windowHistory{
+		counts:  make([]int, windows),
+		current: now.Truncate(TimeWindow),
+	}
+}
+
+// counts a request in the window now falls into
+func (h *windowHistory) add(now time.Time) {
+	h.advance(now)
+	h.counts[h.head]++
+}
+
+// moves on to the window now falls into, windows without any request count 0
+func (h *windowHistory) advance(now time.Time) {
+	start := now.Truncate(TimeWindow)
+	steps := int(start.Sub(h.current) / TimeWindow)
+	if steps <= 0 {
+		return
+	}
+	for i := 0; i < min(steps, len(h.counts)); i++ {
+		h.head = (h.head + 1) % len(h.counts)
+		h.counts[h.head] = 0
+	}
+	h.current = start
+}
+
+// the EMA of the counts from the oldest window to the current one
+func (h *windowHistory) ema(alpha float64) float64 {
+	n := len(h.counts)
+	oldest := (h.head + 1) % n
+	ema := float64(h.counts[oldest])
+	for i := 1; i < n; i++ {
+		ema = alpha*float64(h.counts[(oldest+i)%n]) + (1-alpha)*ema
+	}
+	return ema
+}
+
+// keeps the request counts of each user's last windows so EMARequestRate can tell trends from spikes.
+// alpha (0 to 1) is the weight of the newest window, higher reacts faster. Zero values fall back to the defaults.
+func WithEMA(windows int, alpha float64) Option {
+	return func(rl *RateLimiter) {
+		if windows <= 0 {
+			windows = defaultEMAWindows
+		}
+		if alpha <= 0 || alpha > 1 {
+			alpha = defaultEMAAlpha
+		}
+		rl.emaWindows = windows
+		rl.emaAlpha = alpha
+	}
+}
+
+// returns the EMA of the user's requests per window over the last windows, the current (unfinished) one included.
+// It is 0 for unknown users or when WithEMA isn't used. A user quiet long enough to be cleaned up starts over.
+func (rl *RateLimiter) EMARequestRate(userID string) float64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	visitor, exists := rl.visitors.peek(userID)
+	if !exists || visitor.history == nil {
+		return 0
+	}
+	visitor.history.advance(rl.now())
+	return visitor.history.ema(rl.emaAlpha)
+}
@@ -0,0 +1,35 @@
+package main
+
+/**
+A visitor is forgotten when the cleanup finds their window expired, or when WithMaxVisitors evicts them to make room.
+Whatever was kept about their session goes with them: a caller flushing an audit trail or sending end-of-session
+analytics needs to hear about it first.
+
+The hooks registered with OnVisitorExpired are called for every visitor forgotten either way, each in a goroutine of
+its own: the visitors are removed with the lock held, a slow hook must not hold up every request. The hooks get a copy
+of the Visitor as it was when it was removed, in no particular order, and possibly after the user came back and got a
+new Visitor. Bot counters (see bot.go) are visitors too, they come with the "bot:" prefix.
+*/
+
+// called with a visitor that was forgotten, see above
+type VisitorExpiredHook func(userID string, visitor Visitor)
+
+// registers a hook called for every visitor removed by the cleanup or evicted by WithMaxVisitors
+func (rl *RateLimiter) OnVisitorExpired(hook VisitorExpiredHook) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.expiredHooks = append(rl.expiredHooks, hook)
+}
+
+// drops what is kept about a visitor next to their Visitor, which was just removed, and tells the hooks (must be
+// called with rl.mu held)
+func (rl *RateLimiter) forgetVisitor(userID string, visitor *Visitor) {
+	// an override only applies to the window it was set in, which a removed visitor loses
+	delete(rl.userOverrides, userID)
+	delete(rl.decisions, userID)
+
+	for _, hook := range rl.expiredHooks {
+		go hook(userID, *visitor)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+)
+
+/**
+Switching every user to a new rate limit strategy at once is a bet: if it turns away more (or fewer) requests than it
+should, everyone notices at the same time. Feature flags let a new strategy run for some of the users first, next to
+the old one, and the audit log tells which strategy decided each request so both can be compared.
+
+PercentageFlags enables a feature for a percentage of the users. Which users is decided by hashing the user ID along
+with the feature name rather than at random per request: a user stays on the same side (and keeps their count) from
+one request to the next, on every node, and the users in the 10% of one feature aren't the same as those in the 10%
+of another.
+
+The limiter asks for SlidingWindowFeature: users it is enabled for are limited by the sliding window (sliding.go),
+the others by the fixed window.
+*/
+
+// the feature routing users to the sliding window
+const SlidingWindowFeature = "sliding_window"
+
+// the strategies a request can be limited by, as written to the audit log
+const (
+	StrategyFixedWindow   = "fixed_window"
+	StrategySlidingWindow = "sliding_window"
+)
+
+// tells which features are enabled for which users
+type FeatureFlags interface {
+	Enabled(feature string, userID string) bool
+}
+
+// enables a single feature for a percentage of the users, see above
+type percentageFlags struct {
+	feature string
+	// hundredths of a percent, 10000 is everyone
+	buckets uint32
+}
+
+// enables feature for percent (0 to 100) of the users, the same users every time
+func PercentageFlags(feature string, percent float64) FeatureFlags {
+	percent = min(max(percent, 0), 100)
+	return percentageFlags{feature: feature, buckets: uint32(percent * 100)}
+}
+
+func (f percentageFlags) Enabled(feature string, userID string) bool {
+	if feature != f.feature {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(feature))
+	// keeps "ab"+"c" apart from "a"+"bc"
+	h.Write([]byte{0})
+	h.Write([]byte(userID))
+	return h.Sum32()%10000 < f.buckets
+}
+
+// routes users between rate limit strategies, without flags everyone gets the fixed window
+func WithFeatureFlags(flags FeatureFlags) Option {
+	return func(rl *RateLimiter) {
+		rl.flags = flags
+	}
+}
+
+// writes a line per request to logger, telling who was limited by which strategy and whether they were turned away
+func WithAuditLog(logger *log.Logger) Option {
+	return func(rl *RateLimiter) {
+		rl.audit = logger
+	}
+}
+
+// the strategy limiting the user's requests
+func (rl *RateLimiter) strategy(userID string) string {
+	if rl.flags != nil && rl.flags.Enabled(SlidingWindowFeature, userID) {
+		return StrategySlidingWindow
+	}
+	return StrategyFixedWindow
+}
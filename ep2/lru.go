@@ -0,0 +1,146 @@
+package main
+
+/**
+Every user that ever sent a request has a Visitor until the cleanup notices their window expired, which only happens
+once a minute. A million one-time users in a minute means a million Visitors in memory.
+
+WithMaxVisitors bounds that with an LRU cache: a hash map for the lookups, plus a doubly linked list ordering the
+visitors from most to least recently seen. Once the cache is full, the least recently seen visitor makes room for the
+new one, in O(1).
+
+The tradeoff: an evicted visitor may still be inside their time window. Their count is forgotten, so their next request
+starts a fresh window with a full quota (and their override and EMA history are gone with it). With a capacity well
+above the number of users active within a window only idle users get evicted, who would have been cleaned up anyway.
+Too small a capacity lets users get around the limit by having the cache churn, so size it for peak active users.
+*/
+
+// configures the max number of visitors kept at once (0 means no limit), see above
+func WithMaxVisitors(maxVisitors int) Option {
+	return func(rl *RateLimiter) {
+		rl.visitors.capacity = maxVisitors
+	}
+}
+
+// how many visitors were evicted to make room so far
+func (rl *RateLimiter) EvictedVisitors() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.visitors.evictions
+}
+
+// an entry of the LRU list
+type lruEntry struct {
+	key        string
+	visitor    *Visitor
+	prev, next *lruEntry
+}
+
+// rate data by key, evicting the least recently used entry beyond capacity (not safe for concurrent use)
+type visitorCache struct {
+	entries map[string]*lruEntry
+	// most and least recently used entries
+	head, tail *lruEntry
+	// 0 means no limit
+	capacity int
+	// called for every entry evicted to make room, nil means nobody cares
+	onEvict func(key string, visitor *Visitor)
+	// how many entries were evicted so far
+	evictions int
+}
+
+func newVisitorCache() *visitorCache {
+	return &visitorCache{entries: make(map[string]*lruEntry)}
+}
+
+// returns the visitor stored under key, marking it as the most recently used
+func (c *visitorCache) get(key string) (*Visitor, bool) {
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	c.unlink(entry)
+	c.pushFront(entry)
+	return entry.visitor, true
+}
+
+// returns the visitor stored under key without marking it as used
+func (c *visitorCache) peek(key string) (*Visitor, bool) {
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	return entry.visitor, true
+}
+
+// stores the visitor under key as the most recently used, evicting the least recently used one if the cache is full
+func (c *visitorCache) add(key string, visitor *Visitor) {
+	if entry, exists := c.entries[key]; exists {
+		entry.visitor = visitor
+		c.unlink(entry)
+		c.pushFront(entry)
+		return
+	}
+
+	entry := &lruEntry{key: key, visitor: visitor}
+	c.entries[key] = entry
+	c.pushFront(entry)
+
+	if c.capacity > 0 && len(c.entries) > c.capacity {
+		oldest := c.tail
+		c.remove(oldest.key)
+		c.evictions++
+		if c.onEvict != nil {
+			c.onEvict(oldest.key, oldest.visitor)
+		}
+	}
+}
+
+// removes the visitor stored under key, if any
+func (c *visitorCache) remove(key string) {
+	entry, exists := c.entries[key]
+	if !exists {
+		return
+	}
+	c.unlink(entry)
+	delete(c.entries, key)
+}
+
+// calls fn for every visitor, fn may remove the visitor it is called for
+func (c *visitorCache) each(fn func(key string, visitor *Visitor)) {
+	for entry := c.head; entry != nil; {
+		next := entry.next
+		fn(entry.key, entry.visitor)
+		entry = next
+	}
+}
+
+func (c *visitorCache) len() int {
+	return len(c.entries)
+}
+
+func (c *visitorCache) pushFront(entry *lruEntry) {
+	entry.prev = nil
+	entry.next = c.head
+	if c.head != nil {
+		c.head.prev = entry
+	}
+	c.head = entry
+	if c.tail == nil {
+		c.tail = entry
+	}
+}
+
+func (c *visitorCache) unlink(entry *lruEntry) {
+	if entry.prev != nil {
+		entry.prev.next = entry.next
+	} else {
+		c.head = entry.next
+	}
+	if entry.next != nil {
+		entry.next.prev = entry.prev
+	} else {
+		c.tail = entry.prev
+	}
+	entry.prev, entry.next = nil, nil
+}
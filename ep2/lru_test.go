@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// the keys of the cache from most to least recently used
+func cacheKeys(c *visitorCache) []string {
+	var keys []string
+	c.each(func(key string, visitor *Visitor) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+func TestVisitorCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newVisitorCache()
+	c.capacity = 3
+	var evicted []string
+	c.onEvict = func(key string, visitor *Visitor) {
+		evicted = append(evicted, key)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.add(key, &Visitor{})
+	}
+	// a is used again, peeking at b doesn't count
+	c.get("a")
+	c.peek("b")
+	c.add("d", &Visitor{})
+	c.add("e", &Visitor{})
+
+	if keys := cacheKeys(c); !slices.Equal(keys, []string{"e", "d", "a"}) {
+		t.Fatalf("cache holds %v, expected e, d and a", keys)
+	}
+	if !slices.Equal(evicted, []string{"b", "c"}) || c.evictions != 2 {
+		t.Fatalf("evicted %v (%d evictions), expected b then c", evicted, c.evictions)
+	}
+
+	c.remove("d")
+	c.remove("missing")
+	if keys := cacheKeys(c); !slices.Equal(keys, []string{"e", "a"}) || c.len() != 2 {
+		t.Fatalf("cache holds %v after removing d, expected e and a", keys)
+	}
+}
+
+func TestEvictedVisitorStartsAFreshWindow(t *testing.T) {
+	clock := newFakeClock()
+	rl := NewRateLimiter(WithTimeFunc(clock.Now), WithMaxVisitors(2))
+
+	mustAllow(t, rl, "alice", RequestLimit)
+	mustLimit(t, rl, "alice")
+
+	// two other users push alice out while her window is still running, see the tradeoff in lru.go
+	mustAllow(t, rl, "bob", 1)
+	mustAllow(t, rl, "carol", 1)
+	if evicted := rl.EvictedVisitors(); evicted != 1 {
+		t.Fatalf("%d visitors evicted, expected alice", evicted)
+	}
+	mustAllow(t, rl, "alice", RequestLimit)
+}
+
+// a million users, each seen once: the unbounded map keeps all of them, the LRU cache the last 100,000
+func BenchmarkVisitors(b *testing.B) {
+	users := make([]string, 1_000_000)
+	for i := range users {
+		users[i] = "user" + strconv.Itoa(i)
+	}
+	for _, tc := range []struct {
+		name        string
+		maxVisitors int
+	}{{"unbounded", 0}, {"lru", 100_000}} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				rl := NewRateLimiter(WithMaxVisitors(tc.maxVisitors))
+				for _, user := range users {
+					rl.Limit(user)
+				}
+				b.ReportMetric(float64(rl.visitors.len()), "visitors")
+			}
+		})
+	}
+}
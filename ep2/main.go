@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,29 +21,110 @@ const (
 	TimeWindow   = time.Minute // time window for rate limiting
 )
 
+// how many quota reset notifications can wait for a reader before new ones are dropped
+const quotaResetBuffer = 10000
+
 // to hold the visitor's rate limit data
 type RateLimiter struct {
 	// to ensure thread safe acces to the the `visitors` map
 	mu sync.Mutex
-	// a map with user-id as key and value as Visitor data
-	visitors map[string]*Visitor
+	// a map with user-id as key and value as Visitor data, bounded with WithMaxVisitors
+	visitors *visitorCache
 	// to simulate storage availability (In reality, central storage like redis can be unavailable. Please check main function to see how this simulation works)
 	storageEnabled bool
+	// maps a user to the group (e.g organization) whose quota they share, nil means no groups
+	groupResolver GroupResolver
+	// the max requests per time window for a whole group
+	groupLimit int
+	// a map with group-id as key and value as the group's combined rate data
+	groups *visitorCache
+	// limits set by operators for specific users, they only last until the user's current window resets
+	userOverrides map[string]int
+	// notifications for users whose window expired, see QuotaResets
+	quotaResets chan QuotaResetEvent
+	// tells the current time
+	now TimeFunc
+	// how many windows of history are kept per user for the EMA (0 means none), and the weight of the newest one
+	emaWindows int
+	emaAlpha   float64
+	// called for every request turned away, see OnRateLimited
+	limitHooks []RateLimitHook
+	// routes users between the fixed and sliding window, see WithFeatureFlags
+	flags FeatureFlags
+	// where the decision on every request is written, nil means nowhere
+	audit *log.Logger
+	// tells requests from bots apart, nil means none are, and the max requests per time window of a bot
+	botDetector     BotDetector
+	botRequestLimit int
+	// what Limit decides while storage is unavailable, see degradation.go
+	storageFailurePolicy StorageFailurePolicy
+	// called for every request let through unchecked with AllowWithAlert, see OnStorageFailure
+	storageFailureHooks []StorageFailureHook
+	// the last decision for every user, only kept with UseCachedDecision
+	decisions map[string]cachedDecision
+	// called for every visitor removed, see OnVisitorExpired
+	expiredHooks []VisitorExpiredHook
+}
+
+// tells the current time, replacing it (e.g with a fake clock in tests) makes windows controllable
+type TimeFunc func() time.Time
+
+// tells that a user's quota was restored
+type QuotaResetEvent struct {
+	UserID string
+	// when the user's window expired
+	ResetAt time.Time
+}
+
+// resolves the group a user belongs to, ok is false for users that don't belong to any group
+type GroupResolver func(userID string) (groupID string, ok bool)
+
+// configures optional RateLimiter behavior
+type Option func(*RateLimiter)
+
+// makes users of the same group share a combined quota of groupLimit requests per time window.
+// Each user is still held to their individual RequestLimit, so one sub-account can't drain the whole pool.
+func WithGroupResolver(resolver GroupResolver, groupLimit int) Option {
+	return func(rl *RateLimiter) {
+		rl.groupResolver = resolver
+		rl.groupLimit = groupLimit
+	}
+}
+
+// replaces time.Now as the source of the current time
+func WithTimeFunc(now TimeFunc) Option {
+	return func(rl *RateLimiter) {
+		rl.now = now
+	}
 }
 
 // to track number of requests and last seen time
 type Visitor struct {
 	lastSeen time.Time
 	requests int
+	// request counts of the last windows, only kept for users and with WithEMA
+	history *windowHistory
+	// when the requests let through in the last TimeWindow came in, only kept for users on the sliding window
+	recent []time.Time
 }
 
 // initializes the RateLimiter
-func NewRateLimiter() *RateLimiter {
+func NewRateLimiter(opts ...Option) *RateLimiter {
 	rl := &RateLimiter{
-		visitors: make(map[string]*Visitor),
+		visitors: newVisitorCache(),
+		groups:   newVisitorCache(),
+
+		userOverrides: make(map[string]int),
+		decisions:     make(map[string]cachedDecision),
+		quotaResets:   make(chan QuotaResetEvent, quotaResetBuffer),
+		now:           time.Now,
 		// storage initially available
 		storageEnabled: true,
 	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	rl.visitors.onEvict = rl.forgetVisitor
 
 	// very important!
 	// having 100,000 one-time user that never come back to our platform.
@@ -63,52 +147,190 @@ func (rl *RateLimiter) SimulateStorageFailure(enable bool) {
 	}
 }
 
+// notifies about users whose quota was restored, so they can be told without polling.
+//
+// An event is sent when the cleanup removes a user whose window expired. The channel holds up to 10,000 events,
+// once it is full new events are dropped rather than holding up the cleanup (and every request waiting on the lock),
+// so a reader that falls behind misses notifications. Resets are also only noticed by the cleanup,
+// so an event can arrive up to a minute after the quota was actually restored.
+func (rl *RateLimiter) QuotaResets() <-chan QuotaResetEvent {
+	return rl.quotaResets
+}
+
 // helper function to remove visitors that have not been seen within the time window
 func (rl *RateLimiter) cleanupVisitors() {
 	for {
 		time.Sleep(time.Minute)
 		rl.mu.Lock()
-		for id, visitor := range rl.visitors {
-			if time.Since(visitor.lastSeen) > TimeWindow {
-				delete(rl.visitors, id)
+		rl.visitors.each(func(id string, visitor *Visitor) {
+			if rl.now().Sub(visitor.lastSeen) > TimeWindow {
+				rl.visitors.remove(id)
+				rl.forgetVisitor(id, visitor)
+
+				// a bot's quota being restored isn't something to tell the user about
+				if strings.HasPrefix(id, botKeyPrefix) {
+					return
+				}
+				select {
+				case rl.quotaResets <- QuotaResetEvent{UserID: id, ResetAt: visitor.lastSeen.Add(TimeWindow)}:
+				default:
+					// nobody is keeping up with the notifications, drop it
+				}
 			}
-		}
+		})
+		rl.groups.each(func(id string, group *Visitor) {
+			if rl.now().Sub(group.lastSeen) > TimeWindow {
+				rl.groups.remove(id)
+			}
+		})
 		rl.mu.Unlock()
 	}
 }
 
 // core rate limit checker to check if a user has exceeded the rate limit
 func (rl *RateLimiter) Limit(userID string) (bool, error) {
+	return rl.limit(userID, rl.strategy(userID))
+}
+
+// like Limit, holding the request to the bot limit if the user agent is a bot's, see WithBotDetector
+func (rl *RateLimiter) LimitUserAgent(userID, userAgent string) (bool, error) {
+	if rl.isBot(userAgent) {
+		return rl.limit(userID, StrategyBot)
+	}
+	return rl.Limit(userID)
+}
+
+// checks the request with the given strategy, logs the decision and calls the hooks
+func (rl *RateLimiter) limit(userID, strategy string) (bool, error) {
+	limited, at, hooks, err := rl.check(userID, strategy)
+	if err != nil {
+		return rl.limitUnchecked(userID, visitorKey(userID, strategy), err), err
+	}
+	if rl.audit != nil {
+		rl.audit.Printf("user=%s strategy=%s limited=%t", userID, strategy, limited)
+	}
+	// without the lock, a slow hook would hold up every request
+	if limited {
+		for _, hook := range hooks {
+			hook(userID, at)
+		}
+	}
+	return limited, nil
+}
+
+// counts the request with the given strategy and tells whether it is over the limit, along with the hooks to call
+// if it is
+func (rl *RateLimiter) check(userID, strategy string) (limited bool, at time.Time, hooks []RateLimitHook, err error) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
 	if !rl.storageEnabled {
-		// Simulate storage failure ->  Allow request (as a fallback)
-		return false, fmt.Errorf("storage unavailable")
+		// Simulate storage failure -> Limit falls back to the StorageFailurePolicy
+		return false, time.Time{}, nil, ErrStorageUnavailable
+	}
+
+	switch strategy {
+	case StrategyBot:
+		// bots only have their own counter, see bot.go
+		key := visitorKey(userID, strategy)
+		requests, _ := rl.record(rl.visitors, key)
+		limited = requests > rl.botRequestLimit
+		rl.cacheDecision(key, limited)
+		return limited, rl.now(), rl.limitHooks, nil
+	case StrategySlidingWindow:
+		limited = rl.slide(userID)
+	default:
+		requests, newWindow := rl.record(rl.visitors, userID)
+		if newWindow {
+			// an override only applies to the window it was set in
+			delete(rl.userOverrides, userID)
+		}
+		limited = requests > rl.userLimit(userID)
+	}
+	if rl.emaWindows > 0 {
+		visitor, _ := rl.visitors.peek(userID)
+		if visitor.history == nil {
+			visitor.history = newWindowHistory(rl.emaWindows, rl.now())
+		}
+		visitor.history.add(rl.now())
+	}
+
+	// both the user's own limit and their group's combined limit have to hold for the request to go through.
+	// A request the user's own limit turned away isn't counted against the group, or a user hammering past their
+	// limit would drain the group's quota (and keep its window alive) for everyone else in it.
+	if !limited && rl.groupResolver != nil {
+		if groupID, ok := rl.groupResolver(userID); ok {
+			groupRequests, _ := rl.record(rl.groups, groupID)
+			limited = groupRequests > rl.groupLimit
+		}
 	}
+	rl.cacheDecision(userID, limited)
+
+	return limited, rl.now(), rl.limitHooks, nil
+}
 
-	visitor, exists := rl.visitors[userID]
+// the max requests per time window of the user, their override if they have one (must be called with rl.mu held)
+func (rl *RateLimiter) userLimit(userID string) int {
+	if override, exists := rl.userOverrides[userID]; exists {
+		return override
+	}
+	return RequestLimit
+}
+
+// counts a request against the counter stored under key and returns the number of requests in its current window,
+// newWindow reports whether this request started a new window (must be called with rl.mu held)
+func (rl *RateLimiter) record(counters *visitorCache, key string) (requests int, newWindow bool) {
+	visitor, exists := counters.get(key)
 	if !exists {
-		rl.visitors[userID] = &Visitor{
-			lastSeen: time.Now(),
+		counters.add(key, &Visitor{
+			lastSeen: rl.now(),
 			requests: 1,
-		}
-		return false, nil // Not exceeded
+		})
+		return 1, true
 	}
 
-	if time.Since(visitor.lastSeen) > TimeWindow {
-		visitor.lastSeen = time.Now()
+	if rl.now().Sub(visitor.lastSeen) > TimeWindow {
+		visitor.lastSeen = rl.now()
 		visitor.requests = 1
-		return false, nil // Not exceeded
+		return 1, true
 	}
 
 	visitor.requests++
-	visitor.lastSeen = time.Now()
-	if visitor.requests > RequestLimit {
-		return true, nil //  exceeded
+	visitor.lastSeen = rl.now()
+	return visitor.requests, false
+}
+
+// changes a user's effective limit until their current window resets
+func (rl *RateLimiter) SetUserLimit(userID string, limit int) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if !rl.storageEnabled {
+		return ErrStorageUnavailable
+	}
+
+	// a user without a window gets one now, otherwise their very next request would start a new window and drop the override
+	if _, exists := rl.visitors.get(userID); !exists {
+		rl.visitors.add(userID, &Visitor{lastSeen: rl.now()})
+	}
+	rl.userOverrides[userID] = limit
+	return nil
+}
+
+// clears a user's request count for their current window
+func (rl *RateLimiter) ResetUser(userID string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if !rl.storageEnabled {
+		return ErrStorageUnavailable
 	}
 
-	return false, nil
+	if visitor, exists := rl.visitors.peek(userID); exists {
+		visitor.requests = 0
+		visitor.recent = nil
+	}
+	return nil
 }
 
 // applies rate limiting to incoming requests
@@ -120,13 +342,10 @@ func rateLimiterMiddleware(rl *RateLimiter, next http.Handler) http.Handler {
 			return
 		}
 
-		limited, err := rl.Limit(userID)
+		limited, err := rl.LimitUserAgent(userID, r.UserAgent())
 		if err != nil {
-			// central storage is unavailable; implement graceful degradation
+			// central storage is unavailable, limited is what the StorageFailurePolicy decided
 			log.Printf("Storage error: %v", err)
-			// allow the request but in an actual system, we should also log the incident
-			next.ServeHTTP(w, r)
-			return
 		}
 
 		if limited {
@@ -143,13 +362,83 @@ func rateLimiterMiddleware(rl *RateLimiter, next http.Handler) http.Handler {
 	})
 }
 
+// lets operators adjust a specific user's rate limit, e.g
+//
+//	PATCH /admin/rate-limit/{userID}  {"limit": 100, "reset": true}
+//
+// "limit" overrides the user's limit for their current window and "reset" clears what they have used so far.
+func adminRateLimitHandler(rl *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("userID")
+
+		var body struct {
+			Limit *int `json:"limit"`
+			Reset bool `json:"reset"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if body.Limit == nil && !body.Reset {
+			http.Error(w, "nothing to update, provide \"limit\" and/or \"reset\"", http.StatusBadRequest)
+			return
+		}
+		if body.Limit != nil && *body.Limit < 0 {
+			http.Error(w, "limit must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		if body.Limit != nil {
+			if err := rl.SetUserLimit(userID, *body.Limit); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if body.Reset {
+			if err := rl.ResetUser(userID); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 // dummy handler to simulate an API endpoint
 func apiHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Request successful")
 }
 
 func main() {
-	rateLimiter := NewRateLimiter()
+	// user IDs like "acme:alice" belong to the "acme" organization whose sub-accounts share 20 requests per window
+	// and the request trend of every user is kept to tell steady heavy users from one-off spikes.
+	// At most a million users are tracked at once.
+	// Half of the users are limited by the sliding window, every decision is logged with the strategy that made it.
+	// Scripts and crawlers get 2 requests per window, apart from the user's own.
+	rateLimiter := NewRateLimiter(
+		WithGroupResolver(func(userID string) (string, bool) {
+			org, _, found := strings.Cut(userID, ":")
+			return org, found
+		}, 20),
+		WithEMA(0, 0),
+		WithMaxVisitors(1_000_000),
+		WithFeatureFlags(PercentageFlags(SlidingWindowFeature, 50)),
+		WithAuditLog(log.New(os.Stdout, "audit: ", log.LstdFlags)),
+		WithBotDetector(DefaultBotDetector, 2),
+	)
+
+	// rate-limited requests are counted by episode 3's aggregator when its API is given, see analytics.go
+	if url := os.Getenv("ANALYTICS_URL"); url != "" {
+		RateLimitAnalytics(rateLimiter, NewAggregator(url))
+	}
+
+	// in reality this would e.g push a notification to the user's client
+	go func() {
+		for reset := range rateLimiter.QuotaResets() {
+			log.Printf("Quota of user %s restored at %s", reset.UserID, reset.ResetAt.Format(time.RFC3339))
+		}
+	}()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api", apiHandler)
@@ -184,6 +473,20 @@ func main() {
 		}
 	}()
 
+	// the admin API is kept off the public ports (and the rate limiter) so only operators can reach it
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("PATCH /admin/rate-limit/{userID}", adminRateLimitHandler(rateLimiter))
+	adminServer := &http.Server{
+		Addr:    ":9090",
+		Handler: adminMux,
+	}
+	go func() {
+		log.Println("Admin server is running on port 9090")
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Admin server failed: %v", err)
+		}
+	}()
+
 	// simulating storage unavailability after some time
 	go func() {
 		for {
@@ -0,0 +1,46 @@
+package main
+
+/**
+The fixed window counts requests from the first one on and only starts over once the user has been quiet for a whole
+TimeWindow. A user sending a request every 30 seconds never gets a new window, and is turned away for good after
+RequestLimit requests even though they never sent more than 2 a minute.
+
+The sliding window keeps the time of each request it let through and counts those of the last TimeWindow: a request
+goes through if fewer than the limit were let through within the minute before it. Requests turned away aren't kept,
+so a user retrying in a loop gets through again as soon as their oldest request leaves the window, and a user never
+holds more than their limit of timestamps.
+
+Overrides set with SetUserLimit last until the user has been quiet for a whole TimeWindow, like with the fixed window.
+Groups keep their fixed window whatever the strategy of their users.
+*/
+
+// counts the request in the user's sliding window, unless it is over the limit, see above
+// (must be called with rl.mu held)
+func (rl *RateLimiter) slide(userID string) (limited bool) {
+	now := rl.now()
+	visitor, exists := rl.visitors.get(userID)
+	if !exists {
+		visitor = &Visitor{}
+		rl.visitors.add(userID, visitor)
+	} else if now.Sub(visitor.lastSeen) > TimeWindow {
+		// an override only applies to the window it was set in
+		delete(rl.userOverrides, userID)
+	}
+	visitor.lastSeen = now
+
+	start := now.Add(-TimeWindow)
+	expired := 0
+	for _, at := range visitor.recent {
+		if at.After(start) {
+			break
+		}
+		expired++
+	}
+	visitor.recent = visitor.recent[expired:]
+
+	if len(visitor.recent) >= rl.userLimit(userID) {
+		return true
+	}
+	visitor.recent = append(visitor.recent, now)
+	return false
+}
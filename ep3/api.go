@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+A JSON API over the aggregator:
+
+- GET /aggregates: the aggregates of all users combined
+- GET /aggregates/{userID}: every window of the user
+- GET /aggregates/{userID}/current: the user's current window, read without the lock (see CurrentValue)
+- POST /events: processes an Event sent as JSON, refusing timestamps more than maxEventSkew ahead of the clock or
+  older than the retention period
+
+NewTenantAPIHandler serves the same routes for every tenant of a Registry under /tenants/{tenant}, e.g
+POST /tenants/shop/events or GET /tenants/shop/aggregates/42, each tenant's requests going to its own aggregator.
+*/
+
+// max size of a POST /events body, an event is a few hundred bytes at most
+const maxEventBody = 64 << 10
+
+// how far ahead of the aggregator's clock a POST /events timestamp may be, to allow for the client's clock drifting.
+// Anything further ahead would make the aggregator keep a window until that day comes.
+const maxEventSkew = time.Minute
+
+// a window as served by the API
+type windowJSON struct {
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Value     int       `json:"value"`
+	Events    int       `json:"events"`
+	Throttled int       `json:"throttled,omitempty"`
+}
+
+func toJSON(windows ...Window) []windowJSON {
+	out := make([]windowJSON, len(windows))
+	for i, window := range windows {
+		out[i] = windowJSON{
+			StartTime: window.StartTime,
+			EndTime:   window.EndTime,
+			Value:     window.Value,
+			Events:    window.Events,
+			Throttled: window.Throttled,
+		}
+	}
+	return out
+}
+
+// serves the API above
+func NewAPIHandler(a *Aggregator) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /events", func(w http.ResponseWriter, r *http.Request) {
+		postEvent(a, w, r)
+	})
+	mux.HandleFunc("GET /aggregates", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, toJSON(a.GetGlobalAggregates()...))
+	})
+	mux.HandleFunc("GET /aggregates/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		getUserAggregates(a, w, r)
+	})
+	mux.HandleFunc("GET /aggregates/{userID}/current", func(w http.ResponseWriter, r *http.Request) {
+		getCurrentValue(a, w, r)
+	})
+	return mux
+}
+
+// serves the API above for every tenant of the registry, under /tenants/{tenant}
+func NewTenantAPIHandler(reg *Registry) http.Handler {
+	var mu sync.Mutex
+	// the API of each tenant's aggregator, built the first time the tenant is used
+	handlers := make(map[*Aggregator]http.Handler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, "/tenants/")
+		tenant, _, _ := strings.Cut(rest, "/")
+		if !ok || tenant == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		aggr, err := reg.Aggregator(tenant)
+		switch {
+		case errors.Is(err, ErrUnknownTenant):
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		case errors.Is(err, ErrRegistryClosed):
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		mu.Lock()
+		handler, exists := handlers[aggr]
+		if !exists {
+			handler = http.StripPrefix("/tenants/"+tenant, NewAPIHandler(aggr))
+			handlers[aggr] = handler
+		}
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// GET /aggregates/{userID}
+func getUserAggregates(a *Aggregator, w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDOf(w, r)
+	if !ok {
+		return
+	}
+	windows := a.GetUserAggregates(userID)
+	if len(windows) == 0 {
+		writeError(w, http.StatusNotFound, "no data for the user")
+		return
+	}
+	writeJSON(w, http.StatusOK, toJSON(windows...))
+}
+
+// GET /aggregates/{userID}/current
+func getCurrentValue(a *Aggregator, w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDOf(w, r)
+	if !ok {
+		return
+	}
+	window, ok := a.CurrentValue(userID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no data for the user in the current window")
+		return
+	}
+	writeJSON(w, http.StatusOK, toJSON(window)[0])
+}
+
+// the {userID} of the request's path, answering 400 if it isn't a positive integer
+func userIDOf(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil || userID <= 0 {
+		writeError(w, http.StatusBadRequest, "userID must be a positive integer")
+		return 0, false
+	}
+	return userID, true
+}
+
+// POST /events
+func postEvent(a *Aggregator, w http.ResponseWriter, r *http.Request) {
+	var event Event
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&event); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, "event too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid event: "+err.Error())
+		return
+	}
+	if event.UserID <= 0 {
+		writeError(w, http.StatusBadRequest, "user_id must be a positive integer")
+		return
+	}
+	if event.Value < 0 {
+		writeError(w, http.StatusBadRequest, "value must not be negative")
+		return
+	}
+	if !event.Timestamp.IsZero() {
+		now := a.clock.Now()
+		if event.Timestamp.After(now.Add(maxEventSkew)) {
+			writeError(w, http.StatusBadRequest, "timestamp is in the future")
+			return
+		}
+		if !event.Timestamp.After(now.Add(-a.retention)) {
+			writeError(w, http.StatusBadRequest, "timestamp is older than the retention period")
+			return
+		}
+	}
+
+	if err := a.ProcessEventWithTimeout(r.Context(), event); err != nil {
+		// the aggregator is overloaded, the client may retry later
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
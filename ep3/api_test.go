@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sends the request to the server, decoding a JSON response into out (if not nil)
+func doJSON(t *testing.T, server *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// the JSON of an event of the user at the start of the tests
+func eventJSON(userID, value int) string {
+	return eventJSONAt(userID, value, testStart)
+}
+
+// the JSON of an event of the user at the given time
+func eventJSONAt(userID, value int, timestamp time.Time) string {
+	event, _ := json.Marshal(Event{UserID: userID, Timestamp: timestamp, Value: value})
+	return string(event)
+}
+
+func TestAPI(t *testing.T) {
+	a := NewAggregator(time.Minute, WithClock(newFakeClock()))
+	defer a.Close()
+	server := httptest.NewServer(NewAPIHandler(a))
+	defer server.Close()
+
+	for _, value := range []int{2, 3} {
+		if status := doJSON(t, server, http.MethodPost, "/events", eventJSON(1, value), nil); status != http.StatusAccepted {
+			t.Fatalf("POST /events answered %d", status)
+		}
+	}
+
+	var windows []windowJSON
+	if status := doJSON(t, server, http.MethodGet, "/aggregates/1", "", &windows); status != http.StatusOK {
+		t.Fatalf("GET /aggregates/1 answered %d", status)
+	}
+	if len(windows) != 1 || windows[0].Value != 5 || windows[0].Events != 2 {
+		t.Fatalf("GET /aggregates/1: %+v, expected a window with 5", windows)
+	}
+
+	var current windowJSON
+	if status := doJSON(t, server, http.MethodGet, "/aggregates/1/current", "", &current); status != http.StatusOK {
+		t.Fatalf("GET /aggregates/1/current answered %d", status)
+	}
+	if current.Value != 5 {
+		t.Fatalf("GET /aggregates/1/current: %+v, expected 5", current)
+	}
+
+	doJSON(t, server, http.MethodPost, "/events", eventJSON(2, 4), nil)
+	if status := doJSON(t, server, http.MethodGet, "/aggregates", "", &windows); status != http.StatusOK {
+		t.Fatalf("GET /aggregates answered %d", status)
+	}
+	if len(windows) != 1 || windows[0].Value != 9 {
+		t.Fatalf("GET /aggregates: %+v, expected a window with 9", windows)
+	}
+}
+
+func TestAPIAcceptsTimestampsWithinTheSkew(t *testing.T) {
+	a := NewAggregator(time.Minute, WithClock(newFakeClock()))
+	defer a.Close()
+	server := httptest.NewServer(NewAPIHandler(a))
+	defer server.Close()
+
+	for _, timestamp := range []time.Time{
+		testStart.Add(maxEventSkew),
+		testStart.Add(-retentionPeriod + time.Second),
+		{},
+	} {
+		body := eventJSONAt(3, 1, timestamp)
+		if status := doJSON(t, server, http.MethodPost, "/events", body, nil); status != http.StatusAccepted {
+			t.Errorf("POST /events %s answered %d", body, status)
+		}
+	}
+	if windows := a.GetUserAggregates(3); len(windows) != 3 {
+		t.Fatalf("%d windows, expected one per accepted event", len(windows))
+	}
+}
+
+func TestAPIRejectsBadRequests(t *testing.T) {
+	a := NewAggregator(time.Minute, WithClock(newFakeClock()))
+	defer a.Close()
+	server := httptest.NewServer(NewAPIHandler(a))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, "/aggregates/7", "", http.StatusNotFound},
+		{http.MethodGet, "/aggregates/7/current", "", http.StatusNotFound},
+		{http.MethodGet, "/aggregates/0", "", http.StatusBadRequest},
+		{http.MethodGet, "/aggregates/alice", "", http.StatusBadRequest},
+		{http.MethodGet, "/aggregates/1/history", "", http.StatusNotFound},
+		{http.MethodPost, "/events", eventJSON(0, 1), http.StatusBadRequest},
+		{http.MethodPost, "/events", eventJSON(1, -1), http.StatusBadRequest},
+		{http.MethodPost, "/events", `{"user_id": 1, "value": 1, "color": "red"}`, http.StatusBadRequest},
+		{http.MethodPost, "/events", `{"user_id": 1,`, http.StatusBadRequest},
+		{http.MethodPost, "/events", eventJSONAt(1, 1, testStart.AddDate(1, 0, 0)), http.StatusBadRequest},
+		{http.MethodPost, "/events", eventJSONAt(1, 1, testStart.Add(2*maxEventSkew)), http.StatusBadRequest},
+		{http.MethodPost, "/events", eventJSONAt(1, 1, testStart.Add(-retentionPeriod)), http.StatusBadRequest},
+		{http.MethodGet, "/events", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/aggregates/1", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/aggregates/1/current", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/aggregates/", "", http.StatusNotFound},
+	} {
+		if status := doJSON(t, server, tc.method, tc.path, tc.body, nil); status != tc.status {
+			t.Errorf("%s %s %s answered %d, expected %d", tc.method, tc.path, tc.body, status, tc.status)
+		}
+	}
+
+	// none of the rejected events got a window, a year ahead or otherwise
+	if windows := a.GetUserAggregates(1); len(windows) != 0 {
+		t.Fatalf("windows %+v of rejected events", windows)
+	}
+}
+
+func TestTenantAPI(t *testing.T) {
+	reg := NewRegistry(map[string]TenantConfig{
+		"shop":    {WindowSize: time.Minute},
+		"billing": {WindowSize: time.Hour},
+		"broken":  {WindowSize: 0},
+	}, newFakeClock())
+	defer reg.Close()
+	server := httptest.NewServer(NewTenantAPIHandler(reg))
+	defer server.Close()
+
+	doJSON(t, server, http.MethodPost, "/tenants/shop/events", eventJSON(1, 2), nil)
+	doJSON(t, server, http.MethodPost, "/tenants/billing/events", eventJSON(1, 30), nil)
+
+	// the same user ID in two tenants, two sets of windows
+	var windows []windowJSON
+	if status := doJSON(t, server, http.MethodGet, "/tenants/shop/aggregates/1", "", &windows); status != http.StatusOK {
+		t.Fatalf("GET /tenants/shop/aggregates/1 answered %d", status)
+	}
+	if len(windows) != 1 || windows[0].Value != 2 || windows[0].EndTime.Sub(windows[0].StartTime) != time.Minute {
+		t.Fatalf("shop: %+v, expected a minute window with 2", windows)
+	}
+	if status := doJSON(t, server, http.MethodGet, "/tenants/billing/aggregates", "", &windows); status != http.StatusOK {
+		t.Fatalf("GET /tenants/billing/aggregates answered %d", status)
+	}
+	if len(windows) != 1 || windows[0].Value != 30 || windows[0].EndTime.Sub(windows[0].StartTime) != time.Hour {
+		t.Fatalf("billing: %+v, expected an hour window with 30", windows)
+	}
+
+	for path, expected := range map[string]int{
+		"/tenants/games/aggregates":   http.StatusNotFound,
+		"/tenants/broken/aggregates":  http.StatusInternalServerError,
+		"/tenants/":                   http.StatusNotFound,
+		"/aggregates":                 http.StatusNotFound,
+		"/tenants/shop/aggregates/0":  http.StatusBadRequest,
+		"/tenants/shop/aggregates/99": http.StatusNotFound,
+	} {
+		if status := doJSON(t, server, http.MethodGet, path, "", nil); status != expected {
+			t.Errorf("GET %s answered %d, expected %d", path, status, expected)
+		}
+	}
+
+	reg.Close()
+	status := doJSON(t, server, http.MethodGet, "/tenants/shop/aggregates", "", nil)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("GET /tenants/shop/aggregates answered %d once the registry closed", status)
+	}
+}
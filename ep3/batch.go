@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+/**
+ProcessEvents holds the lock for the whole slice: 10,000 events from 100 users keep every query and every other
+writer waiting until the last one is in.
+
+ProcessEventsBatch takes the events grouped by user and locks once per user instead. Between two users the lock is
+released, so queries and other writers get in without paying for a lock per event. The users are taken in ascending
+ID order: with a lock per shard (see ring.go) two batches locking users in different orders could deadlock, sorted
+they can't.
+
+Each user's events are checked before any of them is processed, a user whose batch has an invalid event (an ID that
+isn't the user's, a negative value) gets an error and none of their events are counted, the other users' events are.
+
+BenchmarkProcessEventsBatch (see batch_test.go) times it against ProcessEvent called for every event. From a single
+goroutine the two are close, an uncontended lock is cheap. What the batch saves is the lock being taken once per event, every one of
+those a point where a query or another writer has to wait its turn.
+*/
+
+// an event ProcessEventsBatch refuses, see above
+var ErrInvalidEvent = errors.New("invalid event")
+
+// processes the events of each user in a lock acquisition of their own, see above. The error of a user whose events were
+// refused is returned under their ID, users missing from the result had all their events processed.
+func (a *Aggregator) ProcessEventsBatch(batches map[int][]Event) map[int]error {
+	a.acquireProcessor(context.Background())
+	defer a.releaseProcessor()
+
+	errs := make(map[int]error)
+	userIDs := make([]int, 0, len(batches))
+	for userID := range batches {
+		userIDs = append(userIDs, userID)
+	}
+	slices.Sort(userIDs)
+
+	for _, userID := range userIDs {
+		events := batches[userID]
+		if err := validateBatch(userID, events); err != nil {
+			errs[userID] = err
+			continue
+		}
+		a.mu.Lock()
+		for _, event := range events {
+			a.processEvent(event)
+		}
+		a.mu.Unlock()
+	}
+	return errs
+}
+
+// checks that every event of the user's batch can be processed
+func validateBatch(userID int, events []Event) error {
+	if userID <= 0 {
+		return fmt.Errorf("%w: user_id must be a positive integer, got %d", ErrInvalidEvent, userID)
+	}
+	for i, event := range events {
+		if event.UserID != userID {
+			return fmt.Errorf("%w: event %d is for user %d, not %d", ErrInvalidEvent, i, event.UserID, userID)
+		}
+		if event.Value < 0 {
+			return fmt.Errorf("%w: event %d has a negative value", ErrInvalidEvent, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// eventsPerUser events for each of the users, at the clock's time
+func testBatches(clock Clock, users, eventsPerUser int) map[int][]Event {
+	batches := make(map[int][]Event, users)
+	for userID := 1; userID <= users; userID++ {
+		for i := range eventsPerUser {
+			batches[userID] = append(batches[userID], eventAt(clock, userID, i%10))
+		}
+	}
+	return batches
+}
+
+func TestProcessEventsBatchMatchesProcessEvent(t *testing.T) {
+	clock := newFakeClock()
+	batches := testBatches(clock, 20, 50)
+
+	oneByOne := NewAggregator(time.Hour, WithClock(clock))
+	defer oneByOne.Close()
+	for _, events := range batches {
+		for _, event := range events {
+			oneByOne.ProcessEvent(event)
+		}
+	}
+	batched := NewAggregator(time.Hour, WithClock(clock))
+	defer batched.Close()
+	if errs := batched.ProcessEventsBatch(batches); len(errs) != 0 {
+		t.Fatalf("valid batches refused: %v", errs)
+	}
+
+	for userID := range batches {
+		want, got := oneByOne.GetUserAggregates(userID), batched.GetUserAggregates(userID)
+		if len(want) != 1 || len(got) != 1 || want[0].Value != got[0].Value || want[0].Events != got[0].Events {
+			t.Fatalf("user %d: %+v one by one, %+v batched", userID, want, got)
+		}
+	}
+}
+
+func TestProcessEventsBatchRefusesInvalidUsers(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Hour, WithClock(clock))
+	defer a.Close()
+
+	errs := a.ProcessEventsBatch(map[int][]Event{
+		1: {eventAt(clock, 1, 3), eventAt(clock, 1, 4)},
+		// an event of another user in the batch, the whole batch of user 2 is refused
+		2: {eventAt(clock, 2, 5), eventAt(clock, 3, 5)},
+		4: {eventAt(clock, 4, 1), eventAt(clock, 4, -1)},
+		0: {eventAt(clock, 0, 1)},
+	})
+
+	refused := make([]int, 0, len(errs))
+	for userID, err := range errs {
+		if !errors.Is(err, ErrInvalidEvent) {
+			t.Fatalf("user %d refused with %v, expected ErrInvalidEvent", userID, err)
+		}
+		refused = append(refused, userID)
+	}
+	slices.Sort(refused)
+	if !slices.Equal(refused, []int{0, 2, 4}) {
+		t.Fatalf("users %v refused, expected 0, 2 and 4", refused)
+	}
+	if windows := a.GetUserAggregates(1); len(windows) != 1 || windows[0].Value != 7 {
+		t.Fatalf("user 1's valid batch wasn't processed: %+v", windows)
+	}
+	for _, userID := range []int{2, 3, 4} {
+		if windows := a.GetUserAggregates(userID); len(windows) != 0 {
+			t.Fatalf("events of user %d processed from a refused batch: %+v", userID, windows)
+		}
+	}
+}
+
+// 100 users x 100 events, a lock per event
+func BenchmarkProcessEvent(b *testing.B) {
+	clock := newFakeClock()
+	batches := testBatches(clock, 100, 100)
+	a := NewAggregator(time.Hour, WithClock(clock))
+	defer a.Close()
+
+	for b.Loop() {
+		for _, events := range batches {
+			for _, event := range events {
+				a.ProcessEvent(event)
+			}
+		}
+	}
+}
+
+// the same events, a lock per user
+func BenchmarkProcessEventsBatch(b *testing.B) {
+	clock := newFakeClock()
+	batches := testBatches(clock, 100, 100)
+	a := NewAggregator(time.Hour, WithClock(clock))
+	defer a.Close()
+
+	for b.Loop() {
+		a.ProcessEventsBatch(batches)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+/**
+At 100,000 events per second, ProcessEvent takes the lock 100,000 times per second and the callers spend more time
+queuing on the mutex than aggregating.
+
+WithEventBuffer puts a buffered channel in front of the lock: ProcessEvent drops the event into the buffer and returns
+right away, and a single flusher goroutine takes the events out in batches, processing each batch under a single lock
+acquisition. Batches are made just like Run makes them (every N events or every T, see WithIngestBatching).
+
+The tradeoffs:
+
+- an event isn't visible to queries until its batch is flushed, up to the batching interval later
+- when the buffer is full ProcessEvent drops the event (counted in EventsDropped) rather than block,
+  ProcessEventWithTimeout returns ErrBufferFull so the caller can retry or shed load
+- Close processes what is still buffered, but events submitted after Close are buffered and never processed
+*/
+
+// returned by ProcessEventWithTimeout when the event buffer has no room for the event, see WithEventBuffer
+var ErrBufferFull = errors.New("event buffer is full")
+
+// buffers up to size events in front of the lock, processing them in batches (see above)
+func WithEventBuffer(size int) Option {
+	return func(a *Aggregator) {
+		if size > 0 {
+			a.buffer = make(chan Event, size)
+		}
+	}
+}
+
+// starts the goroutine flushing the event buffer, if there is one
+func (a *Aggregator) startFlusher() {
+	if a.buffer == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stopFlusher = cancel
+	a.flusherDone = make(chan struct{})
+	go func() {
+		defer close(a.flusherDone)
+		a.consume(ctx, a.buffer)
+	}()
+}
+
+// hands the event over to the flusher, dropping it if the buffer is full
+func (a *Aggregator) bufferEvent(event Event) bool {
+	select {
+	case a.buffer <- event:
+		return true
+	default:
+		a.counters.eventsDropped.Add(1)
+		return false
+	}
+}
+
+// stops the flusher and processes whatever is still buffered
+func (a *Aggregator) flushBuffer() {
+	if a.buffer == nil {
+		return
+	}
+	a.stopFlusher()
+	<-a.flusherDone
+
+	var rest []Event
+	for {
+		select {
+		case event := <-a.buffer:
+			rest = append(rest, event)
+		default:
+			a.ProcessEvents(rest)
+			return
+		}
+	}
+}
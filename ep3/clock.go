@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// the source of time for the aggregator, swapping it out (e.g for a fake clock in tests) makes
+// window boundaries and the pruning cadence controllable
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// the part of time.Ticker the aggregator needs
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// the default Clock, backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{ticker: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
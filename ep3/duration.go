@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Durations in queries (the window size of globalAggregate and topN, see graphql.go) are ISO-8601 durations like PT1H or
+P1DT12H, the format dashboards and most languages' date libraries speak. Go's own format ("1h30m") is taken too.
+
+Only weeks, days, hours, minutes and seconds are supported: years and months have no fixed length, a month is 28 to 31
+days depending on which one, and an aggregator's windows are a fixed time.Duration. A day is 24 hours, DST aside.
+*/
+
+// returned for durations that are neither ISO-8601 durations nor Go durations
+var ErrInvalidDuration = errors.New("invalid duration")
+
+// parses an ISO-8601 duration (e.g "PT1H", "P1DT12H", "PT0.5S", "P2W"), or a Go duration (e.g "1h30m")
+func ParseDuration(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return parseISODuration(s)
+}
+
+// the designators of an ISO-8601 duration in the order they must come in, split by the T between the date and time
+// parts
+var (
+	isoDateUnits = []isoUnit{{'W', 7 * 24 * time.Hour}, {'D', 24 * time.Hour}}
+	isoTimeUnits = []isoUnit{{'H', time.Hour}, {'M', time.Minute}, {'S', time.Second}}
+)
+
+type isoUnit struct {
+	designator byte
+	size       time.Duration
+}
+
+func parseISODuration(s string) (time.Duration, error) {
+	rest, ok := strings.CutPrefix(s, "P")
+	if !ok || rest == "" || rest == "T" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+	}
+	datePart, timePart, hasTime := strings.Cut(rest, "T")
+	if hasTime && timePart == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDuration, s)
+	}
+
+	dateDuration, err := sumISOUnits(datePart, isoDateUnits)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q: %v", ErrInvalidDuration, s, err)
+	}
+	timeDuration, err := sumISOUnits(timePart, isoTimeUnits)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q: %v", ErrInvalidDuration, s, err)
+	}
+	return dateDuration + timeDuration, nil
+}
+
+// sums the amounts of part (e.g "1H30M"), each followed by one of units' designators in their order
+func sumISOUnits(part string, units []isoUnit) (time.Duration, error) {
+	var total time.Duration
+	for part != "" {
+		end := strings.IndexFunc(part, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != ',' })
+		if end <= 0 {
+			return 0, fmt.Errorf("expected an amount at %q", part)
+		}
+		// ISO-8601 allows a decimal comma as well as a point
+		amount, err := strconv.ParseFloat(strings.Replace(part[:end], ",", ".", 1), 64)
+		if err != nil {
+			return 0, err
+		}
+		for len(units) > 0 && units[0].designator != part[end] {
+			units = units[1:]
+		}
+		if len(units) == 0 {
+			return 0, fmt.Errorf("unexpected designator %q", part[end])
+		}
+		total += time.Duration(amount * float64(units[0].size))
+		units = units[1:]
+		part = part[end+1:]
+	}
+	return total, nil
+}
+
+// formats d (not negative, ISO-8601 has no negative durations) as an ISO-8601 duration (e.g "PT1H30M", "P1D"), the
+// way ParseDuration reads it back
+func FormatDuration(d time.Duration) string {
+	if d <= 0 {
+		return "PT0S"
+	}
+	var b strings.Builder
+	b.WriteByte('P')
+	if days := d / (24 * time.Hour); days > 0 {
+		fmt.Fprintf(&b, "%dD", days)
+		d -= days * 24 * time.Hour
+	}
+	if d == 0 {
+		return b.String()
+	}
+	b.WriteByte('T')
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+		d -= minutes * time.Minute
+	}
+	if d > 0 {
+		b.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S")
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		d time.Duration
+	}{
+		{"PT1H", time.Hour},
+		{"PT90M", 90 * time.Minute},
+		{"PT1H30M", 90 * time.Minute},
+		{"P1D", 24 * time.Hour},
+		{"P1DT12H", 36 * time.Hour},
+		{"P2W", 14 * 24 * time.Hour},
+		{"PT0.5S", 500 * time.Millisecond},
+		{"PT1,5M", 90 * time.Second},
+		{"PT0S", 0},
+		// Go's format too
+		{"1h", time.Hour},
+		{"1h30m", 90 * time.Minute},
+	} {
+		d, err := ParseDuration(tc.s)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.s, err)
+		}
+		if d != tc.d {
+			t.Fatalf("%q parsed as %s, expected %s", tc.s, d, tc.d)
+		}
+	}
+}
+
+func TestParseInvalidDuration(t *testing.T) {
+	for _, s := range []string{
+		"", "P", "PT", "P1DT", "1H", "PT1", "PTH",
+		// years and months have no fixed length
+		"P1Y", "P1M",
+		// out of order, or in the wrong part
+		"PT1M1H", "P1D1W", "P1H", "PT1D", "PT1H1H",
+		"PT1.5.2S", "1x",
+	} {
+		if d, err := ParseDuration(s); !errors.Is(err, ErrInvalidDuration) {
+			t.Fatalf("%q parsed as %s (%v), expected ErrInvalidDuration", s, d, err)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d time.Duration
+		s string
+	}{
+		{0, "PT0S"},
+		{time.Hour, "PT1H"},
+		{90 * time.Minute, "PT1H30M"},
+		{24 * time.Hour, "P1D"},
+		{36*time.Hour + 90*time.Second, "P1DT12H1M30S"},
+		{1500 * time.Millisecond, "PT1.5S"},
+	} {
+		if s := FormatDuration(tc.d); s != tc.s {
+			t.Fatalf("%s formatted as %q, expected %q", tc.d, s, tc.s)
+		}
+		if d, err := ParseDuration(tc.s); err != nil || d != tc.d {
+			t.Fatalf("%q read back as %s (%v), expected %s", tc.s, d, err, tc.d)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+Closed windows usually end up in a warehouse, and every one of them should land there exactly once,
+even when the process restarts half way.
+
+The Exporter is a window close callback that batches closed windows and writes them to a Sink, retrying with
+backoff until the sink takes them. After every successful write it records, per user, the start of the last window
+delivered in a checkpoint file. After a restart the aggregator recomputes windows (e.g by replaying the event log)
+and closes them again, anything at or before the checkpoint is skipped instead of delivered twice.
+
+The gotcha: the checkpoint can only be written after the sink acknowledged the batch, so a crash between the two
+means the batch is sent again on restart. Checkpointing can't close that gap on its own, the sink has to be able to
+recognise a window it already has. JSONLinesSink does that by reading back what is already in its file.
+
+Both rely on a user's windows closing in order, which they do: windows only ever close as the watermark moves forward.
+*/
+
+// a closed window of a user, as handed to a Sink
+type ClosedWindow struct {
+	UserID    int       `json:"user_id"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Value     int       `json:"value"`
+	Events    int       `json:"events"`
+	Throttled int       `json:"throttled"`
+}
+
+// receives batches of closed windows. A non-nil error means the batch wasn't stored and will be sent again.
+type Sink interface {
+	Write(ctx context.Context, windows []ClosedWindow) error
+}
+
+// returned by Exporter.Close when closed windows were still waiting to be delivered
+var ErrExportIncomplete = errors.New("exporter closed before delivering every window")
+
+const (
+	// bounds of the backoff between attempts to write a batch to the sink
+	minExportBackoff = 100 * time.Millisecond
+	maxExportBackoff = 30 * time.Second
+
+	// closed windows waiting for the export goroutine, the close callback blocks once it is full
+	exportQueueSize = 1000
+)
+
+// delivers closed windows to a Sink exactly once, see above
+type Exporter struct {
+	sink           Sink
+	checkpointPath string
+	batchSize      int
+	flushInterval  time.Duration
+
+	// start of the last window delivered per user, only touched by the export goroutine
+	delivered map[int]time.Time
+
+	windows chan ClosedWindow
+	// closed by Close, stops the exporter from taking new windows
+	done      chan struct{}
+	closeOnce sync.Once
+	// closed once the export goroutine returned
+	stopped chan struct{}
+	// cancels retries when Close gives up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+	// whether windows were left undelivered
+	incomplete bool
+}
+
+// creates an exporter writing to sink, resuming from the checkpoint file if there is one.
+// Windows are written in batches of batchSize, or every flushInterval if the batch doesn't fill up.
+func NewExporter(sink Sink, checkpointPath string, batchSize int, flushInterval time.Duration) (*Exporter, error) {
+	delivered, err := loadCheckpoint(checkpointPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Exporter{
+		sink:           sink,
+		checkpointPath: checkpointPath,
+		batchSize:      max(batchSize, 1),
+		flushInterval:  flushInterval,
+		delivered:      delivered,
+		windows:        make(chan ClosedWindow, exportQueueSize),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	go e.run()
+	return e, nil
+}
+
+// the WindowCloseFunc to register on the aggregator with WithWindowCloseCallback.
+// It blocks while the export queue is full, windows closed after Close are dropped.
+func (e *Exporter) OnWindowClose(userID int, window Window) {
+	closed := ClosedWindow{
+		UserID:    userID,
+		StartTime: window.StartTime,
+		EndTime:   window.EndTime,
+		Value:     window.Value,
+		Events:    window.Events,
+		Throttled: window.Throttled,
+	}
+	select {
+	case e.windows <- closed:
+	case <-e.done:
+		log.Printf("exporter closed, dropping window %s of user %d", window.StartTime.Format(time.RFC3339), userID)
+	}
+}
+
+// stops taking windows and delivers the ones already taken. If ctx is done first, delivery is abandoned and
+// ctx.Err() returned. Close the aggregator first, so the windows it flushes on close are exported too.
+func (e *Exporter) Close(ctx context.Context) error {
+	e.closeOnce.Do(func() { close(e.done) })
+
+	select {
+	case <-e.stopped:
+	case <-ctx.Done():
+		e.cancel()
+		<-e.stopped
+		return ctx.Err()
+	}
+	e.cancel()
+
+	if e.incomplete {
+		return ErrExportIncomplete
+	}
+	return nil
+}
+
+// batches the closed windows and delivers them until the exporter is closed
+func (e *Exporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ClosedWindow, 0, e.batchSize)
+	add := func(window ClosedWindow) {
+		// already delivered before a restart
+		if last, exists := e.delivered[window.UserID]; exists && !window.StartTime.After(last) {
+			return
+		}
+		batch = append(batch, window)
+	}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.deliver(batch); err != nil {
+			log.Printf("exporting %d windows failed: %v", len(batch), err)
+			e.incomplete = true
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case window := <-e.windows:
+			add(window)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			// take whatever made it into the queue before Close
+			for {
+				select {
+				case window := <-e.windows:
+					add(window)
+					if len(batch) >= e.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// writes the batch to the sink, retrying until it succeeds or the exporter gives up, then moves the checkpoint
+func (e *Exporter) deliver(batch []ClosedWindow) error {
+	backoff := minExportBackoff
+	for {
+		err := e.sink.Write(e.ctx, batch)
+		if err == nil {
+			break
+		}
+		if e.ctx.Err() != nil {
+			return err
+		}
+		log.Printf("sink write failed: %v, retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-e.ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, maxExportBackoff)
+	}
+
+	for _, window := range batch {
+		if window.StartTime.After(e.delivered[window.UserID]) {
+			e.delivered[window.UserID] = window.StartTime
+		}
+	}
+	if err := saveCheckpoint(e.checkpointPath, e.delivered); err != nil {
+		// the batch is in the sink, a stale checkpoint only means the sink may see it again after a restart
+		log.Printf("saving export checkpoint failed: %v", err)
+	}
+	return nil
+}
+
+// reads the last window delivered per user, an empty checkpoint if the file doesn't exist yet
+func loadCheckpoint(path string) (map[int]time.Time, error) {
+	delivered := make(map[int]time.Time)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return delivered, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading export checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(data, &delivered); err != nil {
+		return nil, fmt.Errorf("parsing export checkpoint %s: %w", path, err)
+	}
+	return delivered, nil
+}
+
+// writes the checkpoint to a temporary file first and renames it over the old one, so a crash half way never
+// leaves a truncated checkpoint behind
+func saveCheckpoint(path string, delivered map[int]time.Time) error {
+	data, err := json.Marshal(delivered)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// a Sink appending closed windows to a file, one JSON object per line.
+// Windows already in the file (at or before the last window written for their user) are skipped,
+// so a batch sent again after a crash isn't written twice.
+type JSONLinesSink struct {
+	mu      sync.Mutex
+	file    *os.File
+	written map[int]time.Time
+}
+
+// opens (or creates) the file and reads back which windows it already holds
+func NewJSONLinesSink(path string) (*JSONLinesSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	written := make(map[int]time.Time)
+	scanner := bufio.NewScanner(file)
+	var last []byte
+	for scanner.Scan() {
+		last = scanner.Bytes()
+		var window ClosedWindow
+		if err := json.Unmarshal(last, &window); err != nil {
+			// most likely a line cut short by a crash
+			continue
+		}
+		if window.StartTime.After(written[window.UserID]) {
+			written[window.UserID] = window.StartTime
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	// a line cut short would otherwise swallow the next window written
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		tail := make([]byte, 1)
+		if _, err := file.ReadAt(tail, info.Size()-1); err != nil && err != io.EOF {
+			file.Close()
+			return nil, err
+		}
+		if tail[0] != '\n' {
+			if _, err := file.Write([]byte("\n")); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return &JSONLinesSink{file: file, written: written}, nil
+}
+
+func (s *JSONLinesSink) Write(ctx context.Context, windows []ClosedWindow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	written := make(map[int]time.Time)
+	for _, window := range windows {
+		last := s.written[window.UserID]
+		if t, exists := written[window.UserID]; exists {
+			last = t
+		}
+		if !window.StartTime.After(last) {
+			continue
+		}
+		if err := encoder.Encode(window); err != nil {
+			return err
+		}
+		written[window.UserID] = window.StartTime
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	for userID, start := range written {
+		s.written[userID] = start
+	}
+	return nil
+}
+
+func (s *JSONLinesSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
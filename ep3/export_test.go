@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testWindows = 10
+	testUsers   = 2
+)
+
+// an aggregator at the end of testWindows minute windows, with an event in each of them for every user
+func replayedAggregator(t *testing.T, opts ...Option) *Aggregator {
+	t.Helper()
+	clock := newFakeClock()
+	clock.Advance(testWindows * time.Minute)
+	a := NewAggregator(time.Minute, append(opts, WithClock(clock))...)
+	for i := range testWindows {
+		for userID := 1; userID <= testUsers; userID++ {
+			a.ProcessEvent(Event{UserID: userID, Timestamp: testStart.Add(time.Duration(i) * time.Minute), Value: i})
+		}
+	}
+	return a
+}
+
+// the windows in the JSON-lines file, in the order they were written
+func readExported(t *testing.T, path string) []ClosedWindow {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var windows []ClosedWindow
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var window ClosedWindow
+		if err := json.Unmarshal(scanner.Bytes(), &window); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		windows = append(windows, window)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return windows
+}
+
+// checks every window of every user is in the file once, with the value of its event
+func checkExactlyOnce(t *testing.T, windows []ClosedWindow) {
+	t.Helper()
+	seen := make(map[int]map[time.Time]int)
+	for _, window := range windows {
+		if seen[window.UserID] == nil {
+			seen[window.UserID] = make(map[time.Time]int)
+		}
+		seen[window.UserID][window.StartTime]++
+		if i := int(window.StartTime.Sub(testStart) / time.Minute); window.Value != i {
+			t.Fatalf("window %d of user %d exported with value %d", i, window.UserID, window.Value)
+		}
+	}
+	for userID := 1; userID <= testUsers; userID++ {
+		for i := range testWindows {
+			if n := seen[userID][testStart.Add(time.Duration(i)*time.Minute)]; n != 1 {
+				t.Fatalf("window %d of user %d exported %d times", i, userID, n)
+			}
+		}
+	}
+	if len(windows) != testWindows*testUsers {
+		t.Fatalf("%d windows exported, expected %d", len(windows), testWindows*testUsers)
+	}
+}
+
+// runs an aggregator exporting to the file until it closed the windows before through, then drops it the way a
+// crash would (what the exporter took is still delivered, nothing closed after is)
+func exportUntil(t *testing.T, sinkPath, checkpointPath string, through time.Time) {
+	t.Helper()
+	sink, err := NewJSONLinesSink(sinkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	exporter, err := NewExporter(sink, checkpointPath, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := replayedAggregator(t, WithWindowCloseCallback(exporter.OnWindowClose))
+	a.Flush(through)
+	if err := exporter.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// windows closing from here on have no exporter to go to, like after a crash
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	a.Close()
+}
+
+func TestExporterResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	sinkPath, checkpointPath := filepath.Join(dir, "windows.jsonl"), filepath.Join(dir, "export.checkpoint")
+
+	exportUntil(t, sinkPath, checkpointPath, testStart.Add(4*time.Minute))
+	if exported := readExported(t, sinkPath); len(exported) != 4*testUsers {
+		t.Fatalf("%d windows exported before the crash, expected %d", len(exported), 4*testUsers)
+	}
+
+	// the restarted aggregator replays every event and closes every window again
+	exportUntil(t, sinkPath, checkpointPath, testStart.Add(testWindows*time.Minute))
+	checkExactlyOnce(t, readExported(t, sinkPath))
+}
+
+func TestExporterSurvivesStaleCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	sinkPath, checkpointPath := filepath.Join(dir, "windows.jsonl"), filepath.Join(dir, "export.checkpoint")
+
+	exportUntil(t, sinkPath, checkpointPath, testStart.Add(4*time.Minute))
+	// crashed after the sink took the windows but before the checkpoint was saved
+	if err := os.Remove(checkpointPath); err != nil {
+		t.Fatal(err)
+	}
+
+	exportUntil(t, sinkPath, checkpointPath, testStart.Add(testWindows*time.Minute))
+	checkExactlyOnce(t, readExported(t, sinkPath))
+}
+
+// a Sink failing its first writes, then keeping what it is given
+type flakySink struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	windows  []ClosedWindow
+}
+
+func (s *flakySink) Write(ctx context.Context, windows []ClosedWindow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attempts++; s.attempts <= s.failures {
+		return errors.New("warehouse unavailable")
+	}
+	s.windows = append(s.windows, windows...)
+	return nil
+}
+
+func TestExporterRetriesFailedWrites(t *testing.T) {
+	// the failed writes are logged
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	sink := &flakySink{failures: 2}
+	exporter, err := NewExporter(sink, filepath.Join(t.TempDir(), "export.checkpoint"), testWindows*testUsers, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := replayedAggregator(t, WithWindowCloseCallback(exporter.OnWindowClose))
+	a.Close()
+	if err := exporter.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if sink.attempts != 3 {
+		t.Fatalf("%d writes, expected 2 failures and the write going through", sink.attempts)
+	}
+	checkExactlyOnce(t, sink.windows)
+}
+
+func TestExporterCloseGivesUp(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	exporter, err := NewExporter(&flakySink{failures: 1 << 30}, filepath.Join(t.TempDir(), "export.checkpoint"), 1,
+		time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter.OnWindowClose(1, Window{StartTime: testStart, EndTime: testStart.Add(time.Minute), Value: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := exporter.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close returned %v with the sink down, expected the context's error", err)
+	}
+}
+
+// concurrent closes used to run their callbacks side by side, a later window could be delivered before an earlier one
+func TestClosedWindowsDeliveredInOrder(t *testing.T) {
+	var mu sync.Mutex
+	delivered := make(map[int][]time.Time)
+	a := replayedAggregator(t, WithWindowCloseCallback(func(userID int, window Window) {
+		// slow enough for the closes to overlap
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[userID] = append(delivered[userID], window.StartTime)
+	}))
+	defer a.Close()
+
+	var wg sync.WaitGroup
+	for i := testWindows; i > 0; i-- {
+		wg.Go(func() { a.Flush(testStart.Add(time.Duration(i) * time.Minute)) })
+	}
+	wg.Wait()
+
+	for userID := 1; userID <= testUsers; userID++ {
+		starts := delivered[userID]
+		if len(starts) != testWindows {
+			t.Fatalf("%d windows of user %d delivered, expected %d", len(starts), userID, testWindows)
+		}
+		for i := 1; i < len(starts); i++ {
+			if !starts[i].After(starts[i-1]) {
+				t.Fatalf("user %d: window %s delivered after %s", userID, starts[i].Format(time.TimeOnly),
+					starts[i-1].Format(time.TimeOnly))
+			}
+		}
+	}
+}
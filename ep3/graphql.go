@@ -0,0 +1,220 @@
+//go:build graphql
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+/**
+A GraphQL API over the aggregator at /graphql, for dashboards to ask for exactly the data they need in one request:
+
+	query {
+	  userAggregates(userID: 1, from: "2024-01-01T00:00:00Z", to: "2024-01-02T00:00:00Z") { startTime endTime value }
+	  globalAggregate(windowSize: "PT1H") { value }
+	  topN(n: 10, windowSize: "PT1H") { userID value }
+	}
+
+globalAggregate and topN cover the current window of windowSize (the aggregator's window size if omitted), which must
+be a multiple of the aggregator's window size, see Aggregator.GlobalAggregate. Durations are ISO-8601 durations (see
+duration.go), times are RFC 3339.
+
+It's built with github.com/graphql-go/graphql and only compiled with the graphql build tag, so the default build
+doesn't link it in:
+
+	go run -tags graphql .
+	go test -tags graphql .
+*/
+
+// max size of a POST /graphql body, queries are a few kB at most
+const maxQueryBody = 64 << 10
+
+// a time.Duration, as an ISO-8601 duration string
+var durationScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Duration",
+	Description: `An ISO-8601 duration of weeks, days, hours, minutes and seconds, e.g "PT1H" or "P1DT12H"`,
+	Serialize: func(value any) any {
+		if d, ok := value.(time.Duration); ok {
+			return FormatDuration(d)
+		}
+		return nil
+	},
+	ParseValue: func(value any) any {
+		if s, ok := value.(string); ok {
+			return parseDurationArg(s)
+		}
+		return nil
+	},
+	ParseLiteral: func(valueAST ast.Value) any {
+		if s, ok := valueAST.(*ast.StringValue); ok {
+			return parseDurationArg(s.Value)
+		}
+		return nil
+	},
+})
+
+// the duration, or nil (an invalid value to graphql-go) if it can't be parsed
+func parseDurationArg(s string) any {
+	d, err := ParseDuration(s)
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+var windowType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Window",
+	Fields: graphql.Fields{
+		"startTime": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"endTime":   &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		"value":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"events":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"throttled": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+var userValueType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "UserValue",
+	Fields: graphql.Fields{
+		"userID": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"value":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"events": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+// the fields of a window as graphql-go's default resolver looks them up
+func windowFields(window Window) map[string]any {
+	return map[string]any{
+		"startTime": window.StartTime,
+		"endTime":   window.EndTime,
+		"value":     window.Value,
+		"events":    window.Events,
+		"throttled": window.Throttled,
+	}
+}
+
+// the schema above, resolved against the aggregator
+func newGraphQLSchema(a *Aggregator) (graphql.Schema, error) {
+	// the windowSize argument, the aggregator's window size if omitted
+	windowSize := func(p graphql.ResolveParams) time.Duration {
+		if d, ok := p.Args["windowSize"].(time.Duration); ok {
+			return d
+		}
+		return a.windowSize
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"userAggregates": &graphql.Field{
+				Description: "The user's windows starting in [from, to), every window if omitted",
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(windowType))),
+				Args: graphql.FieldConfigArgument{
+					"userID": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"from":   &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"to":     &graphql.ArgumentConfig{Type: graphql.DateTime},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					from, hasFrom := p.Args["from"].(time.Time)
+					to, hasTo := p.Args["to"].(time.Time)
+					windows := []map[string]any{}
+					for _, window := range a.GetUserAggregates(p.Args["userID"].(int)) {
+						if (hasFrom && window.StartTime.Before(from)) || (hasTo && !window.StartTime.Before(to)) {
+							continue
+						}
+						windows = append(windows, windowFields(window))
+					}
+					return windows, nil
+				},
+			},
+			"globalAggregate": &graphql.Field{
+				Description: "The activity of all users over the current window of windowSize",
+				Type:        graphql.NewNonNull(windowType),
+				Args: graphql.FieldConfigArgument{
+					"windowSize": &graphql.ArgumentConfig{Type: durationScalar},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					window, err := a.GlobalAggregate(windowSize(p))
+					if err != nil {
+						return nil, err
+					}
+					return windowFields(window), nil
+				},
+			},
+			"topN": &graphql.Field{
+				Description: "The n users with the highest value over the current window of windowSize",
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userValueType))),
+				Args: graphql.FieldConfigArgument{
+					"n":          &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"windowSize": &graphql.ArgumentConfig{Type: durationScalar},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					users, err := a.TopN(p.Args["n"].(int), windowSize(p))
+					if err != nil {
+						return nil, err
+					}
+					top := make([]map[string]any, len(users))
+					for i, user := range users {
+						top[i] = map[string]any{"userID": user.UserID, "value": user.Value, "events": user.Events}
+					}
+					return top, nil
+				},
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// a GraphQL request, as POSTed to /graphql
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// serves the schema above, the query POSTed as JSON or (for a quick look from a browser) passed as ?query=
+func NewGraphQLHandler(a *Aggregator) (http.Handler, error) {
+	schema, err := newGraphQLSchema(a)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+		case http.MethodPost:
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBody)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+				return
+			}
+		default:
+			methodNotAllowed(w, "GET, POST")
+			return
+		}
+
+		// errors of the query itself are part of the result, as GraphQL clients expect
+		writeJSON(w, http.StatusOK, graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			OperationName:  req.OperationName,
+			VariableValues: req.Variables,
+			Context:        r.Context(),
+		}))
+	}), nil
+}
+
+// serves the schema above at /graphql
+func mountGraphQL(mux *http.ServeMux, a *Aggregator) error {
+	handler, err := NewGraphQLHandler(a)
+	if err != nil {
+		return err
+	}
+	mux.Handle("/graphql", handler)
+	return nil
+}
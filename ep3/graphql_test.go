@@ -0,0 +1,209 @@
+//go:build graphql
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// a GraphQL response, the data left for the test to decode
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// POSTs the query to the server and decodes its data into out, failing on any error unless errors are expected
+func doGraphQL(t *testing.T, server *httptest.Server, query string, variables map[string]any, out any) graphQLResponse {
+	t.Helper()
+	body, err := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Post(server.URL+"/graphql", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s answered %d", query, resp.StatusCode)
+	}
+
+	var result graphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		if len(result.Errors) > 0 {
+			t.Fatalf("%s: %+v", query, result.Errors)
+		}
+		if err := json.Unmarshal(result.Data, out); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	return result
+}
+
+// an aggregator of minute windows two minutes into the hour, with user 1 active in both minutes and user 2 in the
+// first, served at /graphql
+func newGraphQLServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	t.Cleanup(a.Close)
+	a.ProcessEvent(Event{UserID: 1, Timestamp: testStart, Value: 2})
+	a.ProcessEvent(Event{UserID: 1, Timestamp: testStart.Add(time.Minute), Value: 3})
+	a.ProcessEvent(Event{UserID: 2, Timestamp: testStart, Value: 10})
+	clock.Advance(time.Minute + 30*time.Second)
+
+	mux := http.NewServeMux()
+	if err := mountGraphQL(mux, a); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+type graphQLWindow struct {
+	StartTime time.Time `json:"startTime"`
+	Value     int       `json:"value"`
+	Events    int       `json:"events"`
+}
+
+func TestGraphQLUserAggregates(t *testing.T) {
+	server := newGraphQLServer(t)
+
+	var all struct{ UserAggregates []graphQLWindow }
+	doGraphQL(t, server, `{ userAggregates(userID: 1) { startTime value events } }`, nil, &all)
+	if len(all.UserAggregates) != 2 || all.UserAggregates[0].Value != 2 || all.UserAggregates[1].Value != 3 {
+		t.Fatalf("userAggregates: %+v, expected windows with 2 and 3", all.UserAggregates)
+	}
+
+	// from is inclusive, to exclusive
+	var second struct{ UserAggregates []graphQLWindow }
+	doGraphQL(t, server, `query($from: DateTime, $to: DateTime) {
+		userAggregates(userID: 1, from: $from, to: $to) { startTime value }
+	}`, map[string]any{
+		"from": testStart.Add(time.Minute).Format(time.RFC3339),
+		"to":   testStart.Add(2 * time.Minute).Format(time.RFC3339),
+	}, &second)
+	if len(second.UserAggregates) != 1 || !second.UserAggregates[0].StartTime.Equal(testStart.Add(time.Minute)) {
+		t.Fatalf("userAggregates from the second minute: %+v, expected that window only", second.UserAggregates)
+	}
+
+	var unknown struct{ UserAggregates []graphQLWindow }
+	doGraphQL(t, server, `{ userAggregates(userID: 7) { value } }`, nil, &unknown)
+	if unknown.UserAggregates == nil || len(unknown.UserAggregates) != 0 {
+		t.Fatalf("userAggregates of an unknown user: %+v, expected an empty list", unknown.UserAggregates)
+	}
+}
+
+func TestGraphQLGlobalAggregate(t *testing.T) {
+	server := newGraphQLServer(t)
+
+	for _, tc := range []struct {
+		query     string
+		variables map[string]any
+		value     int
+	}{
+		// the aggregator's window, the second minute
+		{`{ globalAggregate { value } }`, nil, 3},
+		{`{ globalAggregate(windowSize: "PT1H") { value } }`, nil, 15},
+		{`{ globalAggregate(windowSize: "1h") { value } }`, nil, 15},
+		{`query($size: Duration) { globalAggregate(windowSize: $size) { value } }`, map[string]any{"size": "PT2M"}, 15},
+	} {
+		var result struct{ GlobalAggregate graphQLWindow }
+		doGraphQL(t, server, tc.query, tc.variables, &result)
+		if result.GlobalAggregate.Value != tc.value {
+			t.Errorf("%s %v: %+v, expected %d", tc.query, tc.variables, result.GlobalAggregate, tc.value)
+		}
+	}
+
+	// a size the minute windows don't add up to, and sizes that aren't durations
+	for _, query := range []string{
+		`{ globalAggregate(windowSize: "PT90S") { value } }`,
+		`{ globalAggregate(windowSize: "P1M") { value } }`,
+		`{ globalAggregate(windowSize: "an hour") { value } }`,
+		`{ globalAggregate(windowSize: 60) { value } }`,
+	} {
+		if result := doGraphQL(t, server, query, nil, nil); len(result.Errors) == 0 {
+			t.Errorf("%s gave no error", query)
+		}
+	}
+}
+
+func TestGraphQLTopN(t *testing.T) {
+	server := newGraphQLServer(t)
+
+	type user struct {
+		UserID int `json:"userID"`
+		Value  int `json:"value"`
+	}
+	var hour struct{ TopN []user }
+	doGraphQL(t, server, `{ topN(n: 10, windowSize: "PT1H") { userID value } }`, nil, &hour)
+	if len(hour.TopN) != 2 || hour.TopN[0] != (user{2, 10}) || hour.TopN[1] != (user{1, 5}) {
+		t.Fatalf("topN of the hour: %+v, expected user 2 with 10 then user 1 with 5", hour.TopN)
+	}
+
+	var minute struct{ TopN []user }
+	doGraphQL(t, server, `{ topN(n: 1) { userID value } }`, nil, &minute)
+	if len(minute.TopN) != 1 || minute.TopN[0] != (user{1, 3}) {
+		t.Fatalf("topN of the minute: %+v, expected user 1 with 3", minute.TopN)
+	}
+
+	if result := doGraphQL(t, server, `{ topN(n: 1, windowSize: "PT90S") { userID } }`, nil, nil); len(result.Errors) == 0 {
+		t.Fatal("topN over a size the windows don't add up to gave no error")
+	}
+}
+
+func TestGraphQLDurationScalar(t *testing.T) {
+	if s := durationScalar.Serialize(90 * time.Minute); s != "PT1H30M" {
+		t.Fatalf("90m serialized as %v, expected PT1H30M", s)
+	}
+	if s := durationScalar.Serialize("PT1H"); s != nil {
+		t.Fatalf("a string serialized as %v, expected nil", s)
+	}
+	if d := durationScalar.ParseValue("P1DT12H"); d != 36*time.Hour {
+		t.Fatalf("P1DT12H parsed as %v, expected 36h", d)
+	}
+	for _, value := range []any{"P1Y", "", 3600} {
+		if d := durationScalar.ParseValue(value); d != nil {
+			t.Errorf("%#v parsed as %v, expected nil", value, d)
+		}
+	}
+}
+
+func TestGraphQLHandlerMethods(t *testing.T) {
+	server := newGraphQLServer(t)
+
+	resp, err := server.Client().Get(server.URL + "/graphql?query=" + url.QueryEscape(`{ topN(n: 1) { userID } }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result graphQLResponse
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(result.Errors) > 0 {
+		t.Fatalf("GET /graphql?query= answered %d with %+v", resp.StatusCode, result.Errors)
+	}
+
+	for method, status := range map[string]int{http.MethodPut: http.StatusMethodNotAllowed, http.MethodPost: http.StatusBadRequest} {
+		req, _ := http.NewRequest(method, server.URL+"/graphql", bytes.NewReader([]byte("{")))
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s /graphql answered %d, expected %d", method, resp.StatusCode, status)
+		}
+	}
+}
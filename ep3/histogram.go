@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+/**
+A histogram is how we get percentiles (p50/p95/p99) per window without keeping every single event value around.
+
+Values are counted into buckets whose bounds grow exponentially: bucket 0 holds everything below 1 and
+bucket i (i >= 1) holds values in [growth^(i-1), growth^i). A quantile is answered with the geometric middle
+of the bucket it falls in, so as long as the value is within the covered range the estimate is off by at most
+a factor of sqrt(growth) (about ±5% for a growth of 1.1). Values beyond the last bucket are clamped into it,
+which is why the number of buckets has to be picked for the expected value range.
+
+Memory is fixed at one counter per bucket, and two histograms with the same layout can be merged by simply
+adding their counters, which is what makes it work for rollups across windows or nodes.
+*/
+
+const (
+	// default layout: ±5% error for values up to ~180,000 in about 1KB per window
+	defaultHistogramBuckets = 128
+	defaultHistogramGrowth  = 1.1
+)
+
+// a mergeable fixed-bucket histogram of event values
+type Histogram struct {
+	growth float64
+	counts []uint64
+	total  uint64
+}
+
+// creates an empty histogram with the given number of buckets and bucket growth factor
+func NewHistogram(buckets int, growth float64) *Histogram {
+	return &Histogram{
+		growth: growth,
+		counts: make([]uint64, buckets),
+	}
+}
+
+// records a value
+func (h *Histogram) Add(value float64) {
+	h.counts[h.bucketOf(value)]++
+	h.total++
+}
+
+// finds the bucket a value falls into
+func (h *Histogram) bucketOf(value float64) int {
+	if value < 1 {
+		return 0
+	}
+	i := int(math.Floor(math.Log(value)/math.Log(h.growth))) + 1
+	if i >= len(h.counts) {
+		i = len(h.counts) - 1
+	}
+	return i
+}
+
+// estimates the value at quantile q (0 <= q <= 1), see the error bounds above
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	q = math.Max(0, math.Min(1, q))
+
+	// the rank of the value we're after, 1-based
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			if i == 0 {
+				return 0
+			}
+			return math.Pow(h.growth, float64(i)-0.5)
+		}
+	}
+	return math.Pow(h.growth, float64(len(h.counts))-0.5)
+}
+
+// adds another histogram's counts into this one, both must share the same layout
+func (h *Histogram) Merge(other *Histogram) error {
+	if len(h.counts) != len(other.counts) || h.growth != other.growth {
+		return fmt.Errorf("cannot merge histograms with different layouts (%d buckets x %.3f vs %d buckets x %.3f)",
+			len(h.counts), h.growth, len(other.counts), other.growth)
+	}
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.total += other.total
+	return nil
+}
+
+// returns an independent copy of the histogram
+func (h *Histogram) Clone() *Histogram {
+	clone := &Histogram{
+		growth: h.growth,
+		counts: make([]uint64, len(h.counts)),
+		total:  h.total,
+	}
+	copy(clone.counts, h.counts)
+	return clone
+}
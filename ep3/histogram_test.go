@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+// checks the histogram's quantiles of the values against the exact ones, within the documented sqrt(growth)
+func checkQuantiles(t *testing.T, h *Histogram, growth float64, values []float64) {
+	t.Helper()
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	bound := math.Sqrt(growth) * (1 + 1e-9)
+	for _, q := range []float64{0.5, 0.95, 0.99, 0.999} {
+		exact := sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+		estimate := h.Quantile(q)
+		if estimate > exact*bound || estimate < exact/bound {
+			t.Errorf("p%g: %.2f, exact %.2f, expected within a factor of %.3f", q*100, estimate, exact, bound)
+		}
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	uniform := make([]float64, 10_000)
+	for i := range uniform {
+		uniform[i] = float64(1 + rng.IntN(10_000))
+	}
+	// mostly small values with a long tail (p99.9 around 1000), where an average says nothing
+	skewed := make([]float64, 10_000)
+	for i := range skewed {
+		skewed[i] = max(math.Floor(math.Exp(rng.ExpFloat64())), 1)
+	}
+
+	for name, values := range map[string][]float64{"uniform": uniform, "skewed": skewed} {
+		t.Run(name, func(t *testing.T) {
+			h := NewHistogram(defaultHistogramBuckets, defaultHistogramGrowth)
+			for _, value := range values {
+				h.Add(value)
+			}
+			checkQuantiles(t, h, defaultHistogramGrowth, values)
+		})
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	first := NewHistogram(64, 1.2)
+	second := NewHistogram(64, 1.2)
+	var values []float64
+	for i := 1; i <= 1000; i++ {
+		value := float64(i)
+		values = append(values, value)
+		if i%2 == 0 {
+			first.Add(value)
+		} else {
+			second.Add(value)
+		}
+	}
+	if err := first.Merge(second); err != nil {
+		t.Fatal(err)
+	}
+	checkQuantiles(t, first, 1.2, values)
+
+	if err := first.Merge(NewHistogram(64, 1.1)); err == nil {
+		t.Fatal("merged histograms with different layouts")
+	}
+}
+
+func TestAggregatorQuantile(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithDigest(0, 0))
+	defer a.Close()
+	other := NewAggregator(time.Minute, WithClock(clock), WithDigest(0, 0))
+	defer other.Close()
+
+	// 1 to 100, half in each aggregator, the rollup should know about all of them
+	var values []float64
+	for value := 1; value <= 100; value++ {
+		values = append(values, float64(value))
+		target := a
+		if value > 50 {
+			target = other
+		}
+		target.ProcessEvent(eventAt(clock, 1, value))
+	}
+	if p99, _ := a.Quantile(1, testStart, 0.99); p99 > 50*math.Sqrt(defaultHistogramGrowth) {
+		t.Fatalf("p99 %.2f before the merge, expected at most about 50", p99)
+	}
+	if err := a.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	p99, ok := a.Quantile(1, testStart, 0.99)
+	if !ok {
+		t.Fatal("no digest for the window")
+	}
+	if bound := math.Sqrt(defaultHistogramGrowth); p99 > 99*bound || p99 < 99/bound {
+		t.Fatalf("p99 %.2f after the merge, expected about 99", p99)
+	}
+
+	if _, ok := a.Quantile(1, testStart.Add(time.Minute), 0.5); ok {
+		t.Fatal("a quantile for a window without events")
+	}
+	plain := NewAggregator(time.Minute, WithClock(clock))
+	defer plain.Close()
+	plain.ProcessEvent(eventAt(clock, 1, 1))
+	if _, ok := plain.Quantile(1, testStart, 0.5); ok {
+		t.Fatal("a quantile without digests")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+Getting the closed windows into InfluxDB (or anything else Telegraf feeds) doesn't need a client library: both take
+the line protocol as is, one point per line
+
+	window,user_id=42 value=17i 1700000000000000000
+
+a measurement, its tags, its fields and the timestamp in nanoseconds since the Unix epoch. The i marks the value as an
+integer, a bare 17 is a float, and InfluxDB refuses points whose field type differs from the one a field already has,
+so the suffix can't be added later without starting a new measurement. The timestamp is the
+window's EndTime, the point in time its value is known at. Points with the same measurement, tags and timestamp
+overwrite each other, so a window closed again after a restart lands on its first point instead of doubling it.
+
+InfluxDBExporter writes each closed window as a line as it closes, to a file Telegraf tails, a pipe into
+`influx write`, or a socket. Unlike the Exporter there is no retrying: a failed write is logged and the window lost
+to that writer.
+*/
+
+// a WindowCloseFunc writing every closed window to w in InfluxDB line protocol, see above.
+// Windows may close on several goroutines at once, the lines are written one at a time.
+func InfluxDBExporter(w io.Writer) WindowCloseFunc {
+	var mu sync.Mutex
+	return func(userID int, window Window) {
+		line := fmt.Sprintf("window,user_id=%d value=%di %d\n", userID, window.Value, window.EndTime.UnixNano())
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if _, err := io.WriteString(w, line); err != nil {
+			log.Printf("writing window %s of user %d as line protocol failed: %v",
+				window.StartTime.Format(time.RFC3339), userID, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxDBExporter(t *testing.T) {
+	var out strings.Builder
+	export := InfluxDBExporter(&out)
+	end := testStart.Add(time.Minute)
+	export(42, Window{StartTime: testStart, EndTime: end, Value: 17})
+	export(7, Window{StartTime: testStart, EndTime: end, Value: -3})
+
+	expected := "window,user_id=42 value=17i 1704067260000000000\n" +
+		"window,user_id=7 value=-3i 1704067260000000000\n"
+	if out.String() != expected {
+		t.Fatalf("wrote\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+func TestInfluxDBExporterWritesWholeLines(t *testing.T) {
+	var out strings.Builder
+	export := InfluxDBExporter(&out)
+
+	// windows may close on several goroutines at once
+	var wg sync.WaitGroup
+	for userID := range 50 {
+		wg.Go(func() {
+			export(userID, Window{StartTime: testStart, EndTime: testStart.Add(time.Minute), Value: userID})
+		})
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 50 {
+		t.Fatalf("%d lines for 50 closed windows", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "window,user_id=") || !strings.HasSuffix(line, "i 1704067260000000000") {
+			t.Fatalf("malformed line %q", line)
+		}
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // represents a user activity event
 type Event struct {
-	UserID    int
-	Timestamp time.Time
-	Value     int // sample metric to keep track of(in reality this could be metric like "likes")
+	UserID    int       `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     int       `json:"value"` // sample metric to keep track of(in reality this could be metric like "likes")
+	// optional dimensions of the event (e.g "country" -> "NG", "device" -> "ios")
+	Labels map[string]string `json:"labels,omitempty"`
+	// the aggregates the event counts towards when fed to a TaggedAggregator (e.g "purchases", "revenue")
+	Tags []string `json:"tags,omitempty"`
 }
 
 // represents a time window for aggregations
@@ -18,147 +26,1011 @@ type Window struct {
 	StartTime time.Time
 	EndTime   time.Time
 	Value     int
+	// bumped every time Value changes, see GetUserAggregatesSince
+	Version uint64
+	// events added to Value
+	Events int
+	// events that arrived after the user hit the ingest cap for this window, sampled or not
+	Throttled int
+	// breakdown of Value per label value, only maintained when the aggregator groups by a label
+	groups map[string]int
+	// distribution of the event values, only maintained when digests are enabled
+	digest *Histogram
 }
 
+// returns a deep copy of the window, sharing nothing with the original
+func (w Window) clone() Window {
+	if w.groups != nil {
+		groups := make(map[string]int, len(w.groups))
+		for group, value := range w.groups {
+			groups[group] = value
+		}
+		w.groups = groups
+	}
+	if w.digest != nil {
+		w.digest = w.digest.Clone()
+	}
+	return w
+}
+
+// represents a window broken down by the aggregator's group-by label
+type WindowBreakdown struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Groups    map[string]int
+}
+
+// marks how far a poller has read a user's windows, the zero Cursor reads everything
+type Cursor struct {
+	// start of the latest window seen
+	LastStart time.Time
+	// highest window version seen
+	Version uint64
+}
+
+// how long windows are kept around for by default.
+// This makes sense say if the standard window size for aggregation is about 1 hour.
+const retentionPeriod = 24 * time.Hour
+
+// the most windows preallocated for a new user
+const maxPreallocatedWindows = 64
+
+// the longest the aggregator waits between two pruning passes by default
+const defaultPruneInterval = time.Minute
+
+// called once for every window that gets closed, either because time moved past it or because of a Flush
+type WindowCloseFunc func(userID int, window Window)
+
+// decides what happens to events that arrive for a window that has already been closed
+type LateEventPolicy int
+
+const (
+	// late events are still added to their (closed) window, close callbacks are not fired again
+	MergeLateEvents LateEventPolicy = iota
+	// late events are ignored
+	DropLateEvents
+)
+
+const (
+	// bucket for events that don't carry the group-by label
+	DefaultGroup = "default"
+	// bucket for label values beyond the per-user cardinality cap
+	OverflowGroup = "other"
+)
+
+// hands out aggregator IDs, used to always lock aggregators in the same order
+var aggregatorIDs atomic.Uint64
+
 // handles time-windowed data aggregation
 type Aggregator struct {
-	mu           sync.Mutex
+	id uint64
+	// reads (queries) share the lock, writes (events, advancing windows) hold it exclusively
+	mu           sync.RWMutex
 	windowSize   time.Duration
 	userWindows  map[int][]Window
-	windowTicker *time.Ticker
+	windowTicker Ticker
+	clock        Clock
+
+	// how long windows are kept for
+	retention time.Duration
+	// how often windows are advanced (closed and pruned)
+	pruneInterval time.Duration
+	// max windows removed per pruning pass (0 means no limit)
+	maxPrunePerPass int
+
+	// label to break the windows down by ("" means no breakdown)
+	groupBy string
+	// max distinct label values tracked per user, anything beyond goes into OverflowGroup
+	maxGroupsPerUser int
+	// number of retained windows referencing each label value, per user
+	userGroups map[int]map[string]int
+	// last version handed out to a window, every change to any window takes the next one
+	version uint64
+	// layout of the per-window value digests (0 buckets means digests are disabled)
+	digestBuckets int
+	digestGrowth  float64
+
+	// every window ending at or before this instant is closed
+	closedThrough time.Time
+	onClose       []WindowCloseFunc
+	latePolicy    LateEventPolicy
+	// held from closing windows until their callbacks returned, so windows are delivered in the order they closed.
+	// Taken before mu, never while holding it.
+	notifyMu sync.Mutex
+	// max events processed per user per window (0 means no cap), and the fraction of events over it still processed
+	ingestCap  int
+	sampleRate float64
+	// how Run batches the events it consumes
+	ingestBatchSize     int
+	ingestBatchInterval time.Duration
+	// current window of each user (userID -> *atomic.Pointer[Window]), readable without the lock, see CurrentValue
+	current sync.Map
+	// slots for callers processing events, nil means no limit, see WithMaxConcurrentProcessors
+	processors chan struct{}
+	// see Stats
+	counters aggregatorCounters
+	// events waiting for the flusher, nil means events are processed right away, see WithEventBuffer
+	buffer      chan Event
+	stopFlusher context.CancelFunc
+	flusherDone chan struct{}
+	// stops the windowing goroutine
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// configures optional Aggregator behavior
+type Option func(*Aggregator)
+
+// breaks every user's windows down by the value of the given label.
+//
+// A label like "country" is fine but something like "session_id" would create a bucket per event,
+// so the number of distinct values kept per user is capped. Values seen after the cap is reached are
+// folded into the OverflowGroup bucket. A cap of 0 or less leaves the values uncapped.
+func WithGroupBy(label string, maxGroupsPerUser int) Option {
+	return func(a *Aggregator) {
+		a.groupBy = label
+		a.maxGroupsPerUser = maxGroupsPerUser
+	}
 }
 
-// initializes the Aggregator
-func NewAggregator(windowSize time.Duration) *Aggregator {
+// keeps a histogram of event values per window so percentiles can be queried with Quantile.
+// Each window costs 8 bytes per bucket, see histogram.go for how buckets and growth trade memory for accuracy.
+// Zero values fall back to the defaults.
+func WithDigest(buckets int, growth float64) Option {
+	return func(a *Aggregator) {
+		if buckets <= 0 {
+			buckets = defaultHistogramBuckets
+		}
+		if growth <= 1 {
+			growth = defaultHistogramGrowth
+		}
+		a.digestBuckets = buckets
+		a.digestGrowth = growth
+	}
+}
+
+// registers a callback that fires for every closed window (e.g to export finished windows).
+// Callbacks are called without the aggregator lock held, one window at a time and in the order the windows closed,
+// so a slow callback holds up the next close (but not event processing). They must not call Flush or Close.
+func WithWindowCloseCallback(fn WindowCloseFunc) Option {
+	return func(a *Aggregator) {
+		a.onClose = append(a.onClose, fn)
+	}
+}
+
+// sets what happens to events for windows that are already closed (default MergeLateEvents)
+func WithLateEventPolicy(policy LateEventPolicy) Option {
+	return func(a *Aggregator) {
+		a.latePolicy = policy
+	}
+}
+
+// caps how many events of a single user are processed per window, so one misbehaving client can't eat all the CPU.
+// Events over the cap are counted in the window's Throttled counter, and sampleRate of them (0 to 1) are still
+// processed. Sampling is deterministic: with a rate of 0.1, exactly every 10th throttled event gets through.
+// The cap is per user and per window, so it starts over with every new window.
+func WithIngestCap(eventsPerWindow int, sampleRate float64) Option {
+	return func(a *Aggregator) {
+		a.ingestCap = eventsPerWindow
+		a.sampleRate = min(max(sampleRate, 0), 1)
+	}
+}
+
+// sets how often windows are closed and pruned, independently of the window size, and how many windows a single
+// pruning pass may remove. A 24 hour window shouldn't mean memory is only reclaimed once a day, and a 1 second window
+// shouldn't mean pruning every second. A backlog bigger than maxPerPass is worked through in several passes,
+// giving the lock back in between so event processing isn't stalled. maxPerPass <= 0 means no limit.
+//
+// The interval defaults to the window size or a minute, whichever is shorter, and may not exceed the retention period.
+func WithPruning(interval time.Duration, maxPerPass int) Option {
+	return func(a *Aggregator) {
+		a.pruneInterval = interval
+		a.maxPrunePerPass = maxPerPass
+	}
+}
+
+// sets how long windows are kept around for (default 24 hours)
+func WithRetention(retention time.Duration) Option {
+	return func(a *Aggregator) {
+		a.retention = retention
+	}
+}
+
+// bounds how many callers may be processing events (or waiting for the lock to do so) at once.
+//
+// Under extreme load every caller of ProcessEvent queues up on the mutex, each of them a goroutine holding on to its
+// stack. With a limit the callers beyond it wait for a slot instead, and ProcessEventWithTimeout callers give up on
+// a slot just like on the lock, so an upstream pipeline can shed load before piling up on the aggregator.
+func WithMaxConcurrentProcessors(n int) Option {
+	return func(a *Aggregator) {
+		if n > 0 {
+			a.processors = make(chan struct{}, n)
+		}
+	}
+}
+
+// replaces the real clock, mostly useful for tests
+func WithClock(clock Clock) Option {
+	return func(a *Aggregator) {
+		a.clock = clock
+	}
+}
+
+// initializes the Aggregator.
+// It panics if the options don't make sense together, just like time.NewTicker does for a non-positive interval.
+func NewAggregator(windowSize time.Duration, opts ...Option) *Aggregator {
+	aggr, err := newAggregator(windowSize, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return aggr
+}
+
+// NewAggregator returning an error instead of panicking, for configs that aren't known upfront (see Registry)
+func newAggregator(windowSize time.Duration, opts ...Option) (*Aggregator, error) {
 	aggr := &Aggregator{
+		id:          aggregatorIDs.Add(1),
 		windowSize:  windowSize,
 		userWindows: make(map[int][]Window),
+		userGroups:  make(map[int]map[string]int),
+		done:        make(chan struct{}),
+		clock:       realClock{},
+		retention:   retentionPeriod,
+	}
+	for _, opt := range opts {
+		opt(aggr)
+	}
+
+	if windowSize <= 0 {
+		return nil, fmt.Errorf("window size %s must be positive", windowSize)
+	}
+	if aggr.pruneInterval == 0 {
+		aggr.pruneInterval = min(windowSize, defaultPruneInterval)
+	}
+	if aggr.pruneInterval < 0 || aggr.pruneInterval > aggr.retention {
+		return nil, fmt.Errorf("prune interval %s must be positive and no longer than the retention period %s",
+			aggr.pruneInterval, aggr.retention)
 	}
+
 	aggr.startWindowing()
-	return aggr
+	aggr.startFlusher()
+	return aggr, nil
 }
 
 // periodically advances the windows
 func (a *Aggregator) startWindowing() {
-	a.windowTicker = time.NewTicker(a.windowSize)
+	a.windowTicker = a.clock.NewTicker(a.pruneInterval)
 	go func() {
-		for range a.windowTicker.C {
-			a.advanceWindows()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-a.windowTicker.C():
+				a.advanceWindows()
+			}
 		}
 	}()
 }
 
-// advances the time windows and removes old data
+// advances the time windows, closing the ones time has moved past, and removes old data
 func (a *Aggregator) advanceWindows() {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.closeAndNotify(getCurrentWindow(a.clock, a.windowSize).StartTime)
+
+	// prune in bounded passes, giving the lock back in between so a big backlog doesn't hold up events
+	for {
+		a.mu.Lock()
+		pruned := a.pruneWindows(a.maxPrunePerPass)
+		a.mu.Unlock()
 
-	// keep data for the last 24 hours
-	// This makes sense say if the standard window size for aggregation is about 1 hour.
-	cutoff := time.Now().Add(-24 * time.Hour)
+		if a.maxPrunePerPass <= 0 || pruned < a.maxPrunePerPass {
+			return
+		}
+	}
+}
+
+// closes all open windows ending at or before asOf. When asOf is now (or later), the current window is
+// closed early too, which is what end-of-day jobs and shutdown want.
+//
+// Events arriving for a flushed period afterwards are late and follow the late-event policy.
+func (a *Aggregator) Flush(asOf time.Time) {
+	// future windows can't be closed, now or later closes the current window. An earlier asOf (even the current
+	// window's start) only closes the windows ending by then.
+	if !asOf.Before(a.clock.Now()) {
+		asOf = getCurrentWindow(a.clock, a.windowSize).EndTime
+	}
+
+	a.closeAndNotify(asOf)
+}
+
+// stops advancing the windows and flushes everything that is still open
+func (a *Aggregator) Close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.windowTicker.Stop()
+		a.flushBuffer()
+		a.Flush(a.clock.Now())
+	})
+}
+
+// represents a window that was closed for a user
+type closedWindow struct {
+	userID int
+	window Window
+}
+
+// moves the close watermark up to through and returns the windows that got closed on the way (must be called with a.mu held)
+func (a *Aggregator) closeWindows(through time.Time) []closedWindow {
+	if !through.After(a.closedThrough) {
+		return nil
+	}
+
+	var closed []closedWindow
 	for userID, windows := range a.userWindows {
-		var updatedWindows []Window
 		for _, window := range windows {
-			if window.EndTime.After(cutoff) {
-				updatedWindows = append(updatedWindows, window)
+			if window.EndTime.After(a.closedThrough) && !window.EndTime.After(through) {
+				window.groups = nil
+				window.digest = nil
+				closed = append(closed, closedWindow{userID: userID, window: window})
 			}
 		}
-		a.userWindows[userID] = updatedWindows
 	}
+	a.closedThrough = through
+	return closed
 }
 
-// processes a new event and updates aggregates
-func (a *Aggregator) ProcessEvent(event Event) {
+// closes the windows ending at or before through and fires the close callbacks for them.
+//
+// The callbacks run without a.mu, but a ticker tick and a Flush can close windows at the same time: without
+// notifyMu the one closing the later windows could deliver them before the other delivered the earlier ones.
+func (a *Aggregator) closeAndNotify(through time.Time) {
+	a.notifyMu.Lock()
+	defer a.notifyMu.Unlock()
+
 	a.mu.Lock()
-	defer a.mu.Unlock()
+	closed := a.closeWindows(through)
+	a.mu.Unlock()
+
+	a.notifyClosed(closed)
+}
+
+// fires the close callbacks, outside the lock so a slow callback doesn't hold up event processing
+func (a *Aggregator) notifyClosed(closed []closedWindow) {
+	for _, c := range closed {
+		for _, fn := range a.onClose {
+			fn(c.userID, c.window)
+		}
+	}
+}
 
-	userWindows := a.userWindows[event.UserID]
-	currentWindow := getCurrentWindow(a.windowSize)
+// removes up to limit windows past the retention period (no limit if limit <= 0) and returns how many were removed
+// (must be called with a.mu held)
+func (a *Aggregator) pruneWindows(limit int) int {
+	cutoff := a.clock.Now().Add(-a.retention)
+	pruned := 0
+	for userID, windows := range a.userWindows {
+		// windows are ordered by start time, so the expired ones are at the front
+		expired := 0
+		for expired < len(windows) && !windows[expired].EndTime.After(cutoff) {
+			if limit > 0 && pruned == limit {
+				break
+			}
+			a.releaseGroups(userID, windows[expired])
+			expired++
+			pruned++
+		}
+
+		switch {
+		case expired == len(windows):
+			delete(a.userWindows, userID)
+			a.current.Delete(userID)
+		case expired > 0:
+			// filter in place so the backing array is reused instead of reallocated on every pass.
+			// Nothing outside the lock holds on to it, queries only ever hand out copies.
+			kept := copy(windows, windows[expired:])
+			clear(windows[kept:])
+			a.userWindows[userID] = windows[:kept]
+		}
 
-	// check if there is an existing window we can update
-	var windowUpdated bool
-	for i, window := range userWindows {
-		if window.StartTime.Equal(currentWindow.StartTime) {
-			userWindows[i].Value += event.Value
-			windowUpdated = true
+		if limit > 0 && pruned == limit {
 			break
 		}
 	}
+	a.counters.windowsExpired.Add(uint64(pruned))
+	return pruned
+}
 
-	// If no existing window, create a new one
-	if !windowUpdated {
-		newWindow := Window{
-			StartTime: currentWindow.StartTime,
-			EndTime:   currentWindow.EndTime,
-			Value:     event.Value,
+// drops the label values referenced by a window that is being pruned so they no longer count towards the cap
+func (a *Aggregator) releaseGroups(userID int, window Window) {
+	groups := a.userGroups[userID]
+	for group := range window.groups {
+		groups[group]--
+		if groups[group] <= 0 {
+			delete(groups, group)
 		}
-		userWindows = append(userWindows, newWindow)
 	}
+	if len(groups) == 0 {
+		delete(a.userGroups, userID)
+	}
+}
 
-	a.userWindows[event.UserID] = userWindows
+// picks the bucket an event falls into, respecting the per-user cardinality cap
+func (a *Aggregator) resolveGroup(userID int, event Event) string {
+	return a.capGroup(userID, event.Labels[a.groupBy])
 }
 
-// retrieves aggregates for a user
-func (a *Aggregator) GetUserAggregates(userID int) []Window {
+// maps a label value to the bucket it is counted in for the user
+func (a *Aggregator) capGroup(userID int, value string) string {
+	if value == "" {
+		return DefaultGroup
+	}
+	if _, tracked := a.userGroups[userID][value]; tracked {
+		return value
+	}
+	if a.maxGroupsPerUser > 0 && len(a.userGroups[userID]) >= a.maxGroupsPerUser {
+		return OverflowGroup
+	}
+	return value
+}
+
+// adds an event's value to the window's breakdown
+func (a *Aggregator) addToGroup(userID int, window *Window, group string, value int) {
+	if window.groups == nil {
+		window.groups = make(map[string]int)
+	}
+	if _, exists := window.groups[group]; !exists && group != DefaultGroup && group != OverflowGroup {
+		if a.userGroups[userID] == nil {
+			a.userGroups[userID] = make(map[string]int)
+		}
+		a.userGroups[userID][group]++
+	}
+	window.groups[group] += value
+}
+
+// takes a processor slot, waiting until ctx is done at most
+func (a *Aggregator) acquireProcessor(ctx context.Context) error {
+	if a.processors == nil {
+		return nil
+	}
+	select {
+	case a.processors <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// gives back a slot taken with acquireProcessor
+func (a *Aggregator) releaseProcessor() {
+	if a.processors != nil {
+		<-a.processors
+	}
+}
+
+// processes several events under a single lock
+func (a *Aggregator) ProcessEvents(events []Event) {
+	a.acquireProcessor(context.Background())
+	defer a.releaseProcessor()
+
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	// return a copy to prevent external modification
-	userWindows, exists := a.userWindows[userID]
-	if !exists {
-		return []Window{}
+	for _, event := range events {
+		a.processEvent(event)
 	}
-
-	aggregates := make([]Window, len(userWindows))
-	copy(aggregates, userWindows)
-	return aggregates
 }
 
-// calculates the current time window
-func getCurrentWindow(windowSize time.Duration) Window {
-	now := time.Now()
-	windowStart := now.Truncate(windowSize)
-	return Window{
-		StartTime: windowStart,
-		EndTime:   windowStart.Add(windowSize),
+// returned by ProcessEventWithTimeout when the aggregator couldn't be locked (or no processor slot was free) in time
+var ErrLockTimeout = errors.New("timed out waiting for the aggregator lock")
+
+// processes a new event and updates aggregates. With WithEventBuffer the event is only buffered, and dropped if the
+// buffer is full.
+func (a *Aggregator) ProcessEvent(event Event) {
+	if a.buffer != nil {
+		a.bufferEvent(event)
+		return
 	}
+
+	a.acquireProcessor(context.Background())
+	defer a.releaseProcessor()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.processEvent(event)
 }
 
-func main() {
-	windowSize := time.Hour
-	aggregator := NewAggregator(windowSize)
+// same as ProcessEvent but gives up with ErrLockTimeout if the lock can't be acquired before ctx is done.
+// With WithEventBuffer it never waits, and returns ErrBufferFull if the buffer has no room for the event.
+//
+// ProcessEvent can be called from hundreds of goroutines that all queue up on the same mutex, and an upstream
+// event pipeline would rather drop (or retry) an event than stall behind a slow aggregator.
+func (a *Aggregator) ProcessEventWithTimeout(ctx context.Context, event Event) error {
+	if a.buffer != nil {
+		if !a.bufferEvent(event) {
+			return ErrBufferFull
+		}
+		return nil
+	}
 
-	// simulate  events for some set of users
+	if err := a.acquireProcessor(ctx); err != nil {
+		return ErrLockTimeout
+	}
+	defer a.releaseProcessor()
+
+	locked := make(chan struct{})
 	go func() {
-		users := []int{1, 2, 3}
-		for {
-			for _, userID := range users {
-				event := Event{
-					UserID:    userID,
-					Timestamp: time.Now(),
-					Value:     1,
+		a.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		// the goroutine above still gets the lock eventually, so someone has to give it back
+		go func() {
+			<-locked
+			a.mu.Unlock()
+		}()
+		return ErrLockTimeout
+	}
+	defer a.mu.Unlock()
+
+	a.processEvent(event)
+	return nil
+}
+
+// updates the aggregates with an event (must be called with a.mu held)
+func (a *Aggregator) processEvent(event Event) {
+	// events are aggregated into the window they happened in, so a late event is merged into an older window
+	eventWindow := getCurrentWindow(a.clock, a.windowSize)
+	if !event.Timestamp.IsZero() {
+		eventWindow = getWindowAt(event.Timestamp, a.windowSize)
+	}
+
+	// no point keeping an event that the next advance would prune anyway
+	if !eventWindow.EndTime.After(a.clock.Now().Add(-a.retention)) {
+		a.counters.eventsDropped.Add(1)
+		return
+	}
+
+	// the event's window was already closed
+	if !eventWindow.EndTime.After(a.closedThrough) && a.latePolicy == DropLateEvents {
+		a.counters.eventsDropped.Add(1)
+		return
+	}
+
+	window := a.findOrCreateWindow(event.UserID, eventWindow)
+	if a.ingestCap > 0 && window.Events >= a.ingestCap {
+		window.Throttled++
+		if !window.sample(a.sampleRate) {
+			// the value didn't change, so no new version and nothing new to publish: a flooding user should cost as
+			// little as possible. CurrentValue and delta queries see the new Throttled count with the next change to
+			// the value, the other queries right away.
+			a.counters.eventsDropped.Add(1)
+			return
+		}
+	}
+
+	var group string
+	if a.groupBy != "" {
+		group = a.resolveGroup(event.UserID, event)
+	}
+
+	window.Value += event.Value
+	window.Events++
+	if a.groupBy != "" {
+		a.addToGroup(event.UserID, window, group, event.Value)
+	}
+	if a.digestBuckets > 0 {
+		if window.digest == nil {
+			window.digest = NewHistogram(a.digestBuckets, a.digestGrowth)
+		}
+		window.digest.Add(float64(event.Value))
+	}
+	a.counters.eventsProcessed.Add(1)
+	a.bumpVersion(window)
+	a.publishCurrent(event.UserID, window)
+}
+
+// decides whether the latest throttled event is processed anyway: it is whenever throttled * rate crosses
+// the next whole number
+func (w *Window) sample(rate float64) bool {
+	return int(float64(w.Throttled)*rate) > int(float64(w.Throttled-1)*rate)
+}
+
+// returns the user's window with the same start time as target, creating it if it doesn't exist yet.
+// A user's windows are kept ordered by start time.
+func (a *Aggregator) findOrCreateWindow(userID int, target Window) *Window {
+	userWindows := a.userWindows[userID]
+	i := sort.Search(len(userWindows), func(i int) bool {
+		return !userWindows[i].StartTime.Before(target.StartTime)
+	})
+	if i < len(userWindows) && userWindows[i].StartTime.Equal(target.StartTime) {
+		return &userWindows[i]
+	}
+
+	// size a new user's slice for the windows they are expected to keep so it doesn't keep regrowing
+	if userWindows == nil {
+		userWindows = make([]Window, 0, a.expectedWindows())
+	}
+	userWindows = append(userWindows, Window{})
+	copy(userWindows[i+1:], userWindows[i:])
+	userWindows[i] = Window{
+		StartTime: target.StartTime,
+		EndTime:   target.EndTime,
+	}
+	a.userWindows[userID] = userWindows
+	a.counters.windowsCreated.Add(1)
+	return &userWindows[i]
+}
+
+// merges another aggregator's windows into this one, e.g to combine partial data from two nodes.
+// Windows for the same user and start time are summed, windows only other has are added. other is left untouched.
+func (a *Aggregator) Merge(other *Aggregator) error {
+	if a == other {
+		return errors.New("cannot merge an aggregator into itself")
+	}
+	if a.windowSize != other.windowSize {
+		return fmt.Errorf("cannot merge aggregators with different window sizes (%s vs %s)", a.windowSize, other.windowSize)
+	}
+	if a.digestBuckets > 0 && other.digestBuckets > 0 &&
+		(a.digestBuckets != other.digestBuckets || a.digestGrowth != other.digestGrowth) {
+		return errors.New("cannot merge aggregators with different digest layouts")
+	}
+
+	// always lock the older aggregator first, otherwise a.Merge(b) and b.Merge(a) running at the same time
+	// could each hold one lock while waiting on the other. other is only read from.
+	if a.id < other.id {
+		a.mu.Lock()
+		other.mu.RLock()
+	} else {
+		other.mu.RLock()
+		a.mu.Lock()
+	}
+	defer a.mu.Unlock()
+	defer other.mu.RUnlock()
+
+	for userID, windows := range other.userWindows {
+		for _, theirs := range windows {
+			ours := a.findOrCreateWindow(userID, theirs)
+			ours.Value += theirs.Value
+			ours.Events += theirs.Events
+			ours.Throttled += theirs.Throttled
+			if a.groupBy != "" {
+				for group, value := range theirs.groups {
+					a.addToGroup(userID, ours, a.capGroup(userID, group), value)
+				}
+			}
+			if a.digestBuckets > 0 && theirs.digest != nil {
+				if ours.digest == nil {
+					ours.digest = theirs.digest.Clone()
+				} else if err := ours.digest.Merge(theirs.digest); err != nil {
+					return err
 				}
-				aggregator.ProcessEvent(event)
 			}
-			time.Sleep(10 * time.Second)
+			a.bumpVersion(ours)
+			a.publishCurrent(userID, ours)
 		}
-	}()
+	}
+	return nil
+}
 
-	// simulate requests for aggregates for one of the users above
-	go func() {
-		for {
-			time.Sleep(30 * time.Second)
-			userID := 1
-			aggregates := aggregator.GetUserAggregates(userID)
-			fmt.Printf("User %d aggregates:\n", userID)
-			for _, window := range aggregates {
-				fmt.Printf("Window %s - %s: Value = %d\n",
-					window.StartTime.Format(time.RFC822),
-					window.EndTime.Format(time.RFC822),
-					window.Value)
+// the number of windows a user retains at most (one more while a window is partially expired), capped by
+// maxPreallocatedWindows so tiny windows with a long retention don't preallocate megabytes per user
+func (a *Aggregator) expectedWindows() int {
+	return min(int(a.retention/a.windowSize)+1, maxPreallocatedWindows)
+}
+
+// publishes the window as the user's current one for CurrentValue if it is the window the clock is in
+// (must be called with a.mu held, which keeps publishers from racing each other).
+//
+// Late events and events timestamped ahead of the clock leave the published window alone. Publishing the latest
+// window seen instead would let a single event dated a year ahead take the slot, and every window after it would be
+// refused until that one came around.
+func (a *Aggregator) publishCurrent(userID int, window *Window) {
+	if now := a.clock.Now(); now.Before(window.StartTime) || !now.Before(window.EndTime) {
+		return
+	}
+
+	// LoadOrStore alone would allocate a pointer for every event just to throw it away
+	entry, exists := a.current.Load(userID)
+	if !exists {
+		entry, _ = a.current.LoadOrStore(userID, new(atomic.Pointer[Window]))
+	}
+	latest := entry.(*atomic.Pointer[Window])
+
+	// a fresh copy every time, readers may still hold on to the previous one
+	summary := *window
+	summary.groups = nil
+	summary.digest = nil
+	latest.Store(&summary)
+}
+
+// marks a window as changed so delta queries pick it up
+func (a *Aggregator) bumpVersion(window *Window) {
+	a.version++
+	window.Version = a.version
+}
+
+// returns the user's running value for the current window without taking the lock, for hot read paths that
+// shouldn't queue up behind writers. It is updated with every event, so at most it misses the event being processed
+// right now. ok is false if the user has no events in the current window.
+func (a *Aggregator) CurrentValue(userID int) (Window, bool) {
+	entry, exists := a.current.Load(userID)
+	if !exists {
+		return Window{}, false
+	}
+	published := entry.(*atomic.Pointer[Window]).Load()
+	if published == nil || !published.StartTime.Equal(getCurrentWindow(a.clock, a.windowSize).StartTime) {
+		return Window{}, false
+	}
+	return *published, true
+}
+
+// retrieves aggregates for a user
+func (a *Aggregator) GetUserAggregates(userID int) []Window {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return copyWindows(a.userWindows[userID])
+}
+
+// hands the user's windows to read without copying them, for hot read paths where GetUserAggregates'
+// copy per call adds up. read runs under the read lock, so it must be quick and must neither modify the
+// windows nor keep a reference to them after returning.
+func (a *Aggregator) ReadUserAggregates(userID int, read func([]Window)) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	read(a.userWindows[userID])
+}
+
+// retrieves aggregates for a user broken down by the group-by label
+func (a *Aggregator) GetUserBreakdown(userID int) []WindowBreakdown {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return breakdownOf(a.userWindows[userID])
+}
+
+// retrieves only the user's windows created or modified since the cursor, along with the cursor to use next time.
+// This saves pollers from re-downloading every window on each poll.
+func (a *Aggregator) GetUserAggregatesSince(userID int, cursor Cursor) ([]Window, Cursor) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return windowsSince(a.userWindows[userID], cursor)
+}
+
+// estimates the q-quantile (e.g 0.99 for p99) of the event values in the user's window starting at windowStart,
+// ok is false if digests are disabled or there's no such window
+func (a *Aggregator) Quantile(userID int, windowStart time.Time, q float64) (value float64, ok bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return quantileOf(a.userWindows[userID], windowStart, q)
+}
+
+// represents the share of a user in all activity of a window
+type SharePoint struct {
+	StartTime time.Time
+	EndTime   time.Time
+	// the user's value and the value of all users together
+	UserValue  int
+	TotalValue int
+	// UserValue / TotalValue, 0 when there was no activity at all
+	Share float64
+	// true when TotalValue is 0, telling "no activity" apart from "none of it was this user's"
+	NoActivity bool
+}
+
+// retrieves the aggregates of all users combined, summed at query time
+func (a *Aggregator) GetGlobalAggregates() []Window {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.globalWindows()
+}
+
+// returned for a window size the aggregator's windows can't be summed into, see GlobalAggregate
+var ErrWindowSize = errors.New("window size must be a multiple of the aggregator's window size")
+
+// a user's activity over a span of windows, see TopN
+type UserValue struct {
+	UserID int
+	Value  int
+	Events int
+}
+
+// retrieves the activity of all users combined over the current window of windowSize (e.g the current hour of an
+// aggregator with windows of a minute). windowSize must be a multiple of the aggregator's window size, so that
+// every window of the aggregator falls into exactly one of windowSize.
+func (a *Aggregator) GlobalAggregate(windowSize time.Duration) (Window, error) {
+	if windowSize <= 0 || windowSize%a.windowSize != 0 {
+		return Window{}, ErrWindowSize
+	}
+	global := getCurrentWindow(a.clock, windowSize)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, window := range a.globalWindows() {
+		if !window.StartTime.Before(global.StartTime) && window.StartTime.Before(global.EndTime) {
+			global.Value += window.Value
+			global.Events += window.Events
+			global.Throttled += window.Throttled
+			global.Version = max(global.Version, window.Version)
+		}
+	}
+	return global, nil
+}
+
+// retrieves the n users with the highest value over the current window of windowSize (see GlobalAggregate), highest
+// first and by user ID between equals. Users without activity in the window aren't ranked.
+func (a *Aggregator) TopN(n int, windowSize time.Duration) ([]UserValue, error) {
+	if windowSize <= 0 || windowSize%a.windowSize != 0 {
+		return nil, ErrWindowSize
+	}
+	span := getCurrentWindow(a.clock, windowSize)
+
+	a.mu.RLock()
+	var users []UserValue
+	for userID, windows := range a.userWindows {
+		user := UserValue{UserID: userID}
+		for _, window := range windows {
+			if !window.StartTime.Before(span.StartTime) && window.StartTime.Before(span.EndTime) {
+				user.Value += window.Value
+				user.Events += window.Events
 			}
 		}
-	}()
+		if user.Events > 0 {
+			users = append(users, user)
+		}
+	}
+	a.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Value != users[j].Value {
+			return users[i].Value > users[j].Value
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	return users[:min(max(n, 0), len(users))], nil
+}
+
+// retrieves the fraction of all activity the user accounted for, for every window starting in [from, to).
+// Windows without data count as 0, so every window in the range gets a point.
+func (a *Aggregator) GetUserShare(userID int, from, to time.Time) []SharePoint {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// both series come from the same windows under the same lock, so their boundaries always line up
+	// keyed by UnixNano, equal instants in different locations are different time.Time map keys
+	totals := make(map[int64]int)
+	for _, window := range a.globalWindows() {
+		totals[window.StartTime.UnixNano()] = window.Value
+	}
+	values := make(map[int64]int)
+	for _, window := range a.userWindows[userID] {
+		values[window.StartTime.UnixNano()] = window.Value
+	}
+
+	var points []SharePoint
+	for window := getWindowAt(from, a.windowSize); window.StartTime.Before(to); window = getWindowAt(window.EndTime, a.windowSize) {
+		if window.StartTime.Before(from) {
+			continue
+		}
+		point := SharePoint{
+			StartTime:  window.StartTime,
+			EndTime:    window.EndTime,
+			UserValue:  values[window.StartTime.UnixNano()],
+			TotalValue: totals[window.StartTime.UnixNano()],
+		}
+		if point.TotalValue == 0 {
+			point.NoActivity = true
+		} else {
+			point.Share = float64(point.UserValue) / float64(point.TotalValue)
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// sums the windows of all users per start time, ordered by start time (must be called with a.mu held)
+func (a *Aggregator) globalWindows() []Window {
+	byStart := make(map[int64]*Window)
+	for _, windows := range a.userWindows {
+		for _, window := range windows {
+			global, exists := byStart[window.StartTime.UnixNano()]
+			if !exists {
+				global = &Window{StartTime: window.StartTime, EndTime: window.EndTime}
+				byStart[window.StartTime.UnixNano()] = global
+			}
+			global.Value += window.Value
+			global.Events += window.Events
+			global.Throttled += window.Throttled
+			global.Version = max(global.Version, window.Version)
+		}
+	}
+
+	globals := make([]Window, 0, len(byStart))
+	for _, window := range byStart {
+		globals = append(globals, *window)
+	}
+	sort.Slice(globals, func(i, j int) bool {
+		return globals[i].StartTime.Before(globals[j].StartTime)
+	})
+	return globals
+}
+
+// returns a copy of the windows that is safe to hand out
+func copyWindows(windows []Window) []Window {
+	aggregates := make([]Window, len(windows))
+	copy(aggregates, windows)
+	for i := range aggregates {
+		aggregates[i].groups = nil
+		aggregates[i].digest = nil
+	}
+	return aggregates
+}
+
+// returns the group-by breakdown of the windows
+func breakdownOf(windows []Window) []WindowBreakdown {
+	breakdowns := make([]WindowBreakdown, 0, len(windows))
+	for _, window := range windows {
+		groups := make(map[string]int, len(window.groups))
+		for group, value := range window.groups {
+			groups[group] = value
+		}
+		breakdowns = append(breakdowns, WindowBreakdown{
+			StartTime: window.StartTime,
+			EndTime:   window.EndTime,
+			Groups:    groups,
+		})
+	}
+	return breakdowns
+}
+
+// picks the windows changed since the cursor and moves the cursor past them
+func windowsSince(windows []Window, cursor Cursor) ([]Window, Cursor) {
+	next := cursor
+	var changed []Window
+	for _, window := range windows {
+		if window.Version > cursor.Version {
+			window.groups = nil
+			window.digest = nil
+			changed = append(changed, window)
+		}
+		if window.Version > next.Version {
+			next.Version = window.Version
+		}
+		if window.StartTime.After(next.LastStart) {
+			next.LastStart = window.StartTime
+		}
+	}
+	return changed, next
+}
+
+// estimates a quantile of the window starting at windowStart
+func quantileOf(windows []Window, windowStart time.Time, q float64) (float64, bool) {
+	for _, window := range windows {
+		if window.StartTime.Equal(windowStart) && window.digest != nil {
+			return window.digest.Quantile(q), true
+		}
+	}
+	return 0, false
+}
+
+// calculates the current time window
+func getCurrentWindow(clock Clock, windowSize time.Duration) Window {
+	return getWindowAt(clock.Now(), windowSize)
+}
 
-	select {}
+// calculates the time window a given instant falls into
+func getWindowAt(t time.Time, windowSize time.Duration) Window {
+	windowStart := t.Truncate(windowSize)
+	return Window{
+		StartTime: windowStart,
+		EndTime:   windowStart.Add(windowSize),
+	}
 }
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sends the user n events of value 1 at the clock's time
+func sendEvents(a *Aggregator, clock Clock, userID, n int) {
+	for range n {
+		a.ProcessEvent(eventAt(clock, userID, 1))
+	}
+}
+
+// the user's only window
+func onlyWindow(t *testing.T, a *Aggregator, userID int) Window {
+	t.Helper()
+	windows := a.GetUserAggregates(userID)
+	if len(windows) != 1 {
+		t.Fatalf("user %d has %d windows, expected 1", userID, len(windows))
+	}
+	return windows[0]
+}
+
+func TestIngestCap(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithIngestCap(5, 0))
+	defer a.Close()
+
+	sendEvents(a, clock, 1, 20)
+	sendEvents(a, clock, 2, 5)
+	if w := onlyWindow(t, a, 1); w.Value != 5 || w.Events != 5 || w.Throttled != 15 {
+		t.Fatalf("user 1 over the cap: value %d, %d events, %d throttled, expected 5, 5 and 15",
+			w.Value, w.Events, w.Throttled)
+	}
+	if w := onlyWindow(t, a, 2); w.Value != 5 || w.Throttled != 0 {
+		t.Fatalf("user 2 at the cap: value %d, %d throttled, expected 5 and none", w.Value, w.Throttled)
+	}
+
+	// the cap starts over with the next window
+	clock.Advance(time.Minute)
+	sendEvents(a, clock, 1, 3)
+	windows := a.GetUserAggregates(1)
+	if len(windows) != 2 || windows[1].Value != 3 || windows[1].Throttled != 0 {
+		t.Fatalf("user 1 in the next window: %+v, expected a value of 3 and nothing throttled", windows)
+	}
+}
+
+func TestIngestCapSampling(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithIngestCap(5, 0.1))
+	defer a.Close()
+
+	sendEvents(a, clock, 1, 105)
+	// the 5 under the cap, then every 10th of the 100 over it
+	if w := onlyWindow(t, a, 1); w.Value != 15 || w.Events != 15 || w.Throttled != 100 {
+		t.Fatalf("value %d, %d events, %d throttled, expected 15, 15 and 100", w.Value, w.Events, w.Throttled)
+	}
+}
+
+func TestThrottledEventsKeepVersion(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithIngestCap(5, 0))
+	defer a.Close()
+
+	sendEvents(a, clock, 1, 5)
+	_, cursor := a.GetUserAggregatesSince(1, Cursor{})
+	current, _ := a.CurrentValue(1)
+
+	// dropped over the cap, the value doesn't change
+	sendEvents(a, clock, 1, 10)
+	if changed, _ := a.GetUserAggregatesSince(1, cursor); len(changed) != 0 {
+		t.Fatalf("throttled events gave the window a new version: %+v", changed)
+	}
+	if latest, _ := a.CurrentValue(1); latest.Throttled != current.Throttled {
+		t.Fatalf("throttled events republished the window: %+v, was %+v", latest, current)
+	}
+	if w := onlyWindow(t, a, 1); w.Throttled != 10 {
+		t.Fatalf("%d throttled, expected 10", w.Throttled)
+	}
+}
+
+// the user's event at the clock's time, labelled with the country (none if empty)
+func eventFrom(clock Clock, userID, value int, country string) Event {
+	event := eventAt(clock, userID, value)
+	if country != "" {
+		event.Labels = map[string]string{"country": country}
+	}
+	return event
+}
+
+// the breakdown of the user's only window
+func onlyBreakdown(t *testing.T, a *Aggregator, userID int) map[string]int {
+	t.Helper()
+	breakdowns := a.GetUserBreakdown(userID)
+	if len(breakdowns) != 1 {
+		t.Fatalf("user %d has %d windows, expected 1", userID, len(breakdowns))
+	}
+	return breakdowns[0].Groups
+}
+
+func TestGroupBy(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithGroupBy("country", 2))
+	defer a.Close()
+
+	for _, e := range []struct {
+		country string
+		value   int
+	}{{"NG", 1}, {"US", 2}, {"NG", 3}, {"", 4}, {"DE", 5}, {"FR", 6}, {"US", 7}} {
+		a.ProcessEvent(eventFrom(clock, 1, e.value, e.country))
+	}
+
+	// NG and US take the two slots, DE and FR overflow, the unlabelled event goes to the default bucket
+	groups := onlyBreakdown(t, a, 1)
+	expected := map[string]int{"NG": 4, "US": 9, OverflowGroup: 11, DefaultGroup: 4}
+	if len(groups) != len(expected) {
+		t.Fatalf("groups %v, expected %v", groups, expected)
+	}
+	for group, value := range expected {
+		if groups[group] != value {
+			t.Fatalf("groups %v, expected %v", groups, expected)
+		}
+	}
+	if w := onlyWindow(t, a, 1); w.Value != 28 {
+		t.Fatalf("value %d, expected the 28 of all groups", w.Value)
+	}
+
+	// the cap is per user
+	a.ProcessEvent(eventFrom(clock, 2, 1, "DE"))
+	if groups := onlyBreakdown(t, a, 2); groups["DE"] != 1 || len(groups) != 1 {
+		t.Fatalf("user 2: %v, expected DE on its own", groups)
+	}
+}
+
+func TestGroupByFreesPrunedGroups(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithRetention(time.Minute), WithGroupBy("country", 1))
+	defer a.Close()
+
+	a.ProcessEvent(eventFrom(clock, 1, 1, "NG"))
+	clock.Advance(2 * time.Minute)
+	a.advanceWindows()
+
+	// NG's window is gone, so US gets the slot instead of overflowing
+	a.ProcessEvent(eventFrom(clock, 1, 1, "US"))
+	if groups := onlyBreakdown(t, a, 1); groups["US"] != 1 {
+		t.Fatalf("groups %v, expected US to have its own bucket", groups)
+	}
+}
+
+func TestGetUserAggregatesSince(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+
+	sendEvents(a, clock, 1, 2)
+	clock.Advance(time.Minute)
+	sendEvents(a, clock, 1, 1)
+	windows, cursor := a.GetUserAggregatesSince(1, Cursor{})
+	if len(windows) != 2 {
+		t.Fatalf("first fetch: %d windows, expected both", len(windows))
+	}
+	if again, _ := a.GetUserAggregatesSince(1, cursor); len(again) != 0 {
+		t.Fatalf("nothing changed, but got %+v", again)
+	}
+
+	// a late event merged into the first window, and a new third one
+	a.ProcessEvent(Event{UserID: 1, Timestamp: testStart, Value: 5})
+	clock.Advance(time.Minute)
+	sendEvents(a, clock, 1, 1)
+
+	changed, next := a.GetUserAggregatesSince(1, cursor)
+	if len(changed) != 2 {
+		t.Fatalf("%d windows changed, expected the merged and the new one: %+v", len(changed), changed)
+	}
+	if !changed[0].StartTime.Equal(testStart) || changed[0].Value != 7 {
+		t.Fatalf("merged window %+v, expected the first window with 7", changed[0])
+	}
+	if !changed[1].StartTime.Equal(testStart.Add(2*time.Minute)) || changed[1].Value != 1 {
+		t.Fatalf("new window %+v, expected the third window with 1", changed[1])
+	}
+	if !next.LastStart.Equal(changed[1].StartTime) || next.Version <= cursor.Version {
+		t.Fatalf("cursor %+v didn't move past %+v", next, cursor)
+	}
+}
+
+// records the windows the aggregator closes
+type closeRecorder struct {
+	mu     sync.Mutex
+	closed []Window
+}
+
+func (r *closeRecorder) record(userID int, window Window) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = append(r.closed, window)
+}
+
+func (r *closeRecorder) windows() []Window {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.closed)
+}
+
+func TestFlushClosesTheCurrentWindow(t *testing.T) {
+	for _, tc := range []struct {
+		policy LateEventPolicy
+		value  int
+	}{
+		{MergeLateEvents, 3},
+		{DropLateEvents, 1},
+	} {
+		clock := newFakeClock()
+		var recorder closeRecorder
+		a := NewAggregator(time.Minute, WithClock(clock), WithLateEventPolicy(tc.policy),
+			WithWindowCloseCallback(recorder.record))
+
+		sendEvents(a, clock, 1, 1)
+		a.Flush(clock.Now())
+		if closed := recorder.windows(); len(closed) != 1 || closed[0].Value != 1 {
+			t.Fatalf("policy %d: closed %+v, expected the current window with 1", tc.policy, closed)
+		}
+
+		// still the same minute, but the window was flushed
+		a.ProcessEvent(eventAt(clock, 1, 2))
+		if w := onlyWindow(t, a, 1); w.Value != tc.value {
+			t.Fatalf("policy %d: value %d after a late event, expected %d", tc.policy, w.Value, tc.value)
+		}
+
+		a.Flush(clock.Now())
+		a.Close()
+		if closed := recorder.windows(); len(closed) != 1 {
+			t.Fatalf("policy %d: %d windows closed, a flushed window closes once", tc.policy, len(closed))
+		}
+	}
+}
+
+func TestFlushLeavesLaterWindowsOpen(t *testing.T) {
+	clock := newFakeClock()
+	var recorder closeRecorder
+	a := NewAggregator(time.Minute, WithClock(clock), WithWindowCloseCallback(recorder.record))
+
+	sendEvents(a, clock, 1, 1)
+	clock.Advance(90 * time.Second)
+	sendEvents(a, clock, 1, 1)
+	// the first window's end, which is where the current one starts
+	a.Flush(testStart.Add(time.Minute))
+	if closed := recorder.windows(); len(closed) != 1 || !closed[0].StartTime.Equal(testStart) {
+		t.Fatalf("closed %+v, expected only the first window", closed)
+	}
+
+	// Close flushes what is left
+	a.Close()
+	if closed := recorder.windows(); len(closed) != 2 || !closed[1].StartTime.Equal(testStart.Add(time.Minute)) {
+		t.Fatalf("closed %+v after Close, expected the second window too", closed)
+	}
+}
+
+func TestQueriesShareTheLock(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+	sendEvents(a, clock, 1, 1)
+
+	// another query in progress
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.GetUserAggregates(1)
+		a.GetGlobalAggregates()
+		a.GetUserAggregatesSince(1, Cursor{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queries wait for each other")
+	}
+}
+
+// 9 dashboard queries (summing every user's windows) for every event, from every CPU. shared queries take the read
+// lock, exclusive ones take the write lock like every query did before the read-write lock.
+func BenchmarkMixedLoad(b *testing.B) {
+	for _, mode := range []string{"shared", "exclusive"} {
+		b.Run(mode, func(b *testing.B) {
+			clock := newFakeClock()
+			a := NewAggregator(time.Minute, WithClock(clock))
+			defer a.Close()
+			for userID := 1; userID <= 100; userID++ {
+				sendEvents(a, clock, userID, 10)
+			}
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					userID := i%100 + 1
+					switch {
+					case i%10 == 0:
+						a.ProcessEvent(eventAt(clock, userID, 1))
+					case mode == "shared":
+						a.GetGlobalAggregates()
+					default:
+						a.mu.Lock()
+						a.globalWindows()
+						a.mu.Unlock()
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestGetUserShare(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+
+	// first minute: 1, 3 and 6 for users 1 to 3, second minute: nothing, third minute: user 2 only
+	for userID, value := range map[int]int{1: 1, 2: 3, 3: 6} {
+		a.ProcessEvent(eventAt(clock, userID, value))
+	}
+	clock.Advance(2 * time.Minute)
+	a.ProcessEvent(eventAt(clock, 2, 4))
+	a.Flush(testStart.Add(time.Minute))
+
+	total := 0.0
+	for userID := 1; userID <= 3; userID++ {
+		points := a.GetUserShare(userID, testStart, testStart.Add(3*time.Minute))
+		if len(points) != 3 {
+			t.Fatalf("user %d: %d points, expected one per window", userID, len(points))
+		}
+		total += points[0].Share
+		if points[0].TotalValue != 10 || points[0].NoActivity {
+			t.Fatalf("user %d, closed window: %+v, expected a total of 10", userID, points[0])
+		}
+		if !points[1].NoActivity || points[1].Share != 0 {
+			t.Fatalf("user %d, empty window: %+v, expected no activity", userID, points[1])
+		}
+		if share := points[2].Share; (userID == 2) != (share == 1) || points[2].NoActivity {
+			t.Fatalf("user %d, third window: %+v", userID, points[2])
+		}
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Fatalf("shares of the closed window add up to %f, expected 1", total)
+	}
+
+	if points := a.GetUserShare(1, testStart.Add(30*time.Second), testStart.Add(time.Minute)); len(points) != 0 {
+		t.Fatalf("%+v, expected no window starting in the range", points)
+	}
+}
+
+// an aggregator with windows of a minute, at 00:02 after events of 1, 3 and 6 for users 1 to 3 at 00:00, and 4 and 6
+// for users 2 and 4 at 00:02
+func spreadActivity(t *testing.T) *Aggregator {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	t.Cleanup(a.Close)
+
+	for userID, value := range map[int]int{1: 1, 2: 3, 3: 6} {
+		a.ProcessEvent(eventAt(clock, userID, value))
+	}
+	clock.Advance(2 * time.Minute)
+	a.ProcessEvent(eventAt(clock, 2, 4))
+	a.ProcessEvent(eventAt(clock, 4, 6))
+	return a
+}
+
+func TestGlobalAggregate(t *testing.T) {
+	a := spreadActivity(t)
+
+	for _, tc := range []struct {
+		windowSize time.Duration
+		start      time.Time
+		value      int
+		events     int
+	}{
+		{time.Minute, testStart.Add(2 * time.Minute), 10, 2},
+		{2 * time.Minute, testStart.Add(2 * time.Minute), 10, 2},
+		{time.Hour, testStart, 20, 5},
+	} {
+		window, err := a.GlobalAggregate(tc.windowSize)
+		if err != nil {
+			t.Fatalf("window of %s: %v", tc.windowSize, err)
+		}
+		if !window.StartTime.Equal(tc.start) || !window.EndTime.Equal(tc.start.Add(tc.windowSize)) {
+			t.Fatalf("window of %s: %s - %s, expected the one starting at %s", tc.windowSize,
+				window.StartTime, window.EndTime, tc.start)
+		}
+		if window.Value != tc.value || window.Events != tc.events {
+			t.Fatalf("window of %s: value %d of %d events, expected %d of %d", tc.windowSize,
+				window.Value, window.Events, tc.value, tc.events)
+		}
+	}
+
+	for _, windowSize := range []time.Duration{0, 30 * time.Second, 90 * time.Second, -time.Hour} {
+		if _, err := a.GlobalAggregate(windowSize); !errors.Is(err, ErrWindowSize) {
+			t.Fatalf("window of %s: %v, expected ErrWindowSize", windowSize, err)
+		}
+	}
+}
+
+func TestTopN(t *testing.T) {
+	a := spreadActivity(t)
+
+	for _, tc := range []struct {
+		n          int
+		windowSize time.Duration
+		top        []UserValue
+	}{
+		// users 3 and 4 both have 6, the lower ID first
+		{10, time.Hour, []UserValue{{2, 7, 2}, {3, 6, 1}, {4, 6, 1}, {1, 1, 1}}},
+		{2, time.Hour, []UserValue{{2, 7, 2}, {3, 6, 1}}},
+		{10, time.Minute, []UserValue{{4, 6, 1}, {2, 4, 1}}},
+		{0, time.Hour, []UserValue{}},
+	} {
+		top, err := a.TopN(tc.n, tc.windowSize)
+		if err != nil {
+			t.Fatalf("top %d over %s: %v", tc.n, tc.windowSize, err)
+		}
+		if !slices.Equal(top, tc.top) {
+			t.Fatalf("top %d over %s: %+v, expected %+v", tc.n, tc.windowSize, top, tc.top)
+		}
+	}
+
+	if _, err := a.TopN(3, 90*time.Second); !errors.Is(err, ErrWindowSize) {
+		t.Fatalf("top 3 over 1m30s: %v, expected ErrWindowSize", err)
+	}
+}
+
+func TestProcessorSlotTimeout(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithMaxConcurrentProcessors(1))
+	defer a.Close()
+
+	// the only slot is taken
+	if err := a.acquireProcessor(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := a.ProcessEventWithTimeout(ctx, eventAt(clock, 1, 1)); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("waiting for a slot: %v, expected ErrLockTimeout", err)
+	}
+
+	a.releaseProcessor()
+	if err := a.ProcessEventWithTimeout(context.Background(), eventAt(clock, 1, 1)); err != nil {
+		t.Fatalf("with the slot free: %v", err)
+	}
+	if w := onlyWindow(t, a, 1); w.Events != 1 {
+		t.Fatalf("%d events processed, expected only the one that got a slot", w.Events)
+	}
+}
+
+// events from every CPU, with 1, 10 and 100 processors at once at most, and no limit
+func BenchmarkMaxConcurrentProcessors(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 0} {
+		name := fmt.Sprint(n)
+		if n == 0 {
+			name = "unlimited"
+		}
+		b.Run(name, func(b *testing.B) {
+			clock := newFakeClock()
+			a := NewAggregator(time.Minute, WithClock(clock), WithMaxConcurrentProcessors(n))
+			defer a.Close()
+
+			b.SetParallelism(100)
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					a.ProcessEvent(eventAt(clock, i%100+1, 1))
+				}
+			})
+		})
+	}
+}
+
+func TestPruningInterval(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		windowSize time.Duration
+		opts       []Option
+		interval   time.Duration
+	}{
+		// memory is reclaimed every minute, not once a day
+		{"day windows", 24 * time.Hour, nil, time.Minute},
+		{"second windows", time.Second, nil, time.Second},
+		{"set", time.Second, []Option{WithPruning(5*time.Minute, 0)}, 5 * time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			a := NewAggregator(tc.windowSize, append(tc.opts, WithClock(clock))...)
+			defer a.Close()
+			if intervals := clock.intervals(); len(intervals) != 1 || intervals[0] != tc.interval {
+				t.Fatalf("tickers at %v, expected one at %s", intervals, tc.interval)
+			}
+		})
+	}
+
+	for _, interval := range []time.Duration{-time.Minute, 2 * time.Hour} {
+		if _, err := newAggregator(time.Minute, WithRetention(time.Hour), WithPruning(interval, 0)); err == nil {
+			t.Fatalf("aggregator pruning every %s with an hour of retention, expected an error", interval)
+		}
+	}
+}
+
+func TestPruningOnEveryTick(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(24*time.Hour, WithClock(clock), WithRetention(time.Hour))
+	defer a.Close()
+	sendEvents(a, clock, 1, 1)
+
+	// the day's window ends after 24h, an hour later it is past the retention period
+	for _, tc := range []struct {
+		advance time.Duration
+		windows int
+	}{
+		{24 * time.Hour, 1},
+		{59 * time.Minute, 1},
+		{time.Minute, 0},
+	} {
+		clock.Advance(tc.advance)
+		// the ticker takes the second tick once it is done with the first
+		clock.Tick()
+		clock.Tick()
+		if windows := a.GetUserAggregates(1); len(windows) != tc.windows {
+			t.Fatalf("%d windows at %s, expected %d", len(windows), clock.Now().Sub(testStart), tc.windows)
+		}
+	}
+}
+
+func TestPruningInBoundedPasses(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithRetention(time.Hour), WithPruning(time.Minute, 2))
+	defer a.Close()
+	for userID := range 5 {
+		sendEvents(a, clock, userID, 1)
+	}
+	clock.Advance(2 * time.Hour)
+
+	// each pass removes at most 2 windows
+	for _, expected := range []int{2, 2, 1, 0} {
+		a.mu.Lock()
+		pruned := a.pruneWindows(a.maxPrunePerPass)
+		a.mu.Unlock()
+		if pruned != expected {
+			t.Fatalf("pass pruned %d windows, expected %d", pruned, expected)
+		}
+	}
+	if s := a.Stats(); s.WindowsExpired != 5 {
+		t.Fatalf("%d windows expired, expected 5", s.WindowsExpired)
+	}
+
+	// an advance keeps going until the backlog is gone, dropping the users left without windows
+	for userID := range 5 {
+		a.ProcessEvent(eventAt(clock, userID, 1))
+	}
+	clock.Advance(2 * time.Hour)
+	a.advanceWindows()
+	a.mu.RLock()
+	users := len(a.userWindows)
+	a.mu.RUnlock()
+	if s := a.Stats(); s.WindowsExpired != 10 || users != 0 {
+		t.Fatalf("%d windows expired and %d users left, expected 10 and none", s.WindowsExpired, users)
+	}
+}
+
+func TestPruningInPlaceLeavesCopiesAlone(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithRetention(time.Hour))
+	defer a.Close()
+	for range 3 {
+		sendEvents(a, clock, 1, 1)
+		clock.Advance(30 * time.Minute)
+	}
+	before := a.GetUserAggregates(1)
+	a.mu.RLock()
+	backing := a.userWindows[1][:3]
+	a.mu.RUnlock()
+
+	// the first window is past the retention period
+	a.advanceWindows()
+	after := a.GetUserAggregates(1)
+	if len(after) != 2 || !after[0].StartTime.Equal(before[1].StartTime) {
+		t.Fatalf("windows starting at %v after pruning, expected the last 2 of %v", startTimes(after), startTimes(before))
+	}
+	// what a query handed out before is a copy, the windows moved up underneath without touching it
+	for i, start := range []time.Duration{0, 30 * time.Minute, time.Hour} {
+		if !before[i].StartTime.Equal(testStart.Add(start)) || before[i].Value != 1 {
+			t.Fatalf("copy taken before pruning changed to %+v", before)
+		}
+	}
+
+	// the backing array is reused, the slot left behind is cleared so it doesn't hold on to a window
+	a.mu.RLock()
+	reused := &a.userWindows[1][0] == &backing[0]
+	a.mu.RUnlock()
+	if !reused || !backing[0].StartTime.Equal(before[1].StartTime) || !backing[2].StartTime.IsZero() {
+		t.Fatalf("backing array reused: %v, holding windows starting at %v", reused, startTimes(backing))
+	}
+}
+
+// the start times of the windows
+func startTimes(windows []Window) []time.Time {
+	var starts []time.Time
+	for _, w := range windows {
+		starts = append(starts, w.StartTime)
+	}
+	return starts
+}
+
+func TestPruningDoesntAllocate(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithRetention(time.Hour))
+	defer a.Close()
+	for range 60 {
+		for userID := 1; userID <= 100; userID++ {
+			a.ProcessEvent(eventAt(clock, userID, 1))
+		}
+		clock.Advance(time.Minute)
+	}
+
+	// a window of every user expires each minute, the rest move up in place
+	allocs := testing.AllocsPerRun(20, func() {
+		clock.Advance(time.Minute)
+		a.mu.Lock()
+		a.pruneWindows(0)
+		a.mu.Unlock()
+	})
+	if allocs != 0 || a.Stats().WindowsExpired != 2100 {
+		t.Fatalf("%g allocations per pass pruning %d windows, expected none pruning 2100", allocs,
+			a.Stats().WindowsExpired)
+	}
+}
+
+// 100 users keeping an hour of minute windows, each round opens a window per user and prunes the oldest
+func BenchmarkPruneWindows(b *testing.B) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithRetention(time.Hour))
+	defer a.Close()
+	round := func() {
+		clock.Advance(time.Minute)
+		for userID := 1; userID <= 100; userID++ {
+			a.ProcessEvent(eventAt(clock, userID, 1))
+		}
+		a.mu.Lock()
+		a.pruneWindows(0)
+		a.mu.Unlock()
+	}
+	for range 60 {
+		round()
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		round()
+	}
+}
+
+// a user's hour of minute windows read by copy, and through the callback
+func BenchmarkReadUserAggregates(b *testing.B) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+	for range 60 {
+		sendEvents(a, clock, 1, 1)
+		clock.Advance(time.Minute)
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			a.GetUserAggregates(1)
+		}
+	})
+	b.Run("callback", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			a.ReadUserAggregates(1, func([]Window) {})
+		}
+	})
+}
+
+// fails unless CurrentValue gives the user's latest window as the locked queries see it
+func expectCurrentValue(t *testing.T, a *Aggregator, userID int) {
+	t.Helper()
+	windows := a.GetUserAggregates(userID)
+	current, ok := a.CurrentValue(userID)
+	latest := windows[len(windows)-1]
+	if !ok || current.StartTime != latest.StartTime || current.Value != latest.Value ||
+		current.Events != latest.Events || current.Version != latest.Version {
+		t.Fatalf("current value %+v (ok: %v), expected the latest window %+v", current, ok, latest)
+	}
+}
+
+func TestCurrentValueMatchesTheLockedState(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+	if _, ok := a.CurrentValue(1); ok {
+		t.Fatal("current value of a user without events")
+	}
+
+	// writers racing a lock-free reader, which never sees a window going back
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() { sendEvents(a, clock, 1, 1000) })
+	}
+	var last Window
+	for range 1000 {
+		if current, ok := a.CurrentValue(1); ok {
+			if current.Version < last.Version || current.Events < last.Events {
+				t.Fatalf("current value went from %+v back to %+v", last, current)
+			}
+			last = current
+		}
+	}
+	wg.Wait()
+	expectCurrentValue(t, a, 1)
+
+	// a late event changes an older window, the current one stays the latest
+	clock.Advance(time.Minute)
+	if _, ok := a.CurrentValue(1); ok {
+		t.Fatal("current value of a user without events in the new window")
+	}
+	sendEvents(a, clock, 1, 2)
+	a.ProcessEvent(Event{UserID: 1, Timestamp: testStart, Value: 5})
+	if current, _ := a.CurrentValue(1); current.Value != 2 || !current.StartTime.Equal(clock.Now()) {
+		t.Fatalf("current value %+v after a late event, expected the new window with 2", current)
+	}
+
+	// a merge publishes what it changed
+	other := NewAggregator(time.Minute, WithClock(clock))
+	defer other.Close()
+	sendEvents(other, clock, 1, 3)
+	if err := a.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	expectCurrentValue(t, a, 1)
+}
+
+func TestCurrentValueIgnoresSkewedTimestamps(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+
+	// a client clock a year ahead doesn't take over the user's current window
+	a.ProcessEvent(Event{UserID: 1, Timestamp: clock.Now().AddDate(1, 0, 0), Value: 100})
+	if current, ok := a.CurrentValue(1); ok {
+		t.Fatalf("current value %+v after an event dated a year ahead", current)
+	}
+	sendEvents(a, clock, 1, 2)
+	if current, ok := a.CurrentValue(1); !ok || current.Value != 2 || !current.StartTime.Equal(clock.Now()) {
+		t.Fatalf("current value %+v (ok: %v), expected the current window with 2", current, ok)
+	}
+
+	// nor does it hold back the windows that follow
+	clock.Advance(time.Minute)
+	sendEvents(a, clock, 1, 3)
+	if current, ok := a.CurrentValue(1); !ok || current.Value != 3 || !current.StartTime.Equal(clock.Now()) {
+		t.Fatalf("current value %+v (ok: %v), expected the next window with 3", current, ok)
+	}
+}
+
+func TestCurrentValueAllocations(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock))
+	defer a.Close()
+	event := eventAt(clock, 1, 1)
+	a.ProcessEvent(event)
+
+	// readers may still hold the previous copy, every event publishes a new one
+	if allocs := testing.AllocsPerRun(100, func() { a.ProcessEvent(event) }); allocs != 1 {
+		t.Fatalf("%g allocations per event, expected the published copy only", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { a.CurrentValue(1) }); allocs != 0 {
+		t.Fatalf("%g allocations per CurrentValue, expected none", allocs)
+	}
+}
+
+// reading the current value of 100 users from every CPU while an event comes in for every 10 reads, lock-free and
+// through the lock. On the real clock, a fakeClock's mutex would be the bottleneck of both.
+func BenchmarkCurrentValue(b *testing.B) {
+	for _, mode := range []string{"lock-free", "locked"} {
+		b.Run(mode, func(b *testing.B) {
+			a := NewAggregator(time.Hour)
+			defer a.Close()
+			for userID := 1; userID <= 100; userID++ {
+				a.ProcessEvent(Event{UserID: userID, Value: 1})
+			}
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					userID := i%100 + 1
+					switch {
+					case i%10 == 0:
+						a.ProcessEvent(Event{UserID: userID, Value: 1})
+					case mode == "lock-free":
+						a.CurrentValue(userID)
+					default:
+						a.ReadUserAggregates(userID, func([]Window) {})
+					}
+				}
+			})
+		})
+	}
+}
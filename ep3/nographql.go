@@ -0,0 +1,10 @@
+//go:build !graphql
+
+package main
+
+import "net/http"
+
+// built without the graphql tag there is no /graphql, see graphql.go
+func mountGraphQL(mux *http.ServeMux, a *Aggregator) error {
+	return nil
+}
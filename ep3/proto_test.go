@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// a window with every encoded field set
+func fullWindow() Window {
+	return Window{
+		StartTime: testStart,
+		EndTime:   testStart.Add(time.Minute),
+		Value:     -42,
+		Version:   7,
+		Events:    1000,
+		Throttled: 3,
+	}
+}
+
+// checks the window comes back from the wire as it went in
+func roundTrip(t *testing.T, in Window) Window {
+	t.Helper()
+	data, err := in.MarshalProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Window
+	if err := out.UnmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if !out.StartTime.Equal(in.StartTime) || !out.EndTime.Equal(in.EndTime) || out.Value != in.Value ||
+		out.Version != in.Version || out.Events != in.Events || out.Throttled != in.Throttled {
+		t.Fatalf("%+v came back as %+v", in, out)
+	}
+	return out
+}
+
+func TestWindowProtoRoundTrip(t *testing.T) {
+	roundTrip(t, fullWindow())
+
+	// nothing set encodes to nothing, and the times stay zero rather than turning into 1754
+	out := roundTrip(t, Window{})
+	if !out.StartTime.IsZero() || !out.EndTime.IsZero() {
+		t.Fatalf("zero times came back as %s and %s", out.StartTime, out.EndTime)
+	}
+	if data, _ := (&Window{}).MarshalProto(); len(data) != 0 {
+		t.Fatalf("an empty window took %d bytes", len(data))
+	}
+}
+
+func TestWindowProtoSkipsUnknownFields(t *testing.T) {
+	w := fullWindow()
+	data, _ := w.MarshalProto()
+	// a newer writer's field 9 (bytes) and field 10 (fixed32)
+	data = binary.AppendUvarint(data, 9<<3|wireBytes)
+	data = binary.AppendUvarint(data, 3)
+	data = append(data, "new"...)
+	data = binary.AppendUvarint(data, 10<<3|wireFixed32)
+	data = append(data, 1, 2, 3, 4)
+
+	var out Window
+	if err := out.UnmarshalProto(data); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != w.Value || !out.EndTime.Equal(w.EndTime) {
+		t.Fatalf("%+v read as %+v", w, out)
+	}
+}
+
+func TestWindowProtoTruncated(t *testing.T) {
+	w := fullWindow()
+	data, _ := w.MarshalProto()
+	for n := 1; n < len(data); n++ {
+		var out Window
+		// cut inside a varint is an error, cut between fields is a shorter (valid) message
+		if err := out.UnmarshalProto(data[:n]); err != nil && !errors.Is(err, errTruncated) {
+			t.Fatalf("cut at %d: %v", n, err)
+		}
+	}
+	var out Window
+	if err := out.UnmarshalProto(data[:len(data)-1]); !errors.Is(err, errTruncated) {
+		t.Fatalf("cut in the last varint: %v, expected errTruncated", err)
+	}
+}
+
+// the fields of a Window with a fixed size, the way encoding/binary writes structs
+type binaryWindow struct {
+	StartTime, EndTime int64
+	Value              int64
+	Version            uint64
+	Events, Throttled  int64
+}
+
+func BenchmarkWindowProto(b *testing.B) {
+	w := fullWindow()
+	var size int
+	for b.Loop() {
+		data, _ := w.MarshalProto()
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkWindowJSON(b *testing.B) {
+	w := fullWindow()
+	var size int
+	for b.Loop() {
+		data, _ := json.Marshal(w)
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkWindowBinary(b *testing.B) {
+	w := fullWindow()
+	var size int
+	for b.Loop() {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, binaryWindow{
+			StartTime: w.StartTime.UnixNano(), EndTime: w.EndTime.UnixNano(), Value: int64(w.Value),
+			Version: w.Version, Events: int64(w.Events), Throttled: int64(w.Throttled),
+		})
+		size = buf.Len()
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
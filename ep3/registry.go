@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**
+One analytics service often serves several products (tenants) that want different things: one aggregates per
+minute and keeps an hour, another aggregates per hour and keeps a day. Running a process per tenant is wasteful,
+so the Registry keeps one Aggregator per tenant, created the first time the tenant is used.
+
+Tenants never share windows, so a query for a user in tenant A can't see events sent for the same user ID in tenant B.
+What they do share is the infrastructure handed to the registry, like the clock.
+*/
+
+// returned for tenants the registry has no config for
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// returned for tenants whose config the aggregator can't be created with
+var ErrInvalidTenantConfig = errors.New("invalid config for tenant")
+
+// returned once the registry has been closed
+var ErrRegistryClosed = errors.New("registry is closed")
+
+// settings of a single tenant's aggregator
+type TenantConfig struct {
+	WindowSize time.Duration
+	// how long windows are kept, 0 means the default retention
+	Retention time.Duration
+	// any other aggregator options (group-by, digests, callbacks...)
+	Options []Option
+}
+
+// manages one Aggregator per tenant
+type Registry struct {
+	mu          sync.Mutex
+	configs     map[string]TenantConfig
+	aggregators map[string]*Aggregator
+	clock       Clock
+	closed      bool
+}
+
+// creates a registry for the given tenants, all of them sharing the clock (nil means the real clock)
+func NewRegistry(configs map[string]TenantConfig, clock Clock) *Registry {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &Registry{
+		configs:     configs,
+		aggregators: make(map[string]*Aggregator),
+		clock:       clock,
+	}
+}
+
+// returns the tenant's aggregator, creating it on first use. A tenant whose config doesn't make sense (e.g a window
+// size of 0) gets an error rather than taking the whole service down.
+func (r *Registry) Aggregator(tenant string) (*Aggregator, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	if aggr, exists := r.aggregators[tenant]; exists {
+		return aggr, nil
+	}
+
+	cfg, exists := r.configs[tenant]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTenant, tenant)
+	}
+
+	opts := []Option{WithClock(r.clock)}
+	if cfg.Retention > 0 {
+		opts = append(opts, WithRetention(cfg.Retention))
+	}
+	// the tenant's own options go last so they win over the shared ones
+	opts = append(opts, cfg.Options...)
+
+	aggr, err := newAggregator(cfg.WindowSize, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %w", ErrInvalidTenantConfig, tenant, err)
+	}
+	r.aggregators[tenant] = aggr
+	return aggr, nil
+}
+
+// lists the tenants the registry knows about
+func (r *Registry) Tenants() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenants := make([]string, 0, len(r.configs))
+	for tenant := range r.configs {
+		tenants = append(tenants, tenant)
+	}
+	return tenants
+}
+
+// closes (and so flushes) every tenant's aggregator, the registry can't be used afterwards
+func (r *Registry) Close() {
+	r.mu.Lock()
+	r.closed = true
+	aggregators := r.aggregators
+	r.aggregators = make(map[string]*Aggregator)
+	r.mu.Unlock()
+
+	for _, aggr := range aggregators {
+		aggr.Close()
+	}
+}
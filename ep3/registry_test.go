@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryKeepsTenantsApart(t *testing.T) {
+	clock := newFakeClock()
+	reg := NewRegistry(map[string]TenantConfig{
+		"shop":    {WindowSize: time.Minute},
+		"billing": {WindowSize: time.Hour},
+	}, clock)
+	defer reg.Close()
+
+	shop, err := reg.Aggregator("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := reg.Aggregator("shop"); again != shop {
+		t.Fatal("a tenant's second use created another aggregator")
+	}
+	billing, err := reg.Aggregator("billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shop.ProcessEvent(eventAt(clock, 1, 2))
+	if windows := billing.GetUserAggregates(1); len(windows) != 0 {
+		t.Fatalf("billing sees the shop's events: %+v", windows)
+	}
+	windows := shop.GetUserAggregates(1)
+	if len(windows) != 1 || windows[0].EndTime.Sub(windows[0].StartTime) != time.Minute {
+		t.Fatalf("shop: %+v, expected a minute window", windows)
+	}
+}
+
+func TestRegistryRefusesBadTenants(t *testing.T) {
+	reg := NewRegistry(map[string]TenantConfig{
+		"no-window": {WindowSize: 0},
+		// pruning less often than windows are dropped
+		"bad-pruning": {WindowSize: time.Minute, Retention: time.Minute, Options: []Option{WithPruning(time.Hour, 0)}},
+	}, newFakeClock())
+	defer reg.Close()
+
+	if _, err := reg.Aggregator("games"); !errors.Is(err, ErrUnknownTenant) {
+		t.Fatalf("unknown tenant: %v, expected ErrUnknownTenant", err)
+	}
+	for _, tenant := range []string{"no-window", "bad-pruning"} {
+		if _, err := reg.Aggregator(tenant); !errors.Is(err, ErrInvalidTenantConfig) {
+			t.Fatalf("%s: %v, expected ErrInvalidTenantConfig", tenant, err)
+		}
+	}
+
+	reg.Close()
+	if _, err := reg.Aggregator("no-window"); !errors.Is(err, ErrRegistryClosed) {
+		t.Fatalf("closed registry: %v, expected ErrRegistryClosed", err)
+	}
+}
+
+func TestRegistryTenantsRunConcurrently(t *testing.T) {
+	clock := newFakeClock()
+	sizes := map[string]time.Duration{"shop": time.Minute, "billing": time.Hour}
+	reg := NewRegistry(map[string]TenantConfig{
+		"shop":    {WindowSize: sizes["shop"]},
+		"billing": {WindowSize: sizes["billing"]},
+	}, clock)
+	defer reg.Close()
+
+	// every tenant's events come from 4 goroutines, and the tenant is looked up (created) concurrently too.
+	// shop events are worth 1, billing events 100, so a single misrouted event shows.
+	values := map[string]int{"shop": 1, "billing": 100}
+	const perGoroutine = 250
+	var wg sync.WaitGroup
+	for tenant := range sizes {
+		for range 4 {
+			wg.Go(func() {
+				a, err := reg.Aggregator(tenant)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for range perGoroutine {
+					a.ProcessEvent(eventAt(clock, 1, values[tenant]))
+				}
+			})
+		}
+	}
+	wg.Wait()
+
+	for tenant, size := range sizes {
+		a, _ := reg.Aggregator(tenant)
+		w := onlyWindow(t, a, 1)
+		if w.Events != 4*perGoroutine || w.Value != 4*perGoroutine*values[tenant] {
+			t.Fatalf("%s: %d events worth %d, expected %d worth %d", tenant, w.Events, w.Value,
+				4*perGoroutine, 4*perGoroutine*values[tenant])
+		}
+		if w.EndTime.Sub(w.StartTime) != size {
+			t.Fatalf("%s: window of %s, expected %s", tenant, w.EndTime.Sub(w.StartTime), size)
+		}
+	}
+}
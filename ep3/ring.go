@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/**
+A single Aggregator lives in a single process. Spread over several nodes, each node should own a share of the users, so
+every event of a user lands on the same node and no window has to be merged across nodes.
+
+Sharding with userID % nodes moves almost every user when a node joins or leaves, and each moved user's windows are
+rebuilt from scratch on the new node. The ConsistentHashRing puts every node on a ring at several points (its virtual
+nodes) and gives a user to the first node point following the user's hash. Adding a node only takes over the users
+right before its points, about 1/n of them, and removing one hands its users to the next points along, the others
+don't move.
+
+Virtual nodes keep the shares even: with a single point per node, the gaps between points (and so the load) vary
+wildly. SHA-256 spreads the points and users evenly, and unlike a seeded hash it places them the same on every node, so
+all of them agree on the owners without talking to each other.
+*/
+
+// the default number of points per node on the ring
+const defaultVirtualNodes = 100
+
+// maps users to the node owning them, see above. Safe for concurrent use.
+type ConsistentHashRing struct {
+	mu sync.RWMutex
+	// points per node
+	virtualNodes int
+	// hashes of all the points, sorted
+	points []uint64
+	// node owning each point
+	owners map[uint64]string
+	nodes  map[string]bool
+}
+
+// creates an empty ring placing every node at virtualNodes points (0 means the default of 100)
+func NewConsistentHashRing(virtualNodes int) *ConsistentHashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	return &ConsistentHashRing{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint64]string),
+		nodes:        make(map[string]bool),
+	}
+}
+
+// the position of a key on the ring
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// adds a node to the ring, adding a node that is already there changes nothing
+func (r *ConsistentHashRing) AddNode(nodeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[nodeID] {
+		return
+	}
+	r.nodes[nodeID] = true
+	for i := range r.virtualNodes {
+		point := ringHash(nodeID + "#" + strconv.Itoa(i))
+		// two points colliding on 64 bits is next to impossible, the first node keeps it
+		if _, taken := r.owners[point]; taken {
+			continue
+		}
+		r.owners[point] = nodeID
+		r.points = append(r.points, point)
+	}
+	slices.Sort(r.points)
+}
+
+// removes a node from the ring, its users go to the nodes following its points
+func (r *ConsistentHashRing) RemoveNode(nodeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[nodeID] {
+		return
+	}
+	delete(r.nodes, nodeID)
+	r.points = slices.DeleteFunc(r.points, func(point uint64) bool {
+		if r.owners[point] != nodeID {
+			return false
+		}
+		delete(r.owners, point)
+		return true
+	})
+}
+
+// the node owning the user, "" if the ring is empty
+func (r *ConsistentHashRing) OwnerOf(userID int) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(strconv.Itoa(userID))
+	// the first point at or after the user's hash, wrapping around past the last one
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// the nodes on the ring, sorted
+func (r *ConsistentHashRing) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
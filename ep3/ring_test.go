@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// the owner of every user
+func ownersOf(ring *ConsistentHashRing, users int) map[int]string {
+	owners := make(map[int]string, users)
+	for userID := range users {
+		owners[userID] = ring.OwnerOf(userID)
+	}
+	return owners
+}
+
+// how many users changed owners, and how many each node owns now
+func compareOwners(before, after map[int]string) (moved int, load map[string]int) {
+	load = make(map[string]int)
+	for userID, owner := range after {
+		if before[userID] != owner {
+			moved++
+		}
+		load[owner]++
+	}
+	return moved, load
+}
+
+// fails the test unless every node owns its share of the users, within 30%
+func checkBalanced(t *testing.T, load map[string]int, users int) {
+	t.Helper()
+	share := users / len(load)
+	for node, owned := range load {
+		if owned < share*7/10 || owned > share*13/10 {
+			t.Fatalf("%s owns %d of %d users, expected about %d: %v", node, owned, users, share, load)
+		}
+	}
+}
+
+func TestRingMovesFewUsers(t *testing.T) {
+	const users = 10_000
+	ring := NewConsistentHashRing(0)
+	for _, node := range []string{"node-1", "node-2", "node-3"} {
+		ring.AddNode(node)
+	}
+	initial := ownersOf(ring, users)
+	_, load := compareOwners(initial, initial)
+	checkBalanced(t, load, users)
+
+	// the new node takes about a quarter of the users, all of them from the others
+	ring.AddNode("node-4")
+	grown := ownersOf(ring, users)
+	moved, load := compareOwners(initial, grown)
+	if moved > users*35/100 {
+		t.Fatalf("adding a fourth node moved %d of %d users, expected about a quarter", moved, users)
+	}
+	for userID, owner := range grown {
+		if owner != initial[userID] && owner != "node-4" {
+			t.Fatalf("user %d moved from %s to %s when node-4 joined", userID, initial[userID], owner)
+		}
+	}
+	checkBalanced(t, load, users)
+
+	// only node-2's users move when it leaves
+	ring.RemoveNode("node-2")
+	shrunk := ownersOf(ring, users)
+	for userID, owner := range shrunk {
+		if grown[userID] != "node-2" && owner != grown[userID] {
+			t.Fatalf("user %d of %s moved to %s when node-2 left", userID, grown[userID], owner)
+		}
+		if owner == "node-2" {
+			t.Fatalf("user %d still owned by node-2 after it left", userID)
+		}
+	}
+	_, load = compareOwners(grown, shrunk)
+	checkBalanced(t, load, users)
+}
+
+func TestRingOwnersAreStable(t *testing.T) {
+	// nodes placed the same whatever the order they joined in, so every node agrees on the owners
+	first, second := NewConsistentHashRing(0), NewConsistentHashRing(0)
+	for i := 1; i <= 5; i++ {
+		first.AddNode(fmt.Sprintf("node-%d", i))
+		second.AddNode(fmt.Sprintf("node-%d", 6-i))
+	}
+	for userID := range 1000 {
+		if a, b := first.OwnerOf(userID), second.OwnerOf(userID); a != b {
+			t.Fatalf("user %d owned by %s on one ring and %s on the other", userID, a, b)
+		}
+	}
+
+	if owner := NewConsistentHashRing(0).OwnerOf(1); owner != "" {
+		t.Fatalf("an empty ring gave user 1 to %q", owner)
+	}
+}
@@ -0,0 +1,132 @@
+//go:build !(js && wasm)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runs the aggregator as a server, the browser build has a main of its own (see wasm.go)
+func main() {
+	windowSize := time.Hour
+
+	// export every closed window to a file exactly once, even across restarts
+	sink, err := NewJSONLinesSink("closed_windows.jsonl")
+	if err != nil {
+		fmt.Printf("Opening the export file failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer sink.Close()
+	exporter, err := NewExporter(sink, "closed_windows.checkpoint", 100, 10*time.Second)
+	if err != nil {
+		fmt.Printf("Starting the exporter failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer exporter.Close(context.Background())
+
+	// break activity down per country, keeping at most 5 countries per user,
+	// and keep a digest of event values for percentiles
+	options := []Option{
+		WithGroupBy("country", 5),
+		WithDigest(0, 0),
+		WithWindowCloseCallback(func(userID int, window Window) {
+			fmt.Printf("User %d window %s closed with value %d\n", userID, window.StartTime.Format(time.RFC822), window.Value)
+		}),
+		WithWindowCloseCallback(exporter.OnWindowClose),
+		WithMaxConcurrentProcessors(100),
+	}
+	// closed windows as InfluxDB line protocol too, for Telegraf to tail (see influx.go)
+	if path := os.Getenv("INFLUX_LINES_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Printf("Opening the line protocol file failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		options = append(options, WithWindowCloseCallback(InfluxDBExporter(file)))
+	}
+	aggregator := NewAggregator(windowSize, options...)
+	defer aggregator.Close()
+
+	// serve the aggregates (and take events) over HTTP, see api.go
+	addr := os.Getenv("API_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	// products with windows of their own, under /tenants/{tenant} (see registry.go)
+	registry := NewRegistry(map[string]TenantConfig{
+		"shop":    {WindowSize: time.Minute, Retention: time.Hour},
+		"billing": {WindowSize: time.Hour, Retention: 24 * time.Hour},
+	}, nil)
+	defer registry.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/", NewAPIHandler(aggregator))
+	mux.Handle("/tenants/", NewTenantAPIHandler(registry))
+	// and a GraphQL API for dashboards, when built with the graphql tag (see graphql.go)
+	if err := mountGraphQL(mux, aggregator); err != nil {
+		fmt.Printf("Building the GraphQL schema failed: %v\n", err)
+		os.Exit(1)
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("API server failed: %v\n", err)
+		}
+	}()
+
+	// replay recorded events (one JSON event per line) if a file is given
+	if len(os.Args) > 1 {
+		go func() {
+			if err := aggregator.Run(context.Background(), &FileReplaySource{Path: os.Args[1]}); err != nil {
+				fmt.Printf("Replaying %s failed: %v\n", os.Args[1], err)
+			}
+		}()
+	}
+
+	// simulate  events for some set of users
+	go func() {
+		users := []int{1, 2, 3}
+		countries := []string{"NG", "GH", "KE", ""}
+		for i := 0; ; i++ {
+			for _, userID := range users {
+				event := Event{
+					UserID:    userID,
+					Timestamp: time.Now(),
+					Value:     1,
+					Labels:    map[string]string{"country": countries[(i+userID)%len(countries)]},
+				}
+				aggregator.ProcessEvent(event)
+			}
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	// simulate requests for aggregates for one of the users above, only fetching what changed since the last poll
+	go func() {
+		var cursor Cursor
+		for {
+			time.Sleep(30 * time.Second)
+			userID := 1
+			var aggregates []Window
+			aggregates, cursor = aggregator.GetUserAggregatesSince(userID, cursor)
+			fmt.Printf("User %d aggregates changed since last poll:\n", userID)
+			for _, window := range aggregates {
+				fmt.Printf("Window %s - %s: Value = %d\n",
+					window.StartTime.Format(time.RFC822),
+					window.EndTime.Format(time.RFC822),
+					window.Value)
+				p50, _ := aggregator.Quantile(userID, window.StartTime, 0.5)
+				p99, _ := aggregator.Quantile(userID, window.StartTime, 0.99)
+				fmt.Printf("Window %s: p50 = %.1f, p99 = %.1f\n", window.StartTime.Format(time.RFC822), p50, p99)
+			}
+			for _, breakdown := range aggregator.GetUserBreakdown(userID) {
+				fmt.Printf("Window %s breakdown: %v\n", breakdown.StartTime.Format(time.RFC822), breakdown.Groups)
+			}
+		}
+	}()
+
+	select {}
+}
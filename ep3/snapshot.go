@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+/**
+Querying 10 users in a loop takes the lock 10 times, and windows can be advanced (closed, pruned) in between,
+so some users' data could be from before the advance and some from after. A snapshot copies every window under
+a single lock, giving a consistent view across users.
+
+The snapshot is never modified after it's taken, so it can be queried from any number of goroutines without locking.
+Copying everything isn't free though, it's meant for consistent reports, not for every single query.
+*/
+
+// a consistent, read-only copy of all of an aggregator's windows
+type AggregatorSnapshot struct {
+	// when the snapshot was taken
+	TakenAt     time.Time
+	userWindows map[int][]Window
+}
+
+// copies every user's windows under one lock
+func (a *Aggregator) Snapshot() AggregatorSnapshot {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	userWindows := make(map[int][]Window, len(a.userWindows))
+	for userID, windows := range a.userWindows {
+		copied := make([]Window, len(windows))
+		for i, window := range windows {
+			copied[i] = window.clone()
+		}
+		userWindows[userID] = copied
+	}
+
+	return AggregatorSnapshot{
+		TakenAt:     a.clock.Now(),
+		userWindows: userWindows,
+	}
+}
+
+// lists the users in the snapshot, in ascending order
+func (s AggregatorSnapshot) Users() []int {
+	users := make([]int, 0, len(s.userWindows))
+	for userID := range s.userWindows {
+		users = append(users, userID)
+	}
+	sort.Ints(users)
+	return users
+}
+
+// same as Aggregator.GetUserAggregates, as of the snapshot
+func (s AggregatorSnapshot) GetUserAggregates(userID int) []Window {
+	return copyWindows(s.userWindows[userID])
+}
+
+// same as Aggregator.GetUserBreakdown, as of the snapshot
+func (s AggregatorSnapshot) GetUserBreakdown(userID int) []WindowBreakdown {
+	return breakdownOf(s.userWindows[userID])
+}
+
+// same as Aggregator.GetUserAggregatesSince, as of the snapshot
+func (s AggregatorSnapshot) GetUserAggregatesSince(userID int, cursor Cursor) ([]Window, Cursor) {
+	return windowsSince(s.userWindows[userID], cursor)
+}
+
+// same as Aggregator.Quantile, as of the snapshot
+func (s AggregatorSnapshot) Quantile(userID int, windowStart time.Time, q float64) (float64, bool) {
+	return quantileOf(s.userWindows[userID], windowStart, q)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+/**
+In reality events don't come from a goroutine in main, they come from a stream (Kafka, a socket, a file...).
+A Source hides where they come from, Run takes care of the rest:
+
+- batching: taking the lock once per event is wasteful at high rates, so events are buffered and handed to
+  ProcessEvents every N events or every T, whichever comes first.
+- reconnecting: a source that fails to connect is retried with exponential backoff. When its channel closes the stream
+  ended, and Run asks the source for a new one: right away if events came through, after the same backoff if none
+  did, or a source closing empty streams (or failing on its first event every time) would be asked again and again in
+  a busy loop. A source with nothing more to give returns io.EOF.
+- failing streams: a channel can't carry an error, a FailingSource tells through Err why its stream ended early (a
+  read failing half way, a line too long to scan), and Run logs it.
+- stopping: cancelling ctx flushes what is buffered and returns.
+*/
+
+// produces events for the aggregator. The channel is closed when the stream ends, Events returns io.EOF once the
+// source is exhausted for good.
+type Source interface {
+	Events(ctx context.Context) (<-chan Event, error)
+}
+
+// a Source whose stream can end because of an error rather than because it was over, see above
+type FailingSource interface {
+	Source
+	// why the last channel returned by Events was closed, nil if its stream just ended
+	Err() error
+}
+
+const (
+	// defaults for batching events consumed by Run
+	defaultIngestBatchSize     = 100
+	defaultIngestBatchInterval = 100 * time.Millisecond
+
+	// bounds of the backoff between attempts to (re)connect to a source
+	minSourceBackoff = 100 * time.Millisecond
+	maxSourceBackoff = 10 * time.Second
+)
+
+// sets how Run batches events: a batch is processed once it holds size events or interval has passed
+func WithIngestBatching(size int, interval time.Duration) Option {
+	return func(a *Aggregator) {
+		a.ingestBatchSize = size
+		a.ingestBatchInterval = interval
+	}
+}
+
+// consumes events from the source until it is exhausted (returns nil) or ctx is cancelled (returns ctx.Err())
+func (a *Aggregator) Run(ctx context.Context, src Source) error {
+	backoff := minSourceBackoff
+	for {
+		events, err := src.Events(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("event source failed: %v, reconnecting in %s", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff = min(backoff*2, maxSourceBackoff)
+			continue
+		}
+
+		consumed, err := a.consume(ctx, events)
+		if err != nil {
+			return err
+		}
+		if failing, ok := src.(FailingSource); ok && failing.Err() != nil {
+			log.Printf("event stream failed after %d events: %v", consumed, failing.Err())
+		}
+		// the source worked, the next failure starts backing off from scratch
+		if consumed > 0 {
+			backoff = minSourceBackoff
+			continue
+		}
+
+		// nothing came through, asking again right away would only spin
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxSourceBackoff)
+	}
+}
+
+// feeds the events into the aggregator in batches until the channel closes, returns how many events were consumed
+func (a *Aggregator) consume(ctx context.Context, events <-chan Event) (int, error) {
+	size := a.ingestBatchSize
+	if size <= 0 {
+		size = defaultIngestBatchSize
+	}
+	interval := a.ingestBatchInterval
+	if interval <= 0 {
+		interval = defaultIngestBatchInterval
+	}
+
+	ticker := a.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	consumed := 0
+	batch := make([]Event, 0, size)
+	flush := func() {
+		if len(batch) > 0 {
+			a.ProcessEvents(batch)
+			consumed += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return consumed, ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				flush()
+				return consumed, nil
+			}
+			batch = append(batch, event)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C():
+			flush()
+		}
+	}
+}
+
+// replays events from a file with one JSON encoded Event per line.
+// If reading fails half way, the next call to Events picks up after the last line delivered, and Err tells why.
+type FileReplaySource struct {
+	Path string
+	// lines already delivered
+	delivered int
+	exhausted bool
+	// why the last stream ended early, see Err
+	err error
+}
+
+// why the last channel returned by Events closed before the end of the file, e.g bufio.ErrTooLong for a line over
+// 64KB. nil if the whole file was replayed.
+func (s *FileReplaySource) Err() error {
+	return s.err
+}
+
+func (s *FileReplaySource) Events(ctx context.Context) (<-chan Event, error) {
+	if s.exhausted {
+		return nil, io.EOF
+	}
+
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.err = nil
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if line <= s.delivered {
+				continue
+			}
+
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				// a corrupt line won't get any better by retrying, skip it
+				log.Printf("%s:%d: skipping invalid event: %v", s.Path, line, err)
+				s.delivered = line
+				continue
+			}
+
+			select {
+			case events <- event:
+				s.delivered = line
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			s.err = fmt.Errorf("%s: reading events after line %d: %w", s.Path, line, err)
+			return
+		}
+		s.exhausted = true
+	}()
+
+	return events, nil
+}
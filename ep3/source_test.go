@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a Source closing an empty stream every time, until it has been asked streams times
+type emptySource struct {
+	streams int
+	asked   []time.Time
+}
+
+func (s *emptySource) Events(ctx context.Context) (<-chan Event, error) {
+	s.asked = append(s.asked, time.Now())
+	if len(s.asked) > s.streams {
+		return nil, io.EOF
+	}
+	events := make(chan Event)
+	close(events)
+	return events, nil
+}
+
+// writes the lines to a file in the test's directory
+func writeLines(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// the line of an event of the user at the clock's time
+func eventLine(t *testing.T, clock Clock, userID, value int) string {
+	t.Helper()
+	line, err := json.Marshal(eventAt(clock, userID, value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line)
+}
+
+func TestRunBacksOffOnEmptyStreams(t *testing.T) {
+	a := NewAggregator(time.Hour, WithClock(newFakeClock()))
+	defer a.Close()
+
+	src := &emptySource{streams: 3}
+	if err := a.Run(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+	// 100ms, 200ms and 400ms between the streams
+	wait := minSourceBackoff
+	for i := 1; i < len(src.asked); i++ {
+		if gap := src.asked[i].Sub(src.asked[i-1]); gap < wait {
+			t.Fatalf("stream %d asked for %s after an empty one, expected a backoff of %s", i+1, gap, wait)
+		}
+		wait *= 2
+	}
+}
+
+func TestRunStopsBackingOffWhenCancelled(t *testing.T) {
+	a := NewAggregator(time.Hour, WithClock(newFakeClock()))
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Run(ctx, &emptySource{streams: 1000}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run returned %v, expected the context's error", err)
+	}
+}
+
+func TestFileReplaySource(t *testing.T) {
+	// the invalid line is skipped, with a log line
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	clock := newFakeClock()
+	a := NewAggregator(time.Hour, WithClock(clock))
+	defer a.Close()
+
+	path := writeLines(t, eventLine(t, clock, 1, 2), "not an event", eventLine(t, clock, 1, 3), eventLine(t, clock, 2, 4))
+	src := &FileReplaySource{Path: path}
+	if err := a.Run(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Err(); err != nil {
+		t.Fatalf("the whole file was replayed, Err returned %v", err)
+	}
+	if windows := a.GetUserAggregates(1); len(windows) != 1 || windows[0].Value != 5 {
+		t.Fatalf("user 1: %+v, expected a window with 5", windows)
+	}
+	if windows := a.GetUserAggregates(2); len(windows) != 1 || windows[0].Value != 4 {
+		t.Fatalf("user 2: %+v, expected a window with 4", windows)
+	}
+}
+
+func TestFileReplaySourceSurfacesScanErrors(t *testing.T) {
+	clock := newFakeClock()
+	path := writeLines(t, eventLine(t, clock, 1, 2), strings.Repeat("x", bufio.MaxScanTokenSize+1))
+	src := &FileReplaySource{Path: path}
+
+	events, err := src.Events(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := 0
+	for range events {
+		delivered++
+	}
+	if delivered != 1 {
+		t.Fatalf("%d events delivered before the long line, expected 1", delivered)
+	}
+	if err := src.Err(); !errors.Is(err, bufio.ErrTooLong) {
+		t.Fatalf("Err returned %v, expected bufio.ErrTooLong", err)
+	}
+
+	// the next stream picks up after the event delivered, and fails on the same line
+	events, err = src.Events(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for event := range events {
+		t.Fatalf("event %+v delivered again", event)
+	}
+	if err := src.Err(); !errors.Is(err, bufio.ErrTooLong) {
+		t.Fatalf("Err returned %v on the second stream, expected bufio.ErrTooLong", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "sync/atomic"
+
+/**
+How many windows come and go, and how many events make it into one? Stats answers without taking the aggregator's
+lock: the counters are atomics bumped where things happen (under the lock, as it happens), so reading them never waits
+behind a batch of events or a pruning pass, and a monitoring loop polling Stats never slows down ingestion.
+
+The counters are read one after the other, so a snapshot taken while events flow in may be a few events off between
+fields. Fine for dashboards, not for accounting.
+*/
+
+// counters describing what the aggregator has done so far, see Aggregator.Stats
+type AggregatorStats struct {
+	WindowsCreated uint64
+	// windows pruned after the retention period
+	WindowsExpired  uint64
+	EventsProcessed uint64
+	// events too old to keep, arriving after their window closed with DropLateEvents, throttled by the ingest cap
+	// and not sampled, or finding the event buffer full
+	EventsDropped uint64
+}
+
+// the counters behind AggregatorStats, see above
+type aggregatorCounters struct {
+	windowsCreated  atomic.Uint64
+	windowsExpired  atomic.Uint64
+	eventsProcessed atomic.Uint64
+	eventsDropped   atomic.Uint64
+}
+
+// what the aggregator has done so far, readable at any time without blocking on the lock
+func (a *Aggregator) Stats() AggregatorStats {
+	return AggregatorStats{
+		WindowsCreated:  a.counters.windowsCreated.Load(),
+		WindowsExpired:  a.counters.windowsExpired.Load(),
+		EventsProcessed: a.counters.eventsProcessed.Load(),
+		EventsDropped:   a.counters.eventsDropped.Load(),
+	}
+}
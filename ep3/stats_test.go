@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with -race: the counters are bumped by every writer and read by Stats without the lock
+func TestStatsUnderConcurrentLoad(t *testing.T) {
+	clock := newFakeClock()
+	a := NewAggregator(time.Minute, WithClock(clock), WithRetention(time.Hour), WithLateEventPolicy(DropLateEvents))
+	defer a.Close()
+
+	// a closed window for the dropped events
+	a.Flush(clock.Now())
+	const writers, eventsPerWriter = 8, 500
+	var writing, reading sync.WaitGroup
+	for w := range writers {
+		writing.Go(func() {
+			for i := range eventsPerWriter {
+				userID := w*eventsPerWriter + i + 1
+				// every other event is late for the flushed window
+				timestamp := testStart.Add(time.Minute)
+				if i%2 == 1 {
+					timestamp = testStart
+				}
+				a.ProcessEvent(Event{UserID: userID, Timestamp: timestamp, Value: 1})
+			}
+		})
+	}
+	stop := make(chan struct{})
+	reading.Go(func() {
+		var last AggregatorStats
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := a.Stats()
+			if s.EventsProcessed < last.EventsProcessed || s.EventsDropped < last.EventsDropped {
+				t.Errorf("counters went backwards: %+v after %+v", s, last)
+			}
+			last = s
+			a.advanceWindows()
+		}
+	})
+	writing.Wait()
+	close(stop)
+	reading.Wait()
+
+	total := writers * eventsPerWriter
+	s := a.Stats()
+	if s.EventsProcessed != uint64(total/2) || s.EventsDropped != uint64(total/2) {
+		t.Fatalf("%d events processed and %d dropped, expected %d each", s.EventsProcessed, s.EventsDropped, total/2)
+	}
+	if s.WindowsCreated != uint64(total/2) || s.WindowsExpired != 0 {
+		t.Fatalf("%d windows created and %d expired, expected %d and none", s.WindowsCreated, s.WindowsExpired, total/2)
+	}
+
+	// past the retention, every window goes
+	clock.Advance(2 * time.Hour)
+	a.advanceWindows()
+	if s := a.Stats(); s.WindowsExpired != uint64(total/2) {
+		t.Fatalf("%d windows expired, expected all %d", s.WindowsExpired, total/2)
+	}
+}
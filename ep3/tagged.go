@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+/**
+A single event often means several things: a purchase counts towards the "purchases" aggregate and towards the
+"revenue" one. Rather than making callers send the same event twice, the TaggedAggregator keeps one Aggregator per
+tag and hands every event to each aggregator it is tagged for.
+
+The set of tags is fixed when the TaggedAggregator is created, so looking up an aggregator needs no lock, each
+aggregator still takes care of its own locking. Tags nobody asked for are ignored.
+*/
+
+// maintains a separate set of windows per tag
+type TaggedAggregator struct {
+	aggregators map[string]*Aggregator
+}
+
+// creates an Aggregator for each tag, all of them with the same window size and options
+func NewTaggedAggregator(tags []string, windowSize time.Duration, opts ...Option) *TaggedAggregator {
+	aggregators := make(map[string]*Aggregator, len(tags))
+	for _, tag := range tags {
+		if _, exists := aggregators[tag]; !exists {
+			aggregators[tag] = NewAggregator(windowSize, opts...)
+		}
+	}
+	return &TaggedAggregator{aggregators: aggregators}
+}
+
+// processes the event in the aggregator of every tag it carries
+func (t *TaggedAggregator) ProcessEvent(event Event) {
+	for _, tag := range event.Tags {
+		if aggr, exists := t.aggregators[tag]; exists {
+			aggr.ProcessEvent(event)
+		}
+	}
+}
+
+// retrieves a user's aggregates for a tag, nil if the tag is unknown
+func (t *TaggedAggregator) GetTagAggregates(tag string, userID int) []Window {
+	aggr, exists := t.aggregators[tag]
+	if !exists {
+		return nil
+	}
+	return aggr.GetUserAggregates(userID)
+}
+
+// closes (and so flushes) every tag's aggregator
+func (t *TaggedAggregator) Close() {
+	for _, aggr := range t.aggregators {
+		aggr.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// what the tests share
+
+// where the fakeClocks of the tests start, at the start of an hour
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// a Clock the test moves by hand. Its tickers never fire on their own, the tests advance the windows (or Tick) when
+// they want to.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: testStart}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ticker := &fakeTicker{c: make(chan time.Time), interval: d}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+// fires every ticker of the clock, waiting for each tick to be taken
+func (c *fakeClock) Tick() {
+	c.mu.Lock()
+	tickers, now := c.tickers, c.now
+	c.mu.Unlock()
+
+	for _, ticker := range tickers {
+		ticker.c <- now
+	}
+}
+
+// the intervals of the tickers of the clock, in the order they were made
+func (c *fakeClock) intervals() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var intervals []time.Duration
+	for _, ticker := range c.tickers {
+		intervals = append(intervals, ticker.interval)
+	}
+	return intervals
+}
+
+type fakeTicker struct {
+	c chan time.Time
+	// what it was asked to tick at, it never does on its own
+	interval time.Duration
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {}
+
+// the event of the user at the clock's time
+func eventAt(clock Clock, userID, value int) Event {
+	return Event{UserID: userID, Timestamp: clock.Now(), Value: value}
+}
@@ -0,0 +1,80 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"syscall/js"
+	"time"
+)
+
+/**
+The aggregator compiled to WebAssembly runs in the browser, e.g to aggregate a page's own events before (or instead
+of) sending them anywhere. make build-wasm builds aggregator.wasm and copies Go's wasm_exec.js next to it, index.html
+loads both: serve the directory over HTTP (e.g python3 -m http.server), browsers don't load WebAssembly from file://.
+
+The page talks to the aggregator through functions set on the global object:
+
+- processEvent(userID, value) counts an event for the user, timestamped now
+- currentWindow(userID) returns the user's current window ({start, end, value, events}), null without events in it
+- globalWindows() returns the windows of all users combined, oldest first
+
+The clock is the page's (Date.now()) rather than the one the Go runtime keeps, which is what the page's own timestamps
+are compared with. Tickers still come from the Go runtime, which schedules its timers with the page's.
+
+A function called from JavaScript holds up the page's event loop until it returns, so they only do what the
+aggregator does without waiting: take a lock, update or copy windows. The server side of the aggregator (the HTTP
+API, the exporter, the file replay) isn't part of this build, see server.go.
+*/
+
+// a Clock reading the page's time
+type jsClock struct {
+	realClock
+}
+
+func (jsClock) Now() time.Time {
+	return time.UnixMilli(int64(js.Global().Get("Date").Call("now").Float()))
+}
+
+// a window as JavaScript gets it
+func jsWindow(window Window) map[string]any {
+	return map[string]any{
+		"start":  window.StartTime.UnixMilli(),
+		"end":    window.EndTime.UnixMilli(),
+		"value":  window.Value,
+		"events": window.Events,
+	}
+}
+
+// runs the aggregator for the page, see above
+func main() {
+	clock := jsClock{}
+	aggregator := NewAggregator(time.Minute, WithClock(clock))
+
+	js.Global().Set("processEvent", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 2 {
+			return js.Global().Get("Error").New("processEvent takes a user ID and a value")
+		}
+		aggregator.ProcessEvent(Event{UserID: args[0].Int(), Timestamp: clock.Now(), Value: args[1].Int()})
+		return nil
+	}))
+	js.Global().Set("currentWindow", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 1 {
+			return js.Global().Get("Error").New("currentWindow takes a user ID")
+		}
+		window, ok := aggregator.CurrentValue(args[0].Int())
+		if !ok {
+			return nil
+		}
+		return jsWindow(window)
+	}))
+	js.Global().Set("globalWindows", js.FuncOf(func(this js.Value, args []js.Value) any {
+		var windows []any
+		for _, window := range aggregator.GetGlobalAggregates() {
+			windows = append(windows, jsWindow(window))
+		}
+		return windows
+	}))
+
+	// the functions above live as long as the program
+	select {}
+}
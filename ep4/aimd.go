@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/**
+RequestsPerMinute is what we believe the third party allows, but the provider may lower its limit without telling,
+or another service may be spending the same quota. Then every minute starts with a storm of 429s.
+
+With Config.Adaptive the send rate follows what the third party actually accepts, AIMD style (like TCP congestion
+control): every rate-limited response halves the rate, down to a floor, and every AdaptiveInterval without one adds
+a step back, up to RequestsPerMinute. A single burst of 429s comes back from many senders at once, so the rate is
+halved at most once per aimdDecreaseGap instead of once per response.
+*/
+
+const (
+	// what a rate-limited response multiplies the rate by
+	aimdDecreaseFactor = 0.5
+	// minimum time between two decreases
+	aimdDecreaseGap = time.Second
+	// the default for Config.AdaptiveInterval
+	defaultAdaptiveInterval = 10 * time.Second
+)
+
+// adjusts the rate of a target's token bucket, see above. Guarded by the target's bucketMu.
+type aimdController struct {
+	floor, ceiling float64
+	// added to the rate every interval without a rate-limited response
+	step     float64
+	interval time.Duration
+
+	lastDecrease time.Time
+	lastChange   time.Time
+}
+
+func newAIMDController(cfg Config, now time.Time) *aimdController {
+	if !cfg.Adaptive {
+		return nil
+	}
+	ceiling := float64(cfg.RequestsPerMinute)
+	floor := float64(cfg.MinRequestsPerMinute)
+	if floor <= 0 || floor > ceiling {
+		floor = ceiling / 10
+	}
+	step := float64(cfg.AdaptiveIncrease)
+	if step <= 0 {
+		step = ceiling / 20
+	}
+	interval := cfg.AdaptiveInterval
+	if interval <= 0 {
+		interval = defaultAdaptiveInterval
+	}
+	return &aimdController{floor: floor, ceiling: ceiling, step: step, interval: interval, lastChange: now}
+}
+
+// makes ceiling the highest rate, the rate it is at (set by UpdateConfig) being the starting point
+func (c *aimdController) setCeiling(ceiling float64, now time.Time) {
+	c.ceiling = ceiling
+	c.floor = min(c.floor, ceiling)
+	c.lastChange = now
+}
+
+// backs the rate off after a rate-limited response
+func (t *target) rateLimited(now time.Time) {
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	c := t.aimd
+	if c == nil || now.Sub(c.lastDecrease) < aimdDecreaseGap {
+		return
+	}
+	rate := max(t.bucket.refillPerMinute*aimdDecreaseFactor, c.floor)
+	t.bucket.setRate(rate, now)
+	c.lastDecrease = now
+	c.lastChange = now
+	log.Printf("Rate limited by %s, sending %.0f requests per minute from now on", t.name, rate)
+}
+
+// raises the rate by a step for every interval passed without a rate-limited response (called with bucketMu held)
+func (t *target) recoverRate(now time.Time) {
+	c := t.aimd
+	if c == nil || t.bucket.refillPerMinute >= c.ceiling {
+		return
+	}
+	steps := int(now.Sub(c.lastChange) / c.interval)
+	if steps <= 0 {
+		return
+	}
+	t.bucket.setRate(min(t.bucket.refillPerMinute+float64(steps)*c.step, c.ceiling), now)
+	c.lastChange = c.lastChange.Add(time.Duration(steps) * c.interval)
+}
+
+// the rate requests are currently sent to the target at, in requests per minute
+func (t *target) effectiveRate(now time.Time) float64 {
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	t.recoverRate(now)
+	return t.bucket.refillPerMinute
+}
+
+// the rate requests are currently sent to the default target at, in requests per minute
+func (rl *RateLimiter) EffectiveRate() float64 {
+	return rl.targets[DefaultTarget].effectiveRate(rl.clock.Now())
+}
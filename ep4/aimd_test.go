@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a rate limiter adapting its rate of 60/min, by steps of 6 every 10s down to 10/min at the lowest
+func adaptiveLimiter(burst int) (*RateLimiter, *FakeClock, *ScriptedClient) {
+	return scriptedLimiter(Config{RequestsPerMinute: 60, Burst: burst, Adaptive: true, MinRequestsPerMinute: 10,
+		AdaptiveIncrease: 6, AdaptiveInterval: 10 * time.Second, Backoff: fixedBackoff(time.Second)})
+}
+
+func TestAdaptiveRateHalvesAndRecovers(t *testing.T) {
+	rl, clock, client := adaptiveLimiter(2)
+	defer shutdownNow(rl)
+	if rate := rl.EffectiveRate(); rate != 60 {
+		t.Fatalf("effective rate %g/min, expected 60 to start with", rate)
+	}
+
+	// the two 429s of the same burst halve the rate once
+	client.Script("user0", RateLimited(0))
+	client.Script("user1", RateLimited(0))
+	for _, req := range submitRequests(t, rl, 2) {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	if rate := rl.EffectiveRate(); rate != 30 {
+		t.Fatalf("effective rate %g/min after a burst of 429s, expected 30", rate)
+	}
+
+	// then a step back up every 10s without one, up to RequestsPerMinute
+	for _, tc := range []struct {
+		at   time.Duration
+		rate float64
+	}{
+		{9 * time.Second, 30},
+		{10 * time.Second, 36},
+		{25 * time.Second, 42},
+		{50 * time.Second, 60},
+		{10 * time.Minute, 60},
+	} {
+		clock.Advance(testStart.Add(tc.at).Sub(clock.Now()))
+		if rate := rl.EffectiveRate(); rate != tc.rate {
+			t.Fatalf("effective rate %g/min %s after the 429s, expected %g", rate, tc.at, tc.rate)
+		}
+	}
+}
+
+func TestAdaptiveRateStopsAtTheFloor(t *testing.T) {
+	rl, clock, client := adaptiveLimiter(1)
+	defer shutdownNow(rl)
+
+	// 429s a retry apart halve the rate every time: 30, 15, then the floor of 10
+	client.Script("alice", RateLimited(0), RateLimited(0), RateLimited(0), RateLimited(0))
+	if resp := awaitResponse(t, clock, submitAlice(t, rl, testRequest("alice", "ping"))); resp.Err != nil {
+		t.Fatalf("request of alice failed: %v", resp.Err)
+	}
+	if rate := rl.EffectiveRate(); rate != 10 {
+		t.Fatalf("effective rate %g/min after four 429s in a row, expected the floor of 10", rate)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/**
+MaxPendingPerUser caps the requests a single user has pending: queued, backing off between retries, waiting in a
+batch or in flight. Capping the queue alone isn't enough, a user's requests leave the queue as soon as they are sent
+and a client with slow calls would get MaxPendingPerUser more in every time they do, taking up workers and in-flight
+slots instead of queue room.
+
+A request counts from the moment it is admitted by SubmitRequest (or Recover) until it is answered, however it is
+answered: a response, an error, a cancellation, an expiry or ErrShuttingDown all go through respond. A request that
+never makes it into the queue (the queue is full, the journal fails) is let go of right away.
+*/
+
+// returned by SubmitRequest when the user already has Config.MaxPendingPerUser requests pending,
+// it matches ErrTooManyPending with errors.Is
+type TooManyPendingError struct {
+	UserID string
+	Limit  int
+}
+
+// matched by TooManyPendingError
+var ErrTooManyPending = errors.New("too many pending requests for user")
+
+func (e *TooManyPendingError) Error() string {
+	return fmt.Sprintf("%v %s (limit %d)", ErrTooManyPending, e.UserID, e.Limit)
+}
+
+func (e *TooManyPendingError) Is(target error) bool {
+	return target == ErrTooManyPending
+}
+
+// the requests each user has pending, see above
+type userBacklog struct {
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+// counts the request as pending for its user, unless the user has limit requests pending already (0 means no limit)
+func (b *userBacklog) admit(req *UserRequest, limit int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if limit > 0 && b.pending[req.UserID] >= limit {
+		return &TooManyPendingError{UserID: req.UserID, Limit: limit}
+	}
+	if b.pending == nil {
+		b.pending = make(map[string]int)
+	}
+	b.pending[req.UserID]++
+	req.admitted = true
+	return nil
+}
+
+// stops counting the request, requests that were never admitted (e.g answered from the cache) are ignored
+func (b *userBacklog) release(req *UserRequest) {
+	if !req.admitted {
+		return
+	}
+	req.admitted = false
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending[req.UserID]--
+	if b.pending[req.UserID] <= 0 {
+		delete(b.pending, req.UserID)
+	}
+}
+
+// the number of requests the user has pending
+func (b *userBacklog) pendingFor(userID string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.pending[userID]
+}
+
+// the number of requests the user has pending, queued, retrying or in flight
+func (rl *RateLimiter) PendingFor(userID string) int {
+	return rl.backlog.pendingFor(userID)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fails unless submitting a request of the user is refused with a TooManyPendingError at the limit
+func expectTooManyPending(t *testing.T, rl *RateLimiter, userID string, limit int) {
+	t.Helper()
+	var pendingErr *TooManyPendingError
+	err := rl.SubmitRequest(context.Background(), testRequest(userID, "ping"))
+	if !errors.Is(err, ErrTooManyPending) || !errors.As(err, &pendingErr) || pendingErr.UserID != userID ||
+		pendingErr.Limit != limit {
+		t.Fatalf("request of %s past the limit: %v, expected a TooManyPendingError with the limit %d", userID, err,
+			limit)
+	}
+}
+
+func TestMaxPendingPerUser(t *testing.T) {
+	// a call a second, one at a time
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 1, MaxPendingPerUser: 3})
+	defer shutdownNow(rl)
+
+	pending := make([]*UserRequest, 3)
+	for i := range pending {
+		pending[i] = testRequest("alice", "ping")
+		if err := rl.SubmitRequest(context.Background(), pending[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectTooManyPending(t, rl, "alice", 3)
+	// the others have limits of their own
+	if err := rl.SubmitRequest(context.Background(), testRequest("bob", "ping")); err != nil {
+		t.Fatalf("request of bob refused: %v", err)
+	}
+
+	// a request answered makes room for another
+	awaitResponse(t, clock, pending[0])
+	if count := rl.PendingFor("alice"); count != 2 {
+		t.Fatalf("alice has %d requests pending, expected 2 once one was answered", count)
+	}
+	if err := rl.SubmitRequest(context.Background(), testRequest("alice", "ping")); err != nil {
+		t.Fatalf("request of alice refused after one of hers was answered: %v", err)
+	}
+	expectTooManyPending(t, rl, "alice", 3)
+}
+
+// submits the request of alice
+func submitAlice(t *testing.T, rl *RateLimiter, req *UserRequest) *UserRequest {
+	t.Helper()
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestPendingRequestsAreLetGoOfHoweverAnswered(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// submits alice's request and has it answered, returning the request
+		answer func(t *testing.T, rl *RateLimiter, client *ScriptedClient) *UserRequest
+	}{
+		{"failure", func(t *testing.T, rl *RateLimiter, client *ScriptedClient) *UserRequest {
+			client.Script("alice", RejectWith(400))
+			return submitAlice(t, rl, testRequest("alice", "ping"))
+		}},
+		{"cancellation", func(t *testing.T, rl *RateLimiter, client *ScriptedClient) *UserRequest {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			req := testRequest("alice", "ping")
+			req.Ctx = ctx
+			return submitAlice(t, rl, req)
+		}},
+		{"expiry", func(t *testing.T, rl *RateLimiter, client *ScriptedClient) *UserRequest {
+			req := testRequest("alice", "ping")
+			req.ExpiresAt = testStart.Add(time.Second)
+			return submitAlice(t, rl, req)
+		}},
+		{"shutdown", func(t *testing.T, rl *RateLimiter, client *ScriptedClient) *UserRequest {
+			req := submitAlice(t, rl, testRequest("alice", "ping"))
+			shutdownNow(rl)
+			return req
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the queue only grows, user0's request takes the only call of the minute
+			rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1, MaxPendingPerUser: 1})
+			defer shutdownNow(rl)
+			submitRequests(t, rl, 1)
+			settle(clock)
+
+			req := tc.answer(t, rl, client)
+			if resp := awaitResponse(t, clock, req); resp.Err == nil {
+				t.Fatalf("alice's request succeeded, expected the %s", tc.name)
+			}
+			if count := rl.PendingFor("alice"); count != 0 {
+				t.Fatalf("alice has %d requests pending after the %s of her only one", count, tc.name)
+			}
+		})
+	}
+}
+
+func TestHandlerAnswers429PastMaxPending(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1, MaxPendingPerUser: 1})
+	defer shutdownNow(rl)
+	// user0's request takes the only call of the minute, alice's waits
+	submitRequests(t, rl, 1)
+	settle(clock)
+	submitAlice(t, rl, testRequest("alice", "ping"))
+	server := httptest.NewServer(newMux(rl, newAsyncTracker(&WebhookSender{}, clock), "", ""))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/request", nil)
+	req.Header.Set("X-User-ID", "alice")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(string(body), "already has 1 requests") {
+		t.Fatalf("answered %d with %q, expected 429 explaining the limit", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/**
+How long to wait before retrying a request the third party turned down (when it doesn't say how long itself).
+
+Waiting the same for every request means every request that failed together retries together, and fails together
+again. Jitter spreads them out: Backoff, the default, waits a random time between 0 and an exponentially growing
+ceiling ("full jitter"), and the ceiling is capped so a few failures in a row don't turn into minutes of waiting.
+
+DecorrelatedJitterBackoff is the alternative from https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/,
+it picks each wait at random between the base and three times the previous wait: it still grows quickly when the
+third party keeps failing, but on average waits less than full jitter for the same amount of spreading.
+
+Whatever the strategy, Config.MaxBackoff caps the wait it gives: a DecorrelatedJitterBackoff without Max, or a
+strategy of the caller's, would otherwise grow until the Duration overflows and comes out negative (or, for the
+previous wait multiplied again, panics in rand). A Retry-After of the third party isn't capped, it knows best.
+*/
+
+// decides how long to wait before retrying a request
+type BackoffStrategy interface {
+	// the wait before retry number attempt (1 for the first retry), last is the wait before the previous retry
+	// (0 before the first one)
+	Next(attempt int, last time.Duration) time.Duration
+}
+
+// defaults for Backoff
+const (
+	defaultBackoffBase       = 500 * time.Millisecond
+	defaultBackoffMultiplier = 2
+	defaultBackoffCap        = 30 * time.Second
+)
+
+// capped exponential backoff with full jitter: the wait before retry number attempt is random in
+// [0, min(Cap, Base * Multiplier^attempt)]. Zero fields take the defaults (500ms, 2, 30s).
+type Backoff struct {
+	Base       time.Duration
+	Multiplier float64
+	Cap        time.Duration
+	// source of the jitter, nil means math/rand's global source. Set it (e.g rand.New(rand.NewSource(seed)))
+	// to get the same sequence of waits every time.
+	Rand *rand.Rand
+	// a *rand.Rand isn't safe for concurrent use
+	mu sync.Mutex
+}
+
+func (b *Backoff) Next(attempt int, last time.Duration) time.Duration {
+	base, multiplier, limit := b.Base, b.Multiplier, b.Cap
+	if base <= 0 {
+		base = defaultBackoffBase
+	}
+	if multiplier <= 0 {
+		multiplier = defaultBackoffMultiplier
+	}
+	if limit <= 0 {
+		limit = defaultBackoffCap
+	}
+
+	// computed in float64, it would overflow a Duration long before reaching the cap otherwise
+	ceiling := time.Duration(min(float64(base)*math.Pow(multiplier, float64(attempt)), float64(limit)))
+	return time.Duration(b.int63n(int64(ceiling) + 1))
+}
+
+// the wait of a BackoffStrategy, at most limit. A negative wait can only be an overflow, it gets limit too.
+func capBackoff(wait, limit time.Duration) time.Duration {
+	if wait < 0 || wait > limit {
+		return limit
+	}
+	return wait
+}
+
+// a random number in [0, n)
+func (b *Backoff) int63n(n int64) int64 {
+	if b.Rand == nil {
+		return rand.Int63n(n)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.Rand.Int63n(n)
+}
+
+// decorrelated jitter, see above: each wait is random between Base and three times the previous wait, capped at Max
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	// 0 means no cap
+	Max time.Duration
+}
+
+func (b DecorrelatedJitterBackoff) Next(attempt int, last time.Duration) time.Duration {
+	last = max(last, b.Base)
+	wait := b.Base + time.Duration(rand.Int63n(int64(3*last-b.Base)+1))
+	if b.Max > 0 {
+		wait = min(wait, b.Max)
+	}
+	return wait
+}
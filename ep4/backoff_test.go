@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the waits of the given number of retry sequences, retries waits each, and their mean
+func simulateBackoff(strategy BackoffStrategy, sequences, retries int) ([]time.Duration, time.Duration) {
+	var waits []time.Duration
+	var total time.Duration
+	for range sequences {
+		var last time.Duration
+		for attempt := 1; attempt <= retries; attempt++ {
+			last = capBackoff(strategy.Next(attempt, last), defaultMaxBackoff)
+			waits = append(waits, last)
+			total += last
+		}
+	}
+	return waits, total / time.Duration(len(waits))
+}
+
+// a text histogram of the waits, one line per 2s
+func histogram(waits []time.Duration) string {
+	const width = 2 * time.Second
+	counts := make([]int, defaultMaxBackoff/width+1)
+	most := 0
+	for _, wait := range waits {
+		i := int(wait / width)
+		counts[i]++
+		most = max(most, counts[i])
+	}
+	var b strings.Builder
+	for i, count := range counts {
+		bar := strings.Repeat("#", count*50/most)
+		fmt.Fprintf(&b, "%5s-%-5s %6d %s\n", time.Duration(i)*width, time.Duration(i+1)*width, count, bar)
+	}
+	return b.String()
+}
+
+func TestDecorrelatedJitterWaitsLess(t *testing.T) {
+	// a third party down for a while: full jitter's ceiling doubles to the cap within 6 retries, decorrelated jitter
+	// grows by 1.5 on average. Over the first few retries it's the other way around, its first wait is at least Base.
+	const sequences, retries = 1000, 10
+	full := &Backoff{Rand: rand.New(rand.NewSource(1))}
+	decorrelated := DecorrelatedJitterBackoff{Base: defaultBackoffBase, Max: defaultBackoffCap}
+
+	fullWaits, fullMean := simulateBackoff(full, sequences, retries)
+	decorrelatedWaits, decorrelatedMean := simulateBackoff(decorrelated, sequences, retries)
+	t.Logf("full jitter, mean %s\n%s", fullMean.Round(time.Millisecond), histogram(fullWaits))
+	t.Logf("decorrelated jitter, mean %s\n%s", decorrelatedMean.Round(time.Millisecond), histogram(decorrelatedWaits))
+
+	if decorrelatedMean >= fullMean {
+		t.Fatalf("decorrelated jitter waits %s on average, full jitter %s", decorrelatedMean, fullMean)
+	}
+	for _, wait := range decorrelatedWaits {
+		if wait < decorrelated.Base || wait > decorrelated.Max {
+			t.Fatalf("decorrelated jitter waited %s, expected between Base and Max", wait)
+		}
+	}
+}
+
+func TestDecorrelatedJitterStaysWithinThreeTimesTheLastWait(t *testing.T) {
+	b := DecorrelatedJitterBackoff{Base: time.Second}
+	last := time.Duration(0)
+	for attempt := 1; attempt <= 20; attempt++ {
+		wait := b.Next(attempt, last)
+		if wait < b.Base || wait > 3*max(last, b.Base) {
+			t.Fatalf("retry %d waited %s after %s, expected between Base and three times the last wait", attempt,
+				wait, last)
+		}
+		last = wait
+	}
+}
+
+func TestBackoffStaysWithinItsCeiling(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Rand is set per seed
+		backoff *Backoff
+		// the ceiling before retry number attempt
+		ceiling func(attempt int) time.Duration
+	}{
+		{"defaults", &Backoff{}, func(attempt int) time.Duration {
+			return min(defaultBackoffCap, defaultBackoffBase<<min(attempt, 10))
+		}},
+		{"tripling", &Backoff{Base: 100 * time.Millisecond, Multiplier: 3, Cap: 10 * time.Second},
+			func(attempt int) time.Duration {
+				return time.Duration(min(100*math.Pow(3, float64(attempt)), 10000)) * time.Millisecond
+			}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// attempt 100 would overflow a Duration without the cap
+			for _, attempt := range []int{1, 2, 3, 5, 8, 100} {
+				ceiling := tc.ceiling(attempt)
+				waits := make(map[time.Duration]bool)
+				shortest, longest := ceiling, time.Duration(0)
+				for seed := range int64(50) {
+					b := &Backoff{Base: tc.backoff.Base, Multiplier: tc.backoff.Multiplier, Cap: tc.backoff.Cap,
+						Rand: rand.New(rand.NewSource(seed))}
+					wait := b.Next(attempt, 0)
+					if wait < 0 || wait > ceiling {
+						t.Fatalf("retry %d waited %s with seed %d, expected within [0, %s]", attempt, wait, seed,
+							ceiling)
+					}
+					waits[wait] = true
+					shortest, longest = min(shortest, wait), max(longest, wait)
+				}
+				// jitter spreads the waits over the whole range
+				if len(waits) < 40 || shortest > ceiling/2 || longest < ceiling/2 {
+					t.Fatalf("retry %d waited %d different times from %s to %s over 50 seeds, expected them spread "+
+						"over [0, %s]", attempt, len(waits), shortest, longest, ceiling)
+				}
+			}
+		})
+	}
+}
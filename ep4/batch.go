@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/**
+Many third parties have a bulk endpoint: 50 lookups in a single call, counted as a single request against the quota.
+Sending them one call each spends 50 times the quota (and 50 round trips) on the same work.
+
+With Config.BatchWindow set, requests marked Batchable for a target whose client implements BatchClient are coalesced:
+processQueue holds the first one back, and every Batchable request for the same target taken from the queue in the
+next BatchWindow joins it. The batch goes out as a single CallBatch once BatchSize requests joined or the window is
+over, whichever comes first.
+
+The first request of a batch reserves the call's units (its Cost) as any request does, the others ride along for free.
+They still take their per-user tokens and wait their turn in the queue, so batching changes what a call carries but
+not who gets to go first.
+
+CallBatch answers each request on its own: a response per request, in the order they were given, failed items having
+Err set. Those errors go to their own requests only, the others get their data. An error returned by CallBatch itself
+fails the whole call, the batch is then retried like any request (all of it, it is Idempotent only if all of its
+requests are) or each of its requests gets the error.
+
+Gotchas:
+
+- a request waits up to BatchWindow longer than it would on its own, that's the price of sharing the call. Keep it
+  to a few tens of milliseconds for user-facing requests.
+- a batch is made of whatever came in during the window, it can't wait for a user's next request with
+  PreserveOrderPerUser: that one only leaves the queue once the batch is done
+- a request whose context is done (or that expired) before the call is dropped from its batch, but the call can't be
+  cancelled for a single request, it is made without any of the requests' contexts
+*/
+
+// the default for Config.BatchSize
+const defaultBatchSize = 50
+
+// implemented by clients of third parties with a bulk endpoint, see above
+type BatchClient interface {
+	// makes a single call for all the requests, returning a response per request in the same order (Err set for the
+	// requests that failed). An error fails the whole call. The rate limit state the third party reported goes in the
+	// RateLimit of the responses.
+	CallBatch(ctx context.Context, reqs []*UserRequest) ([]*APIResponse, error)
+}
+
+// whether the request waits for others to share its call
+func (t *target) batches(req *UserRequest) bool {
+	return req.Batchable && t.batcher != nil
+}
+
+// whether the request may join the batch on its way out for its target, without units of its own
+// (only called by processQueue)
+func (rl *RateLimiter) joinsBatch(req *UserRequest) bool {
+	t := rl.targetOf(req)
+	return t.batches(req) && t.openBatch != nil
+}
+
+// adds a fresh request taken from the queue to its target's batch, opening one if needed. Returns the batch once it
+// is full, nil while it waits for more.
+func (rl *RateLimiter) addToBatch(t *target, req *UserRequest) *UserRequest {
+	if t.openBatch == nil {
+		// stands in for its requests through the senders and the retries, with the units reserved by the first
+		t.openBatch = &UserRequest{Target: t.name, Cost: req.Cost, readyAt: req.readyAt}
+		t.batchDeadline = rl.clock.Now().Add(rl.cfg.BatchWindow)
+	}
+	t.openBatch.batch = append(t.openBatch.batch, req)
+	if len(t.openBatch.batch) < rl.cfg.BatchSize {
+		return nil
+	}
+	return t.closeBatch()
+}
+
+// takes the target's batch, ready to be sent
+func (t *target) closeBatch() *UserRequest {
+	batch := t.openBatch
+	t.openBatch = nil
+	batch.Idempotent = true
+	for _, req := range batch.batch {
+		batch.Idempotent = batch.Idempotent && req.Idempotent
+	}
+	return batch
+}
+
+// takes a batch whose window is over (any batch with all), nil if none is due
+func (rl *RateLimiter) dueBatch(all bool) *UserRequest {
+	now := rl.clock.Now()
+	for _, t := range rl.targets {
+		if t.openBatch != nil && (all || !now.Before(t.batchDeadline)) {
+			return t.closeBatch()
+		}
+	}
+	return nil
+}
+
+// fires when the earliest window of the open batches is over, nil without any
+func (rl *RateLimiter) batchDue() <-chan time.Time {
+	var earliest time.Time
+	for _, t := range rl.targets {
+		if t.openBatch != nil && (earliest.IsZero() || t.batchDeadline.Before(earliest)) {
+			earliest = t.batchDeadline
+		}
+	}
+	if earliest.IsZero() {
+		return nil
+	}
+	return rl.clock.After(earliest.Sub(rl.clock.Now()))
+}
+
+// takes the open batches without sending them, when the rate limiter stops for good
+func (rl *RateLimiter) abandonBatches() []*UserRequest {
+	var abandoned []*UserRequest
+	for _, t := range rl.targets {
+		if t.openBatch != nil {
+			batch := t.closeBatch()
+			rl.markDone(batch)
+			abandoned = append(abandoned, batch)
+		}
+	}
+	return abandoned
+}
+
+// drops the requests of the batch the skip function answered (e.g because they expired), reporting whether none
+// is left
+func (rl *RateLimiter) dropFromBatch(batch *UserRequest, skip func(req *UserRequest) bool) bool {
+	kept := batch.batch[:0]
+	for _, req := range batch.batch {
+		if skip(req) {
+			rl.markDone(req)
+			continue
+		}
+		kept = append(kept, req)
+	}
+	batch.batch = kept
+	return len(kept) == 0
+}
+
+// how many requests the request stands for, more than one for a batch
+func (req *UserRequest) size() int {
+	if req.batch != nil {
+		return len(req.batch)
+	}
+	return 1
+}
+
+// makes the request's call, a bulk call for a batch. The responses to a batch's requests come back in the batch
+// field of the response.
+func (t *target) call(req *UserRequest) (*APIResponse, error) {
+	if req.batch == nil {
+		return t.client.Call(req.context(), req)
+	}
+
+	responses, err := t.batcher.CallBatch(req.context(), req.batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != len(req.batch) {
+		return nil, fmt.Errorf("bulk call returned %d responses for %d requests", len(responses), len(req.batch))
+	}
+	resp := &APIResponse{batch: responses}
+	for _, item := range responses {
+		if item != nil && item.RateLimit != nil {
+			resp.RateLimit = item.RateLimit
+			break
+		}
+	}
+	return resp, nil
+}
+
+// returned for a request of a batch the bulk call had no response for
+var errNoBatchResponse = errors.New("the bulk call returned no response for the request")
+
+// hands each request of a batch its own response
+func (rl *RateLimiter) respondToBatch(t *target, batch *UserRequest, responses []*APIResponse) {
+	for i, req := range batch.batch {
+		resp := responses[i]
+		if resp == nil {
+			resp = &APIResponse{Err: errNoBatchResponse}
+		}
+		if resp.Err != nil {
+			t.stats.failed.Add(1)
+			rl.respond(req, resp)
+			continue
+		}
+		t.stats.succeeded.Add(1)
+		if req.Cacheable {
+			rl.cache.put(req.cacheKey(), resp, rl.clock.Now())
+		}
+		rl.respond(req, resp)
+	}
+}
+
+func (c SimulatedClient) CallBatch(ctx context.Context, reqs []*UserRequest) ([]*APIResponse, error) {
+	// the bulk call is rate limited as a single request
+	if outcome := c.policy().Outcome(reqs[0]); outcome.Err != nil {
+		return nil, outcome.Err
+	}
+
+	responses := make([]*APIResponse, len(reqs))
+	for i, req := range reqs {
+		// simulate an item the third party refuses (5% chance), the rest of the call goes through
+		if c.policy().refusesItem() {
+			responses[i] = &APIResponse{Err: fmt.Errorf("third party refused the item of user %s", req.UserID)}
+			continue
+		}
+		responses[i] = &APIResponse{Data: fmt.Sprintf("Processed data for user %s (in bulk)", req.UserID)}
+	}
+	return responses, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a ScriptedClient with a bulk endpoint, refusing the items of mallory
+type bulkClient struct {
+	*ScriptedClient
+
+	mu sync.Mutex
+	// the users of each bulk call
+	bulkCalls [][]string
+	// what the next bulk calls fail with as a whole, one error per call until they run out
+	failures []error
+	// leaves the last response out of every bulk call
+	short bool
+}
+
+func (c *bulkClient) CallBatch(ctx context.Context, reqs []*UserRequest) ([]*APIResponse, error) {
+	var users []string
+	responses := make([]*APIResponse, len(reqs))
+	for i, req := range reqs {
+		users = append(users, req.UserID)
+		responses[i] = &APIResponse{Data: "bulk for " + req.UserID}
+		if req.UserID == "mallory" {
+			responses[i] = &APIResponse{Err: RejectWith(422).Err}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bulkCalls = append(c.bulkCalls, users)
+	if len(c.failures) > 0 {
+		err := c.failures[0]
+		c.failures = c.failures[1:]
+		return nil, err
+	}
+	if c.short {
+		responses = responses[:len(responses)-1]
+	}
+	return responses, nil
+}
+
+// the users of each bulk call, sorted by their first user: the senders make the calls of full batches in parallel,
+// in no particular order
+func (c *bulkClient) calls() [][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := slices.Clone(c.bulkCalls)
+	slices.SortStableFunc(calls, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	return calls
+}
+
+// a rate limiter batching Batchable requests for 20ms, calling a bulkClient
+func batchingLimiter(batchSize int) (*RateLimiter, *FakeClock, *bulkClient) {
+	clock := NewFakeClock(testStart)
+	client := &bulkClient{ScriptedClient: &ScriptedClient{Clock: clock}}
+	return NewRateLimiter(Config{Client: client, Clock: clock, Logger: quietLogger(), RequestsPerMinute: 60000,
+		Burst: 10, BatchWindow: 20 * time.Millisecond, BatchSize: batchSize}), clock, client
+}
+
+// submits a Batchable request for each user
+func submitBatchable(t *testing.T, rl *RateLimiter, users ...string) []*UserRequest {
+	t.Helper()
+	var pending []*UserRequest
+	for _, userID := range users {
+		req := testRequest(userID, "lookup")
+		req.Batchable = true
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+	return pending
+}
+
+func TestBatchSharesOneCall(t *testing.T) {
+	rl, clock, client := batchingLimiter(0)
+	defer shutdownNow(rl)
+
+	users := []string{"alice", "bob", "mallory", "carol", "dave"}
+	// each request gets its own response, the item refused fails only its own
+	for _, req := range submitBatchable(t, rl, users...) {
+		resp := awaitResponse(t, clock, req)
+		if req.UserID == "mallory" {
+			if !errors.Is(resp.Err, ErrClientError) {
+				t.Fatalf("refused item of mallory answered %+v, expected its 422", resp)
+			}
+			continue
+		}
+		if resp.Err != nil || resp.Data != "bulk for "+req.UserID {
+			t.Fatalf("request of %s answered %+v, expected its own item of the bulk call", req.UserID, resp)
+		}
+	}
+
+	if calls := client.calls(); len(calls) != 1 || !slices.Equal(calls[0], users) {
+		t.Fatalf("bulk calls for %v, expected a single one for %v", calls, users)
+	}
+	if calls := client.Calls(); len(calls) != 0 {
+		t.Fatalf("%d calls of their own, expected the requests to go out in bulk", len(calls))
+	}
+	// a single call's units for all of them
+	if sent := rl.Stats().UnitsSent; sent != 1 {
+		t.Fatalf("%d units sent, expected 1", sent)
+	}
+}
+
+func TestBatchGoesOutWhenFull(t *testing.T) {
+	rl, clock, client := batchingLimiter(2)
+	defer shutdownNow(rl)
+
+	var users []string
+	for i := range 5 {
+		users = append(users, fmt.Sprintf("user%d", i))
+	}
+	for _, req := range submitBatchable(t, rl, users...) {
+		awaitResponse(t, clock, req)
+	}
+	expected := [][]string{{"user0", "user1"}, {"user2", "user3"}, {"user4"}}
+	if calls := client.calls(); !slices.EqualFunc(calls, expected, slices.Equal) {
+		t.Fatalf("bulk calls for %v, expected %v", calls, expected)
+	}
+}
+
+func TestCancelledRequestIsDroppedFromItsBatch(t *testing.T) {
+	rl, clock, client := batchingLimiter(0)
+	defer shutdownNow(rl)
+
+	pending := submitBatchable(t, rl, "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	bob := testRequest("bob", "lookup")
+	bob.Batchable, bob.Ctx = true, ctx
+	if err := rl.SubmitRequest(context.Background(), bob); err != nil {
+		t.Fatal(err)
+	}
+	pending = append(pending, submitBatchable(t, rl, "carol")...)
+	// bob gives up while the batch waits for more
+	settle(clock)
+	cancel()
+
+	if resp := awaitResponse(t, clock, bob); !errors.Is(resp.Err, context.Canceled) {
+		t.Fatalf("bob's request answered %+v, expected context.Canceled", resp)
+	}
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	if calls := client.calls(); len(calls) != 1 || !slices.Equal(calls[0], []string{"alice", "carol"}) {
+		t.Fatalf("bulk calls for %v, expected a single one without bob", calls)
+	}
+}
+
+func TestFailedBulkCall(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// whether bob's request is safe to retry
+		idempotent bool
+		// the bulk calls expected, and what each request gets
+		calls int
+		err   error
+	}{
+		// retried as a whole, and the second call goes through
+		{"retried", true, 2, nil},
+		// bob's request can't be sent twice, nor can the bulk call carrying it
+		{"not idempotent", false, 1, ErrServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, clock, client := batchingLimiter(0)
+			defer shutdownNow(rl)
+			client.failures = []error{FailWith(503).Err}
+
+			pending := submitBatchable(t, rl, "alice")
+			bob := testRequest("bob", "lookup")
+			bob.Batchable, bob.Idempotent = true, tc.idempotent
+			if err := rl.SubmitRequest(context.Background(), bob); err != nil {
+				t.Fatal(err)
+			}
+			pending = append(pending, bob)
+
+			for _, req := range pending {
+				resp := awaitResponse(t, clock, req)
+				if tc.err == nil && (resp.Err != nil || resp.Data != "bulk for "+req.UserID) {
+					t.Fatalf("request of %s answered %+v, expected its item of the retried call", req.UserID, resp)
+				}
+				if tc.err != nil && !errors.Is(resp.Err, tc.err) {
+					t.Fatalf("request of %s answered %+v, expected the bulk call's %v", req.UserID, resp, tc.err)
+				}
+			}
+			expected := slices.Repeat([][]string{{"alice", "bob"}}, tc.calls)
+			if calls := client.calls(); !slices.EqualFunc(calls, expected, slices.Equal) {
+				t.Fatalf("bulk calls for %v, expected %v", calls, expected)
+			}
+		})
+	}
+}
+
+func TestBulkCallMissingResponses(t *testing.T) {
+	rl, clock, client := batchingLimiter(0)
+	defer shutdownNow(rl)
+	client.short = true
+
+	// the responses can't be matched to the requests anymore, every request fails
+	for _, req := range submitBatchable(t, rl, "alice", "bob", "carol") {
+		resp := awaitResponse(t, clock, req)
+		if resp.Err == nil || !strings.Contains(resp.Err.Error(), "bulk call returned 2 responses for 3 requests") {
+			t.Fatalf("request of %s answered %+v, expected the mismatch", req.UserID, resp)
+		}
+	}
+	if calls := client.calls(); len(calls) != 1 {
+		t.Fatalf("bulk calls for %v, expected a single one, the mismatch isn't worth retrying", calls)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+When the third party is hard-down every call fails, yet we keep pacing requests out and retrying each of them up to
+5 times: the whole minute's quota is spent on failures (and on hammering a service that is trying to come back).
+
+The circuit breaker sits in front of the client:
+
+- closed: calls go out as usual, consecutive failures are counted
+- open: after BreakerThreshold failures in a row, no call goes out for BreakerCooldown. Queued requests are failed
+  with ErrCircuitOpen right away, or kept in the queue with ParkWhenOpen.
+- half-open: once the cooldown is over a single request goes out as a probe. If it succeeds the breaker closes,
+  if it fails the breaker opens for another cooldown.
+
+Rate-limited responses don't count as failures, a third party telling us to slow down is very much up.
+*/
+
+// returned (or sent as the response) for requests failed because the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open, the third party looks down")
+
+// the state of the circuit breaker, see above
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	// the default for Config.BreakerCooldown
+	defaultBreakerCooldown = 30 * time.Second
+	// how often to check on the breaker while a probe is out
+	breakerProbePoll = 100 * time.Millisecond
+)
+
+// the outcome of a call, as far as the breaker is concerned
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	// the call says nothing about the third party's health, e.g the request was cancelled
+	callIgnored
+)
+
+// classifies the result of a call, rate limiting and cancellation aside any error counts as a failure
+func outcomeOf(ctx context.Context, err error) callOutcome {
+	switch {
+	// the third party answered, refusing a request doesn't make it unhealthy
+	case err == nil, errors.Is(err, ErrRateLimited), errors.Is(err, ErrClientError):
+		return callSucceeded
+	case ctx.Err() != nil:
+		return callIgnored
+	}
+	return callFailed
+}
+
+// trips after consecutive failures, see above. A nil breaker never trips.
+type circuitBreaker struct {
+	// the target the breaker guards, for the logs
+	name      string
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+	onChange  func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// whether the half-open probe is out
+	probing bool
+
+	// how many times the breaker opened
+	opens atomic.Int64
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration, clock Clock, onChange func(from, to BreakerState)) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, clock: clock, onChange: onChange}
+}
+
+// how long until a call may go out, 0 if one may go right now
+func (b *circuitBreaker) blockedFor() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return max(b.openedAt.Add(b.cooldown).Sub(b.clock.Now()), 0)
+	case BreakerHalfOpen:
+		if b.probing {
+			return breakerProbePoll
+		}
+	}
+	return 0
+}
+
+// asks to make a call. Unless wait is 0 the call must not go out, wait is how long until asking again makes sense.
+// probe tells whether the call is the half-open probe, which has to be passed on to record.
+func (b *circuitBreaker) acquire() (probe bool, wait time.Duration) {
+	if b == nil {
+		return false, 0
+	}
+	b.mu.Lock()
+	from := b.state
+
+	switch b.state {
+	case BreakerOpen:
+		wait = b.openedAt.Add(b.cooldown).Sub(b.clock.Now())
+		if wait > 0 {
+			break
+		}
+		wait = 0
+		b.state = BreakerHalfOpen
+		b.probing = true
+		probe = true
+	case BreakerHalfOpen:
+		if b.probing {
+			wait = breakerProbePoll
+			break
+		}
+		b.probing = true
+		probe = true
+	}
+
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+	return probe, wait
+}
+
+// records the outcome of a call made after acquire
+func (b *circuitBreaker) record(probe bool, outcome callOutcome) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	from := b.state
+
+	switch {
+	case probe:
+		b.probing = false
+		switch outcome {
+		case callSucceeded:
+			b.state = BreakerClosed
+			b.failures = 0
+		case callFailed:
+			b.open()
+		}
+	case b.state != BreakerClosed:
+		// a call that went out before the breaker opened, the probe decides
+	case outcome == callSucceeded:
+		b.failures = 0
+	case outcome == callFailed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	}
+
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+}
+
+// opens the breaker, called with mu held
+func (b *circuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.clock.Now()
+	b.failures = 0
+	b.opens.Add(1)
+}
+
+// reports a state change, called without mu held so the callback may look at the breaker
+func (b *circuitBreaker) changed(from, to BreakerState) {
+	if from == to {
+		return
+	}
+	log.Printf("Circuit breaker of %s %s -> %s", b.name, from, to)
+	if b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
+
+// the current state, BreakerClosed for a nil breaker
+func (b *circuitBreaker) current() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// waits for the target's circuit breaker to let the request out, or fails it right away without ParkWhenOpen.
+// Returns false if the request was answered instead, probe is to be passed on to record along with the call's outcome.
+func (rl *RateLimiter) passBreaker(t *target, req *UserRequest) (probe bool, ok bool) {
+	for {
+		probe, wait := t.breaker.acquire()
+		if wait == 0 {
+			return probe, true
+		}
+		if !rl.cfg.ParkWhenOpen {
+			t.stats.failed.Add(int64(req.size()))
+			rl.respond(req, &APIResponse{Err: ErrCircuitOpen})
+			return false, false
+		}
+
+		select {
+		case <-rl.clock.After(wait):
+		case <-req.context().Done():
+			rl.skipIfCancelled(req)
+			return false, false
+		case <-rl.shutdownChan:
+			rl.respond(req, &APIResponse{Err: ErrShuttingDown})
+			return false, false
+		}
+	}
+}
+
+// the current state of the default target's circuit breaker, always BreakerClosed without one
+func (rl *RateLimiter) BreakerState() BreakerState {
+	return rl.targets[DefaultTarget].breaker.current()
+}
+
+// how many times the default target's circuit breaker opened
+func (rl *RateLimiter) BreakerOpens() int64 {
+	return rl.targets[DefaultTarget].breaker.openCount()
+}
+
+// how many times the circuit breaker opened, 0 for a nil breaker
+func (b *circuitBreaker) openCount() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.opens.Load()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records the state changes of a circuit breaker
+type transitions struct {
+	mu      sync.Mutex
+	changes []BreakerState
+}
+
+func (r *transitions) record(from, to BreakerState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.changes) == 0 {
+		r.changes = append(r.changes, from)
+	}
+	r.changes = append(r.changes, to)
+}
+
+func (r *transitions) states() []BreakerState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.changes)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	var recorder transitions
+	b := newCircuitBreaker("test", 3, 10*time.Second, clock, recorder.record)
+
+	// a success in between starts the count over
+	for _, outcome := range []callOutcome{callFailed, callFailed, callSucceeded, callFailed, callFailed} {
+		b.record(false, outcome)
+	}
+	if b.current() != BreakerClosed {
+		t.Fatal("opened without 3 failures in a row")
+	}
+	b.record(false, callFailed)
+	if _, wait := b.acquire(); b.current() != BreakerOpen || wait != 10*time.Second {
+		t.Fatalf("%s, waiting %s after 3 failures in a row, expected open for the cooldown", b.current(), wait)
+	}
+
+	// a single probe once the cooldown is over, failing opens it again
+	clock.Advance(10 * time.Second)
+	probe, wait := b.acquire()
+	if !probe || wait != 0 {
+		t.Fatalf("probe %v, waiting %s after the cooldown", probe, wait)
+	}
+	if _, wait := b.acquire(); wait == 0 {
+		t.Fatal("a second call went out while the probe was out")
+	}
+	b.record(true, callFailed)
+	if b.current() != BreakerOpen {
+		t.Fatalf("%s after the probe failed, expected open", b.current())
+	}
+
+	clock.Advance(10 * time.Second)
+	probe, _ = b.acquire()
+	b.record(probe, callSucceeded)
+	expected := []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if states := recorder.states(); !slices.Equal(states, expected) {
+		t.Fatalf("went through %v, expected %v", states, expected)
+	}
+	if opens := b.openCount(); opens != 2 {
+		t.Fatalf("opened %d times, expected 2", opens)
+	}
+}
+
+func TestBreakerStopsCallsToADownThirdParty(t *testing.T) {
+	var recorder transitions
+	rl, clock, client := scriptedLimiter(Config{
+		BreakerThreshold: 3, BreakerCooldown: 10 * time.Second, OnBreakerStateChange: recorder.record, Workers: 1,
+	})
+	defer shutdownNow(rl)
+	// down for 3 calls, then back up
+	client.Script("", FailWith(500), FailWith(500), FailWith(500))
+
+	// not idempotent, a failed call isn't retried
+	send := func(userID string) *APIResponse {
+		req := testRequest(userID, "pay")
+		req.Idempotent = false
+		if err := rl.SubmitRequest(t.Context(), req); err != nil {
+			t.Fatal(err)
+		}
+		return awaitResponse(t, clock, req)
+	}
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		if resp := send(userID); !errors.Is(resp.Err, ErrServerError) {
+			t.Fatalf("request of %s: %v, expected the 500", userID, resp.Err)
+		}
+	}
+	if rl.BreakerState() != BreakerOpen {
+		t.Fatalf("breaker %s after 3 failures, expected open", rl.BreakerState())
+	}
+
+	// failed without a call while open
+	if resp := send("dave"); !errors.Is(resp.Err, ErrCircuitOpen) {
+		t.Fatalf("request while open: %v, expected ErrCircuitOpen", resp.Err)
+	}
+	if calls := len(client.Calls()); calls != 3 {
+		t.Fatalf("%d calls, expected none while the breaker is open", calls)
+	}
+
+	// the probe finds the third party back up
+	clock.Advance(10 * time.Second)
+	if resp := send("erin"); resp.Err != nil {
+		t.Fatalf("probe: %v, expected the third party back up", resp.Err)
+	}
+	if rl.BreakerState() != BreakerClosed {
+		t.Fatalf("breaker %s after a successful probe, expected closed", rl.BreakerState())
+	}
+	expected := []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if states := recorder.states(); !slices.Equal(states, expected) {
+		t.Fatalf("went through %v, expected %v", states, expected)
+	}
+}
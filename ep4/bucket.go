@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// allows bursts of up to capacity requests, refilling at refillPerMinute.
+// Capacity left unused while idle builds up (to capacity at most) instead of being lost, which a fixed
+// ticker can't do: one request every 60ms delays a small burst after minutes of silence for no reason.
+type tokenBucket struct {
+	tokens          float64
+	capacity        float64
+	refillPerMinute float64
+	lastRefill      time.Time
+}
+
+// creates a full bucket
+func newTokenBucket(perMinute, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		tokens:          float64(burst),
+		capacity:        float64(burst),
+		refillPerMinute: float64(perMinute),
+		lastRefill:      now,
+	}
+}
+
+// tops the bucket up for the time passed since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+	// not elapsed.Minutes(), which makes a second a hair less than 1/60 of a minute: at 60 a minute, a refill after
+	// exactly a second would leave the bucket short of its token
+	b.tokens = min(b.capacity, b.tokens+float64(elapsed)*b.refillPerMinute/float64(time.Minute))
+	// the refills add up fractions of a token a float can't hold exactly: at 6 a minute, ten refills a second apart
+	// make 0.9999999999999999 tokens, and the token due after 10s would only be there at the next refill
+	if whole := math.Round(b.tokens); math.Abs(b.tokens-whole) < 1e-9 {
+		b.tokens = whole
+	}
+	b.lastRefill = now
+}
+
+// takes a token if there is one
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// takes n tokens right away, going into debt if there aren't enough, and returns how long until the debt is paid
+// off, i.e how long to wait before using them. Whoever reserves next waits behind, so a big reservation can't be
+// starved by small ones taking every token as it comes in.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	missing := -b.tokens
+	// rounded up, rounding down could go out a hair before the debt is paid off
+	return time.Duration(math.Ceil(missing / b.refillPerMinute * float64(time.Minute)))
+}
+
+// reserves n tokens like reserve, unless there isn't a whole token left (the bucket is empty or already in debt)
+func (b *tokenBucket) reserveIfAvailable(n int, now time.Time) (time.Duration, bool) {
+	b.refill(now)
+	if b.tokens < 1 {
+		return 0, false
+	}
+	return b.reserve(n, now), true
+}
+
+// gives back n tokens taken by a reservation that didn't happen after all
+func (b *tokenBucket) refund(n int) {
+	b.tokens = min(b.capacity, b.tokens+float64(n))
+}
+
+// whether the bucket has refilled completely
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// changes how many tokens the bucket holds at most, the tokens above it are lost
+func (b *tokenBucket) setCapacity(capacity int, now time.Time) {
+	b.refill(now)
+	b.capacity = float64(capacity)
+	b.tokens = min(b.tokens, b.capacity)
+}
+
+// changes the refill rate from now on, the time passed so far is refilled at the old rate
+func (b *tokenBucket) setRate(perMinute float64, now time.Time) {
+	b.refill(now)
+	b.refillPerMinute = perMinute
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// a token a second, 5 at most
+	b := newTokenBucket(60, 5, testStart)
+	for i := range 5 {
+		if !b.take(testStart) {
+			t.Fatalf("token %d of the burst refused", i+1)
+		}
+	}
+	if b.take(testStart) {
+		t.Fatal("took a sixth token from a bucket of 5")
+	}
+	if b.take(testStart.Add(999 * time.Millisecond)) {
+		t.Fatal("took a token before it refilled")
+	}
+	if !b.take(testStart.Add(time.Second)) {
+		t.Fatal("no token a second later")
+	}
+
+	// idle for an hour, capacity builds up to the burst and no further
+	idle := testStart.Add(time.Hour)
+	taken := 0
+	for b.take(idle) {
+		taken++
+	}
+	if taken != 5 {
+		t.Fatalf("%d tokens after an hour idle, expected the burst of 5", taken)
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(60, 2, testStart)
+	if wait := b.reserve(2, testStart); wait != 0 {
+		t.Fatalf("waiting %s for the tokens in the bucket", wait)
+	}
+	// 3 tokens short, whoever comes next waits behind
+	if wait := b.reserve(3, testStart); wait != 3*time.Second {
+		t.Fatalf("waiting %s for 3 tokens, expected 3s", wait)
+	}
+	if _, ok := b.reserveIfAvailable(1, testStart.Add(3*time.Second)); ok {
+		t.Fatal("reserved from a bucket that just paid off its debt")
+	}
+	if wait, ok := b.reserveIfAvailable(1, testStart.Add(4*time.Second)); !ok || wait != 0 {
+		t.Fatalf("reserving a refilled token: %s, %v", wait, ok)
+	}
+}
+
+func TestTokenBucketRefillsAddUp(t *testing.T) {
+	// a token every 10s, checked on every second
+	b := newTokenBucket(6, 1, testStart)
+	b.take(testStart)
+	for i := 1; i < 10; i++ {
+		if b.take(testStart.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("took a token %ds in, expected it after 10s", i)
+		}
+	}
+	if !b.take(testStart.Add(10 * time.Second)) {
+		t.Fatal("no token after 10s")
+	}
+}
+
+func TestBurstAfterIdleness(t *testing.T) {
+	const burst = 5
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: burst})
+	defer shutdownNow(rl)
+
+	// the burst is used up, then nothing for a minute
+	for _, req := range submitRequests(t, rl, burst) {
+		awaitResponse(t, clock, req)
+	}
+	clock.Advance(time.Minute)
+	idleUntil := clock.Now()
+
+	var pending []*UserRequest
+	for range burst + 2 {
+		req := testRequest("alice", "ping")
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+	for _, req := range pending {
+		awaitResponse(t, clock, req)
+	}
+
+	// the burst went out right away, the rest at the rate
+	calls := client.Calls()[burst:]
+	for i, call := range calls {
+		expected := idleUntil
+		if i >= burst {
+			expected = idleUntil.Add(time.Duration(i-burst+1) * time.Second)
+		}
+		if !call.At.Equal(expected) {
+			t.Fatalf("call %d after the idle minute went out at +%s, expected +%s", i, call.At.Sub(idleUntil),
+				expected.Sub(idleUntil))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/**
+The same call made again a few seconds later usually gets the same answer, and spends quota for it all the same.
+
+Requests marked Cacheable (safe to answer from a recent response, e.g GET-style reads) are looked up in a
+responseCache before they are queued. A hit is answered right away without touching the queue or the quota. A miss
+goes out as usual and its response is kept for Config.CacheTTL.
+
+Errors are never cached: a failure is exactly what a retry a few seconds later may not get again.
+The cache is a bounded LRU, beyond Config.CacheSize entries the least recently used one is dropped.
+*/
+
+// defaults for Config.CacheTTL and Config.CacheSize
+const (
+	defaultCacheTTL  = 30 * time.Second
+	defaultCacheSize = 1000
+)
+
+// a cached response
+type cacheEntry struct {
+	key     string
+	resp    APIResponse
+	expires time.Time
+}
+
+// responses by cache key, see above
+type responseCache struct {
+	ttl  time.Duration
+	size int
+
+	mu sync.Mutex
+	// most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newResponseCache(ttl time.Duration, size int) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// the response cached under key, if there is one that hasn't expired
+func (c *responseCache) get(key string, now time.Time) (*APIResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	resp := entry.resp
+	resp.Cached = true
+	return &resp, true
+}
+
+// caches the response under key for the TTL, errors are never cached
+func (c *responseCache) put(key string, resp *APIResponse, now time.Time) {
+	if resp == nil || resp.Err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		entry := element.Value.(*cacheEntry)
+		entry.resp = *resp
+		entry.expires = now.Add(c.ttl)
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, resp: *resp, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// identical calls share a cache key: same user, same target, same data
+func (req *UserRequest) cacheKey() string {
+	return req.UserID + "\x00" + req.Target + "\x00" + req.Data
+}
+
+// answers the request from the cache if it is Cacheable and a fresh response is cached, reporting whether it did
+func (rl *RateLimiter) answerFromCache(req *UserRequest) bool {
+	if !req.Cacheable {
+		return false
+	}
+	resp, hit := rl.cache.get(req.cacheKey(), rl.clock.Now())
+	if !hit {
+		return false
+	}
+	rl.stats.cacheHits.Add(1)
+	rl.respond(req, resp)
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// submits a Cacheable request of the user and waits for its response
+func cachedRequest(t *testing.T, rl *RateLimiter, clock *FakeClock, userID, data string) *APIResponse {
+	t.Helper()
+	req := testRequest(userID, data)
+	req.Cacheable = true
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	return awaitResponse(t, clock, req)
+}
+
+// fails unless the requests of the user for each data were answered as cached says, with a call for each miss
+func expectCached(t *testing.T, rl *RateLimiter, clock *FakeClock, userID string, cached bool, data ...string) {
+	t.Helper()
+	client := rl.cfg.Client.(*ScriptedClient)
+	for _, d := range data {
+		before := len(client.Calls())
+		resp := cachedRequest(t, rl, clock, userID, d)
+		if resp.Err != nil {
+			t.Fatalf("request of %s for %s failed: %v", userID, d, resp.Err)
+		}
+		if calls := len(client.Calls()) - before; resp.Cached != cached || (calls == 0) != cached {
+			t.Fatalf("request of %s for %s: cached %t with %d calls, expected cached %t", userID, d, resp.Cached,
+				calls, cached)
+		}
+	}
+}
+
+func TestCacheAnswersIdenticalRequests(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{})
+	defer shutdownNow(rl)
+
+	expectCached(t, rl, clock, "alice", false, "search?q=go")
+	expectCached(t, rl, clock, "alice", true, "search?q=go", "search?q=go")
+	// other data, or another user, is another call
+	expectCached(t, rl, clock, "alice", false, "search?q=rust")
+	expectCached(t, rl, clock, "bob", false, "search?q=go")
+
+	// a request that doesn't say it may be answered from the cache isn't
+	client := rl.cfg.Client.(*ScriptedClient)
+	req := testRequest("alice", "search?q=go")
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if resp := awaitResponse(t, clock, req); resp.Cached || len(client.Calls()) != 4 {
+		t.Fatalf("request not Cacheable answered from the cache: %+v", resp)
+	}
+	if hits := rl.Stats().CacheHits; hits != 2 {
+		t.Fatalf("%d cache hits counted, expected 2", hits)
+	}
+}
+
+func TestCacheEntriesExpire(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{CacheTTL: 10 * time.Second})
+	defer shutdownNow(rl)
+
+	expectCached(t, rl, clock, "alice", false, "search?q=go")
+	clock.Advance(9 * time.Second)
+	expectCached(t, rl, clock, "alice", true, "search?q=go")
+	// a hit doesn't make the entry last longer
+	clock.Advance(time.Second)
+	expectCached(t, rl, clock, "alice", false, "search?q=go")
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{CacheSize: 2})
+	defer shutdownNow(rl)
+
+	expectCached(t, rl, clock, "alice", false, "a", "b")
+	// a was used last, b goes to make room for c
+	expectCached(t, rl, clock, "alice", true, "a")
+	expectCached(t, rl, clock, "alice", false, "c")
+	expectCached(t, rl, clock, "alice", true, "a", "c")
+	expectCached(t, rl, clock, "alice", false, "b")
+}
+
+func TestCacheNeverKeepsErrors(t *testing.T) {
+	rl, clock, client := scriptedLimiter(Config{})
+	defer shutdownNow(rl)
+	client.Script("alice", RejectWith(404))
+
+	if resp := cachedRequest(t, rl, clock, "alice", "search?q=go"); resp.Err == nil {
+		t.Fatal("request succeeded, expected the scripted 404")
+	}
+	// the next one goes out, and gets an answer worth keeping
+	expectCached(t, rl, clock, "alice", false, "search?q=go")
+	expectCached(t, rl, clock, "alice", true, "search?q=go")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// talks to the third-party API. Failed calls return one of the errors of errors.go: a *RateLimitedError saying how
+// long to wait, a *ServerError, a *NetworkError or a *ClientError (see DefaultIsRetryable). Clients that know better
+// implement RetryClassifier, see retry.go.
+type ThirdPartyClient interface {
+	Call(ctx context.Context, req *UserRequest) (*APIResponse, error)
+}
+
+// simulates the third-party API, rate limiting 30% of the calls at random (see scripted.go)
+type SimulatedClient struct {
+	// where the outcomes come from, nil means a policy seeded with 1 shared by every SimulatedClient
+	Policy *RandomPolicy
+}
+
+func (c SimulatedClient) policy() *RandomPolicy {
+	if c.Policy == nil {
+		return defaultRandomPolicy
+	}
+	return c.Policy
+}
+
+func (c SimulatedClient) Call(ctx context.Context, req *UserRequest) (*APIResponse, error) {
+	return c.policy().Outcome(req).play(ctx, realClock{}, req)
+}
+
+// calls a real third-party API over HTTP: the request's Data is POSTed to BaseURL on behalf of the user
+type HTTPTransport struct {
+	BaseURL string
+	// header carrying the credentials, e.g "Authorization" with "Bearer <token>"
+	AuthHeader string
+	AuthValue  string
+	// how long a single call may take, 0 means no limit other than the request's context
+	Timeout time.Duration
+	// nil means http.DefaultClient
+	Client *http.Client
+	// tells rate-limited responses apart, nil means DefaultResponseParser
+	ResponseParser ResponseParser
+}
+
+// tells whether the third party rate limited a call, and how long it wants us to wait (0 if it doesn't say, the
+// Backoff is used then). The body can be read, it is read already and only kept for the error message.
+// APIs that don't answer with a 429, e.g GitHub's 403 with X-RateLimit-Remaining: 0, need a parser of their own.
+type ResponseParser func(resp *http.Response) (rateLimited bool, retryAfter time.Duration)
+
+// a 429 is rate limited, Retry-After (seconds or an HTTP date) says for how long
+func DefaultResponseParser(resp *http.Response) (rateLimited bool, retryAfter time.Duration) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return false, 0
+	}
+	if info := parseRateLimitHeaders(resp.Header, time.Now()); info != nil {
+		retryAfter = info.RetryAfter
+	}
+	return true, retryAfter
+}
+
+func (t *HTTPTransport) Call(ctx context.Context, req *UserRequest) (*APIResponse, error) {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.BaseURL, strings.NewReader(req.Data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("X-User-ID", req.UserID)
+	// the same for every attempt, so the third party can tell a retry from a new request
+	if req.IdempotencyKey != "" {
+		httpReq.Header.Set(IdempotencyKeyHeader, req.IdempotencyKey)
+	}
+	if t.AuthHeader != "" {
+		httpReq.Header.Set(t.AuthHeader, t.AuthValue)
+	}
+
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, newNetworkError(err)
+	}
+	defer httpResp.Body.Close()
+
+	// the body of an error response is only kept for the error message
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, newNetworkError(err)
+	}
+	info := parseRateLimitHeaders(httpResp.Header, time.Now())
+
+	parse := t.ResponseParser
+	if parse == nil {
+		parse = DefaultResponseParser
+	}
+	httpResp.Body = io.NopCloser(bytes.NewReader(body))
+	if rateLimited, retryAfter := parse(httpResp); rateLimited {
+		limited := &RateLimitedError{}
+		if info != nil {
+			limited.Info = *info
+		}
+		// the retry waits for it instead of the Backoff
+		limited.Info.RetryAfter = retryAfter
+		return nil, limited
+	}
+
+	switch {
+	case httpResp.StatusCode >= 500:
+		return nil, &ServerError{StatusCode: httpResp.StatusCode, Body: string(body)}
+	case httpResp.StatusCode >= 300:
+		return nil, &ClientError{StatusCode: httpResp.StatusCode, Body: string(body)}
+	}
+	return &APIResponse{Data: string(body), RateLimit: info}, nil
+}
+
+// reads Retry-After and the common X-RateLimit-Remaining / X-RateLimit-Reset headers, nil if none are set
+func parseRateLimitHeaders(header http.Header, now time.Time) *RateLimitInfo {
+	var info RateLimitInfo
+	found := false
+
+	// either a number of seconds or an HTTP date
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			info.RetryAfter = time.Duration(seconds) * time.Second
+			found = true
+		} else if at, err := http.ParseTime(retryAfter); err == nil {
+			info.RetryAfter = max(at.Sub(now), 0)
+			found = true
+		}
+	}
+	// the reset is a Unix timestamp, and only means something along with the remaining count
+	remaining, errRemaining := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	reset, errReset := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if errRemaining == nil && errReset == nil {
+		info.Remaining = remaining
+		info.Reset = time.Unix(reset, 0)
+		found = true
+	}
+
+	if !found {
+		return nil
+	}
+	return &info
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// the source of time for the rate limiter, swapping it out (e.g for a fake clock in tests) makes pacing
+// and backoff controllable
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// the default Clock, backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// a context done after d on the clock, like context.WithTimeout (which it is with the real clock). With any other
+// clock its Err is context.Canceled, context.Cause tells context.DeadlineExceeded.
+func withClockTimeout(parent context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, real := clock.(realClock); real {
+		return context.WithTimeout(parent, d)
+	}
+	ctx, cancel := context.WithCancelCause(parent)
+	go func() {
+		select {
+		case <-clock.After(d):
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// a Clock that only moves when told to, so a minute of pacing and backoff takes as long as the work in it
+// (see simulate_test.go). Safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+// a channel returned by After, fired once the clock reaches at
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// a FakeClock showing now until it is moved
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// a channel the time is sent on once the clock has been moved d forward, right away if d isn't positive
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// buffered, nobody may be receiving anymore by the time it fires
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// moves the clock d forward, firing the timers due by then
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.timers = slices.DeleteFunc(c.timers, func(t fakeTimer) bool {
+		if t.at.After(c.now) {
+			return false
+		}
+		t.ch <- c.now
+		return true
+	})
+}
+
+// moves the clock to the earliest timer and fires it (along with any due at the same time), false if there is none
+func (c *FakeClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	next := slices.MinFunc(c.timers, func(a, b fakeTimer) int { return a.at.Compare(b.at) }).at
+	d := next.Sub(c.now)
+	c.mu.Unlock()
+
+	c.Advance(d)
+	return true
+}
+
+// how many channels returned by After haven't fired yet
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
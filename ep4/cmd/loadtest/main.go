@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+How much sustained load does the rate limiter take before the queue backs up? The load test fires requests at a
+running ep4 server at a fixed rate and reports how long they took to be answered.
+
+The rate is kept by a time.Ticker, and every request is sent from a goroutine of its own: waiting on a response must
+not delay the next request, or the test measures its own slowness instead of the server's (the coordinated omission
+problem). A time.Ticker drops ticks a slow receiver misses, the summary reports the rate actually achieved.
+
+The senders record their results with atomic counters only. Latencies go into a histogram with fixed buckets of
+atomic counters, so a percentile is reported as the upper bound of the bucket it falls in (at most 10% too high).
+
+The summary is a single JSON document on stdout, e.g
+
+	go run ./ep4/cmd/loadtest --rps 50 --duration 30s --users 20 | jq .latency_ms.p99
+*/
+
+// upper bounds of the latency histogram buckets, each 10% above the previous one from 1ms to a minute. Anything
+// longer goes into an extra last bucket.
+var latencyBuckets = func() []time.Duration {
+	var buckets []time.Duration
+	for bound := float64(time.Millisecond); bound < float64(time.Minute); bound *= 1.1 {
+		buckets = append(buckets, time.Duration(bound))
+	}
+	return append(buckets, time.Minute)
+}()
+
+// counts latencies per bucket of latencyBuckets, safe for concurrent use without locks
+type histogram struct {
+	counts []atomic.Int64
+	// the longest latency observed, reported for percentiles falling into the last bucket
+	longest atomic.Int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]atomic.Int64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i].Add(1)
+	for {
+		longest := h.longest.Load()
+		if int64(d) <= longest || h.longest.CompareAndSwap(longest, int64(d)) {
+			return
+		}
+	}
+}
+
+// the upper bound of the bucket holding the q-th quantile (0 < q <= 1), 0 without observations. Only called once
+// the senders are done.
+func (h *histogram) quantile(q float64) time.Duration {
+	total := int64(0)
+	for i := range h.counts {
+		total += h.counts[i].Load()
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := max(int64(q*float64(total)), 1)
+	seen := int64(0)
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			if i < len(latencyBuckets) {
+				// the bucket's bound can be above anything observed
+				return min(latencyBuckets[i], time.Duration(h.longest.Load()))
+			}
+			break
+		}
+	}
+	return time.Duration(h.longest.Load())
+}
+
+// what happened to the requests sent, updated by the senders
+type results struct {
+	sent      atomic.Int64
+	succeeded atomic.Int64
+	// 429s: the user has too many requests pending, or the third party rate limited us
+	rejected atomic.Int64
+	// 503s: the queue is full or the circuit breaker is open
+	unavailable atomic.Int64
+	// 504s from the server giving up on the queue, or no answer within -timeout
+	timeouts atomic.Int64
+	// any other status, or the request couldn't be sent at all
+	errors atomic.Int64
+
+	// from sending a request to its response, whatever the response
+	latency *histogram
+}
+
+// the JSON document printed at the end
+type summary struct {
+	URL             string         `json:"url"`
+	TargetRPS       float64        `json:"target_rps"`
+	AchievedRPS     float64        `json:"achieved_rps"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Users           int            `json:"users"`
+	Sent            int64          `json:"sent"`
+	Succeeded       int64          `json:"succeeded"`
+	Rejected        int64          `json:"rejected"`
+	Unavailable     int64          `json:"unavailable"`
+	Timeouts        int64          `json:"timeouts"`
+	Errors          int64          `json:"errors"`
+	LatencyMs       latencySummary `json:"latency_ms"`
+}
+
+type latencySummary struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// sends a request for the user and records what came of it
+func send(client *http.Client, url, userID string, r *results) {
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		r.errors.Add(1)
+		return
+	}
+	req.Header.Set("X-User-ID", userID)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		r.latency.observe(time.Since(start))
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			r.timeouts.Add(1)
+		} else {
+			r.errors.Add(1)
+		}
+		return
+	}
+	// the response only counts as received once it is read entirely
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	r.latency.observe(time.Since(start))
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		r.succeeded.Add(1)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		r.rejected.Add(1)
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		r.unavailable.Add(1)
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		r.timeouts.Add(1)
+	default:
+		r.errors.Add(1)
+	}
+}
+
+func main() {
+	rps := flag.Float64("rps", 10, "requests per second to send")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send requests for")
+	users := flag.Int("users", 10, "number of distinct user IDs to spread the requests over")
+	url := flag.String("url", "http://localhost:8080/api/request", "the endpoint to load")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long to wait for a response before counting a timeout")
+	flag.Parse()
+
+	if *rps <= 0 || *duration <= 0 || *users <= 0 {
+		fmt.Fprintln(os.Stderr, "-rps, -duration and -users must be positive")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		// every request in flight needs a connection of its own, the default of 2 idle ones per host would have most
+		// requests open a new connection (and measure that)
+		Transport: &http.Transport{MaxIdleConnsPerHost: 1000},
+	}
+	r := &results{latency: newHistogram()}
+
+	ctx, stop := context.WithTimeout(context.Background(), *duration)
+	defer stop()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rps))
+	defer ticker.Stop()
+
+	log.Printf("Sending %.1f requests per second to %s for %s", *rps, *url, *duration)
+	var wg sync.WaitGroup
+	start := time.Now()
+sending:
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			break sending
+		case <-ticker.C:
+			r.sent.Add(1)
+			userID := fmt.Sprintf("user-%d", i%*users)
+			wg.Go(func() { send(client, *url, userID, r) })
+		}
+	}
+	elapsed := time.Since(start)
+	log.Printf("Sent %d requests, waiting for the last responses", r.sent.Load())
+	wg.Wait()
+
+	out := summary{
+		URL:             *url,
+		TargetRPS:       *rps,
+		AchievedRPS:     float64(r.sent.Load()) / elapsed.Seconds(),
+		DurationSeconds: elapsed.Seconds(),
+		Users:           *users,
+		Sent:            r.sent.Load(),
+		Succeeded:       r.succeeded.Load(),
+		Rejected:        r.rejected.Load(),
+		Unavailable:     r.unavailable.Load(),
+		Timeouts:        r.timeouts.Load(),
+		Errors:          r.errors.Load(),
+		LatencyMs: latencySummary{
+			P50: milliseconds(r.latency.quantile(0.5)),
+			P95: milliseconds(r.latency.quantile(0.95)),
+			P99: milliseconds(r.latency.quantile(0.99)),
+			Max: milliseconds(time.Duration(r.latency.longest.Load())),
+		},
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(out); err != nil {
+		log.Fatalf("Writing the summary failed: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+Not every call counts the same against the third party's limit: a batch search may count as 10 requests. Pacing them
+as 1 request each blows through the quota 10 times faster than planned.
+
+UserRequest.Cost says how many units a call counts as, and the token bucket takes that many tokens before the call
+goes out, so the units sent per minute stay within RequestsPerMinute whatever the mix of costs. A bucket never holds
+more than Burst tokens, so a request costing more than Burst could never go out: SubmitRequest refuses it with a
+CostTooHighError instead of letting it wait forever.
+
+Config.MaxCost lowers that ceiling. A request costing the whole Burst empties the bucket, every request paced after it
+waits for the bucket to refill that far: a few of them keep cheap requests waiting a long time. With MaxCost, bigger
+requests are refused and have to be split by the caller.
+
+A call takes its units as soon as it is paced, running the bucket into debt if it has to, and goes out once the debt
+is paid off. Calls paced after it wait their turn behind it, otherwise cheap calls would grab every token as it comes
+in and an expensive one could wait forever.
+*/
+
+// matches a CostTooHighError with errors.Is
+var ErrCostTooHigh = errors.New("request cost exceeds the most a request may cost")
+
+// returned by SubmitRequest for a request that costs more units than its target's token bucket can ever hold, or
+// than Config.MaxCost
+type CostTooHighError struct {
+	Cost int
+	// the most a request for the target may cost, its Burst or MaxCost if lower
+	Limit int
+}
+
+func (e *CostTooHighError) Error() string {
+	return fmt.Sprintf("request costs %d units, more than the %d a request may cost", e.Cost, e.Limit)
+}
+
+func (e *CostTooHighError) Is(target error) bool {
+	return target == ErrCostTooHigh
+}
+
+// the units of quota a call for the request takes, at least 1
+func (req *UserRequest) cost() int {
+	return max(req.Cost, 1)
+}
+
+// refuses requests that could never go out, or that cost more than MaxCost
+func (rl *RateLimiter) checkCost(req *UserRequest) error {
+	limit := rl.targetOf(req).currentLimits().burst
+	if rl.cfg.MaxCost > 0 {
+		limit = min(limit, rl.cfg.MaxCost)
+	}
+	if req.cost() > limit {
+		return &CostTooHighError{Cost: req.cost(), Limit: limit}
+	}
+	return nil
+}
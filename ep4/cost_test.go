@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCostsArePacedInUnits(t *testing.T) {
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 10})
+	defer shutdownNow(rl)
+	// the data of each request is its cost
+	var pending []*UserRequest
+	total := 0
+	for i := range 40 {
+		cost := []int{10, 1, 5, 3}[i%4]
+		req := testRequest(fmt.Sprintf("user%d", i%3), strconv.Itoa(cost))
+		req.Cost = cost
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+		total += cost
+	}
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+
+	// whichever minute is looked at, the units of the calls in it
+	calls := client.Calls()
+	for i, last := range calls {
+		units := 0
+		for _, call := range calls[:i+1] {
+			if last.At.Sub(call.At) < time.Minute {
+				cost, _ := strconv.Atoi(call.Data)
+				units += cost
+			}
+		}
+		if units > 60 {
+			t.Fatalf("%d units sent in the minute up to %s, expected 60 at most", units, last.At.Format(time.TimeOnly))
+		}
+	}
+	if sent := rl.Stats().UnitsSent; sent != int64(total) {
+		t.Fatalf("%d units counted as sent, expected %d", sent, total)
+	}
+	// 190 units at 60 a minute, the first 10 of them at once
+	if took := calls[len(calls)-1].At.Sub(testStart); took < 3*time.Minute {
+		t.Fatalf("%d units sent in %s, expected 60 a minute", total, took)
+	}
+}
+
+func TestCostAboveBurstIsRefused(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		maxCost int
+		cost    int
+		// 0 if the request is let in
+		limit int
+	}{
+		{"the whole burst", 0, 10, 0},
+		{"above the burst", 0, 11, 10},
+		{"above MaxCost", 5, 6, 5},
+		{"MaxCost", 5, 5, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, _, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 10, MaxCost: tc.maxCost})
+			defer shutdownNow(rl)
+
+			req := testRequest("alice", "batch search")
+			req.Cost = tc.cost
+			err := rl.SubmitRequest(context.Background(), req)
+			if tc.limit == 0 {
+				if err != nil {
+					t.Fatalf("request costing %d refused: %v", tc.cost, err)
+				}
+				return
+			}
+			var tooHigh *CostTooHighError
+			if !errors.Is(err, ErrCostTooHigh) || !errors.As(err, &tooHigh) || tooHigh.Cost != tc.cost ||
+				tooHigh.Limit != tc.limit {
+				t.Fatalf("request costing %d: %v, expected a CostTooHighError with the limit %d", tc.cost, err, tc.limit)
+			}
+			if len(req.Response) != 0 || len(client.Calls()) != 0 || rl.QueueDepth() != 0 {
+				t.Fatal("refused request was queued")
+			}
+		})
+	}
+}
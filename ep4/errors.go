@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+/**
+A call to the third party fails in one of four ways, and each calls for its own handling:
+
+	RateLimitedError  429, the third party turned the call away: retried after Retry-After, never acted on
+	ServerError       5xx, the third party failed on its end: retried, if the request is safe to retry (see retry.go)
+	NetworkError      no answer at all: retried if Temporary (a reset, a timeout), failed otherwise
+	ClientError       any other 3xx/4xx, the request itself was refused: failed right away, it would only fail again
+
+Each matches its sentinel with errors.Is (ErrRateLimited, ErrServerError, ErrNetwork, ErrClientError) and is found
+with errors.As, whatever wraps it: the error a request fails with after its last retry wraps the last call's.
+HTTPTransport returns them, other clients should too, DefaultIsRetryable and the handler go by them.
+
+A ClientError doesn't count against the circuit breaker: the third party answered, the request was the problem.
+
+The handler answers the end user with the status that tells them what to do: 429 to slow down, 502 when the third
+party failed (504 if it never answered in time), and the third party's own 4xx when it refused what the user sent
+(400, 404, 409, 422). A 401 or 403 is about our credentials, not the user's request, they get a 502.
+*/
+
+var (
+	// matches a ServerError with errors.Is
+	ErrServerError = errors.New("third-party API failed")
+	// matches a ClientError with errors.Is
+	ErrClientError = errors.New("third-party API rejected the request")
+	// matches a NetworkError with errors.Is
+	ErrNetwork = errors.New("third-party API unreachable")
+)
+
+// the third party failed on its end (5xx), trying again later may well work
+type ServerError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("third-party API failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *ServerError) Is(target error) bool {
+	return target == ErrServerError
+}
+
+// the third party refused the request (a 3xx or 4xx other than rate limiting), sending it again won't help
+type ClientError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("third-party API rejected the request with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *ClientError) Is(target error) bool {
+	return target == ErrClientError
+}
+
+// the call got no answer: the connection failed, was cut or timed out
+type NetworkError struct {
+	// the next call may well go through (a reset, a timeout), see transientNetworkError
+	Temporary bool
+	Err       error
+}
+
+func newNetworkError(err error) *NetworkError {
+	return &NetworkError{Temporary: transientNetworkError(err), Err: err}
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrNetwork, e.Err)
+}
+
+func (e *NetworkError) Is(target error) bool {
+	return target == ErrNetwork
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// the statuses of a ClientError passed on to the end user, the request they sent is the problem
+var clientErrorStatuses = map[int]bool{
+	http.StatusBadRequest:          true,
+	http.StatusNotFound:            true,
+	http.StatusConflict:            true,
+	http.StatusUnprocessableEntity: true,
+}
+
+// the status and message answering the end user whose request failed with err, see above
+func responseStatus(err error) (int, string) {
+	var clientErr *ClientError
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, "Service is busy, please try again later."
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrShuttingDown), errors.Is(err, ErrEvicted):
+		return http.StatusServiceUnavailable, "Service is unavailable, please try again later."
+	case errors.Is(err, ErrExpired):
+		// it couldn't go out before the handler's timeout
+		return http.StatusGatewayTimeout, "Request timed out"
+	case errors.Is(err, ErrAmbiguousResult):
+		// a blind retry could do it twice, the client has to check first
+		return http.StatusBadGateway, "The request may or may not have gone through, check before retrying."
+	case errors.Is(err, ErrTransformFailed):
+		// the data couldn't be put in the shape the third party wants, see transform.go
+		return http.StatusBadRequest, err.Error()
+	case errors.As(err, &clientErr) && clientErrorStatuses[clientErr.StatusCode]:
+		return clientErr.StatusCode, clientErr.Body
+	case errors.Is(err, ErrNetwork) && timedOut(err):
+		return http.StatusGatewayTimeout, "The third party didn't answer in time, please try again later."
+	case errors.Is(err, ErrServerError), errors.Is(err, ErrClientError), errors.Is(err, ErrNetwork):
+		return http.StatusBadGateway, "The third party failed to handle the request."
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
+// whether the call ran out of time
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestResponseStatus(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"rate limited", ErrRateLimited, http.StatusTooManyRequests},
+		{"circuit open", ErrCircuitOpen, http.StatusServiceUnavailable},
+		{"shutting down", ErrShuttingDown, http.StatusServiceUnavailable},
+		{"evicted", ErrEvicted, http.StatusServiceUnavailable},
+		{"expired", ErrExpired, http.StatusGatewayTimeout},
+		{"ambiguous", &AmbiguousResultError{Err: newNetworkError(context.DeadlineExceeded)}, http.StatusBadGateway},
+		{"transform failed", &TransformError{Err: errors.New("no such field")}, http.StatusBadRequest},
+		{"400", &ClientError{StatusCode: 400}, http.StatusBadRequest},
+		{"404", &ClientError{StatusCode: 404}, http.StatusNotFound},
+		{"409", &ClientError{StatusCode: 409}, http.StatusConflict},
+		{"422", &ClientError{StatusCode: 422}, http.StatusUnprocessableEntity},
+		// our credentials, not the user's request
+		{"401", &ClientError{StatusCode: 401}, http.StatusBadGateway},
+		{"403", &ClientError{StatusCode: 403}, http.StatusBadGateway},
+		{"deadline exceeded", newNetworkError(context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{"net timeout", newNetworkError(os.ErrDeadlineExceeded), http.StatusGatewayTimeout},
+		{"connection refused", newNetworkError(refused), http.StatusBadGateway},
+		{"server error", &ServerError{StatusCode: 500}, http.StatusBadGateway},
+		{"wrapped", fmt.Errorf("calling the third party: %w", &ClientError{StatusCode: 404}), http.StatusNotFound},
+		{"unknown", errors.New("something else"), http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, _ := responseStatus(tc.err); status != tc.status {
+				t.Fatalf("%v answered %d, expected %d", tc.err, status, tc.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/**
+A client about to queue behind 8,000 requests would rather know it and go elsewhere than find out 8 minutes later.
+
+EstimateWait guesses how long a request would wait before going out, from what is queued ahead of it for the same
+target and the rate the target currently gets tokens at:
+
+- ahead of it in its lane: its user's own requests, and from every other user of the lane as many requests as it has
+  itself (at most), that's how round-robin serves them. A light user doesn't wait behind a flooder's backlog.
+- from the other lane: 1 low priority request every LowPriorityEvery taken, as many as there are.
+- counted in units (UserRequest.Cost), not requests, and less the tokens the bucket already holds
+- plus what the target says about itself: a pause after it told us our quota is used up, or its circuit breaker
+  being open with ParkWhenOpen
+- and with PerUserLimit, the user's own requests going out no faster than that
+
+It is only an estimate: requests cancelled or expired while waiting make it too high, an adaptive rate backing off
+makes it too low.
+
+With Config.MaxEstimatedWait, SubmitRequest refuses requests estimated to wait longer with a WaitTooLongError, a 503
+the client can act on right away instead of a timeout after 5 seconds.
+*/
+
+// matches a WaitTooLongError with errors.Is
+var ErrWaitTooLong = errors.New("estimated wait exceeds the limit")
+
+// returned by SubmitRequest for a request estimated to wait longer than Config.MaxEstimatedWait
+type WaitTooLongError struct {
+	Estimate time.Duration
+	Limit    time.Duration
+}
+
+func (e *WaitTooLongError) Error() string {
+	return fmt.Sprintf("request would wait about %s, more than %s", e.Estimate.Round(time.Millisecond), e.Limit)
+}
+
+func (e *WaitTooLongError) Is(target error) bool {
+	return target == ErrWaitTooLong
+}
+
+// roughly how long the request would wait before going out if it was submitted now, see above
+func (rl *RateLimiter) EstimateWait(req *UserRequest) time.Duration {
+	return rl.estimateWait(req, rl.queue.unitsAhead(req), rl.queue.pendingFor(req.UserID))
+}
+
+// how long until the request goes out, with unitsAhead queued before it for its target and userAhead of its user's
+// own requests
+func (rl *RateLimiter) estimateWait(req *UserRequest, unitsAhead, userAhead int) time.Duration {
+	t := rl.targetOf(req)
+	if t == nil {
+		return 0
+	}
+	now := rl.clock.Now()
+	units := float64(unitsAhead + req.cost())
+
+	t.bucketMu.Lock()
+	t.recoverRate(now)
+	t.bucket.refill(now)
+	missing := units - t.bucket.tokens
+	perMinute := t.bucket.refillPerMinute
+	t.bucketMu.Unlock()
+
+	wait := time.Duration(max(missing, 0) / perMinute * float64(time.Minute))
+	if paused := time.Unix(0, t.pausedUntil.Load()).Sub(now); paused > 0 {
+		wait += paused
+	}
+	if rl.cfg.ParkWhenOpen {
+		wait += t.breaker.blockedFor()
+	}
+	if rl.cfg.PerUserLimit > 0 {
+		// the user's requests already queued go out first, at the user's own rate
+		userWait := time.Duration(userAhead) * time.Minute / time.Duration(rl.cfg.PerUserLimit)
+		wait = max(wait, userWait)
+	}
+	return wait
+}
+
+// refuses requests estimated to wait longer than MaxEstimatedWait
+func (rl *RateLimiter) checkEstimatedWait(req *UserRequest) error {
+	if rl.cfg.MaxEstimatedWait <= 0 {
+		return nil
+	}
+	if estimate := rl.EstimateWait(req); estimate > rl.cfg.MaxEstimatedWait {
+		return &WaitTooLongError{Estimate: estimate, Limit: rl.cfg.MaxEstimatedWait}
+	}
+	return nil
+}
+
+// the units queued for the request's target that would be taken before the request if it was pushed now, see above
+func (q *fairQueue) unitsAhead(req *UserRequest) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	own := &q.lanes[req.lane()]
+	// round-robin takes this many requests of every user before getting to the request
+	turns := len(own.requests[req.UserID]) + 1
+	ahead := 0
+	for _, userID := range own.users {
+		requests := own.requests[userID]
+		ahead += unitsFor(req.targetName(), requests[:min(len(requests), turns)])
+	}
+	return ahead + q.otherLaneUnits(req, ahead)
+}
+
+// the units of the other lane taken in between while ahead units of the request's lane are, see above (must be
+// called with mu held)
+func (q *fairQueue) otherLaneUnits(req *UserRequest, ahead int) int {
+	other := &q.lanes[PriorityHigh-req.lane()]
+	otherUnits := 0
+	for _, requests := range other.requests {
+		otherUnits += unitsFor(req.targetName(), requests)
+	}
+	// the low lane gets 1 request in every lowEvery taken while it has any
+	if req.lane() == PriorityHigh {
+		if q.lowEvery > 1 {
+			otherUnits = min(otherUnits, ahead/(q.lowEvery-1))
+		}
+	} else {
+		// the request itself is one of the low priority ones high priority requests are taken in between of
+		otherUnits = min(otherUnits, (ahead+req.cost())*(q.lowEvery-1))
+	}
+	return otherUnits
+}
+
+// the units of the requests that are for the named target
+func unitsFor(target string, requests []*UserRequest) int {
+	units := 0
+	for _, req := range requests {
+		if req.targetName() == target {
+			units += req.cost()
+		}
+	}
+	return units
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// a limiter sending a call a second, its token just spent, with 9 requests of alice queued
+func aliceBacklog(t *testing.T, cfg Config) (*RateLimiter, *FakeClock) {
+	t.Helper()
+	cfg.RequestsPerMinute, cfg.Burst, cfg.Workers = 60, 1, 1
+	rl, clock, _ := scriptedLimiter(cfg)
+	first := testRequest("zed", "ping")
+	if err := rl.SubmitRequest(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	awaitResponse(t, clock, first)
+	for range 9 {
+		if err := rl.SubmitRequest(context.Background(), testRequest("alice", "ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rl, clock
+}
+
+func TestEstimateWait(t *testing.T) {
+	rl, _ := aliceBacklog(t, Config{})
+	defer shutdownNow(rl)
+
+	expensive := testRequest("bob", "search")
+	expensive.Cost = 5
+	urgent := testRequest("carol", "ping")
+	urgent.Priority = PriorityHigh
+	for _, tc := range []struct {
+		name     string
+		req      *UserRequest
+		expected time.Duration
+	}{
+		// behind all of her own requests
+		{"alice", testRequest("alice", "ping"), 10 * time.Second},
+		// round-robin: behind alice's first request only
+		{"bob", testRequest("bob", "ping"), 2 * time.Second},
+		// behind alice's first request, and 5 units of its own
+		{"bob, cost 5", expensive, 6 * time.Second},
+		// the high priority lane is empty
+		{"carol, high priority", urgent, time.Second},
+	} {
+		if estimate := rl.EstimateWait(tc.req); estimate != tc.expected {
+			t.Errorf("%s: estimated %s, expected %s", tc.name, estimate, tc.expected)
+		}
+	}
+}
+
+func TestMaxEstimatedWait(t *testing.T) {
+	// enough for the backlog, up to alice's 9th request
+	rl, clock := aliceBacklog(t, Config{MaxEstimatedWait: 9500 * time.Millisecond})
+	defer shutdownNow(rl)
+
+	err := rl.SubmitRequest(context.Background(), testRequest("alice", "ping"))
+	var waitErr *WaitTooLongError
+	if !errors.As(err, &waitErr) || waitErr.Estimate != 10*time.Second {
+		t.Fatalf("submitting behind 10s of requests: %v, expected a WaitTooLongError", err)
+	}
+	if err := rl.SubmitRequest(context.Background(), testRequest("bob", "ping")); err != nil {
+		t.Fatalf("submitting 2s away: %v", err)
+	}
+
+	// through the handler, as background traffic to wait in the same lane. bob's request is queued too now: alice
+	// would wait 11s, dave gets his turn after alice's first and bob's
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer callbacks.Close()
+	server := httptest.NewServer(newMux(rl, newAsyncTracker(&WebhookSender{Secret: []byte("s")}, clock), "s", ""))
+	defer server.Close()
+	for _, tc := range []struct {
+		userID     string
+		status     int
+		header     string
+		headerName string
+	}{
+		{"alice", http.StatusServiceUnavailable, "2", "Retry-After"},
+		{"dave", http.StatusAccepted, "3000", "X-Estimated-Wait"},
+	} {
+		form := url.Values{"callback_url": {callbacks.URL}}
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/request?"+form.Encode(), nil)
+		req.Header.Set("X-User-ID", tc.userID)
+		req.Header.Set("X-Priority", "low")
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || resp.Header.Get(tc.headerName) != tc.header {
+			t.Fatalf("request of %s answered %d with %s %q, expected %d with %q", tc.userID, resp.StatusCode,
+				tc.headerName, resp.Header.Get(tc.headerName), tc.status, tc.header)
+		}
+	}
+}
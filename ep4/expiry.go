@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/**
+Cancellation only helps when whoever submitted a request gives up on it. A batch job queuing with a background
+context never does, and a request queued 10 minutes ago for a real-time feature is worthless by now: sending it spends
+third-party quota on an answer nobody can use, while fresher requests wait behind it.
+
+UserRequest.ExpiresAt (or Config.MaxQueueTime for every request that doesn't set one) puts a date on the request. Past
+it the request is answered with ErrExpired instead of being sent, be it still in the queue, waiting for a retry or
+waiting on the rate limit. A request already out to the third party is left alone, the quota is spent by then.
+
+The deadline of a request is the earlier of its ExpiresAt and the deadline of its context (e.g the handler's 5 second
+timeout). A request whose call (or next retry) can't go out before its deadline is answered right away rather than
+once it passes: 500ms + 2s + 8s of backoff don't fit in 5 seconds, there is no point sleeping through them, nor
+waiting on a reservation paid off after the deadline. Either way the response is an ErrExpired, which also matches
+context.DeadlineExceeded.
+*/
+
+// sent as the response for requests dropped because their ExpiresAt passed before they could be sent
+var ErrExpired = errors.New("request expired before it could be sent")
+
+// drops the request if its ExpiresAt passed, reporting whether it did
+func (rl *RateLimiter) skipIfExpired(req *UserRequest) bool {
+	if req.batch != nil {
+		return rl.dropFromBatch(req, rl.skipIfExpired)
+	}
+	if req.ExpiresAt.IsZero() || rl.clock.Now().Before(req.ExpiresAt) {
+		return false
+	}
+	rl.expired.Add(1)
+	rl.respond(req, &APIResponse{Err: ErrExpired})
+	return true
+}
+
+// the time past which the request is of no use, see above
+func (req *UserRequest) deadline() (time.Time, bool) {
+	deadline, ok := req.context().Deadline()
+	if !req.ExpiresAt.IsZero() && (!ok || req.ExpiresAt.Before(deadline)) {
+		return req.ExpiresAt, true
+	}
+	return deadline, ok
+}
+
+// drops the request if its call can't go out before its deadline, at being the earliest it could. cause is the error
+// of the call before it, nil for the first one. Reports whether it dropped the request.
+func (rl *RateLimiter) skipIfTooLate(req *UserRequest, at time.Time, cause error) bool {
+	if req.batch != nil {
+		return rl.dropFromBatch(req, func(req *UserRequest) bool { return rl.skipIfTooLate(req, at, cause) })
+	}
+	deadline, ok := req.deadline()
+	if !ok || at.Before(deadline) {
+		return false
+	}
+	rl.expired.Add(1)
+	err := fmt.Errorf("%w (%w): its call could go out in %s at the earliest, %s after its deadline", ErrExpired,
+		context.DeadlineExceeded, at.Sub(rl.clock.Now()), at.Sub(deadline))
+	if cause != nil {
+		err = fmt.Errorf("%w, the last call failed with: %w", err, cause)
+	}
+	rl.respond(req, &APIResponse{Err: err})
+	return true
+}
+
+// drops the request if it was cancelled or expired, reporting whether it did
+func (rl *RateLimiter) skipIfStale(req *UserRequest) bool {
+	if req.batch != nil {
+		return rl.dropFromBatch(req, rl.skipIfStale)
+	}
+	return rl.skipIfCancelled(req) || rl.skipIfExpired(req)
+}
+
+// whether skipIfStale would drop the request, without dropping it. Neither a done context nor a passed ExpiresAt
+// wears off, a request found stale here is still stale when skipIfStale answers it.
+func (rl *RateLimiter) isStale(req *UserRequest) bool {
+	if req.context().Err() != nil {
+		return true
+	}
+	return !req.ExpiresAt.IsZero() && !rl.clock.Now().Before(req.ExpiresAt)
+}
+
+// how many requests were dropped because they expired before they could be sent
+func (rl *RateLimiter) Expired() int64 {
+	return rl.expired.Load()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiredRequestsAreNotSent(t *testing.T) {
+	expiresAt := testStart.Add(2500 * time.Millisecond)
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		// sets the request's own expiry
+		expire func(req *UserRequest)
+	}{
+		{"ExpiresAt", Config{}, func(req *UserRequest) { req.ExpiresAt = expiresAt }},
+		{"MaxQueueTime", Config{MaxQueueTime: 2500 * time.Millisecond}, func(req *UserRequest) {}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a call a second, the queue drains slower than the requests expire
+			tc.cfg.RequestsPerMinute, tc.cfg.Burst = 60, 1
+			rl, clock, client := scriptedLimiter(tc.cfg)
+			defer shutdownNow(rl)
+			var pending []*UserRequest
+			for i := range 6 {
+				req := testRequest(fmt.Sprintf("user%d", i), "ping")
+				tc.expire(req)
+				if err := rl.SubmitRequest(context.Background(), req); err != nil {
+					t.Fatal(err)
+				}
+				pending = append(pending, req)
+			}
+
+			// the calls at 0s, 1s and 2s make it, the one at 3s would come too late
+			for i, req := range pending {
+				resp := awaitResponse(t, clock, req)
+				if expired := errors.Is(resp.Err, ErrExpired); expired != (i >= 3) || (!expired && resp.Err != nil) {
+					t.Fatalf("request of %s answered %v, expected it expired: %t", req.UserID, resp.Err, i >= 3)
+				}
+			}
+			for _, call := range client.Calls() {
+				if call.UserID >= "user3" {
+					t.Fatalf("expired request of %s sent at %s", call.UserID, call.At.Format(time.TimeOnly))
+				}
+			}
+			if calls := len(client.Calls()); calls != 3 {
+				t.Fatalf("%d calls, expected one for each request that didn't expire", calls)
+			}
+			if expired := rl.Expired(); expired != 3 {
+				t.Fatalf("%d requests counted as expired, expected 3", expired)
+			}
+		})
+	}
+}
+
+// a BackoffStrategy waiting 500ms, 2s, 8s, ... four times longer every retry
+type quadruplingBackoff struct{}
+
+func (quadruplingBackoff) Next(attempt int, last time.Duration) time.Duration {
+	return 500 * time.Millisecond << (2 * (attempt - 1))
+}
+
+func TestRetriesStopAtTheDeadline(t *testing.T) {
+	for _, tc := range []struct {
+		deadline time.Duration
+		// when the calls go out, the request is answered right after the last one
+		calls []time.Duration
+	}{
+		// the third retry would go out at 10.5s
+		{5 * time.Second, []time.Duration{0, 500 * time.Millisecond, 2500 * time.Millisecond}},
+		// a call going out at the deadline is too late already
+		{2500 * time.Millisecond, []time.Duration{0, 500 * time.Millisecond}},
+		{11 * time.Second, []time.Duration{0, 500 * time.Millisecond, 2500 * time.Millisecond,
+			10500 * time.Millisecond}},
+	} {
+		t.Run(tc.deadline.String(), func(t *testing.T) {
+			rl, clock, client := scriptedLimiter(Config{Backoff: quadruplingBackoff{}, MaxBackoff: time.Minute})
+			defer shutdownNow(rl)
+			client.Script("alice", FailWith(503), FailWith(503), FailWith(503), FailWith(503), FailWith(503))
+
+			req := testRequest("alice", "ping")
+			req.ExpiresAt = testStart.Add(tc.deadline)
+			if err := rl.SubmitRequest(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			resp := awaitResponse(t, clock, req)
+			if !errors.Is(resp.Err, ErrExpired) || !errors.Is(resp.Err, context.DeadlineExceeded) ||
+				!errors.Is(resp.Err, ErrServerError) {
+				t.Fatalf("answered %v, expected ErrExpired along with the last 503", resp.Err)
+			}
+
+			calls := client.Calls()
+			if len(calls) != len(tc.calls) {
+				t.Fatalf("%d calls, expected %d", len(calls), len(tc.calls))
+			}
+			for i, call := range calls {
+				if at := call.At.Sub(testStart); at != tc.calls[i] {
+					t.Fatalf("call %d went out at %s, expected %s", i+1, at, tc.calls[i])
+				}
+			}
+			// rather than sleeping through a backoff that can't fit
+			if answered := clock.Now().Sub(testStart); answered != tc.calls[len(tc.calls)-1] {
+				t.Fatalf("answered at %s, expected right after the last call", answered)
+			}
+			if expired := rl.Expired(); expired != 1 {
+				t.Fatalf("%d requests counted as expired, expected 1", expired)
+			}
+		})
+	}
+}
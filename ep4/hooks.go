@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/**
+The log events (see logging.go) tell what happened to every request, but a team tracing its requests or counting them
+in its own metrics has to parse log lines to get at them. Config.Hooks calls their code at the same points instead,
+whatever library it hands the events to:
+
+	OnEnqueue    the request is accepted, about to go in the queue
+	OnDispatch   a call is made for it, once per attempt
+	OnRetry      the call failed and is tried again after backoff (Retry-After if the third party said so)
+	OnComplete   the request is answered, resp.Err nil or not, latency counted from its submission
+
+OnEnqueue comes right before the request goes in the queue, no worker can take it before the hook is done. Should it
+not make it in after all (the queue is full, the submission's context is done), OnComplete follows with the error
+SubmitRequest returns: every OnEnqueue gets its OnComplete, like a span gets its end. A request answered without ever
+being queued (from the cache) only gets OnComplete, with a latency of 0. Every request of a bulk call gets the call's
+OnDispatch and OnRetry.
+
+A hook runs on the goroutine the event happens on, so the events of a request come in order, and it holds up the
+request meanwhile: a slow exporter belongs on a goroutine of its own. No lock of the rate limiter is held, except
+during submission (OnEnqueue, and OnComplete of requests answered from the cache or evicted by it): the submission
+runs under the read side of Shutdown's gate, a hook calling Shutdown there would wait for itself. A hook panicking is
+logged and otherwise ignored, it doesn't take the worker down with it.
+*/
+
+// the request an event is about
+type RequestEvent struct {
+	RequestID string
+	UserID    string
+	Target    string
+	// the calls made for the request so far (the bulk call's, for the requests in one)
+	Attempt int
+}
+
+// callbacks for the events of every request, any of them may be nil, see above
+type Hooks struct {
+	OnEnqueue  func(event RequestEvent)
+	OnDispatch func(event RequestEvent)
+	OnRetry    func(event RequestEvent, backoff time.Duration, err error)
+	OnComplete func(event RequestEvent, resp *APIResponse, latency time.Duration)
+}
+
+// the event of the request, the attempt is batch's for a request in a bulk call
+func eventOf(req, batch *UserRequest) RequestEvent {
+	return RequestEvent{RequestID: req.RequestID, UserID: req.UserID, Target: batch.targetName(), Attempt: batch.attempt}
+}
+
+// calls hook for the request, or for each of the requests a bulk call is made for
+func (rl *RateLimiter) runHook(req *UserRequest, hook func(event RequestEvent)) {
+	requests := []*UserRequest{req}
+	if req.batch != nil {
+		requests = req.batch
+	}
+	for _, r := range requests {
+		callHook(func() { hook(eventOf(r, req)) })
+	}
+}
+
+// calls the hook, a panic is logged and goes no further
+func callHook(hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("A request hook panicked: %v", r)
+		}
+	}()
+	hook()
+}
+
+func (rl *RateLimiter) hookEnqueued(req *UserRequest) {
+	if hook := rl.cfg.Hooks.OnEnqueue; hook != nil {
+		callHook(func() { hook(eventOf(req, req)) })
+	}
+}
+
+func (rl *RateLimiter) hookDispatched(req *UserRequest) {
+	if hook := rl.cfg.Hooks.OnDispatch; hook != nil {
+		rl.runHook(req, hook)
+	}
+}
+
+func (rl *RateLimiter) hookRetrying(req *UserRequest, backoff time.Duration, err error) {
+	if hook := rl.cfg.Hooks.OnRetry; hook != nil {
+		rl.runHook(req, func(event RequestEvent) { hook(event, backoff, err) })
+	}
+}
+
+// called by respond, once per request (a bulk call's are answered one by one)
+func (rl *RateLimiter) hookCompleted(req *UserRequest, resp *APIResponse) {
+	hook := rl.cfg.Hooks.OnComplete
+	if hook == nil {
+		return
+	}
+	var latency time.Duration
+	if !req.enqueuedAt.IsZero() {
+		latency = rl.clock.Now().Sub(req.enqueuedAt)
+	}
+	rl.runHook(req, func(event RequestEvent) { hook(event, resp, latency) })
+}
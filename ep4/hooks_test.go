@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hooks recording the events of every request, one line each
+type hookRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *hookRecorder) record(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnEnqueue: func(event RequestEvent) {
+			r.record("enqueue %s attempt %d", event.UserID, event.Attempt)
+		},
+		OnDispatch: func(event RequestEvent) {
+			r.record("dispatch %s attempt %d", event.UserID, event.Attempt)
+		},
+		OnRetry: func(event RequestEvent, backoff time.Duration, err error) {
+			r.record("retry %s attempt %d after %s: %v", event.UserID, event.Attempt, backoff, err)
+		},
+		OnComplete: func(event RequestEvent, resp *APIResponse, latency time.Duration) {
+			r.record("complete %s attempt %d in %s: %v", event.UserID, event.Attempt, latency, resp.Err)
+		},
+	}
+}
+
+// the events recorded so far
+func (r *hookRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.events)
+}
+
+func TestHooksLifecycle(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		outcomes []Outcome
+		expected []string
+	}{
+		{"success", nil, []string{
+			"enqueue alice attempt 0",
+			"dispatch alice attempt 1",
+			"complete alice attempt 1 in 0s: <nil>",
+		}},
+		{"retry then success", []Outcome{FailWith(503)}, []string{
+			"enqueue alice attempt 0",
+			"dispatch alice attempt 1",
+			"retry alice attempt 1 after 2s: " + FailWith(503).Err.Error(),
+			"dispatch alice attempt 2",
+			"complete alice attempt 2 in 2s: <nil>",
+		}},
+		{"failure", []Outcome{RejectWith(400)}, []string{
+			"enqueue alice attempt 0",
+			"dispatch alice attempt 1",
+			"complete alice attempt 1 in 0s: " + RejectWith(400).Err.Error(),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var recorder hookRecorder
+			rl, clock, client := scriptedLimiter(Config{Hooks: recorder.hooks(),
+				Backoff: fixedBackoff(2 * time.Second)})
+			defer shutdownNow(rl)
+			client.Script("alice", tc.outcomes...)
+
+			req := testRequest("alice", "ping")
+			if err := rl.SubmitRequest(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			awaitResponse(t, clock, req)
+			if events := recorder.recorded(); !slices.Equal(events, tc.expected) {
+				t.Fatalf("hooks called with\n%s\nexpected\n%s", strings.Join(events, "\n"),
+					strings.Join(tc.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestHooksCompleteRequestsNeverQueued(t *testing.T) {
+	var recorder hookRecorder
+	// one call a minute, the queue only grows
+	rl, _, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Hooks: recorder.hooks()})
+	defer shutdownNow(rl)
+
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fillQueue(t, done, rl, "alice"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("submitting to a full queue: %v, expected ErrQueueFull", err)
+	}
+	// the request refused got its OnEnqueue, and an OnComplete with the error
+	events := recorder.recorded()
+	last := events[len(events)-2:]
+	if last[0] != "enqueue alice attempt 0" || !strings.HasPrefix(last[1], "complete alice attempt 0") ||
+		!strings.Contains(last[1], ErrQueueFull.Error()) {
+		t.Fatalf("the refused request's hooks were called with %q, expected it enqueued then completed", last)
+	}
+}
+
+func TestPanickingHooks(t *testing.T) {
+	logged := captureLog(t)
+	rl, clock, client := scriptedLimiter(Config{
+		Backoff: fixedBackoff(time.Second),
+		Hooks: Hooks{
+			OnEnqueue:  func(event RequestEvent) { panic("enqueue") },
+			OnDispatch: func(event RequestEvent) { panic("dispatch") },
+			OnRetry:    func(event RequestEvent, backoff time.Duration, err error) { panic("retry") },
+			OnComplete: func(event RequestEvent, resp *APIResponse, latency time.Duration) { panic("complete") },
+		},
+	})
+	defer shutdownNow(rl)
+	client.Script("alice", FailWith(503))
+
+	// the request goes through all the same, and the workers keep going
+	for _, req := range []*UserRequest{testRequest("alice", "ping"), testRequest("bob", "ping")} {
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	// alice's enqueue, 2 dispatches, retry and complete, bob's enqueue, dispatch and complete
+	if panics := strings.Count(logged.String(), "A request hook panicked"); panics != 8 {
+		t.Fatalf("%d hook panics logged, expected 8", panics)
+	}
+}
+
+func TestHooksMayReadTheQueueForStaleRequests(t *testing.T) {
+	for name, makeStale := range map[string]func(req *UserRequest) func(){
+		"cancelled": func(req *UserRequest) func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			req.Ctx = ctx
+			return cancel
+		},
+		"expired": func(req *UserRequest) func() {
+			req.ExpiresAt = testStart.Add(time.Second)
+			return func() {}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the stale request is dropped by the dispatcher, whose OnComplete reads the queue: answering it with the
+			// queue locked would deadlock right there
+			var rl *RateLimiter
+			depths := make(chan int, 10)
+			rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Hooks: Hooks{
+				OnComplete: func(event RequestEvent, resp *APIResponse, latency time.Duration) {
+					depths <- rl.QueueDepth() + rl.LaneDepth(PriorityLow) + rl.PendingFor(event.UserID)
+				},
+			}})
+			defer shutdownNow(rl)
+
+			// alice takes the minute's call, bob's request waits for the next one and goes stale meanwhile
+			alice, bob := testRequest("alice", "ping"), testRequest("bob", "ping")
+			stale := makeStale(bob)
+			for _, req := range []*UserRequest{alice, bob} {
+				if err := rl.SubmitRequest(context.Background(), req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			awaitResponse(t, clock, alice)
+			stale()
+			if resp := awaitResponse(t, clock, bob); resp.Err == nil {
+				t.Fatal("the stale request was sent")
+			}
+
+			// the dispatcher is still there for the next one
+			carol := testRequest("carol", "ping")
+			if err := rl.SubmitRequest(context.Background(), carol); err != nil {
+				t.Fatal(err)
+			}
+			if resp := awaitResponse(t, clock, carol); resp.Err != nil {
+				t.Fatalf("request after the stale one failed: %v", resp.Err)
+			}
+			if len(depths) != 3 {
+				t.Fatalf("OnComplete read the queue %d times, expected once per request", len(depths))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync"
+)
+
+/**
+A call that timed out may have gone through, and its retry does it again. APIs that take an idempotency key dedupe on
+it: a call carrying a key they have seen before gets the first call's answer instead of being acted on twice. That
+only works if every attempt for a request carries the same key, and no two requests share one.
+
+UserRequest.IdempotencyKey is that key. SubmitRequest gives requests without one a random UUID, kept with the request
+for all its attempts (and in the journal, a request recovered after a restart is sent with the key it had).
+HTTPTransport sends it as the Idempotency-Key header.
+
+Two requests sharing a key is a bug on the caller's side, the third party would answer the second with the first's
+response. It can't be told apart from a client retrying on its own while the first request is still queued though, so
+SubmitRequest only logs a warning and lets it through.
+
+With a third party honoring the keys, requests can be marked Idempotent: retrying them is safe.
+*/
+
+// the header HTTPTransport sends UserRequest.IdempotencyKey in
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// the idempotency keys of the requests not answered yet, to warn about requests sharing one
+type idempotencyKeys struct {
+	mu   sync.Mutex
+	keys map[string]*UserRequest
+}
+
+// a random (version 4) UUID
+func newUUID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// gives the request a key if it has none, and warns if another request waiting to be answered has the same key
+func (k *idempotencyKeys) assign(req *UserRequest) {
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = newUUID()
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if other, exists := k.keys[req.IdempotencyKey]; exists && other != req {
+		log.Printf("Warning: requests of users %s and %s share the idempotency key %s, the third party may answer "+
+			"one with the other's response", other.UserID, req.UserID, req.IdempotencyKey)
+		return
+	}
+	k.keys[req.IdempotencyKey] = req
+}
+
+// forgets the key of an answered request
+func (k *idempotencyKeys) release(req *UserRequest) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys[req.IdempotencyKey] == req {
+		delete(k.keys, req.IdempotencyKey)
+	}
+}
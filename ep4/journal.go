@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+/**
+The queue lives in memory: a deploy (or a crash) drops up to 10,000 requests that were accepted but never sent.
+
+Recover turns on a journal, an append-only file of length-prefixed JSON records:
+
+- a submit record is appended for every request before it is queued
+- a done record is appended once the request is answered
+
+On startup Recover replays the journal and queues again the requests submitted without a done record. Their callers
+and Response channels are gone with the old process, so a recovered request's response goes to
+Config.OnRecoveredResponse (or the log), fire-and-forget style. Requests answered with ErrShuttingDown are not marked
+done: they are exactly the ones a restart should pick up again.
+
+The journal only grows, so every JournalCompactInterval it is rewritten with the incomplete requests alone (into a
+temporary file renamed over the old one, a crash half way leaves the old journal in place).
+
+The tradeoffs:
+
+- a request sent but not marked done when the process dies is sent again after the restart: at least once, not
+  exactly once. The third party needs to tolerate duplicates (an idempotency key helps).
+- records are written without fsync, they survive the process crashing but not the machine losing power. Syncing every
+  submission would make the disk the bottleneck of the whole rate limiter.
+- a request's context isn't journaled, a recovered request never gets cancelled (ExpiresAt still applies)
+*/
+
+// the default for Config.JournalCompactInterval
+const defaultJournalCompactInterval = time.Minute
+
+// records bigger than this can only come from a corrupt length prefix
+const maxJournalRecord = 1 << 20
+
+type journalOp string
+
+const (
+	journalSubmit journalOp = "submit"
+	journalDone   journalOp = "done"
+)
+
+// a record of the journal
+type journalRecord struct {
+	Op journalOp `json:"op"`
+	ID uint64    `json:"id"`
+	// the request, for submit records
+	Request *journaledRequest `json:"request,omitempty"`
+}
+
+// what is kept of a request, its context and Response channel can't outlive the process
+type journaledRequest struct {
+	UserID     string   `json:"user_id"`
+	Target     string   `json:"target,omitempty"`
+	Data       string   `json:"data"`
+	Priority   Priority `json:"priority"`
+	Cacheable  bool     `json:"cacheable,omitempty"`
+	Cost       int      `json:"cost,omitempty"`
+	Idempotent bool     `json:"idempotent,omitempty"`
+	Batchable  bool     `json:"batchable,omitempty"`
+	// the third party must see the same key after a restart, the call may have gone through before it
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at,omitzero"`
+	// a recovered request is logged under the same ID
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func journaled(req *UserRequest) *journaledRequest {
+	return &journaledRequest{
+		UserID:         req.UserID,
+		Target:         req.Target,
+		Data:           req.Data,
+		Priority:       req.Priority,
+		Cacheable:      req.Cacheable,
+		Cost:           req.Cost,
+		Idempotent:     req.Idempotent,
+		Batchable:      req.Batchable,
+		IdempotencyKey: req.IdempotencyKey,
+		ExpiresAt:      req.ExpiresAt,
+		RequestID:      req.RequestID,
+	}
+}
+
+// the request to queue again for an incomplete journal entry
+func (r *journaledRequest) restore(id uint64) *UserRequest {
+	return &UserRequest{
+		UserID:         r.UserID,
+		Target:         r.Target,
+		Data:           r.Data,
+		Response:       make(chan *APIResponse, 1),
+		Priority:       r.Priority,
+		Cacheable:      r.Cacheable,
+		Cost:           r.Cost,
+		Idempotent:     r.Idempotent,
+		Batchable:      r.Batchable,
+		IdempotencyKey: r.IdempotencyKey,
+		ExpiresAt:      r.ExpiresAt,
+		RequestID:      r.RequestID,
+		journalID:      id,
+	}
+}
+
+// the request journal, see above. A nil journal journals nothing.
+type journal struct {
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	lastID uint64
+	// requests submitted and not done yet, by ID
+	pending map[uint64]*journaledRequest
+	closed  bool
+
+	stop chan struct{}
+}
+
+// opens the journal at path, loading what a previous process left in it
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path, pending: make(map[uint64]*journaledRequest), stop: make(chan struct{})}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	// starts off compacted, which also gets rid of a record torn by a crash
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replays the journal file into pending
+func (j *journal) load() error {
+	file, err := os.Open(j.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		record, err := readJournalRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// the process died half way through a write, everything before it is fine
+			log.Printf("Journal %s ends with a partial record, ignoring it", j.path)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading journal %s: %w", j.path, err)
+		}
+
+		j.lastID = max(j.lastID, record.ID)
+		switch record.Op {
+		case journalSubmit:
+			if record.Request != nil {
+				j.pending[record.ID] = record.Request
+			}
+		case journalDone:
+			delete(j.pending, record.ID)
+		}
+	}
+}
+
+func readJournalRecord(r io.Reader) (*journalRecord, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if length > maxJournalRecord {
+		return nil, fmt.Errorf("record of %d bytes, the journal is corrupt", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var record journalRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	return &record, nil
+}
+
+// writes the record with a single Write, so a crash tears at most the last record
+func writeJournalRecord(w io.Writer, record journalRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+// journals the submission of the request, returning the ID to mark it done with
+func (j *journal) submit(req *UserRequest) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	id := j.lastID + 1
+	request := journaled(req)
+	if err := writeJournalRecord(j.file, journalRecord{Op: journalSubmit, ID: id, Request: request}); err != nil {
+		return 0, err
+	}
+	j.lastID = id
+	j.pending[id] = request
+	return id, nil
+}
+
+// marks the request done, it won't be recovered anymore
+func (j *journal) done(id uint64) {
+	if j == nil || id == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.pending[id]; !exists {
+		return
+	}
+	// without the done record the request is sent again after a restart, which the journal tolerates anyway
+	if err := writeJournalRecord(j.file, journalRecord{Op: journalDone, ID: id}); err != nil {
+		log.Printf("Journaling request %d as done failed: %v", id, err)
+	}
+	delete(j.pending, id)
+}
+
+// the requests not done yet, in the order they were submitted
+func (j *journal) incomplete() []uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.pendingIDs()
+}
+
+// the IDs of the pending requests, sorted (must be called with mu held)
+func (j *journal) pendingIDs() []uint64 {
+	ids := make([]uint64, 0, len(j.pending))
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// rewrites the journal with the submit records of the pending requests only
+func (j *journal) compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return nil
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, id := range j.pendingIDs() {
+		if err := writeJournalRecord(writer, journalRecord{Op: journalSubmit, ID: id, Request: j.pending[id]}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	// the rename must not replace the journal with a file whose content isn't on disk yet
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	return nil
+}
+
+// stops compacting and closes the file
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	close(j.stop)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.closed = true
+	return j.file.Close()
+}
+
+// starts journaling submissions to path and queues again the requests a previous process left incomplete there,
+// returning how many. Call it right after NewRateLimiter, requests submitted before aren't journaled.
+func (rl *RateLimiter) Recover(path string) (int, error) {
+	j, err := openJournal(path)
+	if err != nil {
+		return 0, err
+	}
+
+	rl.submitMu.Lock()
+	defer rl.submitMu.Unlock()
+
+	if rl.closing {
+		j.close()
+		return 0, ErrShuttingDown
+	}
+	if rl.journal != nil {
+		j.close()
+		return 0, errors.New("the rate limiter already has a journal")
+	}
+	rl.journal = j
+
+	recovered := 0
+	for _, id := range j.incomplete() {
+		j.mu.Lock()
+		req := j.pending[id].restore(id)
+		j.mu.Unlock()
+
+		req.enqueuedAt = rl.clock.Now()
+		// journaled before requests had IDs
+		if req.RequestID == "" {
+			req.RequestID = newUUID()
+		}
+		// keeps the key it was journaled with, requests journaled without one get one now
+		rl.idempotencyKeys.assign(req)
+		// counted against the user's backlog, but never turned away: it was accepted before the restart
+		rl.backlog.admit(req, 0)
+		rl.requests.add(req)
+		rl.hookEnqueued(req)
+		if _, err := rl.queue.push(req); err != nil {
+			rl.requests.remove(req)
+			rl.hookCompleted(req, &APIResponse{Err: err})
+			// it stays in the journal, the next restart gets another chance at it
+			rl.idempotencyKeys.release(req)
+			rl.backlog.release(req)
+			log.Printf("Recovering request %d of user %s failed: %v", id, req.UserID, err)
+			continue
+		}
+		rl.logEnqueued(req)
+		recovered++
+		go rl.deliverRecovered(req)
+	}
+
+	go rl.compactJournal(j)
+	return recovered, nil
+}
+
+// hands the response to a recovered request to Config.OnRecoveredResponse, nobody else waits for it
+func (rl *RateLimiter) deliverRecovered(req *UserRequest) {
+	resp := <-req.Response
+	if rl.cfg.OnRecoveredResponse != nil {
+		rl.cfg.OnRecoveredResponse(req, resp)
+		return
+	}
+	if resp.Err != nil {
+		log.Printf("Recovered request of user %s failed: %v", req.UserID, resp.Err)
+		return
+	}
+	log.Printf("Recovered request of user %s succeeded: %s", req.UserID, resp.Data)
+}
+
+// compacts the journal every JournalCompactInterval until it is closed
+func (rl *RateLimiter) compactJournal(j *journal) {
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-rl.clock.After(rl.cfg.JournalCompactInterval):
+			if err := j.compact(); err != nil {
+				log.Printf("Compacting journal %s failed: %v", j.path, err)
+			}
+		}
+	}
+}
+
+// answers the request, marking it done in the journal unless the answer is that we are shutting down: after a
+// restart it can still get a proper answer
+func (rl *RateLimiter) respond(req *UserRequest, resp *APIResponse) {
+	// a bulk call failed as a whole, each of its requests gets the error
+	if req.batch != nil {
+		for _, item := range req.batch {
+			rl.respond(item, resp)
+		}
+		return
+	}
+	rl.answered.Add(1)
+	rl.requests.set(req, stateDone, rl.clock.Now())
+	if errors.Is(resp.Err, ErrShuttingDown) {
+		rl.abandoned.Add(1)
+	}
+	if req.journalID != 0 && !errors.Is(resp.Err, ErrShuttingDown) {
+		rl.journal.done(req.journalID)
+	}
+	rl.idempotencyKeys.release(req)
+	rl.backlog.release(req)
+	rl.logOutcome(req, resp)
+	rl.hookCompleted(req, resp)
+	req.Response <- resp
+	rl.logDelivered(req)
+}
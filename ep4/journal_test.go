@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// what a crash leaves of the journal: the file as it is on disk right now
+func crashedJournal(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := path + ".crashed"
+	if err := os.WriteFile(crashed, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return crashed
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.journal")
+
+	// one call a minute: the first request goes out, the other two are still queued when the process dies
+	before, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1})
+	if recovered, err := before.Recover(path); err != nil || recovered != 0 {
+		t.Fatalf("recovering an empty journal: %d, %v", recovered, err)
+	}
+	pending := submitRequests(t, before, 3)
+	awaitResponse(t, clock, pending[0])
+	crashed := crashedJournal(t, path)
+	shutdownNow(before)
+
+	recoveredResponses := make(chan *UserRequest, 3)
+	after, clock, client := scriptedLimiter(Config{
+		RequestsPerMinute: 1, Burst: 1,
+		OnRecoveredResponse: func(req *UserRequest, resp *APIResponse) {
+			if resp.Err != nil {
+				t.Errorf("recovered request of %s failed: %v", req.UserID, resp.Err)
+			}
+			recoveredResponses <- req
+		},
+	})
+	recovered, err := after.Recover(crashed)
+	if err != nil || recovered != 2 {
+		t.Fatalf("recovered %d requests (%v), expected the 2 never sent", recovered, err)
+	}
+	for settle(clock); len(recoveredResponses) < 2 && clock.AdvanceToNext(); settle(clock) {
+	}
+	if len(recoveredResponses) != 2 {
+		t.Fatalf("%d recovered requests answered, expected 2", len(recoveredResponses))
+	}
+	var users []string
+	for _, call := range client.Calls() {
+		users = append(users, call.UserID)
+	}
+	// in the order they were submitted, with the keys they were journaled with
+	if !slices.Equal(users, []string{"user1", "user2"}) {
+		t.Fatalf("calls for %v, expected one each for user1 and user2", users)
+	}
+	if key := client.Calls()[0].IdempotencyKey; key != pending[1].IdempotencyKey {
+		t.Fatalf("recovered request sent with key %q, journaled with %q", key, pending[1].IdempotencyKey)
+	}
+	shutdownNow(after)
+
+	// answered, nothing left for the next restart
+	again, _, _ := scriptedLimiter(Config{})
+	defer shutdownNow(again)
+	if recovered, err := again.Recover(crashed); err != nil || recovered != 0 {
+		t.Fatalf("recovered %d requests (%v) on the second restart, expected none", recovered, err)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.journal")
+	rl, clock, _ := scriptedLimiter(Config{JournalCompactInterval: time.Minute})
+	defer shutdownNow(rl)
+	if _, err := rl.Recover(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range submitRequests(t, rl, 20) {
+		awaitResponse(t, clock, req)
+	}
+	grown, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grown.Size() == 0 {
+		t.Fatal("nothing journaled")
+	}
+
+	// every request is done, compaction leaves nothing. It writes files, settle can't tell when it's over.
+	clock.Advance(time.Minute)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		compacted, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compacted.Size() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("journal of %d bytes after compaction, expected empty (was %d)", compacted.Size(), grown.Size())
+		}
+	}
+}
+
+func TestRecoverIgnoresTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.journal")
+	before, _, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1})
+	before.Recover(path)
+	submitRequests(t, before, 3)
+	crashed := crashedJournal(t, path)
+	shutdownNow(before)
+
+	// the process died half way through writing a record
+	file, err := os.OpenFile(crashed, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1, 0, '{', '"'})
+	file.Close()
+
+	after, _, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1})
+	defer shutdownNow(after)
+	// the first request may have been answered (and marked done) before the crash, the others can't have
+	if recovered, err := after.Recover(crashed); err != nil || recovered < 2 {
+		t.Fatalf("recovered %d requests (%v), expected those before the torn record", recovered, err)
+	}
+}
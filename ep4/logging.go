@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+/**
+A request goes through SubmitRequest, the queue, a worker, maybe a few retries and a bulk call before it is answered,
+and the log lines along the way didn't say which request they were about. With a thousand requests a minute, finding
+out why one of them got stuck meant guessing which "Retrying" line was its own.
+
+Every request now has an ID, UserRequest.RequestID: the caller's (the handler takes X-Request-ID from the client and
+echoes it back) or a random UUID given by SubmitRequest. It is journaled along with the request, a recovered request
+keeps it. The request's way through the rate limiter is logged as structured events, each carrying the ID, the user,
+the target and the attempt:
+
+	request enqueued     submitted, waiting in the queue
+	request dispatched   a call is made for it (batch_size tells it is part of a bulk call)
+	request retrying     the call failed, backoff says how long until the next attempt
+	request succeeded    the terminal outcome, "request failed" (at Warn, with the error) otherwise
+	response delivered   the response is on UserRequest.Response, waited says how long after it was submitted
+
+Config.Logger takes the events, slog's default logger if nil. *slog.Logger fits the Logger interface, anything else
+(e.g a logger recording the events in tests) only needs the two methods.
+*/
+
+// takes the events of the requests going through the rate limiter, see above
+type Logger interface {
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+}
+
+// the events logged for every request, see above
+const (
+	eventEnqueued   = "request enqueued"
+	eventDispatched = "request dispatched"
+	eventRetrying   = "request retrying"
+	eventSucceeded  = "request succeeded"
+	eventFailed     = "request failed"
+	eventDelivered  = "response delivered"
+)
+
+// the header a request ID is taken from and echoed back in
+const RequestIDHeader = "X-Request-ID"
+
+// the logger for Config.Logger
+func newLogger(cfg Config) Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return slog.Default()
+}
+
+// logs an event of the request, or of each of the requests a bulk call is made for
+func (rl *RateLimiter) logRequest(level slog.Level, msg string, req *UserRequest, args ...any) {
+	log := rl.logger.Info
+	if level >= slog.LevelWarn {
+		log = rl.logger.Warn
+	}
+	requests := []*UserRequest{req}
+	if req.batch != nil {
+		requests = req.batch
+		args = append(args, "batch_size", len(req.batch))
+	}
+	for _, r := range requests {
+		// the attempt is the bulk call's for requests in one
+		log(msg, append([]any{
+			"request_id", r.RequestID, "user", r.UserID, "target", req.targetName(), "attempt", req.attempt,
+		}, args...)...)
+	}
+}
+
+// logs that the request is in the queue. A worker may be sending it already, so only the fields set before it was
+// queued are read.
+func (rl *RateLimiter) logEnqueued(req *UserRequest) {
+	rl.logger.Info(eventEnqueued, "request_id", req.RequestID, "user", req.UserID, "target", req.targetName(),
+		"attempt", 0, "priority", req.lane())
+}
+
+// logs the outcome of the request and its delivery, see respond
+func (rl *RateLimiter) logOutcome(req *UserRequest, resp *APIResponse) {
+	if resp.Err != nil {
+		rl.logRequest(slog.LevelWarn, eventFailed, req, "error", resp.Err)
+	} else {
+		rl.logRequest(slog.LevelInfo, eventSucceeded, req)
+	}
+}
+
+// logs that the response is on the request's channel
+func (rl *RateLimiter) logDelivered(req *UserRequest) {
+	if req.enqueuedAt.IsZero() {
+		// answered from the cache, it never waited
+		rl.logRequest(slog.LevelInfo, eventDelivered, req)
+		return
+	}
+	rl.logRequest(slog.LevelInfo, eventDelivered, req, "waited", rl.clock.Now().Sub(req.enqueuedAt).Round(time.Millisecond))
+}
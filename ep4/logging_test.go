@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a Logger recording the events with their level and the fields the tests look at, one line each
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) Info(msg string, args ...any) { r.record("INFO", msg, args) }
+func (r *eventRecorder) Warn(msg string, args ...any) { r.record("WARN", msg, args) }
+
+func (r *eventRecorder) record(level, msg string, args []any) {
+	fields := make(map[string]any)
+	for i := 0; i+1 < len(args); i += 2 {
+		fields[args[i].(string)] = args[i+1]
+	}
+	event := fmt.Sprintf("%s %s %s/%s attempt %d", level, msg, fields["request_id"], fields["user"],
+		fields["attempt"])
+	for _, key := range []string{"backoff", "waited"} {
+		if value, ok := fields[key]; ok {
+			event += fmt.Sprintf(" %s %v", key, value)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// the events recorded once there are n of them, the delivery is logged after the response is sent
+func (r *eventRecorder) await(t *testing.T, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		events := slices.Clone(r.events)
+		r.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+	}
+	t.Fatalf("fewer than %d events logged", n)
+	return nil
+}
+
+func TestRequestEventsAreLogged(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		outcomes []Outcome
+		expected []string
+	}{
+		{"retried", []Outcome{FailWith(503)}, []string{
+			"INFO request enqueued req-1/alice attempt 0",
+			"INFO request dispatched req-1/alice attempt 1",
+			"INFO request retrying req-1/alice attempt 1 backoff 1s",
+			"INFO request dispatched req-1/alice attempt 2",
+			"INFO request succeeded req-1/alice attempt 2",
+			"INFO response delivered req-1/alice attempt 2 waited 1s",
+		}},
+		{"failed", []Outcome{RejectWith(400)}, []string{
+			"INFO request enqueued req-1/alice attempt 0",
+			"INFO request dispatched req-1/alice attempt 1",
+			"WARN request failed req-1/alice attempt 1",
+			"INFO response delivered req-1/alice attempt 1 waited 0s",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &eventRecorder{}
+			rl, clock, client := scriptedLimiter(Config{Logger: recorder, Backoff: fixedBackoff(time.Second)})
+			defer shutdownNow(rl)
+			client.Script("alice", tc.outcomes...)
+
+			req := testRequest("alice", "ping")
+			req.RequestID = "req-1"
+			if err := rl.SubmitRequest(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			awaitResponse(t, clock, req)
+			if events := recorder.await(t, len(tc.expected)); !slices.Equal(events, tc.expected) {
+				t.Fatalf("logged\n%s\nexpected\n%s", strings.Join(events, "\n"), strings.Join(tc.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestSubmitRequestGivesEveryRequestAnID(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{})
+	defer shutdownNow(rl)
+
+	seen := make(map[string]bool)
+	for _, req := range submitRequests(t, rl, 10) {
+		awaitResponse(t, clock, req)
+		if req.RequestID == "" || seen[req.RequestID] {
+			t.Fatalf("request of %s got the ID %q, expected one of its own", req.UserID, req.RequestID)
+		}
+		seen[req.RequestID] = true
+	}
+}
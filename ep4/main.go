@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
-	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -16,168 +25,1148 @@ While there are two common solutions to handling third party API rate limiting,
 I have only demonstrated throttling
 */
 
-const MaxRequestsPerMinute = 1000 // Ttird-party rate limit
+const MaxRequestsPerMinute = 1000 // Ttird-party rate limit, the default for Config.RequestsPerMinute
+
+// settings of the RateLimiter
+type Config struct {
+	// the third-party rate limit (default MaxRequestsPerMinute)
+	RequestsPerMinute int
+	// how many requests may go out back to back after a quiet period (default 1, i.e evenly spaced requests).
+	// Unused capacity builds up to this many requests instead of being lost.
+	Burst int
+	// source of time, nil means the real clock
+	Clock Clock
+	// shares the quota of every target with the other nodes sending to it, nil means LocalQuota (not shared), see
+	// quota.go
+	Quota QuotaCoordinator
+	// talks to the third-party API, nil means the SimulatedClient
+	Client ThirdPartyClient
+	// max requests to the third-party API in flight at once (0 means no limit).
+	// Throughput alone doesn't bound concurrency: at 1000 requests per minute and 10 seconds per request,
+	// 167 requests are waiting on the API at any time. There are never more in flight than Workers either.
+	MaxInflight int
+	// adjusts the in-flight limit to the latency of the calls, between MinInflight (default 1) and MaxInflight,
+	// see vegas.go
+	AdaptiveConcurrency bool
+	MinInflight         int
+	// max requests per minute sent for a single user (0 means no limit), so one user's flood can't use up
+	// the whole third-party quota
+	PerUserLimit int
+	// what SubmitRequest does when the queue is full: wait for room (the default), fail right away or evict the
+	// oldest request, see overflow.go
+	Overflow OverflowPolicy
+	// max requests a single user may have pending, queued or in flight (0 means no limit), beyond that
+	// SubmitRequest fails with a TooManyPendingError, see backlog.go
+	MaxPendingPerUser int
+	// how many goroutines send requests (default 10). Each of them waits on the third party in turn, so with
+	// 200ms per call a single sender can't go beyond 300 requests per minute whatever the rate limit allows.
+	Workers int
+	// high priority requests go first, but at least 1 in LowPriorityEvery requests taken from the queue is a low
+	// priority one while any are waiting (default 10), so background traffic is slowed down rather than starved
+	LowPriorityEvery int
+	// consecutive failed calls to the third party (rate limiting aside) after which the circuit breaker opens and
+	// stops requests from going out (0 means no circuit breaker)
+	BreakerThreshold int
+	// how long the circuit breaker stays open before it lets a probe through (default 30s)
+	BreakerCooldown time.Duration
+	// keeps requests queued while the circuit breaker is open instead of failing them with ErrCircuitOpen
+	ParkWhenOpen bool
+	// called on every state change of the circuit breaker, e.g to update a metric
+	OnBreakerStateChange func(from, to BreakerState)
+	// how long to wait before retrying when the third party doesn't say, nil means a Backoff with the defaults
+	Backoff BackoffStrategy
+	// the longest wait the Backoff strategy of any target can ask for (default 30s), see capBackoff
+	MaxBackoff time.Duration
+	// adapts the send rate to the rate-limited responses of the third party, RequestsPerMinute being the ceiling
+	Adaptive bool
+	// the lowest the adaptive rate goes (default a tenth of RequestsPerMinute)
+	MinRequestsPerMinute int
+	// how much the adaptive rate goes up every AdaptiveInterval (default 10s) without a rate-limited response
+	// (default a twentieth of RequestsPerMinute)
+	AdaptiveIncrease int
+	AdaptiveInterval time.Duration
+	// sends a user's requests one at a time, in the order they were submitted, see orderedBuffer
+	PreserveOrderPerUser bool
+	// decides which errors of the third-party client are worth retrying, nil means the client's own Retryable if it
+	// implements RetryClassifier, DefaultIsRetryable otherwise.
+	// It gets the error as the client returned it, errors.Is and errors.As see through any wrapping.
+	IsRetryable func(err error) bool
+	// how long responses to Cacheable requests are reused for (default 30s), and how many are kept (default 1000)
+	CacheTTL  time.Duration
+	CacheSize int
+	// how long a request may wait to be sent before it expires (0 means forever), for requests without ExpiresAt
+	MaxQueueTime time.Duration
+	// how often the journal turned on by Recover is compacted (default a minute)
+	JournalCompactInterval time.Duration
+	// gets the responses to requests recovered from the journal, whose callers are gone. nil means they are logged.
+	OnRecoveredResponse func(req *UserRequest, resp *APIResponse)
+	// third-party APIs with limits of their own, by name, see target.go. The fields above configure DefaultTarget.
+	Targets map[string]TargetConfig
+	// refuses requests whose estimated wait (see EstimateWait) is longer than this with a WaitTooLongError
+	// (0 means no limit)
+	MaxEstimatedWait time.Duration
+	// the share of a target's calls that may be retries while fresh requests for it are waiting, e.g 0.3
+	// (0 means no cap), see retryshare.go
+	RetryShare float64
+	// how long a Batchable request waits for others to share a bulk call with (0 means no batching), and how many
+	// requests a bulk call carries at most (default 50), see batch.go
+	BatchWindow time.Duration
+	BatchSize   int
+	// the most units a request may cost (see UserRequest.Cost), 0 means up to the Burst of its target. Keeps a few
+	// expensive requests from holding up the cheap ones, see cost.go
+	MaxCost int
+	// takes the events of every request, from submission to response, nil means slog's default logger,
+	// see logging.go
+	Logger Logger
+	// called at the same points as the Logger, for tracing and metrics, see hooks.go
+	Hooks Hooks
+	// turns each request into the one sent to the third party (e.g encrypted), nil sends it as is, see transform.go
+	Transformer RequestTransformer
+}
+
+const (
+	// the default for Config.Workers
+	defaultWorkers = 10
+	// the default for Config.LowPriorityEvery
+	defaultLowPriorityEvery = 10
+	// the default for Config.MaxBackoff
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// which lane of the queue a request waits in
+type Priority int
+
+const (
+	// background traffic, e.g a sync job
+	PriorityLow Priority = iota
+	// user-facing requests, someone is waiting for the answer
+	PriorityHigh
+
+	numPriorities = 2
+)
+
+// the nearest priority there is a lane for
+func (p Priority) clamp() Priority {
+	return min(max(p, PriorityLow), PriorityHigh)
+}
 
 // controls the rate of outgoing requests
 type RateLimiter struct {
-	requests     int
-	requestChan  chan *UserRequest
+	cfg          Config
+	clock        Clock
 	shutdownChan chan struct{}
 	wg           sync.WaitGroup
+
+	// the queue, one lane per priority. With a single FIFO a sync job's 5,000 requests delay a user-facing one by
+	// 5 minutes at 1000 requests per minute.
+	queue *fairQueue
+
+	// held while submitting, so Shutdown knows no request slips into the queue after it stopped taking them
+	submitMu sync.RWMutex
+	closing  bool
+	// closed by Shutdown, the queue keeps going until it is empty
+	draining  chan struct{}
+	abortOnce sync.Once
+
+	// requests currently being sent
+	inflight atomic.Int64
+	// signalled every time an in-flight request finishes
+	inflightFreed chan struct{}
+	// how many times the queue had to wait for the in-flight limit
+	inflightLimitHits atomic.Int64
+	// adjusts the in-flight limit with Config.AdaptiveConcurrency, nil otherwise
+	concurrency *VegasConcurrencyLimiter
+	// requests dropped because whoever submitted them gave up waiting
+	cancelled atomic.Int64
+	// requests dropped because their ExpiresAt passed
+	expired atomic.Int64
+	// requests evicted from the full queue, see OverflowDropOldest
+	evicted atomic.Int64
+	// requests answered, and those of them answered with ErrShuttingDown, see shutdown.go
+	answered  atomic.Int64
+	abandoned atomic.Int64
+
+	// hands requests from the queue to the senders
+	work chan *UserRequest
+	// the third-party APIs by name, each pacing the requests sent to it
+	targets map[string]*target
+	// outgoing requests per user, only touched by processQueue
+	userBuckets map[string]*tokenBucket
+	// requests waiting to be retried, and how many are backing off or waiting there, see retryshare.go
+	retries  *retryQueue
+	retrying atomic.Int64
+	// the idempotency keys of the requests not answered yet
+	idempotencyKeys idempotencyKeys
+	// the requests each user has pending, see MaxPendingPerUser
+	backlog userBacklog
+	// counters behind Stats
+	stats stats
+	// recent responses to Cacheable requests
+	cache *responseCache
+	// per user sequencing with PreserveOrderPerUser, only users with a request being sent have a buffer
+	orderMu sync.Mutex
+	ordered map[string]*orderedBuffer
+	// persists the queue across restarts, nil until Recover turns it on
+	journal *journal
+	// the goroutines sending requests, Workers of them (see reconfig.go)
+	senders senderCount
+	// takes the events of every request, see logging.go
+	logger Logger
+	// where each request is, by ID (see position.go)
+	requests *requestIndex
 }
 
 // represents a user's request to the third-party API
 type UserRequest struct {
-	UserID   string
+	UserID string
+	// the third-party API the request is for, "" means DefaultTarget
+	Target   string
 	Data     string
 	Response chan *APIResponse
+	// the zero value is PriorityLow
+	Priority Priority
+	// the request is safe to answer with a recent response to an identical one (same user and data), see responseCache
+	Cacheable bool
+	// once done, the request is skipped instead of spending third-party quota on an answer nobody waits for.
+	// nil means the request never gives up.
+	Ctx context.Context
+	// how many units of the third-party quota a call counts as, e.g 10 for a batch search (0 means 1)
+	Cost int
+	// making the request twice does no more than making it once (e.g a read), so it is retried whatever the error,
+	// see retry.go
+	Idempotent bool
+	// sent along with every call for the request, so the third party can tell a retry from a new request.
+	// SubmitRequest sets a random one if empty, see idempotency.go.
+	IdempotencyKey string
+	// identifies the request in the logs, SubmitRequest sets a random one if empty, see logging.go
+	RequestID string
+	// the request may share a bulk call with other requests for its target, if its client is a BatchClient and
+	// Config.BatchWindow is set, see batch.go
+	Batchable bool
+	// past it the request is answered with ErrExpired instead of being sent, zero means Config.MaxQueueTime after
+	// it is submitted (or never without one)
+	ExpiresAt time.Time
+
+	// when the request was submitted
+	enqueuedAt time.Time
+	// the request's number among its user's requests, with PreserveOrderPerUser
+	seq uint64
+	// the request's ID in the journal, 0 if it isn't journaled
+	journalID uint64
+	// whether the request counts against its user's backlog, see backlog.go
+	admitted bool
+	// when the units reserved for its next call are paid off, see target.reserveCall
+	readyAt time.Time
+	// whether the QuotaCoordinator has yet to grant the units reserved, and whether they took a turn of the retries
+	// (see target.reserveQuota)
+	quotaPending bool
+	retryTurn    bool
+	// the calls made for the request so far, and the backoff before the last retry
+	attempt int
+	backoff time.Duration
+	// the requests a bulk call is made for, set on the request standing in for them (see batch.go)
+	batch []*UserRequest
+}
+
+// returns the request's context, never nil
+func (req *UserRequest) context() context.Context {
+	if req.Ctx == nil {
+		return context.Background()
+	}
+	return req.Ctx
+}
+
+// the lane the request waits in, priorities out of range are clamped
+func (req *UserRequest) lane() Priority {
+	return req.Priority.clamp()
 }
 
 // represents the response from the third-party API
 type APIResponse struct {
 	Data string
 	Err  error
+	// the rate limit state the third party reported along with the response, nil if it didn't
+	RateLimit *RateLimitInfo
+	// the response was served from the cache rather than by the third party just now
+	Cached bool
+	// the responses to the requests of a bulk call, one each (see batch.go)
+	batch []*APIResponse
 }
 
 // initializes the RateLimiter
-func NewRateLimiter() *RateLimiter {
+func NewRateLimiter(cfg Config) *RateLimiter {
+	if cfg.RequestsPerMinute <= 0 {
+		cfg.RequestsPerMinute = MaxRequestsPerMinute
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = realClock{}
+	}
+	if cfg.Quota == nil {
+		cfg.Quota = LocalQuota{}
+	}
+	if quota, ok := cfg.Quota.(*RedisQuota); ok {
+		quota.useClock(cfg.Clock)
+	}
+	if cfg.Client == nil {
+		cfg.Client = SimulatedClient{}
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultCacheTTL
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = defaultCacheSize
+	}
+	if cfg.Backoff == nil {
+		cfg.Backoff = &Backoff{}
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.LowPriorityEvery <= 0 {
+		cfg.LowPriorityEvery = defaultLowPriorityEvery
+	}
+	if cfg.JournalCompactInterval <= 0 {
+		cfg.JournalCompactInterval = defaultJournalCompactInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
 	rl := &RateLimiter{
-		// buffered channel to handle 10,000 requests. We know each reqeust can't stay more than 5 secs in the channel
-		//(which is the worst case i.e our internal timeout as set in the http handler below)
-		// so we can be sure no request will be left in channel indefinitely.
-		requestChan: make(chan *UserRequest, 10000),
+		cfg:     cfg,
+		clock:   cfg.Clock,
+		targets: newTargets(cfg),
+		queue:   newFairQueue(cfg.LowPriorityEvery),
 		// shutdownChan -> carries signal to gracefully shutdown the rate limiter(not really necessary for our usecase
-		// but I think it's standard for cleanup for instance say we want to perform some operations on user requests left in requestChan)
-		shutdownChan: make(chan struct{}),
+		// but I think it's standard for cleanup for instance say we want to perform some operations on user requests left in the queue)
+		shutdownChan:  make(chan struct{}),
+		draining:      make(chan struct{}),
+		inflightFreed: make(chan struct{}, 1),
+		userBuckets:   make(map[string]*tokenBucket),
+		ordered:       make(map[string]*orderedBuffer),
+		cache:         newResponseCache(cfg.CacheTTL, cfg.CacheSize),
+		work:          make(chan *UserRequest),
+		retries:       &retryQueue{},
+		concurrency:   newConcurrencyLimiter(cfg),
+		logger:        newLogger(cfg),
+		requests:      newRequestIndex(),
 	}
+	rl.idempotencyKeys.keys = make(map[string]*UserRequest)
 	rl.wg.Add(1)
 	go rl.processQueue()
+	rl.senders.changed = make(chan struct{})
+	rl.setWorkers(cfg.Workers)
 	return rl
 }
 
-// handles sending requests to the third-party API
+// sends the requests handed out by processQueue until it stops, or there are more senders than Workers
+func (rl *RateLimiter) sender() {
+	defer rl.wg.Done()
+	for {
+		stop, changed := rl.senders.retire()
+		if stop {
+			return
+		}
+		select {
+		case req, ok := <-rl.work:
+			if !ok {
+				return
+			}
+			rl.sendRequest(req)
+		case <-changed:
+		}
+	}
+}
+
+// hands queued requests to the senders
 func (rl *RateLimiter) processQueue() {
 	defer rl.wg.Done()
-	ticker := time.NewTicker(time.Minute / time.Duration(MaxRequestsPerMinute))
-	defer ticker.Stop()
+	// the senders stop once the queue does
+	defer close(rl.work)
+	cleanup := rl.clock.After(time.Minute)
+
+	// once draining nothing new comes in, the queue stops as soon as the backlog is done
+	draining := false
+	drain := rl.draining
 
 	// We keep processing requests until signaled by the calling go routine to close queue(i.e shutdownChan).
 	for {
+		// batches whose window is over go first, all of them once nothing else is coming (see batch.go)
+		req := rl.dueBatch(draining && rl.QueueDepth() == 0)
+		if req == nil {
+			// then requests to retry, as long as they leave fresh ones their share (see retryshare.go)
+			req = rl.takeRetry()
+		}
+		fresh := req == nil
+		if fresh {
+			// users out of per-user tokens (or still waiting on their previous request with PreserveOrderPerUser, or
+			// on their target's circuit breaker with ParkWhenOpen) are passed over, their requests wait until they may go
+			var stale []*UserRequest
+			req, stale = rl.queue.take(rl.isStale, rl.mayDispatch)
+			for _, dropped := range stale {
+				rl.skipIfStale(dropped)
+			}
+		}
+		// the units are reserved with the node's own pacing, the other nodes' share comes on top (see quota.go)
+		if req != nil && req.quotaPending && !rl.reserveQuota(req, fresh) {
+			continue
+		}
+		if req == nil {
+			// requests being sent may still come back to be retried
+			if draining && rl.QueueDepth() == 0 && rl.retrying.Load() == 0 && rl.inflight.Load() == 0 {
+				return
+			}
+
+			// while requests are waiting on their user's tokens (or the breaker), wake up regularly to check on them
+			var retry <-chan time.Time
+			if rl.QueueDepth() > 0 || rl.retries.len() > 0 {
+				retry = rl.clock.After(rl.pollInterval())
+			}
+			batchDue := rl.batchDue()
+
+			select {
+			case <-rl.shutdownChan:
+				rl.abandonQueue()
+				return
+			case <-drain:
+				draining = true
+				drain = nil
+			case <-cleanup:
+				rl.cleanupUserBuckets()
+				rl.requests.prune(rl.clock.Now())
+				cleanup = rl.clock.After(time.Minute)
+			case <-retry:
+			case <-batchDue:
+			case <-rl.queue.added:
+			}
+			continue
+		}
+		rl.requests.set(req, stateInFlight, rl.clock.Now())
+
+		// no need to hold a sender up with a request the breaker won't let out (a retry finds out in sendRequest)
+		t := rl.targetOf(req)
+		if fresh && !rl.cfg.ParkWhenOpen && t.breaker.blockedFor() > 0 {
+			t.stats.failed.Add(1)
+			rl.respond(req, &APIResponse{Err: ErrCircuitOpen})
+			continue
+		}
+
+		// a Batchable request waits for others to share its call, it goes out along with them
+		if fresh && t.batches(req) {
+			if rl.skipIfStale(req) {
+				continue
+			}
+			rl.markSent(req)
+			rl.stats.queueWait.observe(rl.clock.Now().Sub(req.enqueuedAt))
+			if req = rl.addToBatch(t, req); req == nil {
+				continue
+			}
+			fresh = false
+		}
+
+		if !rl.waitForInflightSlot() {
+			rl.abandonQueue(req)
+			return
+		}
+		// it may have given up (or expired) while waiting for its turn, a retry is checked by sendRequest
+		if fresh && rl.skipIfStale(req) {
+			continue
+		}
+		// counted here rather than by the sender, otherwise the next check could run before it is counted
+		rl.inflight.Add(1)
+		if fresh {
+			rl.markSent(req)
+		}
 		select {
+		case rl.work <- req:
+			if fresh {
+				rl.stats.queueWait.observe(rl.clock.Now().Sub(req.enqueuedAt))
+			}
 		case <-rl.shutdownChan:
+			rl.inflight.Add(-1)
+			rl.abandonQueue(req)
 			return
-		case req := <-rl.requestChan:
-			<-ticker.C
-			rl.sendRequest(req)
 		}
 	}
 }
 
-// sends the request to the third-party API with retry logic
+// waits for d, returns false if the rate limiter shuts down meanwhile
+func (rl *RateLimiter) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-rl.clock.After(d):
+		return true
+	case <-rl.shutdownChan:
+		return false
+	}
+}
+
+// answers every request that is still waiting with ErrShuttingDown, along with the given ones
+func (rl *RateLimiter) abandonQueue(pending ...*UserRequest) {
+	// Shutdown already stopped new submissions
+	pending = append(pending, rl.queue.drain()...)
+	pending = append(pending, rl.abandonRetries()...)
+	pending = append(pending, rl.abandonBatches()...)
+
+	for _, req := range pending {
+		rl.respond(req, &APIResponse{Err: ErrShuttingDown})
+	}
+}
+
+// whether the user's next request may go out now, taking a token from their bucket and reserving the units of its
+// target if so
+func (rl *RateLimiter) mayDispatch(req *UserRequest) bool {
+	t := rl.targetOf(req)
+	if rl.cfg.ParkWhenOpen && t.breaker.blockedFor() > 0 {
+		return false
+	}
+	if !rl.userReady(req.UserID) || !rl.allowUser(req.UserID) {
+		return false
+	}
+	// the bulk call's units are reserved already
+	if rl.joinsBatch(req) {
+		return true
+	}
+	readyAt, ok := t.reserveFirstCall(req.cost(), rl.clock.Now())
+	if !ok {
+		// the user's token is lost, their next turn comes a little later
+		return false
+	}
+	req.readyAt, req.retryTurn, req.quotaPending = readyAt, false, true
+	return true
+}
+
+// asks the QuotaCoordinator for the units reserved for the request's call, once taken from the queue (or the retries)
+// and with no lock held: a slow Redis holds up processQueue, not every submission and query of the queue. A refused
+// request goes back where it came from, in front of its user's requests (or of the retries). Reports whether the
+// units were granted.
+func (rl *RateLimiter) reserveQuota(req *UserRequest, fresh bool) bool {
+	req.quotaPending = false
+	t := rl.targetOf(req)
+	now := rl.clock.Now()
+	if t.reserveQuota(req.cost(), req.readyAt, req.retryTurn, now) {
+		if fresh {
+			t.bucketMu.Lock()
+			t.earnRetryTurn(now)
+			t.bucketMu.Unlock()
+		} else {
+			t.stats.retries.Add(1)
+		}
+		return true
+	}
+
+	if fresh {
+		rl.queue.putBack(req)
+		return false
+	}
+	rl.retrying.Add(1)
+	if !rl.retries.pushFront(req) {
+		rl.abandonRetry(req)
+	}
+	return false
+}
+
+// takes a token from the user's bucket, always true without a per-user limit
+func (rl *RateLimiter) allowUser(userID string) bool {
+	if rl.cfg.PerUserLimit <= 0 {
+		return true
+	}
+	bucket, exists := rl.userBuckets[userID]
+	if !exists {
+		bucket = newTokenBucket(rl.cfg.PerUserLimit, rl.cfg.PerUserLimit, rl.clock.Now())
+		rl.userBuckets[userID] = bucket
+	}
+	return bucket.take(rl.clock.Now())
+}
+
+// drops the request if its context is done, reporting whether it did
+func (rl *RateLimiter) skipIfCancelled(req *UserRequest) bool {
+	err := req.context().Err()
+	if err == nil {
+		return false
+	}
+	rl.cancelled.Add(1)
+	// Response is buffered, this never blocks even though most likely nobody reads it
+	rl.respond(req, &APIResponse{Err: err})
+	return true
+}
+
+// how many requests were dropped because they were cancelled before they could be sent
+func (rl *RateLimiter) Cancelled() int64 {
+	return rl.cancelled.Load()
+}
+
+// forgets the buckets of users that have been quiet long enough for their bucket to be full again
+func (rl *RateLimiter) cleanupUserBuckets() {
+	now := rl.clock.Now()
+	for userID, bucket := range rl.userBuckets {
+		if bucket.full(now) && rl.queue.pendingFor(userID) == 0 {
+			delete(rl.userBuckets, userID)
+		}
+	}
+}
+
+// blocks while the in-flight limit is reached, returns false if the rate limiter shuts down meanwhile
+func (rl *RateLimiter) waitForInflightSlot() bool {
+	limit := rl.inflightLimit()
+	if limit <= 0 || rl.inflight.Load() < limit {
+		return true
+	}
+
+	hits := rl.inflightLimitHits.Add(1)
+	// with AdaptiveConcurrency this is how the limit works, not worth a line every time
+	if rl.concurrency == nil {
+		log.Printf("In-flight limit of %d reached (%d times so far), pausing the queue", limit, hits)
+	}
+	// the limit may change meanwhile with AdaptiveConcurrency
+	for rl.inflight.Load() >= rl.inflightLimit() {
+		select {
+		case <-rl.inflightFreed:
+		case <-rl.shutdownChan:
+			return false
+		}
+	}
+	return true
+}
+
+// how many times the queue paused because too many requests were in flight
+func (rl *RateLimiter) InflightLimitHits() int64 {
+	return rl.inflightLimitHits.Load()
+}
+
+// the calls made for a request before giving up on it
+const maxRetries = 5
+
+// makes a call for the request to the third-party API. A call worth retrying is retried later on, the request goes
+// back to processQueue once its backoff is over (see retryshare.go) rather than holding on to the sender meanwhile.
 func (rl *RateLimiter) sendRequest(req *UserRequest) {
-	var (
-		maxRetries = 5
-		backoff    = time.Millisecond * 500
-	)
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		// simulate third-party API call
-		resp, err := callThirdPartyAPI(req)
-
-		if err == nil {
-			// successful response
-			req.Response <- resp
-			return
+	retrying := false
+	defer func() {
+		if !retrying {
+			rl.markDone(req)
+		}
+		rl.inflight.Add(-1)
+		// wake up the queue if it is waiting for a slot
+		select {
+		case rl.inflightFreed <- struct{}{}:
+		default:
 		}
+		// or for the last request to be done before it stops
+		rl.queue.wake()
+	}()
 
-		if err == ErrRateLimited {
-			// wait for backoff before retrying
-			log.Printf("Retry in %f seconds", backoff.Seconds())
-			time.Sleep(backoff)
-			backoff = time.Duration(float64(backoff) * math.Pow(2, float64(attempt)))
-			continue
-		} else {
-			// Other errors
-			req.Response <- &APIResponse{Err: err}
+	t := rl.targetOf(req)
+	req.attempt++
+	attempt := req.attempt
+
+	if rl.skipIfStale(req) {
+		return
+	}
+	probe, ok := rl.passBreaker(t, req)
+	if !ok {
+		return
+	}
+	// the call's units were reserved when the request was taken from the queue (or the retries)
+	if rl.skipIfTooLate(req, req.readyAt, nil) {
+		t.breaker.record(probe, callIgnored)
+		return
+	}
+	if !rl.sleep(req.readyAt.Sub(rl.clock.Now())) {
+		t.breaker.record(probe, callIgnored)
+		rl.respond(req, &APIResponse{Err: ErrShuttingDown})
+		return
+	}
+	t.stats.unitsSent.Add(int64(req.cost()))
+	// pacing may take a while, the permit is lost but the call isn't worth making anymore
+	if rl.skipIfExpired(req) {
+		t.breaker.record(probe, callIgnored)
+		return
+	}
+
+	// what the third party wants to see, a failure answers the request right away
+	sent, ok := rl.transform(t, req)
+	if !ok {
+		t.breaker.record(probe, callIgnored)
+		return
+	}
+
+	rl.logRequest(slog.LevelInfo, eventDispatched, req)
+	rl.hookDispatched(req)
+	start := rl.clock.Now()
+	resp, err := t.call(sent)
+	rl.observeLatency(req, rl.clock.Now().Sub(start), err)
+	t.breaker.record(probe, outcomeOf(req.context(), err))
+
+	if err == nil {
+		if resp.RateLimit != nil {
+			t.observeRateLimit(*resp.RateLimit)
+		}
+		if req.batch != nil {
+			rl.respondToBatch(t, req, resp.batch)
 			return
 		}
+		// successful response
+		t.stats.succeeded.Add(1)
+		if req.Cacheable {
+			rl.cache.put(req.cacheKey(), resp, rl.clock.Now())
+		}
+		rl.respond(req, resp)
+		return
 	}
 
-	// If all retries failed
-	req.Response <- &APIResponse{Err: fmt.Errorf("request failed after %d retries", maxRetries)}
-}
+	retryable := t.isRetryable(err)
+	if retryable && !req.safeToRetry(err) {
+		// trying again might do it twice, the caller has to find out whether it happened
+		t.stats.failed.Add(int64(req.size()))
+		rl.respond(req, &APIResponse{Err: &AmbiguousResultError{Err: err}})
+		return
+	}
+	if !retryable {
+		// Other errors
+		t.stats.failed.Add(int64(req.size()))
+		rl.respond(req, &APIResponse{Err: err})
+		return
+	}
 
-// csimulates the third-party API call
-func callThirdPartyAPI(req *UserRequest) (*APIResponse, error) {
-	// simulate rate limiting error randomly (30% chance of error)
+	if errors.Is(err, ErrRateLimited) {
+		t.stats.rateLimitHits.Add(1)
+		t.rateLimited(rl.clock.Now())
+	}
+	if attempt == maxRetries {
+		// If all retries failed
+		t.stats.failed.Add(int64(req.size()))
+		rl.respond(req, &APIResponse{Err: fmt.Errorf("request failed after %d retries: %w", maxRetries, err)})
+		return
+	}
 
-	if rand.Float32() < 0.3 {
-		return nil, ErrRateLimited
+	// the third party knows best how long to wait, blind backoff is the fallback
+	req.backoff = capBackoff(t.currentLimits().backoff.Next(attempt, req.backoff), rl.cfg.MaxBackoff)
+	wait := req.backoff
+	var limited *RateLimitedError
+	if errors.As(err, &limited) {
+		t.observeRateLimit(limited.Info)
+		if limited.Info.RetryAfter > 0 {
+			wait = limited.Info.RetryAfter
+		}
+	}
+	// the retry would come too late for those waiting on it
+	if rl.skipIfTooLate(req, rl.clock.Now().Add(wait), err) {
+		return
 	}
 
-	// simulate successful response
-	return &APIResponse{Data: fmt.Sprintf("Processed data for user %s", req.UserID)}, nil
+	// wait before retrying
+	rl.logRequest(slog.LevelInfo, eventRetrying, req, "backoff", wait, "retry", attempt, "max_retries", maxRetries,
+		"error", err)
+	rl.hookRetrying(req, wait, err)
+	retrying = true
+	rl.scheduleRetry(req, wait)
+}
+
+// pauses all requests to the target until the reset when the third party says the quota is used up
+func (t *target) observeRateLimit(info RateLimitInfo) {
+	if !info.exhausted() {
+		return
+	}
+	until := info.Reset.UnixNano()
+	for {
+		current := t.pausedUntil.Load()
+		if current >= until || t.pausedUntil.CompareAndSwap(current, until) {
+			break
+		}
+	}
+	log.Printf("Quota of %s used up, pausing its requests until %s", t.name, info.Reset.Format(time.RFC3339))
 }
 
 // Error to indicate that the request was rate-limited
 var ErrRateLimited = fmt.Errorf("rate limited by third-party API")
 
-// allows users to submit requests to the RateLimiter
-func (rl *RateLimiter) SubmitRequest(req *UserRequest) {
-	rl.requestChan <- req
+// the rate limit state reported by the third party, e.g through Retry-After and X-RateLimit-* headers
+type RateLimitInfo struct {
+	// how long to wait before trying again, 0 if not given
+	RetryAfter time.Duration
+	// requests left until Reset
+	Remaining int
+	// when the quota is restored, zero if not given
+	Reset time.Time
 }
 
-// Shutdown gracefully shuts down the RateLimiter
-func (rl *RateLimiter) Shutdown() {
-	close(rl.shutdownChan)
-	rl.wg.Wait()
+// whether the quota is used up until Reset
+func (info RateLimitInfo) exhausted() bool {
+	return !info.Reset.IsZero() && info.Remaining <= 0
+}
+
+// a rate-limited response along with what the third party said about it, it matches ErrRateLimited with errors.Is
+type RateLimitedError struct {
+	Info RateLimitInfo
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.Info.RetryAfter > 0 {
+		return fmt.Sprintf("%v, retry after %s", ErrRateLimited, e.Info.RetryAfter)
+	}
+	return ErrRateLimited.Error()
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// returned by SubmitRequest when the queue has no room for the request
+var ErrQueueFull = errors.New("request queue is full")
+
+// allows users to submit requests to the RateLimiter.
+// When the queue is full it waits for room until ctx is done and returns ErrQueueFull, or does what Config.Overflow
+// says instead. Blocking forever would turn overload into a pile of goroutines stuck in handlers.
+// A user with MaxPendingPerUser requests pending already gets a TooManyPendingError right away, waiting wouldn't be
+// fair to the others.
+func (rl *RateLimiter) SubmitRequest(ctx context.Context, req *UserRequest) error {
+	rl.submitMu.RLock()
+	defer rl.submitMu.RUnlock()
+
+	return rl.submit(ctx, req, rl.cfg.Overflow)
+}
+
+// submits the request like SubmitRequest, doing what overflow says when the queue is full (must be called with
+// submitMu held for reading)
+func (rl *RateLimiter) submit(ctx context.Context, req *UserRequest, overflow OverflowPolicy) error {
+	if req.RequestID == "" {
+		req.RequestID = newUUID()
+	}
+	if rl.closing {
+		return ErrShuttingDown
+	}
+	if err := rl.checkTarget(req); err != nil {
+		return err
+	}
+	if err := rl.checkCost(req); err != nil {
+		return err
+	}
+	if rl.answerFromCache(req) {
+		return nil
+	}
+	if err := rl.checkEstimatedWait(req); err != nil {
+		return err
+	}
+	if err := rl.backlog.admit(req, rl.cfg.MaxPendingPerUser); err != nil {
+		return err
+	}
+
+	req.enqueuedAt = rl.clock.Now()
+	if req.ExpiresAt.IsZero() && rl.cfg.MaxQueueTime > 0 {
+		req.ExpiresAt = req.enqueuedAt.Add(rl.cfg.MaxQueueTime)
+	}
+	// before journaling, a recovered request must be sent with the same key
+	rl.idempotencyKeys.assign(req)
+	if rl.journal != nil {
+		id, err := rl.journal.submit(req)
+		if err != nil {
+			rl.idempotencyKeys.release(req)
+			rl.backlog.release(req)
+			return fmt.Errorf("journaling the request: %w", err)
+		}
+		req.journalID = id
+	}
+
+	rl.requests.add(req)
+	rl.hookEnqueued(req)
+	err := rl.enqueue(ctx, req, overflow)
+	if err != nil {
+		rl.requests.remove(req)
+		rl.hookCompleted(req, &APIResponse{Err: err})
+		// never queued, nothing to recover
+		rl.journal.done(req.journalID)
+		rl.idempotencyKeys.release(req)
+		rl.backlog.release(req)
+		return err
+	}
+	rl.logEnqueued(req)
+	return nil
+}
+
+// queues the request, making room as overflow says if the queue is full
+func (rl *RateLimiter) enqueue(ctx context.Context, req *UserRequest, overflow OverflowPolicy) error {
+	if overflow == OverflowDropOldest {
+		if evicted := rl.queue.pushEvictingOldest(req); evicted != nil {
+			rl.evict(evicted)
+		}
+		return nil
+	}
+	for {
+		room, err := rl.queue.push(req)
+		if !errors.Is(err, ErrQueueFull) {
+			return err
+		}
+		if overflow == OverflowReject {
+			return err
+		}
+
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrQueueFull, ctx.Err())
+		}
+	}
+}
+
+// the number of requests waiting in the queue, all lanes together
+func (rl *RateLimiter) QueueDepth() int {
+	return rl.queue.len()
+}
+
+// the number of requests waiting in the lane of the given priority
+func (rl *RateLimiter) LaneDepth(priority Priority) int {
+	return rl.queue.laneLen(priority)
+}
+
+// roughly how long it takes to work through the current queue
+func (rl *RateLimiter) queueDrainTime() time.Duration {
+	return time.Duration(float64(rl.QueueDepth()) / rl.EffectiveRate() * float64(time.Minute))
+}
+
+// returned (or sent as the response) for requests the rate limiter won't process because it is shutting down
+var ErrShuttingDown = errors.New("rate limiter is shutting down")
+
+// Shutdown gracefully shuts down the RateLimiter.
+// It stops taking new requests and works through the queue. If ctx is done before the queue is empty, every request
+// still waiting (or backing off between retries) is answered with ErrShuttingDown instead, and ctx.Err() is returned.
+// Either way every submitted request gets exactly one response before Shutdown returns.
+func (rl *RateLimiter) Shutdown(ctx context.Context) error {
+	// waits for submissions already under way, which may be waiting for room in the queue
+	rl.submitMu.Lock()
+	alreadyClosing := rl.closing
+	rl.closing = true
+	journal := rl.journal
+	rl.submitMu.Unlock()
+	if !alreadyClosing {
+		close(rl.draining)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		rl.wg.Wait()
+		// nothing is answered anymore, whatever the journal still holds is for the next process
+		if !alreadyClosing {
+			if err := journal.close(); err != nil {
+				log.Printf("Closing the journal failed: %v", err)
+			}
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		rl.abortOnce.Do(func() { close(rl.shutdownChan) })
+		<-finished
+		return ctx.Err()
+	}
 }
 
 func main() {
-	rateLimiter := NewRateLimiter()
-	defer rateLimiter.Shutdown()
+	// the nodes behind the load balancer share the third party's quota through Redis, when there is one. Each of the
+	// three uses a third of it while Redis is down.
+	var quota QuotaCoordinator
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		quota = &RedisQuota{Addr: addr, LocalFraction: 1.0 / 3}
+	}
+
+	rateLimiter := NewRateLimiter(Config{
+		Quota: quota,
+		Burst: 50, MaxInflight: 100, PerUserLimit: 100, MaxPendingPerUser: 500, BreakerThreshold: 20,
+		// the handler gives up after 5 seconds, no point queuing a request that won't go out by then
+		MaxEstimatedWait: 5 * time.Second,
+		// during a storm of rate-limited responses, new users still get most of the calls
+		RetryShare: 0.3,
+		// Batchable requests arriving within 20ms of each other share a bulk call
+		BatchWindow: 20 * time.Millisecond,
+		// the search endpoint has a much lower limit of its own
+		Targets: map[string]TargetConfig{
+			"search": {RequestsPerMinute: 100, Burst: 10, BreakerThreshold: 20},
+		},
+	})
+
+	// requests queued when the previous process stopped are sent now, see journal.go
+	recovered, err := rateLimiter.Recover("pending_requests.journal")
+	if err != nil {
+		log.Fatalf("Recovering the queue failed: %v", err)
+	}
+	log.Printf("Recovered %d queued requests", recovered)
+
+	// results of requests submitted with a callback_url, signed with the secret shared with the receivers
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	async := newAsyncTracker(&WebhookSender{Secret: []byte(webhookSecret)}, realClock{})
+	// lets operators change the limits without a restart (PUT /api/config), see reconfig.go
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
+	server := &http.Server{Addr: ":8080", Handler: newMux(rateLimiter, async, webhookSecret, adminToken)}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("Server is running on port 8080")
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// a deploy sends SIGTERM, the requests already accepted are answered before the process goes
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	case err := <-serverErr:
+		log.Printf("Server failed: %v", err)
+	}
+	gracefulShutdown(server, rateLimiter, shutdownTimeout)
+}
+
+// the routes of the API, see main
+func newMux(rateLimiter *RateLimiter, async *asyncTracker, webhookSecret, adminToken string) *http.ServeMux {
+	mux := http.NewServeMux()
 
 	// simulate incoming user requests
-	http.HandleFunc("/api/request", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/request", func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Header.Get("X-User-ID")
 		if userID == "" {
 			http.Error(w, "User ID is required", http.StatusBadRequest)
 			return
 		}
 
+		// we give up after 5 seconds (or when the client goes away), and so does the queued request
+		ctx, cancel := withClockTimeout(r.Context(), rateLimiter.clock, 5*time.Second)
+		defer cancel()
+
+		// someone is waiting on this one, unless the caller says it's background traffic
+		priority := PriorityHigh
+		if r.Header.Get("X-Priority") == "low" {
+			priority = PriorityLow
+		}
+
+		// the endpoint being proxied decides what a call costs, e.g a batch search counts as 10 requests
+		cost := 1
+		if header := r.Header.Get("X-Request-Cost"); header != "" {
+			parsed, err := strconv.Atoi(header)
+			if err != nil || parsed < 1 {
+				http.Error(w, "X-Request-Cost must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			cost = parsed
+		}
+
+		// with a callback URL the result is POSTed there instead of holding the connection open, see webhook.go
+		callbackURL := r.FormValue("callback_url")
+		if callbackURL != "" {
+			if webhookSecret == "" {
+				http.Error(w, "Callbacks are not enabled", http.StatusBadRequest)
+				return
+			}
+			if parsed, err := url.Parse(callbackURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				http.Error(w, "callback_url must be an absolute http(s) URL", http.StatusBadRequest)
+				return
+			}
+		}
+
 		// create a UserRequest
 		req := &UserRequest{
-			UserID:   userID,
+			UserID: userID,
+			// which third-party API to call, e.g "search" (none means the default one)
+			Target:   r.Header.Get("X-Target"),
 			Data:     "Some data",
 			Response: make(chan *APIResponse, 1),
+			Ctx:      ctx,
+			Priority: priority,
+			Cost:     cost,
+			// reads can be answered with a response that is a few seconds old, and are safe to make twice
+			Cacheable:  r.Method == http.MethodGet,
+			Idempotent: r.Method == http.MethodGet,
+			// a client retrying on its own sends the same key again
+			IdempotencyKey: r.Header.Get(IdempotencyKeyHeader),
+			// the client's own ID, to find the request in our logs
+			RequestID: r.Header.Get(RequestIDHeader),
+			// the caller can wait a few more milliseconds for the call to be shared, see batch.go
+			Batchable: r.Header.Get("X-Batchable") == "true",
 		}
+		if callbackURL != "" {
+			// nobody waits on the connection, the request outlives the handler
+			req.Ctx = nil
+		}
+
+		// how long the client should expect to wait, in milliseconds
+		estimate := rateLimiter.EstimateWait(req)
 
 		// submit the request to the RateLimiter
-		rateLimiter.SubmitRequest(req)
+		err := rateLimiter.SubmitRequest(ctx, req)
+		w.Header().Set(RequestIDHeader, req.RequestID)
+		if errors.Is(err, ErrCostTooHigh) || errors.Is(err, ErrUnknownTarget) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var waitErr *WaitTooLongError
+		if errors.As(err, &waitErr) {
+			// the queue should be short enough again by the time the request would have gone out
+			retryAfter := max(int(math.Ceil((waitErr.Estimate - waitErr.Limit).Seconds())), 1)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			http.Error(w, "The wait would be too long, please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrShuttingDown) {
+			http.Error(w, "The server is shutting down, please try again.", http.StatusServiceUnavailable)
+			return
+		}
+		var pendingErr *TooManyPendingError
+		if errors.As(err, &pendingErr) {
+			http.Error(w, fmt.Sprintf("User %s already has %d requests queued or in flight, the most a single user may "+
+				"have at once. Wait for some of them to finish before sending more.", pendingErr.UserID, pendingErr.Limit),
+				http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			// tell the client when the queue should have room again
+			retryAfter := max(int(math.Ceil(rateLimiter.queueDrainTime().Seconds())), 1)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			http.Error(w, "Too many requests queued, please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Estimated-Wait", strconv.FormatInt(estimate.Milliseconds(), 10))
+
+		if callbackURL != "" {
+			id := async.track(req, callbackURL)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", "/api/request/"+id)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(AsyncResult{ID: id, Status: asyncPending})
+			return
+		}
 
 		// Wait for the response or timeout
 		select {
 		case resp := <-req.Response:
 			if resp.Err != nil {
-				// handle errors gracefully
-				if resp.Err == ErrRateLimited {
-					http.Error(w, "Service is busy, please try again later.", http.StatusTooManyRequests)
-				} else {
-					http.Error(w, resp.Err.Error(), http.StatusInternalServerError)
-				}
+				// handle errors gracefully, see errors.go
+				status, message := responseStatus(resp.Err)
+				http.Error(w, message, status)
 			} else {
 				// Successful response
+				if resp.Cached {
+					w.Header().Set("X-Cache", "hit")
+				}
 				fmt.Fprintf(w, "Success: %s", resp.Data)
 			}
-		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
 			// Timeout
 			http.Error(w, "Request timed out", http.StatusGatewayTimeout)
 		}
 	})
 
-	// Start the HTTP server
-	log.Println("Server is running on port 8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
-	}
+	mux.HandleFunc("/api/stats", statsHandler(rateLimiter))
+	mux.HandleFunc("/api/config", configHandler(rateLimiter, adminToken))
+	mux.HandleFunc("/api/request/", async.statusHandler())
+	mux.HandleFunc("GET /api/request/{id}/position", positionHandler(rateLimiter))
+	return mux
 }
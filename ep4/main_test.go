@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a rate limiter on a FakeClock calling the client, pacing and logging out of the way unless cfg says otherwise
+func scriptedLimiter(cfg Config) (*RateLimiter, *FakeClock, *ScriptedClient) {
+	clock := NewFakeClock(testStart)
+	client := &ScriptedClient{Clock: clock}
+	cfg.Client, cfg.Clock = client, clock
+	if cfg.Logger == nil {
+		cfg.Logger = quietLogger()
+	}
+	if cfg.RequestsPerMinute == 0 {
+		cfg.RequestsPerMinute, cfg.Burst = 60000, 10
+	}
+	return NewRateLimiter(cfg), clock, client
+}
+
+func TestCancelledRequestsAreNotSent(t *testing.T) {
+	rl, clock, client := scriptedLimiter(Config{})
+	defer shutdownNow(rl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var pending []*UserRequest
+	for i := range 10 {
+		req := testRequest(fmt.Sprintf("user%d", i), "ping")
+		req.Ctx = ctx
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); !errors.Is(resp.Err, context.Canceled) {
+			t.Fatalf("request of %s answered %+v, expected context.Canceled", req.UserID, resp)
+		}
+	}
+	if calls := client.Calls(); len(calls) != 0 {
+		t.Fatalf("%d calls for cancelled requests, expected none", len(calls))
+	}
+	if cancelled := rl.Cancelled(); cancelled != int64(len(pending)) {
+		t.Fatalf("%d requests counted as cancelled, expected %d", cancelled, len(pending))
+	}
+}
+
+func TestCancelledBetweenRetries(t *testing.T) {
+	rl, clock, client := scriptedLimiter(Config{Backoff: fixedBackoff(time.Second)})
+	defer shutdownNow(rl)
+	client.Script("alice", FailWith(503))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := testRequest("alice", "ping")
+	req.Ctx = ctx
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	// the first call failed, the retry waits out its backoff
+	for settle(clock); len(client.Calls()) == 0; settle(clock) {
+		clock.AdvanceToNext()
+	}
+	cancel()
+
+	if resp := awaitResponse(t, clock, req); !errors.Is(resp.Err, context.Canceled) {
+		t.Fatalf("answered %+v, expected context.Canceled", resp)
+	}
+	if calls := client.Calls(); len(calls) != 1 {
+		t.Fatalf("%d calls, the retry of a cancelled request shouldn't go out", len(calls))
+	}
+}
+
+// submits high priority requests of the user until the queue refuses one, returning the error
+func fillQueue(t *testing.T, ctx context.Context, rl *RateLimiter, userID string) error {
+	t.Helper()
+	for range 2 * laneCapacity {
+		req := testRequest(userID, "ping")
+		req.Priority = PriorityHigh
+		if err := rl.SubmitRequest(ctx, req); err != nil {
+			return err
+		}
+	}
+	t.Fatalf("%d requests queued, the queue never filled up", 2*laneCapacity)
+	return nil
+}
+
+func TestSubmitRequestWhenQueueIsFull(t *testing.T) {
+	// one call a minute, the queue only grows
+	rl, _, _ := scriptedLimiter(Config{RequestsPerMinute: 1})
+	defer shutdownNow(rl)
+
+	// a done ctx doesn't wait for room at all
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fillQueue(t, done, rl, "alice"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("submitting to a full queue: %v, expected ErrQueueFull", err)
+	}
+	if depth := rl.LaneDepth(PriorityHigh); depth != laneCapacity {
+		t.Fatalf("%d requests queued, expected a full lane (%d)", depth, laneCapacity)
+	}
+
+	// waiting for room gives up with the ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := testRequest("alice", "ping")
+	req.Priority = PriorityHigh
+	if err := rl.SubmitRequest(ctx, req); !errors.Is(err, ErrQueueFull) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting on a full queue: %v, expected ErrQueueFull once the ctx is done", err)
+	}
+
+	// the other lane still has room
+	if err := rl.SubmitRequest(context.Background(), testRequest("bob", "ping")); err != nil {
+		t.Fatalf("low priority request refused: %v", err)
+	}
+}
+
+func TestHandlerAnswers503WhenQueueIsFull(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Overflow: OverflowReject})
+	defer shutdownNow(rl)
+	server := httptest.NewServer(newMux(rl, newAsyncTracker(&WebhookSender{}, clock), "", ""))
+	defer server.Close()
+	// the handler's own ctx would wait on the FakeClock, OverflowReject doesn't wait
+	if err := fillQueue(t, context.Background(), rl, "alice"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("submitting to a full queue: %v, expected ErrQueueFull right away", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/request", nil)
+	req.Header.Set("X-User-ID", "bob")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("answered %d, expected 503", resp.StatusCode)
+	}
+	// 10,000 requests at 1 a minute
+	if retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retryAfter < 60 {
+		t.Fatalf("Retry-After %q, expected the time the queue takes to drain", resp.Header.Get("Retry-After"))
+	}
+}
+
+// submits n requests of different users
+func submitRequests(t *testing.T, rl *RateLimiter, n int) []*UserRequest {
+	t.Helper()
+	var pending []*UserRequest
+	for i := range n {
+		req := testRequest(fmt.Sprintf("user%d", i), "ping")
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+	return pending
+}
+
+// the only response to the request
+func onlyResponse(t *testing.T, req *UserRequest) *APIResponse {
+	t.Helper()
+	select {
+	case resp := <-req.Response:
+		if len(req.Response) != 0 {
+			t.Fatalf("request of %s answered more than once", req.UserID)
+		}
+		return resp
+	default:
+		t.Fatalf("request of %s wasn't answered", req.UserID)
+		return nil
+	}
+}
+
+func TestShutdownDrainsTheQueue(t *testing.T) {
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 1})
+	pending := submitRequests(t, rl, 20)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- rl.Shutdown(context.Background()) }()
+	for settle(clock); len(shutdown) == 0 && clock.AdvanceToNext(); settle(clock) {
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v, expected the queue to drain", err)
+	}
+
+	for _, req := range pending {
+		if resp := onlyResponse(t, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	if calls := client.Calls(); len(calls) != len(pending) {
+		t.Fatalf("%d calls for %d requests", len(calls), len(pending))
+	}
+	if err := rl.SubmitRequest(context.Background(), testRequest("late", "ping")); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("submitting after Shutdown: %v, expected ErrShuttingDown", err)
+	}
+}
+
+func TestShutdownPastDeadlineAnswersEveryRequest(t *testing.T) {
+	// one call a minute, the deadline is long gone before the queue is
+	rl, _, client := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1})
+	pending := submitRequests(t, rl, 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rl.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Shutdown: %v, expected the ctx's error", err)
+	}
+
+	abandoned := 0
+	for _, req := range pending {
+		resp := onlyResponse(t, req)
+		switch {
+		case errors.Is(resp.Err, ErrShuttingDown):
+			abandoned++
+		case resp.Err != nil:
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	if sent := len(client.Calls()); abandoned+sent != len(pending) || abandoned < len(pending)-1 {
+		t.Fatalf("%d requests abandoned and %d sent, expected all but the burst abandoned", abandoned, sent)
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		// checks what the call returned
+		check     func(resp *APIResponse, err error) bool
+		expected  string
+		retryable bool
+	}{
+		{"success", func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s for %s", body, r.Header.Get("X-User-ID"))
+		}, func(resp *APIResponse, err error) bool {
+			return err == nil && resp.Data == "ping for alice"
+		}, "the body answered", false},
+		{"429 with Retry-After", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}, func(resp *APIResponse, err error) bool {
+			var limited *RateLimitedError
+			return errors.As(err, &limited) && errors.Is(err, ErrRateLimited) && limited.Info.RetryAfter == 3*time.Second
+		}, "ErrRateLimited with Retry-After 3s", true},
+		{"500", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusInternalServerError)
+		}, func(resp *APIResponse, err error) bool {
+			var serverErr *ServerError
+			return errors.As(err, &serverErr) && serverErr.StatusCode == 500 && serverErr.Body == "down\n"
+		}, "a ServerError with the status and body", true},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) {
+			// the server only notices the client hanging up once the body is read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		}, func(resp *APIResponse, err error) bool {
+			return errors.Is(err, ErrNetwork) && errors.Is(err, context.DeadlineExceeded) && timedOut(err)
+		}, "a NetworkError timing out", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			defer server.Close()
+			client := &HTTPTransport{BaseURL: server.URL, Timeout: 50 * time.Millisecond}
+
+			resp, err := client.Call(context.Background(), testRequest("alice", "ping"))
+			if !tc.check(resp, err) {
+				t.Fatalf("call returned %+v, %v, expected %s", resp, err, tc.expected)
+			}
+			if err != nil && DefaultIsRetryable(err) != tc.retryable {
+				t.Fatalf("%v retryable: %t, expected %t", err, !tc.retryable, tc.retryable)
+			}
+		})
+	}
+}
+
+func TestSendRequestOverHTTP(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	var mu sync.Mutex
+	var calls []time.Time
+	// rate limited, failing, then answering
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, clock.Now())
+		call := len(calls)
+		mu.Unlock()
+		switch call {
+		case 1:
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			http.Error(w, "down", http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, "pong")
+		}
+	}))
+	defer server.Close()
+	rl := NewRateLimiter(Config{Client: &HTTPTransport{BaseURL: server.URL}, Clock: clock, Logger: quietLogger(),
+		RequestsPerMinute: 60000, Burst: 10, Backoff: fixedBackoff(time.Second)})
+	defer shutdownNow(rl)
+
+	req := testRequest("alice", "ping")
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if resp := awaitResponse(t, clock, req); resp.Err != nil || resp.Data != "pong" {
+		t.Fatalf("answered %+v, expected the third call's body", resp)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 3 {
+		t.Fatalf("%d calls, expected the 429 and the 500 retried", len(calls))
+	}
+	// the 429 says how long to wait, the 500 leaves it to the backoff
+	if gap := calls[1].Sub(calls[0]); gap < 2*time.Second {
+		t.Fatalf("retried %s after the 429, expected its Retry-After of 2s", gap)
+	}
+	if gap := calls[2].Sub(calls[1]); gap < time.Second {
+		t.Fatalf("retried %s after the 500, expected the backoff of 1s", gap)
+	}
+}
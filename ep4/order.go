@@ -0,0 +1,70 @@
+package main
+
+/**
+The queue keeps each user's requests in order, but with several senders a user's second request can overtake the
+first one on the wire (the first one may be slow, or backing off before a retry). Some third-party APIs require a
+user's requests to arrive in the order they were submitted.
+
+With Config.PreserveOrderPerUser each user gets an orderedBuffer numbering the requests sent for them. A user's next
+request is held in the queue until the previous one completed, retries included, while other users' requests keep
+going out concurrently.
+*/
+
+// numbers the requests sent for a user, see above
+type orderedBuffer struct {
+	// sequence number of the latest request sent, and of the latest one completed
+	sent, done uint64
+}
+
+// whether the user has no request being sent, always true without PreserveOrderPerUser
+func (rl *RateLimiter) userReady(userID string) bool {
+	if !rl.cfg.PreserveOrderPerUser {
+		return true
+	}
+	rl.orderMu.Lock()
+	defer rl.orderMu.Unlock()
+
+	buffer, exists := rl.ordered[userID]
+	return !exists || buffer.sent == buffer.done
+}
+
+// gives the request the next sequence number of its user as it is handed to a sender
+func (rl *RateLimiter) markSent(req *UserRequest) {
+	if !rl.cfg.PreserveOrderPerUser {
+		return
+	}
+	rl.orderMu.Lock()
+	defer rl.orderMu.Unlock()
+
+	buffer, exists := rl.ordered[req.UserID]
+	if !exists {
+		buffer = &orderedBuffer{}
+		rl.ordered[req.UserID] = buffer
+	}
+	buffer.sent++
+	req.seq = buffer.sent
+}
+
+// releases the user's next request once the request completed
+func (rl *RateLimiter) markDone(req *UserRequest) {
+	if !rl.cfg.PreserveOrderPerUser {
+		return
+	}
+	if req.batch != nil {
+		for _, item := range req.batch {
+			rl.markDone(item)
+		}
+		return
+	}
+	rl.orderMu.Lock()
+	buffer := rl.ordered[req.UserID]
+	buffer.done = req.seq
+	// forgotten once idle, the next request starts a new buffer
+	if buffer.done == buffer.sent {
+		delete(rl.ordered, req.UserID)
+	}
+	rl.orderMu.Unlock()
+
+	// the user's next request may be waiting for this one
+	rl.queue.wake()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+/**
+What to do with a request when its lane of the queue is full depends on who is submitting:
+
+- OverflowBlock (the default): SubmitRequest waits for room until its ctx is done, then fails with ErrQueueFull.
+  Fine for callers that can afford to wait a little, as long as their ctx says how little.
+- OverflowReject: SubmitRequest fails with ErrQueueFull right away. A user-facing gateway would rather answer 503
+  now than hold the connection open.
+- OverflowDropOldest: the oldest request of the lane is evicted to make room, answered with ErrEvicted so whoever
+  waits on it doesn't hang. A batch pipeline cares more about fresh data than about a backlog that is stale anyway.
+
+The oldest request is the one submitted first, whichever user it belongs to: with round-robin the flooder's backlog is
+at the back of the queue but its first requests can well be the oldest. MaxPendingPerUser keeps a single user from
+taking the whole lane in the first place.
+*/
+
+// what SubmitRequest does when the request's lane of the queue is full, see above
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota
+	OverflowReject
+	OverflowDropOldest
+)
+
+// sent as the response to a request evicted from the queue by a newer one with OverflowDropOldest
+var ErrEvicted = errors.New("request evicted from the full queue by a newer one")
+
+// adds the request like push, evicting the oldest request of its lane to make room if the lane is full. The evicted
+// request, if any, is returned to be answered.
+func (q *fairQueue) pushEvictingOldest(req *UserRequest) *UserRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[req.lane()]
+	var evicted *UserRequest
+	if l.size >= laneCapacity {
+		evicted = q.evictOldest(l)
+	}
+	q.add(l, req)
+	return evicted
+}
+
+// removes and returns the request of the lane submitted first (must be called with mu held)
+func (q *fairQueue) evictOldest(l *lane) *UserRequest {
+	var oldest *UserRequest
+	for _, requests := range l.requests {
+		// each user's requests are in the order they were submitted
+		if len(requests) > 0 && (oldest == nil || requests[0].enqueuedAt.Before(oldest.enqueuedAt)) {
+			oldest = requests[0]
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+
+	requests := q.remove(l, oldest.UserID, l.requests[oldest.UserID])
+	if len(requests) == 0 {
+		delete(l.requests, oldest.UserID)
+		l.users = slices.DeleteFunc(l.users, func(userID string) bool { return userID == oldest.UserID })
+	} else {
+		l.requests[oldest.UserID] = requests
+	}
+	return oldest
+}
+
+// answers a request evicted by OverflowDropOldest
+func (rl *RateLimiter) evict(req *UserRequest) {
+	rl.evicted.Add(1)
+	rl.respond(req, &APIResponse{Err: ErrEvicted})
+}
+
+// requests evicted from the full queue so far, see OverflowDropOldest
+func (rl *RateLimiter) Evicted() int64 {
+	return rl.evicted.Load()
+}
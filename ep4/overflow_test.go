@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDropOldestEvictsAcrossUsers(t *testing.T) {
+	// one call a minute, the queue only grows
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1, Overflow: OverflowDropOldest,
+		MaxPendingPerUser: 1})
+	defer shutdownNow(rl)
+	if err := rl.SubmitRequest(context.Background(), testRequest("zed", "sent")); err != nil {
+		t.Fatal(err)
+	}
+	settle(clock)
+
+	oldest := testRequest("bob", "oldest")
+	if err := rl.SubmitRequest(context.Background(), oldest); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	// the lane fills up with the requests of other users, one each
+	for i := range laneCapacity - 1 {
+		if err := rl.SubmitRequest(context.Background(), testRequest(fmt.Sprintf("user%d", i), "ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if evicted := rl.Evicted(); evicted != 0 {
+		t.Fatalf("%d requests evicted before the lane was full", evicted)
+	}
+
+	if err := rl.SubmitRequest(context.Background(), testRequest("carol", "newest")); err != nil {
+		t.Fatalf("submitting to a full lane: %v, expected the oldest request evicted instead", err)
+	}
+	if resp := onlyResponse(t, oldest); !errors.Is(resp.Err, ErrEvicted) {
+		t.Fatalf("bob's request answered %+v, expected ErrEvicted", resp)
+	}
+	if evicted := rl.Evicted(); evicted != 1 {
+		t.Fatalf("%d requests counted as evicted, expected 1", evicted)
+	}
+	if depth := rl.LaneDepth(PriorityLow); depth != laneCapacity {
+		t.Fatalf("%d requests queued, expected a full lane (%d)", depth, laneCapacity)
+	}
+
+	// bob has nothing pending anymore, his next request is let in
+	if pending := rl.PendingFor("bob"); pending != 0 {
+		t.Fatalf("bob has %d requests pending, expected his evicted one let go of", pending)
+	}
+	if err := rl.SubmitRequest(context.Background(), testRequest("bob", "again")); err != nil {
+		t.Fatalf("bob submitting after his request was evicted: %v", err)
+	}
+}
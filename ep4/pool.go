@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+Every call to the third party over a new connection pays for a TCP handshake, and over HTTPS for a TLS handshake on
+top: a few round trips before the request is even sent, often more than the call itself takes.
+
+The HTTPConnectionPool keeps up to MaxConnsPerHost connections open per host and sends call after call over them
+(HTTP/1.1 keep-alive). Checkout takes an idle connection, opens a new one if the host has fewer than MaxConnsPerHost,
+or waits for one to be returned. A PooledConn must be returned with Release once its response is read: a connection
+is only reusable once the whole response has been read off it, anything else (an error, a body left half read,
+"Connection: close") and Release closes it instead.
+
+The pool is an http.RoundTripper too, so HTTPTransport uses it with Client: &http.Client{Transport: pool}, the
+connection going back to the pool once the response body is closed.
+
+Capping the connections also caps how many calls are in flight to a host, beyond MaxConnsPerHost they wait for a
+connection. That's on top of MaxInflight, which caps them across all hosts.
+
+Gotchas:
+
+- the server closes idle connections whenever it likes. A call over a connection closed in the meantime fails without
+  having been sent, so RoundTrip sends it once more over a new connection (if its body can be read again).
+- idle connections older than IdleTimeout are closed on checkout instead of being used, most servers have closed them
+  by then anyway
+
+The standard library's http.Transport does all of this (and HTTP/2) already, this shows what it does for us.
+BenchmarkPooledConnections and BenchmarkConnectionPerCall (see pool_test.go) time calls over HTTPS both ways.
+*/
+
+const (
+	// defaults for HTTPConnectionPool
+	defaultMaxConnsPerHost = 4
+	defaultPoolIdleTimeout = 90 * time.Second
+	defaultDialTimeout     = 10 * time.Second
+)
+
+// keeps connections to third-party hosts open for reuse, see above. The zero value is ready to use.
+type HTTPConnectionPool struct {
+	// connections open at once per host (default 4)
+	MaxConnsPerHost int
+	// idle connections unused for longer are closed instead of being reused (default 90s)
+	IdleTimeout time.Duration
+	// how long opening a connection may take (default 10s)
+	DialTimeout time.Duration
+	// for https hosts, nil means the defaults
+	TLSConfig *tls.Config
+
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+}
+
+// the connections to a single host
+type hostConns struct {
+	// connections waiting to be checked out, never more than MaxConnsPerHost
+	idle chan *PooledConn
+	// one per connection open, checked out or idle
+	open chan struct{}
+}
+
+// a connection checked out of the pool, see above
+type PooledConn struct {
+	pool   *HTTPConnectionPool
+	host   *hostConns
+	conn   net.Conn
+	reader *bufio.Reader
+	// whether the connection was used before, a failed write may just mean the server closed it while it was idle
+	reused   bool
+	lastUsed time.Time
+	// the connection can't be reused, Release closes it
+	broken bool
+	// stops aborting the call when its context is done
+	stopAbort func() bool
+}
+
+func (p *HTTPConnectionPool) hostConns(key string) *hostConns {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hosts == nil {
+		p.hosts = make(map[string]*hostConns)
+	}
+	host, exists := p.hosts[key]
+	if !exists {
+		size := p.MaxConnsPerHost
+		if size <= 0 {
+			size = defaultMaxConnsPerHost
+		}
+		host = &hostConns{idle: make(chan *PooledConn, size), open: make(chan struct{}, size)}
+		p.hosts[key] = host
+	}
+	return host
+}
+
+// checks out a connection to the host (scheme "http" or "https", addr "host:port"), opening one if there is room and
+// waiting for one to be released otherwise
+func (p *HTTPConnectionPool) Get(ctx context.Context, scheme, addr string) (*PooledConn, error) {
+	host := p.hostConns(scheme + "://" + addr)
+	for {
+		// an idle connection first, opening a new one costs the handshakes the pool is there to save
+		select {
+		case conn := <-host.idle:
+			if conn = p.checkIdle(conn); conn != nil {
+				return conn, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case conn := <-host.idle:
+			if conn = p.checkIdle(conn); conn != nil {
+				return conn, nil
+			}
+		case host.open <- struct{}{}:
+			conn, err := p.dial(ctx, scheme, addr)
+			if err != nil {
+				<-host.open
+				return nil, err
+			}
+			conn.host = host
+			return conn, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// returns the idle connection if it is still worth using, otherwise closes it and returns nil
+func (p *HTTPConnectionPool) checkIdle(conn *PooledConn) *PooledConn {
+	idleTimeout := p.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultPoolIdleTimeout
+	}
+	if time.Since(conn.lastUsed) > idleTimeout {
+		conn.close()
+		return nil
+	}
+	conn.reused = true
+	return conn
+}
+
+// opens a connection to the host, not counted against MaxConnsPerHost
+func (p *HTTPConnectionPool) dial(ctx context.Context, scheme, addr string) (*PooledConn, error) {
+	timeout := p.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "https" {
+		cfg := p.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		// HTTP/2 would need a client of its own, the pool speaks HTTP/1.1 only
+		cfg.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &PooledConn{pool: p, conn: conn, reader: bufio.NewReader(conn), lastUsed: time.Now()}, nil
+}
+
+// sends the request over the connection and reads the response header. The body must be read entirely and closed
+// before Release for the connection to be reused.
+func (c *PooledConn) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+	// a cancelled call unblocks whatever is reading or writing, which leaves the connection in an unknown state
+	c.stopAbort = context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+
+	if err := req.Write(c.conn); err != nil {
+		c.broken = true
+		return nil, err
+	}
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		c.broken = true
+		return nil, err
+	}
+	if resp.Close {
+		c.broken = true
+	}
+	resp.Body = &pooledBody{ReadCloser: resp.Body, conn: c, eof: resp.Body == http.NoBody}
+	return resp, nil
+}
+
+// tells whether the response body was read to the end before being closed
+type pooledBody struct {
+	io.ReadCloser
+	conn *PooledConn
+	eof  bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.eof = true
+	} else if err != nil {
+		b.conn.broken = true
+	}
+	return n, err
+}
+
+func (b *pooledBody) Close() error {
+	if !b.eof {
+		// the rest of the response is still on the connection, the next response would be read from the middle of it
+		b.conn.broken = true
+	}
+	return b.ReadCloser.Close()
+}
+
+// returns the connection to the pool, or closes it if it can't be reused
+func (c *PooledConn) Release() {
+	if c.stopAbort != nil && !c.stopAbort() {
+		// the call was aborted
+		c.broken = true
+	}
+	c.stopAbort = nil
+	if c.broken {
+		c.close()
+		return
+	}
+	c.lastUsed = time.Now()
+	// never blocks, there are no more connections than room for them
+	c.host.idle <- c
+}
+
+// closes the connection, making room for a new one
+func (c *PooledConn) close() {
+	c.conn.Close()
+	<-c.host.open
+}
+
+// makes the pool usable as the Transport of an http.Client, see above
+func (p *HTTPConnectionPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+
+	for {
+		conn, err := p.Get(req.Context(), req.URL.Scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.Do(req)
+		if err == nil {
+			// the connection goes back to the pool once the body is closed
+			resp.Body = &releasingBody{ReadCloser: resp.Body, conn: conn}
+			return resp, nil
+		}
+		conn.Release()
+
+		// the server closed the idle connection before the request got there, the next one may be fresh
+		if !conn.reused || req.Context().Err() != nil || (req.Body != nil && req.GetBody == nil) {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// releases the connection when closed
+type releasingBody struct {
+	io.ReadCloser
+	conn *PooledConn
+	once sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.conn.Release)
+	return err
+}
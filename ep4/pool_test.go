@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// makes calls over a new connection each, the way the pool is compared to
+type connPerCall struct {
+	pool *HTTPConnectionPool
+}
+
+func (t connPerCall) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := t.pool.dial(req.Context(), req.URL.Scheme, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.Do(req)
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	resp.Body = &closingBody{ReadCloser: resp.Body, conn: conn.conn}
+	return resp, nil
+}
+
+// closes the connection along with the body
+type closingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// a local HTTPS third party answering "ok", counting the connections opened to it
+func newCountingTLSServer(t testing.TB) (server *httptest.Server, opened *atomic.Int64) {
+	opened = &atomic.Int64{}
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, opened
+}
+
+// an HTTPTransport to the server going through transport
+func transportTo(server *httptest.Server, transport http.RoundTripper) *HTTPTransport {
+	return &HTTPTransport{BaseURL: server.URL, Client: &http.Client{Transport: transport}}
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	server, opened := newCountingTLSServer(t)
+	pool := &HTTPConnectionPool{TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	client := transportTo(server, pool)
+
+	for i := range 20 {
+		if _, err := client.Call(context.Background(), &UserRequest{UserID: "alice", Data: "ping"}); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if got := opened.Load(); got != 1 {
+		t.Fatalf("20 calls one after the other opened %d connections, expected 1", got)
+	}
+}
+
+func TestPoolCapsConnectionsPerHost(t *testing.T) {
+	server, opened := newCountingTLSServer(t)
+	pool := &HTTPConnectionPool{
+		MaxConnsPerHost: 2, TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	client := transportTo(server, pool)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for range 50 {
+		wg.Go(func() {
+			if _, err := client.Call(context.Background(), &UserRequest{UserID: "alice", Data: "ping"}); err != nil {
+				errs <- err
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if got := opened.Load(); got > 2 {
+		t.Fatalf("50 concurrent calls opened %d connections, MaxConnsPerHost is 2", got)
+	}
+}
+
+// times calls to a local HTTPS server through transport
+func benchmarkCalls(b *testing.B, transport func(pool *HTTPConnectionPool) http.RoundTripper) {
+	server, _ := newCountingTLSServer(b)
+	pool := &HTTPConnectionPool{TLSConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	client := transportTo(server, transport(pool))
+
+	for b.Loop() {
+		if _, err := client.Call(context.Background(), &UserRequest{UserID: "bench", Data: "ping"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// a TCP and a TLS handshake for every call
+func BenchmarkConnectionPerCall(b *testing.B) {
+	benchmarkCalls(b, func(pool *HTTPConnectionPool) http.RoundTripper { return connPerCall{pool: pool} })
+}
+
+// the handshakes once, every call after the first reusing the connection
+func BenchmarkPooledConnections(b *testing.B) {
+	benchmarkCalls(b, func(pool *HTTPConnectionPool) http.RoundTripper { return pool })
+}
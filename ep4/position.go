@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+A client whose request waits behind a long queue only learns it went through once it is answered. GET
+/api/request/{id}/position tells it where the request is meanwhile:
+
+	queued     waiting in its lane, position 1 is the next of the lane to go out
+	in-flight  taken from the queue, being sent (or waiting to share a bulk call, see batch.go)
+	retrying   the call failed, the request waits out its backoff before going out again
+	done       answered, kept for a minute for a client polling late
+
+Every request accepted gets the next sequence number of the rate limiter, the order they were accepted in. The index
+from request ID to request follows it through submit, processQueue, scheduleRetry and respond, the single points the
+request passes on its way. A request ID given by the client may be reused, the latest request with it is the one
+reported.
+
+The position is counted the way round-robin serves the lane (see queue.go): with n of its user's requests ahead of
+it, a request waits for n requests of every user behind its user in line, and n+1 of every user ahead. Users passed
+over for lack of tokens make it an estimate, like the dispatch time, which EstimateWait works out (see estimate.go)
+from the units ahead of the request instead of from the back of the queue.
+*/
+
+// the states of a request, see above
+const (
+	stateQueued   = "queued"
+	stateInFlight = "in-flight"
+	stateRetrying = "retrying"
+	stateDone     = "done"
+)
+
+// how long a done request is still reported
+const doneRetention = time.Minute
+
+// where a request is, served by GET /api/request/{id}/position
+type RequestPosition struct {
+	ID string `json:"id"`
+	// the order the request was accepted in among all requests
+	Seq   uint64 `json:"seq"`
+	State string `json:"state"`
+	// while queued: the request's place in its lane (1 goes next), and when it is expected to go out
+	Position          int       `json:"position,omitempty"`
+	EstimatedDispatch time.Time `json:"estimated_dispatch,omitzero"`
+}
+
+// a request in the index
+type trackedRequest struct {
+	req    *UserRequest
+	seq    uint64
+	state  string
+	doneAt time.Time
+}
+
+// the requests by ID, see above
+type requestIndex struct {
+	mu       sync.Mutex
+	lastSeq  uint64
+	requests map[string]*trackedRequest
+}
+
+func newRequestIndex() *requestIndex {
+	return &requestIndex{requests: make(map[string]*trackedRequest)}
+}
+
+// gives the request the next sequence number, it is about to be queued
+func (x *requestIndex) add(req *UserRequest) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.lastSeq++
+	x.requests[req.RequestID] = &trackedRequest{req: req, seq: x.lastSeq, state: stateQueued}
+}
+
+// drops a request that didn't make it in the queue after all
+func (x *requestIndex) remove(req *UserRequest) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if tracked, exists := x.requests[req.RequestID]; exists && tracked.req == req {
+		delete(x.requests, req.RequestID)
+	}
+}
+
+// moves the request, or each of the requests of a bulk call, to the state
+func (x *requestIndex) set(req *UserRequest, state string, now time.Time) {
+	requests := []*UserRequest{req}
+	if req.batch != nil {
+		requests = req.batch
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, r := range requests {
+		// another request may have taken the ID over since
+		if tracked, exists := x.requests[r.RequestID]; exists && tracked.req == r {
+			tracked.state = state
+			if state == stateDone {
+				tracked.doneAt = now
+			}
+		}
+	}
+}
+
+// forgets the requests done for longer than doneRetention
+func (x *requestIndex) prune(now time.Time) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for id, tracked := range x.requests {
+		if tracked.state == stateDone && now.Sub(tracked.doneAt) > doneRetention {
+			delete(x.requests, id)
+		}
+	}
+}
+
+// the request with the ID and what is known of it, false if there is none
+func (x *requestIndex) lookup(id string) (trackedRequest, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	tracked, exists := x.requests[id]
+	if !exists {
+		return trackedRequest{}, false
+	}
+	return *tracked, true
+}
+
+// where the request with the ID is, false if it is unknown (or done for longer than doneRetention)
+func (rl *RateLimiter) Position(id string) (RequestPosition, bool) {
+	tracked, exists := rl.requests.lookup(id)
+	if !exists {
+		return RequestPosition{}, false
+	}
+	position := RequestPosition{ID: id, Seq: tracked.seq, State: tracked.state}
+	if tracked.state != stateQueued {
+		return position, true
+	}
+
+	place, unitsAhead, userAhead, queued := rl.queue.positionOf(tracked.req)
+	if !queued {
+		// taken from the queue since it was looked up
+		position.State = stateInFlight
+		return position, true
+	}
+	position.Position = place
+	position.EstimatedDispatch = rl.clock.Now().Add(rl.estimateWait(tracked.req, unitsAhead, userAhead))
+	return position, true
+}
+
+// the request's place in its lane (1 goes next), the units queued for its target that go out before it and how many
+// of its user's requests are ahead of it, see above. False if it isn't queued.
+func (q *fairQueue) positionOf(req *UserRequest) (place, unitsAhead, userAhead int, queued bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[req.lane()]
+	userAhead = -1
+	for i, r := range l.requests[req.UserID] {
+		if r == req {
+			userAhead = i
+			break
+		}
+	}
+	if userAhead < 0 {
+		return 0, 0, 0, false
+	}
+
+	// the users ahead of the request's user in line get one more turn before it
+	turns := userAhead + 1
+	for _, userID := range l.users {
+		if userID == req.UserID {
+			turns = userAhead
+		}
+		requests := l.requests[userID]
+		ahead := requests[:min(len(requests), turns)]
+		place += len(ahead)
+		unitsAhead += unitsFor(req.targetName(), ahead)
+	}
+	return place + 1, unitsAhead + q.otherLaneUnits(req, unitsAhead), userAhead, true
+}
+
+// serves GET /api/request/{id}/position
+func positionHandler(rl *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		position, exists := rl.Position(r.PathValue("id"))
+		if !exists {
+			http.Error(w, "Unknown request", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(position)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPositionFollowsTheQueue(t *testing.T) {
+	// user0's request takes the only call of the minute, the others stay queued
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1})
+	defer shutdownNow(rl)
+	first := submitRequests(t, rl, 1)[0]
+	awaitResponse(t, clock, first)
+
+	alice := []*UserRequest{submitAlice(t, rl, testRequest("alice", "ping")),
+		submitAlice(t, rl, testRequest("alice", "ping"))}
+	bob := submitAlice(t, rl, testRequest("bob", "ping"))
+
+	if position, exists := rl.Position(first.RequestID); !exists || position.State != stateDone {
+		t.Fatalf("answered request at %+v (known: %v), expected done", position, exists)
+	}
+	// round-robin serves bob's only request before alice's second, one a minute. The sequence numbers keep the order
+	// the requests were accepted in.
+	for i, tc := range []struct {
+		req *UserRequest
+		seq uint64
+	}{
+		{alice[0], 2},
+		{bob, 4},
+		{alice[1], 3},
+	} {
+		position, exists := rl.Position(tc.req.RequestID)
+		dispatch := testStart.Add(time.Duration(i+1) * time.Minute)
+		if !exists || position.State != stateQueued || position.Position != i+1 || position.Seq != tc.seq ||
+			!position.EstimatedDispatch.Equal(dispatch) {
+			t.Fatalf("request of %s at %+v (known: %v), expected queued at %d with the sequence number %d, going out "+
+				"at %v", tc.req.UserID, position, exists, i+1, tc.seq, dispatch)
+		}
+	}
+
+	if _, exists := rl.Position("unknown"); exists {
+		t.Fatal("unknown request has a position")
+	}
+}
+
+func TestPositionHandler(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1})
+	defer shutdownNow(rl)
+	submitRequests(t, rl, 1)
+	settle(clock)
+	req := submitAlice(t, rl, testRequest("alice", "ping"))
+	server := httptest.NewServer(newMux(rl, newAsyncTracker(&WebhookSender{}, clock), "", ""))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		id     string
+		status int
+	}{
+		{req.RequestID, http.StatusOK},
+		{"unknown", http.StatusNotFound},
+	} {
+		resp, err := server.Client().Get(server.URL + "/api/request/" + tc.id + "/position")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var position RequestPosition
+		decodeErr := json.NewDecoder(resp.Body).Decode(&position)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("position of %q answered %d, expected %d", tc.id, resp.StatusCode, tc.status)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if decodeErr != nil || position.ID != req.RequestID || position.State != stateQueued ||
+			position.Position != 1 || !position.EstimatedDispatch.After(clock.Now()) {
+			t.Fatalf("position of alice's request answered %+v (%v), expected queued first with a dispatch to come",
+				position, decodeErr)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+/**
+With a single FIFO, a user submitting 9,000 requests at 1000 requests per minute starves everyone else for nine minutes.
+
+So the queue keeps a FIFO per user (in each priority lane) and serves the users round-robin: one request of the
+next user in line, then the user goes to the back of the line if they have more. Within a user the order is kept,
+across users a light user waits for at most one request of every other user instead of for the flooder's backlog.
+
+Users out of per-user tokens are skipped rather than served, their requests stay in place until they have tokens again.
+
+Round-robin alone still lets the flooder's backlog fill the whole queue, MaxPendingPerUser caps how many requests a
+single user may have pending (see backlog.go).
+*/
+
+// how many requests may wait in each lane of the queue. We know each reqeust can't stay more than 5 secs in the queue
+// (which is the worst case i.e our internal timeout as set in the http handler) so we can be sure no request will be
+// left in the queue indefinitely.
+const laneCapacity = 10000
+
+// the requests of one priority, per user
+type lane struct {
+	requests map[string][]*UserRequest
+	// users with requests in the lane, in the order they are served
+	users []string
+	size  int
+}
+
+// the requests waiting to be sent, see above
+type fairQueue struct {
+	mu    sync.Mutex
+	lanes [numPriorities]lane
+	// requests waiting per user, all lanes together
+	pending map[string]int
+	// requests waiting per target, all lanes together
+	perTarget map[string]int
+	// at least 1 in lowEvery requests taken is a low priority one while any are waiting
+	lowEvery int
+	// high priority requests taken in a row while the low lane was waiting
+	highStreak int
+
+	// signalled whenever a request is added (or may be taken now), wakes up processQueue
+	added chan struct{}
+	// closed (and replaced) whenever a request leaves the queue, wakes up submitters waiting for room
+	room chan struct{}
+}
+
+func newFairQueue(lowEvery int) *fairQueue {
+	q := &fairQueue{
+		pending:   make(map[string]int),
+		perTarget: make(map[string]int),
+		lowEvery:  lowEvery,
+		added:     make(chan struct{}, 1),
+		room:      make(chan struct{}),
+	}
+	for i := range q.lanes {
+		q.lanes[i].requests = make(map[string][]*UserRequest)
+	}
+	return q
+}
+
+// adds the request at the back of its user's FIFO.
+// It fails with ErrQueueFull along with a channel closed once there may be room if the lane is full.
+func (q *fairQueue) push(req *UserRequest) (<-chan struct{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[req.lane()]
+	if l.size >= laneCapacity {
+		return q.room, ErrQueueFull
+	}
+	q.add(l, req)
+	return nil, nil
+}
+
+// adds the request at the back of its user's FIFO in the lane, whether or not it is full (must be called with mu held)
+func (q *fairQueue) add(l *lane, req *UserRequest) {
+	if len(l.requests[req.UserID]) == 0 {
+		l.users = append(l.users, req.UserID)
+	}
+	l.requests[req.UserID] = append(l.requests[req.UserID], req)
+	l.size++
+	q.pending[req.UserID]++
+	q.perTarget[req.targetName()]++
+
+	q.wake()
+}
+
+// wakes up processQueue, e.g because a request was added
+func (q *fairQueue) wake() {
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+}
+
+// removes and returns the next request to send, nil if no user in the queue is allowed to send right now.
+// Requests for which stale returns true are removed on the way and returned too, for the caller to answer once the
+// queue is unlocked: answering runs the OnComplete hook, which may well ask the queue for its depth.
+// High priority goes first, unless the low lane has waited for lowEvery-1 requests in a row.
+func (q *fairQueue) take(stale func(*UserRequest) bool, allow func(*UserRequest) bool) (req *UserRequest, dropped []*UserRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	order := []Priority{PriorityHigh, PriorityLow}
+	if q.highStreak >= q.lowEvery-1 {
+		order = []Priority{PriorityLow, PriorityHigh}
+	}
+	for _, priority := range order {
+		req := q.takeFromLane(priority, stale, allow, &dropped)
+		if req == nil {
+			continue
+		}
+		if priority == PriorityLow || q.lanes[PriorityLow].size == 0 {
+			q.highStreak = 0
+		} else {
+			q.highStreak++
+		}
+		return req, dropped
+	}
+	return nil, dropped
+}
+
+// serves the users of the lane round-robin, skipping those not allowed to send and adding the stale requests on the
+// way to dropped
+func (q *fairQueue) takeFromLane(priority Priority, stale func(*UserRequest) bool, allow func(*UserRequest) bool,
+	dropped *[]*UserRequest) *UserRequest {
+	l := &q.lanes[priority]
+	for range len(l.users) {
+		userID := l.users[0]
+		l.users = l.users[1:]
+
+		requests := l.requests[userID]
+		for len(requests) > 0 && stale(requests[0]) {
+			*dropped = append(*dropped, requests[0])
+			requests = q.remove(l, userID, requests)
+		}
+
+		var req *UserRequest
+		if len(requests) > 0 && allow(requests[0]) {
+			req = requests[0]
+			requests = q.remove(l, userID, requests)
+		}
+
+		if len(requests) == 0 {
+			delete(l.requests, userID)
+		} else {
+			l.requests[userID] = requests
+			l.users = append(l.users, userID)
+		}
+		if req != nil {
+			return req
+		}
+	}
+	return nil
+}
+
+// puts a request take returned back in front of its user's requests, e.g because the quota shared with the other
+// nodes had no room for its call. Its user goes to the back of the line, as after any turn.
+func (q *fairQueue) putBack(req *UserRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := &q.lanes[req.lane()]
+	if len(l.requests[req.UserID]) == 0 {
+		l.users = append(l.users, req.UserID)
+	}
+	l.requests[req.UserID] = slices.Insert(l.requests[req.UserID], 0, req)
+	l.size++
+	q.pending[req.UserID]++
+	q.perTarget[req.targetName()]++
+}
+
+// removes the first of the user's requests, returning the ones left
+func (q *fairQueue) remove(l *lane, userID string, requests []*UserRequest) []*UserRequest {
+	q.perTarget[requests[0].targetName()]--
+	if q.perTarget[requests[0].targetName()] == 0 {
+		delete(q.perTarget, requests[0].targetName())
+	}
+	requests[0] = nil
+	l.size--
+	q.pending[userID]--
+	if q.pending[userID] == 0 {
+		delete(q.pending, userID)
+	}
+	close(q.room)
+	q.room = make(chan struct{})
+	return requests[1:]
+}
+
+// removes and returns every request in the queue
+func (q *fairQueue) drain() []*UserRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var all []*UserRequest
+	for i := range q.lanes {
+		l := &q.lanes[i]
+		for _, userID := range l.users {
+			all = append(all, l.requests[userID]...)
+		}
+		q.lanes[i] = lane{requests: make(map[string][]*UserRequest)}
+	}
+	clear(q.pending)
+	clear(q.perTarget)
+	close(q.room)
+	q.room = make(chan struct{})
+	return all
+}
+
+// the number of requests waiting, all lanes together
+func (q *fairQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := 0
+	for _, l := range q.lanes {
+		size += l.size
+	}
+	return size
+}
+
+// the number of requests waiting in the lane of the given priority
+func (q *fairQueue) laneLen(priority Priority) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.lanes[priority.clamp()].size
+}
+
+// the number of requests the user has waiting
+func (q *fairQueue) pendingFor(userID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pending[userID]
+}
+
+// the number of requests waiting for the named target
+func (q *fairQueue) waitingFor(target string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.perTarget[target]
+}
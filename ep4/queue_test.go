@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// queues n requests of the user in the lane of the priority
+func pushRequests(t *testing.T, q *fairQueue, userID string, priority Priority, n int) {
+	t.Helper()
+	for i := range n {
+		req := &UserRequest{UserID: userID, Data: fmt.Sprint(i), Priority: priority}
+		if _, err := q.push(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// takes n requests from the queue, every user allowed to send, nil once it is empty
+func takeRequests(q *fairQueue, n int) []*UserRequest {
+	taken := make([]*UserRequest, n)
+	for i := range taken {
+		taken[i], _ = q.take(func(*UserRequest) bool { return false }, func(*UserRequest) bool { return true })
+	}
+	return taken
+}
+
+// the lanes the requests were taken from, H for high and L for low priority
+func lanesOf(taken []*UserRequest) string {
+	var lanes strings.Builder
+	for _, req := range taken {
+		switch {
+		case req == nil:
+			lanes.WriteString("-")
+		case req.lane() == PriorityHigh:
+			lanes.WriteString("H")
+		default:
+			lanes.WriteString("L")
+		}
+	}
+	return lanes.String()
+}
+
+func TestFairQueueServesHighPriorityFirst(t *testing.T) {
+	// a sync job filled the low lane before the user's request came in
+	q := newFairQueue(defaultLowPriorityEvery)
+	pushRequests(t, q, "sync", PriorityLow, 100)
+	pushRequests(t, q, "alice", PriorityHigh, 1)
+
+	if req := takeRequests(q, 1)[0]; req == nil || req.UserID != "alice" {
+		t.Fatalf("took %+v first, expected alice's high priority request", req)
+	}
+}
+
+func TestFairQueueKeepsTheLowLaneGoing(t *testing.T) {
+	for _, tc := range []struct {
+		lowEvery int
+		expected string
+	}{
+		// the low lane goes first every time
+		{1, "LLLLLLHHHHHH-"},
+		{2, "HLHLHLHLHLHL-"},
+		{3, "HHLHHLHHLLLL-"},
+		// the high lane runs out before the low one gets its turn
+		{10, "HHHHHHLLLLLL-"},
+	} {
+		q := newFairQueue(tc.lowEvery)
+		pushRequests(t, q, "sync", PriorityLow, 6)
+		pushRequests(t, q, "alice", PriorityHigh, 6)
+
+		if lanes := lanesOf(takeRequests(q, 13)); lanes != tc.expected {
+			t.Fatalf("1 low in %d: taken from the lanes %s, expected %s", tc.lowEvery, lanes, tc.expected)
+		}
+	}
+}
+
+func TestFairQueueStreakOnlyCountsWhileTheLowLaneWaits(t *testing.T) {
+	q := newFairQueue(3)
+	pushRequests(t, q, "alice", PriorityHigh, 8)
+	// nothing waited in the low lane meanwhile, these don't count against it
+	if lanes := lanesOf(takeRequests(q, 4)); lanes != "HHHH" {
+		t.Fatalf("taken from the lanes %s, expected HHHH", lanes)
+	}
+
+	pushRequests(t, q, "sync", PriorityLow, 2)
+	if lanes := lanesOf(takeRequests(q, 7)); lanes != "HHLHHL-" {
+		t.Fatalf("taken from the lanes %s once the low lane had requests, expected HHLHHL-", lanes)
+	}
+}
+
+// the users and data of the requests, e.g alice/0
+func requestsOf(taken []*UserRequest) string {
+	var served []string
+	for _, req := range taken {
+		if req == nil {
+			served = append(served, "-")
+		} else {
+			served = append(served, req.UserID+"/"+req.Data)
+		}
+	}
+	return strings.Join(served, " ")
+}
+
+func TestFairQueueServesUsersRoundRobin(t *testing.T) {
+	q := newFairQueue(defaultLowPriorityEvery)
+	pushRequests(t, q, "alice", PriorityHigh, 100)
+	pushRequests(t, q, "bob", PriorityHigh, 2)
+	pushRequests(t, q, "carol", PriorityHigh, 1)
+
+	// the light users wait for one request of alice's rather than her 100, hers keep their order
+	expected := "alice/0 bob/0 carol/0 alice/1 bob/1 alice/2 alice/3"
+	if served := requestsOf(takeRequests(q, 7)); served != expected {
+		t.Fatalf("served %s, expected %s", served, expected)
+	}
+	if pending := q.pendingFor("alice"); pending != 96 {
+		t.Fatalf("alice has %d requests pending, expected 96", pending)
+	}
+}
+
+func TestFairQueueSkipsUsersNotAllowed(t *testing.T) {
+	q := newFairQueue(defaultLowPriorityEvery)
+	pushRequests(t, q, "alice", PriorityHigh, 3)
+	pushRequests(t, q, "bob", PriorityHigh, 2)
+	pushRequests(t, q, "carol", PriorityHigh, 1)
+
+	// bob is out of tokens, his requests stay where they are
+	noBob := func(req *UserRequest) bool { return req.UserID != "bob" }
+	var taken []*UserRequest
+	for range 3 {
+		req, _ := q.take(func(*UserRequest) bool { return false }, noBob)
+		taken = append(taken, req)
+	}
+	taken = append(taken, takeRequests(q, 4)...)
+	expected := "alice/0 carol/0 alice/1 bob/0 alice/2 bob/1 -"
+	if served := requestsOf(taken); served != expected {
+		t.Fatalf("served %s, expected %s", served, expected)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Every node running the rate limiter paces itself to RequestsPerMinute: three nodes configured with the provider's
+1000 a minute send up to 3000 together. Config.Quota shares the provider's quota between them.
+
+Every call reserves its units (its first call and every retry alike, each is a call the provider counts) from the
+QuotaCoordinator once it is taken from the queue, after the node's own bucket and window let it through. A refusal
+refunds the bucket and the window and puts the request back in front of its user's requests, the target isn't
+asked for again before it earns its next token. A call whose reservation goes unused (it expired or was cancelled
+meanwhile) still counts, like its tokens.
+
+- LocalQuota, the default, shares nothing: every node has the whole quota, as before.
+- RedisQuota counts the units of every node in Redis, one counter per target and minute of the call, reserved
+  atomically by a Lua script (INCRBY, undone if over the limit, the key expiring once its minute is long over). The
+  counter is a fixed window: around the turn of the minute the nodes together may send up to twice the limit within
+  a minute, the pacing of each node (its bucket and sliding window) keeps that to its own share of the burst.
+
+When Redis can't be reached, each node falls back to LocalFraction of the quota (e.g 1/3 with three nodes), counted
+locally per minute, and tries Redis again a second later. The reservation is made by processQueue with no lock of
+the rate limiter held: a slow Redis holds up the dispatch of the next requests, not submissions nor the queue's
+stats. Timeout (default 100ms) bounds each command.
+
+The client only speaks what the script needs of the Redis protocol (RESP): commands go out as arrays of bulk strings,
+replies are read back whatever their type. A single connection is kept, commands are sent one at a time.
+*/
+
+// shares a target's quota between the nodes sending to it, see above
+type QuotaCoordinator interface {
+	// reserves units of the target's quota of limit per minute, for the minute of at. False if that minute's quota
+	// is used up.
+	Reserve(target string, units, limit int, at time.Time) bool
+}
+
+// a QuotaCoordinator sharing nothing, the node has the whole quota
+type LocalQuota struct{}
+
+func (LocalQuota) Reserve(target string, units, limit int, at time.Time) bool {
+	return true
+}
+
+// defaults for RedisQuota
+const (
+	defaultRedisTimeout   = 100 * time.Millisecond
+	defaultRedisKeyPrefix = "ratelimit:quota:"
+	// how long Redis isn't tried again after it failed
+	redisRetryInterval = time.Second
+)
+
+// reserves the units unless the counter would go over the limit, the counter expires after a couple of minutes
+const reserveScript = `
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+if count == tonumber(ARGV[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+if count > tonumber(ARGV[2]) then
+	redis.call('DECRBY', KEYS[1], ARGV[1])
+	return 0
+end
+return 1`
+
+// a QuotaCoordinator counting the units of every node in Redis, see above
+type RedisQuota struct {
+	// host:port of the Redis server
+	Addr string
+	// the share of the quota a node uses on its own while Redis is unreachable, 0 means none (nothing is sent)
+	LocalFraction float64
+	// how long a command (or connecting) may take (default 100ms)
+	Timeout time.Duration
+	// prepended to the counter keys (default "ratelimit:quota:")
+	KeyPrefix string
+	// what the retry interval is measured on, nil means the Clock of the rate limiter it is given to (the real clock
+	// outside of one)
+	Clock Clock
+
+	mu   sync.Mutex
+	conn *redisConn
+	// Redis isn't tried before then after it failed
+	retryAt time.Time
+	// the units reserved locally while Redis is unreachable, per target and minute
+	fallback map[string]int
+}
+
+func (q *RedisQuota) Reserve(target string, units, limit int, at time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	minute := at.Truncate(time.Minute)
+	key := q.keyPrefix() + target + ":" + strconv.FormatInt(minute.Unix(), 10)
+	if q.now().After(q.retryAt) {
+		reserved, err := q.reserve(key, units, limit)
+		if err == nil {
+			return reserved
+		}
+		log.Printf("Quota in Redis unavailable, using %.0f%% of it locally for %s: %v", q.LocalFraction*100,
+			redisRetryInterval, err)
+		q.retryAt = q.now().Add(redisRetryInterval)
+	}
+	return q.reserveLocally(key, units, limit, minute)
+}
+
+// sets the clock unless one is set already
+func (q *RedisQuota) useClock(clock Clock) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.Clock == nil {
+		q.Clock = clock
+	}
+}
+
+// the time on the quota's clock (must be called with mu held)
+func (q *RedisQuota) now() time.Time {
+	if q.Clock == nil {
+		return time.Now()
+	}
+	return q.Clock.Now()
+}
+
+func (q *RedisQuota) keyPrefix() string {
+	if q.KeyPrefix == "" {
+		return defaultRedisKeyPrefix
+	}
+	return q.KeyPrefix
+}
+
+// runs the script in Redis (must be called with mu held)
+func (q *RedisQuota) reserve(key string, units, limit int) (bool, error) {
+	timeout := q.Timeout
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+	if q.conn == nil {
+		conn, err := dialRedis(q.Addr, timeout)
+		if err != nil {
+			return false, err
+		}
+		q.conn = conn
+	}
+	reply, err := q.conn.do(timeout, "EVAL", reserveScript, "1", key, strconv.Itoa(units), strconv.Itoa(limit),
+		strconv.FormatInt((2*time.Minute).Milliseconds(), 10))
+	if err != nil {
+		// the connection may be left halfway through a reply
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			q.conn.close()
+			q.conn = nil
+		}
+		return false, err
+	}
+	reserved, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply to the quota script: %v", reply)
+	}
+	return reserved == 1, nil
+}
+
+// reserves the units from LocalFraction of the limit (must be called with mu held)
+func (q *RedisQuota) reserveLocally(key string, units, limit int, minute time.Time) bool {
+	if q.fallback == nil {
+		q.fallback = make(map[string]int)
+	}
+	// the counters of minutes over are no use anymore
+	for k := range q.fallback {
+		if !strings.HasSuffix(k, ":"+strconv.FormatInt(minute.Unix(), 10)) {
+			delete(q.fallback, k)
+		}
+	}
+	if float64(q.fallback[key]+units) > q.LocalFraction*float64(limit) {
+		return false
+	}
+	q.fallback[key] += units
+	return true
+}
+
+// an error reply of Redis, the connection is fine
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// a connection to Redis, see above
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialRedis(addr string, timeout time.Duration) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// sends a command and reads its reply: a string, an int64, nil, a []any or a redisError
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			// $-1 is a nil reply
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(rest)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				var redisErr redisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+				items[i] = redisErr
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+func (c *redisConn) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// a QuotaCoordinator for a node whose peers already used all but available units of every minute
+type peersQuota struct {
+	mu        sync.Mutex
+	available int
+	used      map[time.Time]int
+	refused   int
+}
+
+func (q *peersQuota) Reserve(target string, units, limit int, at time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	minute := at.Truncate(time.Minute)
+	if q.used[minute]+units > q.available {
+		q.refused++
+		return false
+	}
+	q.used[minute] += units
+	return true
+}
+
+func TestQuotaSharedWithPeers(t *testing.T) {
+	// the node's own pacing would send them all at once, the other nodes left 3 units a minute
+	quota := &peersQuota{available: 3, used: make(map[time.Time]int)}
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 10, Quota: quota,
+		Backoff: fixedBackoff(time.Second)})
+	defer shutdownNow(rl)
+	client.Script("user0", FailWith(503))
+
+	for _, req := range submitRequests(t, rl, 5) {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	calls := client.Calls()
+	perMinute := make(map[time.Time]int)
+	for _, call := range calls {
+		perMinute[call.At.Truncate(time.Minute)]++
+	}
+	// the retry reserves a call of its own, refused reservations don't count
+	reserved := 0
+	for minute, count := range quota.used {
+		if count > 3 || perMinute[minute] != count {
+			t.Fatalf("%d units reserved and %d calls made in the minute of %s, expected the same, up to 3",
+				count, perMinute[minute], minute.Format(time.TimeOnly))
+		}
+		reserved += count
+	}
+	if len(calls) != 6 || reserved != 6 {
+		t.Fatalf("%d calls and %d units reserved, expected one for each of the 5 requests and the retry",
+			len(calls), reserved)
+	}
+	if quota.refused == 0 {
+		t.Fatal("no reservation refused, expected requests to wait for the next minute")
+	}
+}
+
+// the counter key of the target for the minute of at
+func quotaKey(target string, at time.Time) string {
+	return defaultRedisKeyPrefix + target + ":" + strconv.FormatInt(at.Truncate(time.Minute).Unix(), 10)
+}
+
+func TestRedisQuotaSharedBetweenNodes(t *testing.T) {
+	redis := miniredis.RunT(t)
+	nodes := []*RedisQuota{{Addr: redis.Addr(), LocalFraction: 0.5}, {Addr: redis.Addr(), LocalFraction: 0.5}}
+
+	// 5 units a minute between them, whichever node asks
+	for i, expected := range []bool{true, true, true, true, true, false, false} {
+		if reserved := nodes[i%2].Reserve("search", 1, 5, testStart); reserved != expected {
+			t.Fatalf("reservation %d: %t, expected %t", i+1, reserved, expected)
+		}
+	}
+	// the refused reservations were taken back, the counter expires once its minute is long over
+	key := quotaKey("search", testStart)
+	if count, err := redis.Get(key); err != nil || count != "5" {
+		t.Fatalf("counter %s at %q (%v), expected 5", key, count, err)
+	}
+	if ttl := redis.TTL(key); ttl != 2*time.Minute {
+		t.Fatalf("counter %s expires in %s, expected 2m", key, ttl)
+	}
+
+	if !nodes[0].Reserve("search", 5, 5, testStart.Add(time.Minute)) {
+		t.Fatal("reservation refused in the next minute")
+	}
+	// a reservation bigger than what is left is refused as a whole
+	if nodes[1].Reserve("search", 2, 6, testStart.Add(time.Minute)) {
+		t.Fatal("reservation of 2 units went through with 1 left")
+	}
+	// the targets have quotas of their own
+	if !nodes[1].Reserve(DefaultTarget, 1, 5, testStart) {
+		t.Fatal("reservation for another target refused")
+	}
+}
+
+func TestRedisQuotaSharedBetweenLimiters(t *testing.T) {
+	redis := miniredis.RunT(t)
+	// the provider allows 5 calls a minute: each node on its own would make its 5 right away, together they share them
+	type node struct {
+		rl      *RateLimiter
+		clock   *FakeClock
+		client  *ScriptedClient
+		pending []*UserRequest
+	}
+	var nodes []*node
+	for range 2 {
+		rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 5, Burst: 5,
+			Quota: &RedisQuota{Addr: redis.Addr()}})
+		defer shutdownNow(rl)
+		nodes = append(nodes, &node{rl: rl, clock: clock, client: client, pending: submitRequests(t, rl, 5)})
+	}
+
+	// the round trips to Redis don't wait on the clocks, so they stay put until the first minute's calls are made
+	deadline := time.After(5 * time.Second)
+	for answered := 0; answered < 5; {
+		for _, n := range nodes {
+			for i, req := range n.pending {
+				select {
+				case resp := <-req.Response:
+					if resp.Err != nil {
+						t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+					}
+					n.pending = slices.Delete(n.pending, i, i+1)
+					answered++
+				default:
+					continue
+				}
+				break
+			}
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("%d requests answered in the first minute, expected 5", answered)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if calls := len(nodes[0].client.Calls()) + len(nodes[1].client.Calls()); calls != 5 {
+		t.Fatalf("%d calls in the first minute, expected 5", calls)
+	}
+	if reserved, _ := redis.Get(quotaKey(DefaultTarget, testStart)); reserved != "5" {
+		t.Fatalf("%s units reserved in the first minute, expected 5", reserved)
+	}
+
+	// the others go out in the minutes after
+	for _, n := range nodes {
+		for _, req := range n.pending {
+			if resp := awaitResponse(t, n.clock, req); resp.Err != nil {
+				t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+			}
+		}
+	}
+	total := 0
+	for _, key := range redis.Keys() {
+		reserved, _ := redis.Get(key)
+		units, _ := strconv.Atoi(reserved)
+		if units > 5 {
+			t.Fatalf("%d units reserved under %s, expected 5 at most", units, key)
+		}
+		total += units
+	}
+	if calls := len(nodes[0].client.Calls()) + len(nodes[1].client.Calls()); calls != 10 || total != 10 {
+		t.Fatalf("%d calls and %d units reserved, expected one for each of the 10 requests", calls, total)
+	}
+}
+
+func TestRedisQuotaFallsBackOnErrors(t *testing.T) {
+	logged := captureLog(t)
+	redis := miniredis.RunT(t)
+	clock := NewFakeClock(testStart)
+	quota := &RedisQuota{Addr: redis.Addr(), LocalFraction: 0.5, Clock: clock}
+
+	// an error reply leaves the connection usable, the node goes on with its share meanwhile
+	redis.SetError("LOADING Redis is loading the dataset in memory")
+	for i, expected := range []bool{true, true, false} {
+		if reserved := quota.Reserve("search", 1, 4, testStart); reserved != expected {
+			t.Fatalf("local reservation %d: %t, expected %t", i+1, reserved, expected)
+		}
+	}
+	if !strings.Contains(logged.String(), "LOADING") {
+		t.Fatalf("logged %q, expected Redis' error", logged.String())
+	}
+
+	redis.SetError("")
+	clock.Advance(redisRetryInterval + time.Millisecond)
+	if !quota.Reserve("search", 4, 4, testStart) {
+		t.Fatal("reservation refused once Redis was back")
+	}
+	if count, _ := redis.Get(quotaKey("search", testStart)); count != "4" {
+		t.Fatalf("counter at %q once Redis was back, expected 4", count)
+	}
+}
+
+func TestRedisQuotaFallsBackWhenUnreachable(t *testing.T) {
+	logged := captureLog(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens there anymore
+	listener.Close()
+	clock := NewFakeClock(testStart)
+	quota := &RedisQuota{Addr: listener.Addr().String(), LocalFraction: 1.0 / 3, Clock: clock}
+
+	// a third of 30 a minute
+	for i := range 10 {
+		if !quota.Reserve("search", 1, 30, testStart.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("reservation %d refused, expected 10 locally", i+1)
+		}
+	}
+	if quota.Reserve("search", 1, 30, testStart.Add(59*time.Second)) {
+		t.Fatal("reservation past a third of the quota went through")
+	}
+	if !quota.Reserve("search", 10, 30, testStart.Add(time.Minute)) {
+		t.Fatal("reservation refused in the next minute")
+	}
+	if strings.Count(logged.String(), "Quota in Redis unavailable") != 1 {
+		t.Fatalf("logged %q, expected Redis to be tried once within its retry interval", logged.String())
+	}
+	// tried again once the interval is over on the quota's clock
+	clock.Advance(redisRetryInterval + time.Millisecond)
+	quota.Reserve("search", 1, 30, testStart.Add(time.Minute))
+	if strings.Count(logged.String(), "Quota in Redis unavailable") != 2 {
+		t.Fatalf("logged %q, expected Redis to be tried again after its retry interval", logged.String())
+	}
+}
+
+func TestRedisQuotaTakesTheLimitersClock(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	quota := &RedisQuota{Addr: "127.0.0.1:0"}
+	rl := NewRateLimiter(Config{Clock: clock, Quota: quota, Logger: quietLogger()})
+	defer shutdownNow(rl)
+	if quota.Clock != clock {
+		t.Fatal("the rate limiter didn't hand its clock to the quota")
+	}
+
+	// one set already is kept
+	own := NewFakeClock(testStart)
+	quota = &RedisQuota{Addr: "127.0.0.1:0", Clock: own}
+	other := NewRateLimiter(Config{Clock: clock, Quota: quota, Logger: quietLogger()})
+	defer shutdownNow(other)
+	if quota.Clock != own {
+		t.Fatal("the rate limiter replaced the quota's own clock")
+	}
+}
+
+// a QuotaCoordinator whose every reservation waits until the test lets it through
+type slowQuota struct {
+	asked   chan struct{}
+	release chan struct{}
+}
+
+func (q *slowQuota) Reserve(target string, units, limit int, at time.Time) bool {
+	q.asked <- struct{}{}
+	<-q.release
+	return true
+}
+
+func TestSlowQuotaLeavesTheQueueAlone(t *testing.T) {
+	quota := &slowQuota{asked: make(chan struct{}), release: make(chan struct{})}
+	rl, clock, _ := scriptedLimiter(Config{Quota: quota})
+	defer shutdownNow(rl)
+
+	pending := submitRequests(t, rl, 1)
+	<-quota.asked
+	// while the reservation hangs, submissions and queries of the queue go on
+	bob := testRequest("bob", "ping")
+	done := make(chan error)
+	go func() {
+		err := rl.SubmitRequest(context.Background(), bob)
+		rl.QueueDepth()
+		rl.PendingFor("bob")
+		rl.Stats()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue was held up by a reservation of the quota")
+	}
+	pending = append(pending, bob)
+
+	close(quota.release)
+	go func() {
+		for range quota.asked {
+		}
+	}()
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+}
+
+func TestRefusedRequestKeepsItsPlace(t *testing.T) {
+	// a single unit a minute left by the other nodes
+	quota := &peersQuota{available: 1, used: make(map[time.Time]int)}
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 10, Quota: quota})
+	defer shutdownNow(rl)
+
+	var pending []*UserRequest
+	for i := range 3 {
+		req := testRequest("alice", fmt.Sprintf("call %d", i))
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("%s failed: %v", req.Data, resp.Err)
+		}
+	}
+
+	calls := client.Calls()
+	for i, call := range calls {
+		if call.Data != fmt.Sprintf("call %d", i) || !call.At.Equal(testStart.Add(time.Duration(i)*time.Minute)) {
+			t.Fatalf("calls %+v, expected alice's in order, a minute apart", calls)
+		}
+	}
+	if len(calls) != 3 {
+		t.Fatalf("%d calls, expected 3", len(calls))
+	}
+}
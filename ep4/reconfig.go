@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+A third party raising (or cutting) our limit shouldn't take a restart, which drops the queue unless the journal is on
+and resets every bucket, window and breaker. UpdateConfig changes the settings that follow the provider's limits
+while requests keep going out:
+
+- RequestsPerMinute, Burst and Backoff of DefaultTarget, and of the named targets in Config.Targets (a target can't
+  be added or removed, that changes which requests are accepted at all)
+- Workers
+
+The other fields of the Config are ignored, CurrentConfig gives one to start from.
+
+A target's limits are swapped as a whole (targetLimits) under its bucketMu, along with the bucket itself: a call is
+reserved with either the old rate, burst and window limit or the new ones, never some of each. The bucket keeps its
+tokens (down to the new burst), so a cut applies to the next reservation and a raise doesn't hand out a burst for
+free. With Config.Adaptive the new rate is the new ceiling, the controller takes it from there.
+
+Calls already reserved (or backing off) keep the wait they got, the rolling window still counts the calls made at the
+old rate: after a cut it may hold back the next calls until the older ones leave it.
+
+Fewer Workers stop as they finish the request they are sending, more start right away.
+
+PUT /api/config takes a JSON configUpdate (only the fields given change) when the server has an admin token
+(ADMIN_TOKEN), sent as "Authorization: Bearer <token>".
+*/
+
+// returned by UpdateConfig for settings it can't apply
+var ErrInvalidConfig = errors.New("invalid config")
+
+// the settings of a target UpdateConfig changes, swapped as a whole
+type targetLimits struct {
+	requestsPerMinute int
+	burst             int
+	backoff           BackoffStrategy
+}
+
+// the limits in effect for the target
+func (t *target) currentLimits() *targetLimits {
+	return t.limits.Load()
+}
+
+// swaps the target's limits, see above
+func (t *target) setLimits(limits *targetLimits, now time.Time) {
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	t.bucket.setRate(float64(limits.requestsPerMinute), now)
+	t.bucket.setCapacity(limits.burst, now)
+	if t.aimd != nil {
+		t.aimd.setCeiling(float64(limits.requestsPerMinute), now)
+	}
+	t.limits.Store(limits)
+}
+
+// the senders running and how many there should be, see UpdateConfig
+type senderCount struct {
+	mu      sync.Mutex
+	running int
+	wanted  int
+	// closed (and replaced) when wanted goes down, wakes up idle senders to stop
+	changed chan struct{}
+}
+
+// whether the calling sender should stop, along with a channel closed once that may change
+func (c *senderCount) retire() (bool, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running > c.wanted {
+		c.running--
+		return true, nil
+	}
+	return false, c.changed
+}
+
+// how many senders there should be, Config.Workers as last set
+func (c *senderCount) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.wanted
+}
+
+// the Config the RateLimiter runs with, including what UpdateConfig changed
+func (rl *RateLimiter) CurrentConfig() Config {
+	cfg := rl.cfg
+	limits := rl.targets[DefaultTarget].currentLimits()
+	cfg.RequestsPerMinute = limits.requestsPerMinute
+	cfg.Burst = limits.burst
+	cfg.Backoff = limits.backoff
+	cfg.Workers = rl.senders.count()
+
+	cfg.Targets = make(map[string]TargetConfig, len(rl.cfg.Targets))
+	for name, tc := range rl.cfg.Targets {
+		limits := rl.targets[name].currentLimits()
+		tc.RequestsPerMinute = limits.requestsPerMinute
+		tc.Burst = limits.burst
+		tc.Backoff = limits.backoff
+		cfg.Targets[name] = tc
+	}
+	return cfg
+}
+
+// applies the rate, burst, backoff and worker settings of cfg while the RateLimiter runs, see above.
+// Nothing is changed if any of them is invalid.
+func (rl *RateLimiter) UpdateConfig(cfg Config) error {
+	if cfg.RequestsPerMinute <= 0 || cfg.Burst <= 0 {
+		return fmt.Errorf("%w: RequestsPerMinute and Burst must be positive", ErrInvalidConfig)
+	}
+	if cfg.Workers <= 0 {
+		return fmt.Errorf("%w: Workers must be positive", ErrInvalidConfig)
+	}
+	for name, tc := range cfg.Targets {
+		if _, exists := rl.cfg.Targets[name]; !exists {
+			return fmt.Errorf("%w: %w %q, targets can't be added at runtime", ErrInvalidConfig, ErrUnknownTarget, name)
+		}
+		if tc.RequestsPerMinute <= 0 || tc.Burst <= 0 {
+			return fmt.Errorf("%w: RequestsPerMinute and Burst of target %q must be positive", ErrInvalidConfig, name)
+		}
+	}
+
+	rl.submitMu.RLock()
+	defer rl.submitMu.RUnlock()
+	if rl.closing {
+		return ErrShuttingDown
+	}
+
+	now := rl.clock.Now()
+	apply := func(t *target, requestsPerMinute, burst int, backoff BackoffStrategy) {
+		if backoff == nil {
+			backoff = t.currentLimits().backoff
+		}
+		t.setLimits(&targetLimits{requestsPerMinute: requestsPerMinute, burst: burst, backoff: backoff}, now)
+	}
+	apply(rl.targets[DefaultTarget], cfg.RequestsPerMinute, cfg.Burst, cfg.Backoff)
+	for name, tc := range cfg.Targets {
+		apply(rl.targets[name], tc.RequestsPerMinute, tc.Burst, tc.Backoff)
+	}
+	rl.setWorkers(cfg.Workers)
+	// requests waiting for tokens are checked on at the new rate
+	rl.queue.wake()
+	return nil
+}
+
+// starts or stops senders until there are workers of them (must be called with submitMu held for reading, so they
+// can't start once Shutdown is waiting for them)
+func (rl *RateLimiter) setWorkers(workers int) {
+	c := &rl.senders
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if workers < c.wanted {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+	c.wanted = workers
+	for c.running < c.wanted {
+		c.running++
+		rl.wg.Add(1)
+		go rl.sender()
+	}
+}
+
+// the JSON body of PUT /api/config, fields left out keep their current value
+type configUpdate struct {
+	RequestsPerMinute *int           `json:"requests_per_minute"`
+	Burst             *int           `json:"burst"`
+	Workers           *int           `json:"workers"`
+	Backoff           *backoffUpdate `json:"backoff"`
+	// by name, only configured targets
+	Targets map[string]targetUpdate `json:"targets"`
+}
+
+type targetUpdate struct {
+	RequestsPerMinute *int           `json:"requests_per_minute"`
+	Burst             *int           `json:"burst"`
+	Backoff           *backoffUpdate `json:"backoff"`
+}
+
+// a Backoff, see backoff.go
+type backoffUpdate struct {
+	BaseMs     int     `json:"base_ms"`
+	Multiplier float64 `json:"multiplier"`
+	CapMs      int     `json:"cap_ms"`
+}
+
+func (b *backoffUpdate) backoff() BackoffStrategy {
+	return &Backoff{
+		Base:       time.Duration(b.BaseMs) * time.Millisecond,
+		Multiplier: b.Multiplier,
+		Cap:        time.Duration(b.CapMs) * time.Millisecond,
+	}
+}
+
+// applies the update to cfg
+func (u *configUpdate) apply(cfg *Config) error {
+	if u.RequestsPerMinute != nil {
+		cfg.RequestsPerMinute = *u.RequestsPerMinute
+	}
+	if u.Burst != nil {
+		cfg.Burst = *u.Burst
+	}
+	if u.Workers != nil {
+		cfg.Workers = *u.Workers
+	}
+	if u.Backoff != nil {
+		cfg.Backoff = u.Backoff.backoff()
+	}
+	for name, update := range u.Targets {
+		tc, exists := cfg.Targets[name]
+		if !exists {
+			return fmt.Errorf("%w %q", ErrUnknownTarget, name)
+		}
+		if update.RequestsPerMinute != nil {
+			tc.RequestsPerMinute = *update.RequestsPerMinute
+		}
+		if update.Burst != nil {
+			tc.Burst = *update.Burst
+		}
+		if update.Backoff != nil {
+			tc.Backoff = update.Backoff.backoff()
+		}
+		cfg.Targets[name] = tc
+	}
+	return nil
+}
+
+// changes the configuration, PUT /api/config with the admin token, see above. Without a token it is disabled.
+func configHandler(rl *RateLimiter, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var update configUpdate
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg := rl.CurrentConfig()
+		if err := update.apply(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rl.UpdateConfig(cfg); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrShuttingDown) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rl.Stats())
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateConfigChangesThePacing(t *testing.T) {
+	// a call a second, one at a time, with 9 of alice's requests queued
+	rl, clock := aliceBacklog(t, Config{})
+	defer shutdownNow(rl)
+	if estimate := rl.EstimateWait(testRequest("bob", "ping")); estimate != 2*time.Second {
+		t.Fatalf("bob estimated to wait %s at 60/min, expected 2s", estimate)
+	}
+
+	// the provider halves our limit, and the senders go from 1 to 3
+	cfg := rl.CurrentConfig()
+	cfg.RequestsPerMinute, cfg.Workers = 30, 3
+	if err := rl.UpdateConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if estimate := rl.EstimateWait(testRequest("bob", "ping")); estimate != 4*time.Second {
+		t.Fatalf("bob estimated to wait %s at 30/min, expected 4s", estimate)
+	}
+	if s := rl.Stats(); s.EffectiveRatePerMinute != 30 || s.Workers != 3 {
+		t.Fatalf("stats give %g/min with %d workers, expected 30/min with 3", s.EffectiveRatePerMinute, s.Workers)
+	}
+	if current := rl.CurrentConfig(); current.RequestsPerMinute != 30 || current.Burst != 1 || current.Workers != 3 {
+		t.Fatalf("current config %d/min, burst %d, %d workers, expected 30/min, 1, 3",
+			current.RequestsPerMinute, current.Burst, current.Workers)
+	}
+
+	// alice's 9 requests go out at the new rate, more workers don't make it faster
+	client := rl.cfg.Client.(*ScriptedClient)
+	runUntil(clock, testStart.Add(time.Minute))
+	calls := client.Calls()
+	if len(calls) != 10 {
+		t.Fatalf("%d calls, expected the first and alice's 9", len(calls))
+	}
+	for i := 1; i < len(calls); i++ {
+		if gap := calls[i].At.Sub(calls[i-1].At); gap != 2*time.Second {
+			t.Fatalf("call %d went out %s after the one before, expected 2s at 30/min", i, gap)
+		}
+	}
+}
+
+func TestWorkersScaleThroughput(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// the workers to start with, and to have from 1.5s on
+		workers, later int
+		// how many calls went out when, in ms
+		calls map[int]int
+	}{
+		{"constant", 5, 5, map[int]int{0: 5, 1000: 5, 2000: 5}},
+		{"raised", 2, 5, map[int]int{0: 2, 1000: 2, 1500: 3, 2000: 2, 2500: 3, 3000: 2, 3500: 1}},
+		// the workers stop as they finish their call
+		{"lowered", 5, 1, map[int]int{0: 5, 1000: 5, 2000: 1, 3000: 1, 4000: 1, 5000: 1, 6000: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the rate is no limit, every call takes a second
+			rl, clock, client := scriptedLimiter(Config{Workers: tc.workers})
+			defer shutdownNow(rl)
+			client.Fallback = func(req *UserRequest) Outcome { return Hang(time.Second) }
+			pending := submitRequests(t, rl, 15)
+
+			runUntil(clock, testStart.Add(time.Second))
+			clock.Advance(500 * time.Millisecond)
+			settle(clock)
+			cfg := rl.CurrentConfig()
+			cfg.Workers = tc.later
+			if err := rl.UpdateConfig(cfg); err != nil {
+				t.Fatal(err)
+			}
+			for _, req := range pending {
+				awaitResponse(t, clock, req)
+			}
+
+			calls := make(map[int]int)
+			for _, call := range client.Calls() {
+				calls[int(call.At.Sub(testStart).Milliseconds())]++
+			}
+			if !maps.Equal(calls, tc.calls) {
+				t.Fatalf("calls went out at %v, expected %v", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestUpdateConfigRejectsInvalidSettings(t *testing.T) {
+	rl, _, _ := scriptedLimiter(Config{
+		RequestsPerMinute: 60, Burst: 1, Workers: 1,
+		Targets: map[string]TargetConfig{"search": {RequestsPerMinute: 30, Burst: 1}},
+	})
+	defer shutdownNow(rl)
+
+	for _, tc := range []struct {
+		name   string
+		change func(cfg *Config)
+	}{
+		{"no rate", func(cfg *Config) { cfg.RequestsPerMinute = 0 }},
+		{"no burst", func(cfg *Config) { cfg.Burst = -1 }},
+		{"no workers", func(cfg *Config) { cfg.Workers = 0 }},
+		{"target without a rate", func(cfg *Config) { cfg.Targets["search"] = TargetConfig{Burst: 1} }},
+		{"new target", func(cfg *Config) { cfg.Targets["payments"] = TargetConfig{RequestsPerMinute: 10, Burst: 1} }},
+	} {
+		cfg := rl.CurrentConfig()
+		// a valid change along with the invalid one, neither is applied
+		cfg.RequestsPerMinute = 120
+		tc.change(&cfg)
+		if err := rl.UpdateConfig(cfg); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%s: %v, expected ErrInvalidConfig", tc.name, err)
+		}
+		if current := rl.CurrentConfig(); current.RequestsPerMinute != 60 || current.Workers != 1 {
+			t.Fatalf("%s: config changed to %d/min and %d workers", tc.name, current.RequestsPerMinute, current.Workers)
+		}
+	}
+
+	shutdownNow(rl)
+	if err := rl.UpdateConfig(rl.CurrentConfig()); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("updating after Shutdown: %v, expected ErrShuttingDown", err)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	rl, clock, _ := scriptedLimiter(Config{
+		RequestsPerMinute: 60, Burst: 1, Workers: 1,
+		Targets: map[string]TargetConfig{"search": {RequestsPerMinute: 30, Burst: 1}},
+	})
+	defer shutdownNow(rl)
+	async := newAsyncTracker(&WebhookSender{Secret: []byte("s")}, clock)
+	server := httptest.NewServer(newMux(rl, async, "s", "admin"))
+	defer server.Close()
+	disabled := httptest.NewServer(newMux(rl, async, "s", ""))
+	defer disabled.Close()
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		method string
+		token  string
+		body   string
+		status int
+	}{
+		{"no admin token", disabled.URL, http.MethodPut, "", `{"burst": 5}`, http.StatusNotFound},
+		{"not authorized", server.URL, http.MethodPut, "", `{"burst": 5}`, http.StatusUnauthorized},
+		{"wrong token", server.URL, http.MethodPut, "guess", `{"burst": 5}`, http.StatusUnauthorized},
+		{"GET", server.URL, http.MethodGet, "admin", "", http.StatusMethodNotAllowed},
+		{"not JSON", server.URL, http.MethodPut, "admin", `burst=5`, http.StatusBadRequest},
+		{"unknown field", server.URL, http.MethodPut, "admin", `{"brust": 5}`, http.StatusBadRequest},
+		{"unknown target", server.URL, http.MethodPut, "admin", `{"targets": {"payments": {"burst": 5}}}`,
+			http.StatusBadRequest},
+		{"invalid burst", server.URL, http.MethodPut, "admin", `{"burst": 0}`, http.StatusBadRequest},
+		{"update", server.URL, http.MethodPut, "admin",
+			`{"requests_per_minute": 120, "workers": 2, "targets": {"search": {"burst": 3}}}`, http.StatusOK},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url+"/api/config", strings.NewReader(tc.body))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: answered %d, expected %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+
+	// only the fields given changed
+	cfg := rl.CurrentConfig()
+	search := cfg.Targets["search"]
+	if cfg.RequestsPerMinute != 120 || cfg.Burst != 1 || cfg.Workers != 2 ||
+		search.RequestsPerMinute != 30 || search.Burst != 3 {
+		t.Fatalf("config %d/min, burst %d, %d workers, search %d/min, burst %d after the update",
+			cfg.RequestsPerMinute, cfg.Burst, cfg.Workers, search.RequestsPerMinute, search.Burst)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+/**
+A failed call is worth making again when the failure is transient: rate limiting, a 503, a connection reset, a call
+timing out. But for some of them nobody knows whether the third party acted on the call before failing. A search
+tried twice is harmless, a payment tried twice pays twice.
+
+So whether a request is retried depends on two things:
+
+- the error: IsRetryable decides whether trying again may help. It's Config.IsRetryable if set, otherwise the client's
+  own Retryable if it implements RetryClassifier (it knows its errors best), DefaultIsRetryable otherwise.
+- the request: UserRequest.Idempotent says making it twice does no more than making it once
+
+Idempotent requests are retried on every retryable error. Others only on errors that prove the call wasn't acted on:
+rate limiting (the third party turned it away) or a connection never established. On any other retryable error they
+fail with an AmbiguousResultError, telling the caller the operation may or may not have happened, to check before
+trying again themselves.
+*/
+
+// implemented by clients that know which of their errors are worth retrying, see above
+type RetryClassifier interface {
+	Retryable(err error) bool
+}
+
+// matches an AmbiguousResultError with errors.Is
+var ErrAmbiguousResult = errors.New("the third party may or may not have acted on the request")
+
+// the response to a request that isn't Idempotent whose call failed in a way that doesn't tell whether the third party
+// acted on it
+type AmbiguousResultError struct {
+	// the error of the call
+	Err error
+}
+
+func (e *AmbiguousResultError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrAmbiguousResult, e.Err)
+}
+
+func (e *AmbiguousResultError) Is(target error) bool {
+	return target == ErrAmbiguousResult
+}
+
+func (e *AmbiguousResultError) Unwrap() error {
+	return e.Err
+}
+
+// retries rate-limited requests, server errors (5xx) and transient network errors, anything else (e.g a ClientError)
+// would only fail again. See errors.go.
+func DefaultIsRetryable(err error) bool {
+	var netErr *NetworkError
+	if errors.As(err, &netErr) {
+		return netErr.Temporary
+	}
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServerError) || transientNetworkError(err)
+}
+
+// the connection failed or the call timed out, the next one may well go through
+func transientNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// whether the error proves the third party never acted on the call
+func notActedOn(err error) bool {
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	// the connection was never established, so the call was never sent
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// decides which errors of the client are worth retrying, see above
+func retryClassifier(cfg Config, client ThirdPartyClient) func(err error) bool {
+	if cfg.IsRetryable != nil {
+		return cfg.IsRetryable
+	}
+	if classifier, ok := client.(RetryClassifier); ok {
+		return classifier.Retryable
+	}
+	return DefaultIsRetryable
+}
+
+// whether the request may be retried after the (retryable) error, otherwise it fails with an AmbiguousResultError
+func (req *UserRequest) safeToRetry(err error) bool {
+	return req.Idempotent || notActedOn(err)
+}
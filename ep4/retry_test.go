@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a ScriptedClient that knows better than DefaultIsRetryable: only its 503s are worth retrying
+type picky503Client struct {
+	*ScriptedClient
+}
+
+func (c picky503Client) Retryable(err error) bool {
+	var serverErr *ServerError
+	return errors.As(err, &serverErr) && serverErr.StatusCode == 503
+}
+
+// the client's answers to a single request, and how many calls it took
+func sendOnce(t *testing.T, rl *RateLimiter, clock *FakeClock, client *ScriptedClient,
+	req *UserRequest) (*APIResponse, int) {
+	t.Helper()
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	resp := awaitResponse(t, clock, req)
+	return resp, len(client.Calls())
+}
+
+func TestRetryDependsOnIdempotency(t *testing.T) {
+	refused := Outcome{Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	for _, tc := range []struct {
+		name       string
+		failure    Outcome
+		idempotent bool
+		// the calls made, and whether the request ends up answered with an AmbiguousResultError
+		calls     int
+		ambiguous bool
+	}{
+		{"503, idempotent", FailWith(503), true, 2, false},
+		{"503", FailWith(503), false, 1, true},
+		{"reset, idempotent", Disconnect(), true, 2, false},
+		{"reset", Disconnect(), false, 1, true},
+		{"timeout", TimeOut(time.Second), false, 1, true},
+		// turned away, never acted on
+		{"429", RateLimited(time.Second), false, 2, false},
+		{"connection refused", refused, false, 2, false},
+		// not worth retrying at all, nothing ambiguous about it
+		{"400", RejectWith(400), false, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, clock, client := scriptedLimiter(Config{Backoff: fixedBackoff(time.Second)})
+			defer shutdownNow(rl)
+			client.Script("alice", tc.failure)
+
+			req := testRequest("alice", "pay")
+			req.Idempotent = tc.idempotent
+			resp, calls := sendOnce(t, rl, clock, client, req)
+			if calls != tc.calls {
+				t.Fatalf("%d calls, expected %d", calls, tc.calls)
+			}
+			var ambiguous *AmbiguousResultError
+			if isAmbiguous := errors.As(resp.Err, &ambiguous); isAmbiguous != tc.ambiguous {
+				t.Fatalf("answered %v, expected an AmbiguousResultError: %t", resp.Err, tc.ambiguous)
+			}
+			if tc.ambiguous && (!errors.Is(resp.Err, ErrAmbiguousResult) || ambiguous.Err == nil) {
+				t.Fatalf("answered %v, expected it to match ErrAmbiguousResult and wrap the call's error", resp.Err)
+			}
+			if tc.calls == 2 && resp.Err != nil {
+				t.Fatalf("the retry answered %v, expected success", resp.Err)
+			}
+		})
+	}
+}
+
+func TestRetryClassifier(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	scripted := &ScriptedClient{Clock: clock}
+	rl := NewRateLimiter(Config{Client: picky503Client{scripted}, Clock: clock, Logger: quietLogger(),
+		RequestsPerMinute: 60000, Burst: 10, Backoff: fixedBackoff(time.Second)})
+	defer shutdownNow(rl)
+
+	// DefaultIsRetryable would retry a 500, the client says it's no use
+	scripted.Script("alice", FailWith(500))
+	if resp, calls := sendOnce(t, rl, clock, scripted, testRequest("alice", "ping")); calls != 1 || resp.Err == nil {
+		t.Fatalf("500 answered %v after %d calls, expected a failure after 1", resp.Err, calls)
+	}
+	scripted.Script("bob", FailWith(503))
+	if resp, calls := sendOnce(t, rl, clock, scripted, testRequest("bob", "ping")); calls != 3 || resp.Err != nil {
+		t.Fatalf("503 answered %v after %d calls in all, expected success on the retry", resp.Err, calls)
+	}
+}
+
+func TestConfigIsRetryableOverridesTheClient(t *testing.T) {
+	// nothing is retried, not even rate limiting
+	rl, clock, client := scriptedLimiter(Config{
+		Backoff:     fixedBackoff(time.Second),
+		IsRetryable: func(err error) bool { return false },
+	})
+	defer shutdownNow(rl)
+	client.Script("alice", RateLimited(time.Second))
+
+	resp, calls := sendOnce(t, rl, clock, client, testRequest("alice", "ping"))
+	if calls != 1 || !errors.Is(resp.Err, ErrRateLimited) {
+		t.Fatalf("answered %v after %d calls, expected the 429 after 1", resp.Err, calls)
+	}
+}
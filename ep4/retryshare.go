@@ -0,0 +1,172 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+/**
+During a storm of rate-limited responses every call fails and is retried, and the retries take the tokens (and the
+senders) as soon as they come in: fresh requests, new users among them, wait behind a backlog of retries of requests
+that will likely be rate limited again.
+
+So a retry doesn't wait out its backoff in its sender anymore. The sender hands the request back and moves on, the
+request waits out its backoff on its own and then joins the retries, a queue of its own next to the queue of fresh
+requests. processQueue serves both, taking the tokens for a retry just like for a fresh request.
+
+Config.RetryShare caps the share of a target's calls that may be retries while fresh requests for the target are
+waiting in the queue, e.g 0.3 lets 3 retries through for every 7 fresh calls. Every fresh call taken from the queue
+earns the retries waiting on the target RetryShare/(1-RetryShare) of a turn, a retry waits until a whole turn is
+there. While no fresh request for the target waits, retries take their turn right away and may use the whole budget.
+The same goes when fresh requests wait but none went out for a few tokens' time, e.g because every user waiting is
+over their PerUserLimit: the tokens would go unused otherwise.
+
+Turns don't build up beyond a single retry's worth (or a single fresh call's worth of retries, whichever is more), a
+quiet stretch without retries doesn't let a burst of them through later.
+
+Retries don't take per-user tokens, their user paid for them with the first call.
+*/
+
+// how many tokens' time without a fresh call going out lets retries have the tokens
+const freshStalledTokens = 3
+
+// requests whose backoff is over, in the order it ended
+type retryQueue struct {
+	mu       sync.Mutex
+	requests []*UserRequest
+	// set once the rate limiter stops for good, nothing is retried anymore
+	closed bool
+}
+
+// adds the request, unless the queue is closed
+func (q *retryQueue) push(req *UserRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.requests = append(q.requests, req)
+	return true
+}
+
+// puts a request taken by takeRetry back in front, unless the queue is closed
+func (q *retryQueue) pushFront(req *UserRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.requests = slices.Insert(q.requests, 0, req)
+	return true
+}
+
+func (q *retryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.requests)
+}
+
+// hands the request back to processQueue once its backoff is over
+func (rl *RateLimiter) scheduleRetry(req *UserRequest, backoff time.Duration) {
+	rl.retrying.Add(1)
+	rl.requests.set(req, stateRetrying, rl.clock.Now())
+	// Shutdown waits for the request to be answered
+	rl.wg.Add(1)
+	go func() {
+		defer rl.wg.Done()
+		select {
+		case <-rl.clock.After(backoff):
+		case <-req.context().Done():
+			// dropped as cancelled once taken
+		case <-rl.shutdownChan:
+			rl.abandonRetry(req)
+			return
+		}
+		if !rl.retries.push(req) {
+			rl.abandonRetry(req)
+			return
+		}
+		rl.queue.wake()
+	}()
+}
+
+// answers a request that won't be retried because the rate limiter shuts down
+func (rl *RateLimiter) abandonRetry(req *UserRequest) {
+	rl.retrying.Add(-1)
+	rl.markDone(req)
+	rl.respond(req, &APIResponse{Err: ErrShuttingDown})
+}
+
+// removes and returns the first retry whose target has tokens for it (and a turn, see above), nil if none has
+func (rl *RateLimiter) takeRetry() *UserRequest {
+	rl.retries.mu.Lock()
+	defer rl.retries.mu.Unlock()
+
+	now := rl.clock.Now()
+	for i, req := range rl.retries.requests {
+		t := rl.targetOf(req)
+		if rl.cfg.ParkWhenOpen && t.breaker.blockedFor() > 0 {
+			continue
+		}
+		readyAt, turn, ok := t.reserveRetry(req.cost(), now, rl.queue.waitingFor(t.name) > 0)
+		if !ok {
+			continue
+		}
+		rl.retries.requests = slices.Delete(rl.retries.requests, i, i+1)
+		rl.retrying.Add(-1)
+		req.readyAt, req.retryTurn, req.quotaPending = readyAt, turn, true
+		return req
+	}
+	return nil
+}
+
+// closes the retries, returning the requests waiting there. Requests still backing off are answered as they finish.
+func (rl *RateLimiter) abandonRetries() []*UserRequest {
+	rl.retries.mu.Lock()
+	defer rl.retries.mu.Unlock()
+
+	rl.retries.closed = true
+	abandoned := rl.retries.requests
+	rl.retries.requests = nil
+	for _, req := range abandoned {
+		rl.retrying.Add(-1)
+		rl.markDone(req)
+	}
+	return abandoned
+}
+
+// gives the retries waiting on the target their share of turns for a fresh call taken from the queue
+// (must be called with bucketMu held)
+func (t *target) earnRetryTurn(now time.Time) {
+	t.lastFresh = now
+	if t.cfg.RetryShare <= 0 || t.cfg.RetryShare >= 1 {
+		return
+	}
+	perFresh := t.cfg.RetryShare / (1 - t.cfg.RetryShare)
+	t.retryTurns = min(t.retryTurns+perFresh, max(1, perFresh))
+}
+
+// reserves the units of a retry's call like reserveCall, if it is the retries' turn (see above). turn tells whether
+// the reservation took one.
+func (t *target) reserveRetry(cost int, now time.Time, freshWaiting bool) (readyAt time.Time, turn, ok bool) {
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	capped := t.cfg.RetryShare > 0 && t.cfg.RetryShare < 1
+	// fresh requests aren't using the tokens, e.g their users are over their limit
+	stalledFor := time.Duration(freshStalledTokens * float64(time.Minute) / t.bucket.refillPerMinute)
+	needsTurn := capped && freshWaiting && now.Sub(t.lastFresh) <= stalledFor
+	if needsTurn && t.retryTurns < 1 {
+		return time.Time{}, false, false
+	}
+
+	readyAt, ok = t.reserveCall(cost, now)
+	if ok && needsTurn {
+		t.retryTurns--
+	}
+	return readyAt, ok && needsTurn, ok
+}
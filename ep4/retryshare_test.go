@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// the retries and the fresh calls made until the last fresh one went out, for 40 users whose first call
+// fails
+func retryShareDuringStorm(t *testing.T, share float64) (retries, fresh int) {
+	t.Helper()
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 1, RetryShare: share,
+		Backoff: fixedBackoff(time.Second)})
+	defer shutdownNow(rl)
+	for i := range 40 {
+		client.Script(fmt.Sprintf("user%d", i), FailWith(503))
+	}
+	for _, req := range submitRequests(t, rl, 40) {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+
+	// a user's second call is a retry
+	called := make(map[string]bool)
+	for _, call := range client.Calls() {
+		if called[call.UserID] {
+			retries++
+		} else {
+			fresh++
+		}
+		called[call.UserID] = true
+		if fresh == 40 {
+			break
+		}
+		// a turn for the retries builds up at most one retry ahead of its share
+		if share > 0 && float64(retries)*(1-share) > float64(fresh)*share+1 {
+			t.Fatalf("%d retries went out along with %d fresh calls, expected %g of the calls at most", retries,
+				fresh, share)
+		}
+	}
+	return retries, fresh
+}
+
+func TestRetryShareCapsRetries(t *testing.T) {
+	// 3 retries for every 7 fresh calls at most, checked as the calls go out
+	retries, fresh := retryShareDuringStorm(t, 0.3)
+	if retries == 0 {
+		t.Fatalf("no retry went out along with the %d fresh calls, expected up to 30%% of the calls", fresh)
+	}
+
+	// without the cap the retries go first, about one for every fresh call
+	if uncapped, _ := retryShareDuringStorm(t, 0); uncapped < fresh-5 {
+		t.Fatalf("%d retries went out along with the %d fresh calls without RetryShare, expected about as many",
+			uncapped, fresh)
+	}
+}
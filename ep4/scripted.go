@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+The SimulatedClient rate limits 30% of the calls at random, whatever is being checked: a retry, the breaker tripping
+or the adaptive rate backing off happen or not depending on the draw. A ScriptedClient answers each call with the
+next Outcome scripted for the request's user instead: a success, a 429 with its Retry-After, a 5xx, a 4xx, a dropped
+connection, a timeout, a call hanging for a while before answering (see errors.go for the errors). Users without a
+script of their own take the next Outcome scripted for every user (""), and once that runs out the Fallback decides
+(a success if there is none).
+
+The calls are recorded (user, data, idempotency key) with the time on the client's Clock: with the rate limiter's
+FakeClock, they tell to the nanosecond when each attempt went out (see simulate_test.go). An Outcome's Delay waits on
+that clock too, cut short by the request's context like a real call.
+
+The SimulatedClient draws its outcomes from a RandomPolicy, seeded: the same seed gives the same sequence of
+outcomes, so a run can be replayed (as long as the calls come in the same order, which concurrent workers don't
+promise). SimulatedClient{} uses a policy seeded with 1, shared by all of them.
+
+The rate limiter is a main package, nothing outside of it can import these: an integration gets them by copying
+this file along with the Clock and the FakeClock.
+*/
+
+// how the third party answers a call, see above. The zero value succeeds right away.
+type Outcome struct {
+	// how long the call takes before answering, cut short by the request's context
+	Delay time.Duration
+	// the answer after the Delay, when Err is nil. nil means a generic success for the request's user.
+	Resp *APIResponse
+	Err  error
+}
+
+// a success answering data
+func Succeed(data string) Outcome {
+	return Outcome{Resp: &APIResponse{Data: data}}
+}
+
+// a 429 asking to wait retryAfter (0 if it doesn't say)
+func RateLimited(retryAfter time.Duration) Outcome {
+	return Outcome{Err: &RateLimitedError{Info: RateLimitInfo{RetryAfter: retryAfter}}}
+}
+
+// a failure of the third party with the status code, e.g 500 or 503
+func FailWith(statusCode int) Outcome {
+	return Outcome{Err: &ServerError{StatusCode: statusCode, Body: "scripted failure"}}
+}
+
+// a refusal of the request with the status code, e.g 400 or 422
+func RejectWith(statusCode int) Outcome {
+	return Outcome{Err: &ClientError{StatusCode: statusCode, Body: "scripted rejection"}}
+}
+
+// a connection failing (reset by the third party) before an answer came back
+func Disconnect() Outcome {
+	return Outcome{Err: newNetworkError(syscall.ECONNRESET)}
+}
+
+// a call giving up after d without an answer, like HTTPTransport.Timeout running out
+func TimeOut(after time.Duration) Outcome {
+	return Outcome{Delay: after, Err: newNetworkError(context.DeadlineExceeded)}
+}
+
+// a call hanging for d, then succeeding. Set the Delay of another Outcome to hang before it instead.
+func Hang(d time.Duration) Outcome {
+	return Outcome{Delay: d}
+}
+
+// waits for the Delay on the clock and answers
+func (o Outcome) play(ctx context.Context, clock Clock, req *UserRequest) (*APIResponse, error) {
+	if o.Delay > 0 {
+		select {
+		case <-clock.After(o.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if o.Err != nil {
+		return nil, o.Err
+	}
+	if o.Resp == nil {
+		return &APIResponse{Data: fmt.Sprintf("Processed data for user %s", req.UserID)}, nil
+	}
+	// the rate limiter may fill in the response it is given
+	resp := *o.Resp
+	return &resp, nil
+}
+
+// a call a ScriptedClient received
+type RecordedCall struct {
+	// when the call came in, on the client's Clock
+	At             time.Time
+	UserID         string
+	Data           string
+	IdempotencyKey string
+}
+
+// answers calls with scripted Outcomes and records them, see above. Safe for concurrent use.
+type ScriptedClient struct {
+	// the Delays wait on it and the calls are recorded with its time, nil means the real clock
+	Clock Clock
+	// the Outcome of a call nothing is scripted for, nil means a success. Called with the client's lock held, one
+	// call at a time.
+	Fallback func(req *UserRequest) Outcome
+
+	mu sync.Mutex
+	// the Outcomes still to come, per user ("" for every user)
+	scripts map[string][]Outcome
+	calls   []RecordedCall
+}
+
+// queues up the Outcomes of the next calls for the user, after those scripted already. "" scripts the calls of
+// every user without a script of their own.
+func (c *ScriptedClient) Script(userID string, outcomes ...Outcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.scripts == nil {
+		c.scripts = make(map[string][]Outcome)
+	}
+	c.scripts[userID] = append(c.scripts[userID], outcomes...)
+}
+
+// the calls received so far, in the order they came in
+func (c *ScriptedClient) Calls() []RecordedCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]RecordedCall(nil), c.calls...)
+}
+
+func (c *ScriptedClient) Call(ctx context.Context, req *UserRequest) (*APIResponse, error) {
+	clock := c.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	c.mu.Lock()
+	c.calls = append(c.calls, RecordedCall{
+		At: clock.Now(), UserID: req.UserID, Data: req.Data, IdempotencyKey: req.IdempotencyKey,
+	})
+	outcome := c.next(req)
+	c.mu.Unlock()
+
+	return outcome.play(ctx, clock, req)
+}
+
+// takes the Outcome of the call off the scripts (must be called with mu held)
+func (c *ScriptedClient) next(req *UserRequest) Outcome {
+	for _, userID := range []string{req.UserID, ""} {
+		if script := c.scripts[userID]; len(script) > 0 {
+			c.scripts[userID] = script[1:]
+			return script[0]
+		}
+	}
+	if c.Fallback != nil {
+		return c.Fallback(req)
+	}
+	return Outcome{}
+}
+
+// the defaults of a RandomPolicy, the SimulatedClient's from the start
+const (
+	defaultRateLimitedChance = 0.3
+	defaultMaxRetryAfter     = time.Second
+	defaultRefusedItemChance = 0.05
+)
+
+// random outcomes from a seeded source, see above
+type RandomPolicy struct {
+	// the chance of a call being rate limited, with a Retry-After up to MaxRetryAfter
+	RateLimitedChance float64
+	MaxRetryAfter     time.Duration
+	// the chance of an item of a bulk call being refused, see batch.go
+	RefusedItemChance float64
+
+	// a *rand.Rand isn't safe for concurrent use
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// a policy with the SimulatedClient's chances, drawing from seed
+func NewRandomPolicy(seed int64) *RandomPolicy {
+	return &RandomPolicy{
+		RateLimitedChance: defaultRateLimitedChance,
+		MaxRetryAfter:     defaultMaxRetryAfter,
+		RefusedItemChance: defaultRefusedItemChance,
+		rand:              rand.New(rand.NewSource(seed)),
+	}
+}
+
+// the policy of SimulatedClient{}
+var defaultRandomPolicy = NewRandomPolicy(1)
+
+// the Outcome of the next call, fits ScriptedClient.Fallback
+func (p *RandomPolicy) Outcome(req *UserRequest) Outcome {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rand.Float64() < p.RateLimitedChance {
+		// like most real APIs, tell the caller how long to wait
+		retryAfter := time.Duration(p.rand.Int63n(int64(p.MaxRetryAfter)/int64(time.Millisecond)+1)) * time.Millisecond
+		return RateLimited(retryAfter)
+	}
+	return Outcome{}
+}
+
+// whether the third party refuses the next item of a bulk call
+func (p *RandomPolicy) refusesItem() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.rand.Float64() < p.RefusedItemChance
+}
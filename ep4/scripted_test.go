@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// calls the client in the background, the channel gets the error once the call returns
+func callAsync(ctx context.Context, client *ScriptedClient, req *UserRequest) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Call(ctx, req)
+		done <- err
+	}()
+	return done
+}
+
+func TestScriptedClientOutcomes(t *testing.T) {
+	client := &ScriptedClient{Clock: NewFakeClock(testStart)}
+	client.Script("alice", Succeed("scripted"), RateLimited(2*time.Second), FailWith(503), RejectWith(400),
+		Disconnect())
+	// for everyone, alice included once her own script runs out
+	client.Script("", FailWith(500), FailWith(500))
+
+	ctx := context.Background()
+	resp, err := client.Call(ctx, testRequest("alice", "ping"))
+	if err != nil || resp.Data != "scripted" {
+		t.Fatalf("first call answered %+v, %v, expected the scripted success", resp, err)
+	}
+	var rateLimited *RateLimitedError
+	if _, err := client.Call(ctx, testRequest("alice", "ping")); !errors.As(err, &rateLimited) ||
+		rateLimited.Info.RetryAfter != 2*time.Second {
+		t.Fatalf("second call failed with %v, expected a 429 with Retry-After 2s", err)
+	}
+	var serverErr *ServerError
+	if _, err := client.Call(ctx, testRequest("alice", "ping")); !errors.As(err, &serverErr) ||
+		serverErr.StatusCode != 503 {
+		t.Fatalf("third call failed with %v, expected a 503", err)
+	}
+	var clientErr *ClientError
+	if _, err := client.Call(ctx, testRequest("alice", "ping")); !errors.As(err, &clientErr) ||
+		clientErr.StatusCode != 400 {
+		t.Fatalf("fourth call failed with %v, expected a 400", err)
+	}
+	if _, err := client.Call(ctx, testRequest("alice", "ping")); !errors.Is(err, syscall.ECONNRESET) ||
+		!DefaultIsRetryable(err) {
+		t.Fatalf("fifth call failed with %v, expected a retryable connection reset", err)
+	}
+
+	for _, userID := range []string{"alice", "bob"} {
+		if _, err := client.Call(ctx, testRequest(userID, "ping")); !errors.As(err, &serverErr) ||
+			serverErr.StatusCode != 500 {
+			t.Fatalf("call of %s failed with %v, expected the 500 scripted for everyone", userID, err)
+		}
+	}
+	// nothing scripted anymore
+	if resp, err := client.Call(ctx, testRequest("bob", "ping")); err != nil || resp.Data == "" {
+		t.Fatalf("unscripted call answered %+v, %v, expected a success", resp, err)
+	}
+}
+
+func TestScriptedClientDelays(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	client := &ScriptedClient{Clock: clock}
+	client.Script("alice", TimeOut(5*time.Second))
+	client.Script("bob", Hang(time.Minute))
+
+	timedOut := callAsync(context.Background(), client, testRequest("alice", "ping"))
+	ctx, cancel := context.WithCancel(context.Background())
+	hanging := callAsync(ctx, client, testRequest("bob", "ping"))
+	settle(clock)
+	clock.Advance(5 * time.Second)
+	if err := <-timedOut; !errors.Is(err, ErrNetwork) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call timing out after 5s failed with %v, expected a network timeout", err)
+	}
+	// the request's context cuts a hanging call short
+	cancel()
+	if err := <-hanging; !errors.Is(err, context.Canceled) {
+		t.Fatalf("hanging call cancelled with %v, expected context.Canceled", err)
+	}
+}
+
+func TestScriptedClientRecordsCalls(t *testing.T) {
+	clock := NewFakeClock(testStart)
+	client := &ScriptedClient{Clock: clock}
+
+	first := testRequest("alice", "search")
+	first.IdempotencyKey = "key-1"
+	client.Call(context.Background(), first)
+	clock.Advance(1500 * time.Millisecond)
+	client.Call(context.Background(), testRequest("bob", "ping"))
+
+	expected := []RecordedCall{
+		{At: testStart, UserID: "alice", Data: "search", IdempotencyKey: "key-1"},
+		{At: testStart.Add(1500 * time.Millisecond), UserID: "bob", Data: "ping"},
+	}
+	calls := client.Calls()
+	if len(calls) != len(expected) {
+		t.Fatalf("%d calls recorded, expected %d", len(calls), len(expected))
+	}
+	for i := range calls {
+		if calls[i] != expected[i] {
+			t.Fatalf("call %d recorded as %+v, expected %+v", i, calls[i], expected[i])
+		}
+	}
+}
+
+// the errors of n calls answered by a fresh policy seeded with seed, nil for a success
+func drawOutcomes(seed int64, n int) []error {
+	policy := NewRandomPolicy(seed)
+	client := &ScriptedClient{Clock: NewFakeClock(testStart), Fallback: policy.Outcome}
+	outcomes := make([]error, n)
+	for i := range outcomes {
+		_, outcomes[i] = client.Call(context.Background(), testRequest("alice", "ping"))
+	}
+	return outcomes
+}
+
+func TestRandomPolicyReplays(t *testing.T) {
+	const calls = 1000
+	first, replayed, other := drawOutcomes(42, calls), drawOutcomes(42, calls), drawOutcomes(7, calls)
+
+	rateLimited, differ := 0, false
+	for i := range first {
+		if first[i] != nil {
+			rateLimited++
+			var err *RateLimitedError
+			if !errors.As(first[i], &err) || err.Info.RetryAfter > defaultMaxRetryAfter {
+				t.Fatalf("call %d failed with %v, expected a 429 with Retry-After up to 1s", i, first[i])
+			}
+		}
+		if !sameOutcome(first[i], replayed[i]) {
+			t.Fatalf("call %d: %v, then %v with the same seed", i, first[i], replayed[i])
+		}
+		differ = differ || !sameOutcome(first[i], other[i])
+	}
+	if !differ {
+		t.Fatal("seeds 42 and 7 drew the same outcomes")
+	}
+	// 30% of the calls, give or take
+	if rateLimited < 250 || rateLimited > 350 {
+		t.Fatalf("%d of %d calls rate limited, expected about 30%%", rateLimited, calls)
+	}
+}
+
+// whether two drawn outcomes are the same, Retry-After included
+func sameOutcome(a, b error) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Error() == b.Error()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+/**
+A deploy stops the process with SIGTERM. Exiting right away drops every request accepted but not answered yet, and
+calling RateLimiter.Shutdown while the server still takes requests races with the handlers still submitting.
+
+So main shuts down in order, within a single deadline:
+
+1. server.Shutdown closes the listener, nothing new comes in, and waits for the handlers running to return. They
+   wait for their request's response (5 seconds at most), which the rate limiter is still there to send.
+2. RateLimiter.Shutdown works through what is left (callback requests, requests recovered from the journal, retries
+   backing off) or, once the deadline is hit, answers it with ErrShuttingDown. The journal keeps those for the next
+   process.
+
+Either way every request submitted gets a response before main returns, and the log says how many were drained and
+how many abandoned.
+*/
+
+// how long main gives the server and the rate limiter to finish, together
+const shutdownTimeout = 30 * time.Second
+
+// stops the server, then the rate limiter, see above
+func gracefulShutdown(server *http.Server, rl *RateLimiter, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	answered, abandoned := rl.answered.Load(), rl.abandoned.Load()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown: %v", err)
+	}
+	if err := rl.Shutdown(ctx); err != nil {
+		log.Printf("Rate limiter shutdown: %v", err)
+	}
+
+	abandoned = rl.abandoned.Load() - abandoned
+	drained := rl.answered.Load() - answered - abandoned
+	log.Printf("Shut down: %d requests drained, %d abandoned", drained, abandoned)
+}
+
+// how many requests were answered with ErrShuttingDown, because Shutdown's deadline passed before they could be sent
+func (rl *RateLimiter) Abandoned() int64 {
+	return rl.abandoned.Load()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the API of the rate limiter served on a port of its own, as main does
+func serveAPI(t *testing.T, rl *RateLimiter, clock *FakeClock) (*http.Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: newMux(rl, newAsyncTracker(&WebhookSender{Secret: []byte("s")}, clock), "s", "")}
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String()
+}
+
+// what gracefulShutdown logs, until the test is over
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// runs gracefulShutdown, moving the clock for the requests it waits for until it returns
+func shutdownOnClock(t *testing.T, server *http.Server, rl *RateLimiter, clock *FakeClock, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		gracefulShutdown(server, rl, timeout)
+		close(done)
+	}()
+	// server.Shutdown polls its connections on the real clock, the fake one may have nothing to do meanwhile
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		settle(clock)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("gracefulShutdown still running after 5s")
+		}
+		if !clock.AdvanceToNext() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestGracefulShutdownDrains(t *testing.T) {
+	logged := captureLog(t)
+	// a call a second, alice's takes 2s to come back
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 1, Workers: 1})
+	client.Script("alice", Hang(2*time.Second))
+	server, url := serveAPI(t, rl, clock)
+
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, url+"/api/request", nil)
+		req.Header.Set("X-User-ID", "alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("request of alice: %v", err)
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	// the handler waits on alice's call when the deploy comes, with 3 more requests queued behind it
+	for deadline := time.Now().Add(5 * time.Second); len(client.Calls()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("alice's request never went out")
+		}
+	}
+	pending := submitRequests(t, rl, 3)
+
+	shutdownOnClock(t, server, rl, clock, 10*time.Second)
+	if code := <-status; code != http.StatusOK {
+		t.Fatalf("alice's request answered %d, expected the handler to get its response", code)
+	}
+	for _, req := range pending {
+		if resp := onlyResponse(t, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	if !strings.Contains(logged.String(), "4 requests drained, 0 abandoned") {
+		t.Fatalf("logged %q, expected the 4 requests drained", logged.String())
+	}
+	if _, err := http.Post(url+"/api/request", "", nil); err == nil {
+		t.Fatal("the server still takes requests after shutting down")
+	}
+}
+
+func TestGracefulShutdownPastDeadline(t *testing.T) {
+	logged := captureLog(t)
+	// one call a minute: the first request goes out, the other two can't before the deadline
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1, Workers: 1})
+	server, _ := serveAPI(t, rl, clock)
+	pending := submitRequests(t, rl, 3)
+	settle(clock)
+	if resp := onlyResponse(t, pending[0]); resp.Err != nil {
+		t.Fatalf("first request failed: %v", resp.Err)
+	}
+
+	gracefulShutdown(server, rl, 50*time.Millisecond)
+	for _, req := range pending[1:] {
+		if resp := onlyResponse(t, req); !errors.Is(resp.Err, ErrShuttingDown) {
+			t.Fatalf("request of %s answered %+v, expected ErrShuttingDown", req.UserID, resp)
+		}
+	}
+	if !strings.Contains(logged.String(), "0 requests drained, 2 abandoned") || rl.Abandoned() != 2 {
+		t.Fatalf("logged %q (%d abandoned), expected the 2 requests abandoned", logged.String(), rl.Abandoned())
+	}
+}
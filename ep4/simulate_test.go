@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+/**
+Checking that the rate limiter keeps to its rate with the real clock takes as long as the rate says: a minute of
+traffic at 60 requests a minute is a minute of waiting, and a busy machine makes the spacing of the calls jitter.
+Everything that waits in the rate limiter waits on Config.Clock (the pacing of the calls, the backoff before a
+retry, the handler's timeout), so a FakeClock takes the waiting out: the clock only moves when told to, and nothing
+fires before it is moved.
+
+TestPacingMinute runs a minute of traffic that way. Requests for two minutes' worth are queued up front, a third
+party failing every 10th call (a ScriptedClient, see scripted.go) makes some of them back off and retry, and the clock
+jumps from one timer to the next (AdvanceToNext) once the rate limiter's goroutines are done with what the previous
+one woke up. The calls are timed on the fake clock, to the nanosecond: the burst, then the calls paced at
+RequestsPerMinute, retries included, and no more than RequestsPerMinute of them in the minute (see window.go). A
+simulated minute takes milliseconds of wall time.
+
+The backoff jitter comes from a seeded source (Backoff.Rand), so every run makes the same calls at the same times.
+settle, which tells when the woken goroutines are done, can only watch the clock's timers: it yields to them until
+the timers stop changing for a couple hundred yields, enough for a rate limiter with nothing slow between two waits.
+*/
+
+func TestPacingMinute(t *testing.T) {
+	const requestsPerMinute, burst, failEvery = 60, 5, 10
+	started := time.Now()
+	clock := NewFakeClock(testStart)
+	// called one call at a time
+	received := 0
+	client := &ScriptedClient{Clock: clock, Fallback: func(req *UserRequest) Outcome {
+		if received++; received%failEvery == 0 {
+			return FailWith(503)
+		}
+		return Succeed("ok")
+	}}
+	rl := NewRateLimiter(Config{
+		Client: client, Clock: clock, RequestsPerMinute: requestsPerMinute, Burst: burst, Workers: 4,
+		Backoff: &Backoff{Base: time.Second, Rand: rand.New(rand.NewSource(1))}, Logger: quietLogger(),
+	})
+	defer shutdownNow(rl)
+
+	var pending []*UserRequest
+	for i := range 2 * requestsPerMinute {
+		req := testRequest(fmt.Sprintf("user%d", i%20), "ping")
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+
+	end := testStart.Add(time.Minute)
+	runUntil(clock, end)
+	calls := callsBefore(client, end)
+	if len(calls) != requestsPerMinute {
+		t.Fatalf("%d calls in the minute, expected RequestsPerMinute (%d)", len(calls), requestsPerMinute)
+	}
+	for i, at := range calls[:burst] {
+		if !at.Equal(testStart) {
+			t.Fatalf("call %d of the burst went out at %s, expected right away", i, at.Sub(testStart))
+		}
+	}
+	// then one more call per interval at most: the bucket refills, a late call leaves the next one less to wait
+	interval := time.Minute / requestsPerMinute
+	for i := burst; i < len(calls); i++ {
+		if earliest := testStart.Add(time.Duration(i-burst+1) * interval); calls[i].Before(earliest) {
+			t.Fatalf("call %d went out at %s, expected %s at the earliest", i, calls[i].Sub(testStart),
+				earliest.Sub(testStart))
+		}
+	}
+
+	// the rest of the requests, and the retries of those whose call failed
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	if made, failed := len(client.Calls()), len(client.Calls())/failEvery; made != len(pending)+failed {
+		t.Fatalf("%d calls for %d requests and %d failed calls, every failed call should be retried once",
+			made, len(pending), failed)
+	}
+
+	if took := time.Since(started); took > 5*time.Second {
+		t.Fatalf("two simulated minutes took %s of wall time", took)
+	}
+}
+
+// a BackoffStrategy waiting the same every time
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) Next(attempt int, last time.Duration) time.Duration {
+	return time.Duration(b)
+}
+
+// the times between the calls made for a single request failing with the outcomes before it goes through
+func retryGaps(t *testing.T, cfg Config, outcomes ...Outcome) []time.Duration {
+	t.Helper()
+	clock := NewFakeClock(testStart)
+	client := &ScriptedClient{Clock: clock}
+	client.Script("alice", outcomes...)
+	cfg.Client, cfg.Clock, cfg.Logger = client, clock, quietLogger()
+	// pacing out of the way, a call can go out whenever its backoff is over
+	cfg.RequestsPerMinute, cfg.Burst = 60000, 10
+	rl := NewRateLimiter(cfg)
+	defer shutdownNow(rl)
+
+	req := testRequest("alice", "ping")
+	if err := rl.SubmitRequest(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if resp := awaitResponse(t, clock, req); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+
+	calls := client.Calls()
+	if len(calls) != len(outcomes)+1 {
+		t.Fatalf("%d calls for %d failures, expected a retry after each", len(calls), len(outcomes))
+	}
+	var gaps []time.Duration
+	for i := 1; i < len(calls); i++ {
+		gaps = append(gaps, calls[i].At.Sub(calls[i-1].At))
+	}
+	return gaps
+}
+
+func TestRetryWaitsOutBackoff(t *testing.T) {
+	cfg := Config{Backoff: &Backoff{Base: time.Second, Rand: rand.New(rand.NewSource(7))}}
+	gaps := retryGaps(t, cfg, FailWith(503), FailWith(503), FailWith(503))
+
+	// the same seed gives the same waits
+	expected := &Backoff{Base: time.Second, Rand: rand.New(rand.NewSource(7))}
+	var last time.Duration
+	for i, gap := range gaps {
+		last = expected.Next(i+1, last)
+		if gap != last {
+			t.Fatalf("retry %d went out %s after the failed call, expected the backoff of %s", i+1, gap, last)
+		}
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	gaps := retryGaps(t, Config{Backoff: fixedBackoff(time.Hour), MaxBackoff: 2 * time.Second},
+		FailWith(503), FailWith(500))
+	for i, gap := range gaps {
+		if gap != 2*time.Second {
+			t.Fatalf("retry %d went out %s after the failed call, expected MaxBackoff (2s)", i+1, gap)
+		}
+	}
+}
+
+func TestRetryAfterOverridesBackoff(t *testing.T) {
+	gaps := retryGaps(t, Config{Backoff: fixedBackoff(time.Second), MaxBackoff: 2 * time.Second},
+		RateLimited(7*time.Second))
+	// the third party knows best, its Retry-After isn't capped
+	if gaps[0] != 7*time.Second {
+		t.Fatalf("retry went out %s after the 429, expected its Retry-After (7s)", gaps[0])
+	}
+}
+
+func TestUsedUpQuotaPausesTheQueue(t *testing.T) {
+	reset := testStart.Add(30 * time.Second)
+	usedUp := &RateLimitInfo{Remaining: 0, Reset: reset}
+	for _, tc := range []struct {
+		name    string
+		outcome Outcome
+		calls   int
+	}{
+		// alice's request is retried
+		{"429", Outcome{Err: &RateLimitedError{Info: *usedUp}}, 7},
+		{"last call of the quota", Outcome{Resp: &APIResponse{Data: "last", RateLimit: usedUp}}, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLog(t)
+			rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 10,
+				Backoff: fixedBackoff(time.Second)})
+			defer shutdownNow(rl)
+			client.Script("alice", tc.outcome)
+
+			first := testRequest("alice", "ping")
+			if err := rl.SubmitRequest(context.Background(), first); err != nil {
+				t.Fatal(err)
+			}
+			for settle(clock); len(client.Calls()) == 0; settle(clock) {
+				clock.AdvanceToNext()
+			}
+			// the pacing would let them all through at once, the quota holds up every user
+			pending := append(submitRequests(t, rl, 5), first)
+			for _, req := range pending {
+				if resp := awaitResponse(t, clock, req); resp.Err != nil {
+					t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+				}
+			}
+
+			calls := client.Calls()
+			if len(calls) != tc.calls {
+				t.Fatalf("%d calls, expected %d", len(calls), tc.calls)
+			}
+			for _, call := range calls[1:] {
+				if call.At.Before(reset) {
+					t.Fatalf("call of %s went out at %s, expected none before the reset at %s", call.UserID,
+						call.At.Format(time.TimeOnly), reset.Format(time.TimeOnly))
+				}
+			}
+			if resumed := calls[1].At.Sub(reset); resumed > time.Second {
+				t.Fatalf("calls resumed %s after the reset, expected right away", resumed)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+How backed up is the limiter? Stats tells, and GET /api/stats serves it as JSON.
+
+Queue wait (from SubmitRequest to a sender picking the request up) goes into a histogram with fixed buckets, so
+percentiles cost a few counters instead of keeping every sample. The price is precision: a percentile is reported as
+the upper bound of the bucket it falls in.
+*/
+
+// a snapshot of what the RateLimiter is doing and has done
+type Stats struct {
+	// requests waiting in the queue
+	Queued int `json:"queued"`
+	// requests being sent to the third party
+	Inflight int64 `json:"inflight"`
+	// how many may be at once, 0 means no limit (it changes with Config.AdaptiveConcurrency)
+	InflightLimit int64 `json:"inflight_limit"`
+	// goroutines sending requests, Config.Workers as last set by UpdateConfig
+	Workers int `json:"workers"`
+	// requests answered with the third party's response, all targets together (as are the other counters of calls)
+	Succeeded int64 `json:"succeeded"`
+	// requests answered with an error: failed calls, retries used up, circuit breaker open
+	Failed int64 `json:"failed"`
+	// calls made again after a rate-limited or failed one
+	Retries int64 `json:"retries"`
+	// units of third-party quota spent on calls, see UserRequest.Cost
+	UnitsSent int64 `json:"units_sent"`
+	// rate-limited responses from the third party
+	RateLimitHits int64 `json:"rate_limit_hits"`
+	// the rate requests are sent to DefaultTarget at, below RequestsPerMinute while Config.Adaptive backs off
+	EffectiveRatePerMinute float64 `json:"effective_rate_per_minute"`
+	// units of DefaultTarget's quota spent over the last minute, never more than RequestsPerMinute (see window.go)
+	UnitsLastMinute int `json:"units_last_minute"`
+	// requests dropped because they were cancelled before they could be sent
+	Cancelled int64 `json:"cancelled"`
+	// requests dropped because they expired before they could be sent
+	Expired int64 `json:"expired"`
+	// requests evicted from the full queue by newer ones, see OverflowDropOldest
+	Evicted int64 `json:"evicted"`
+	// requests answered from the response cache
+	CacheHits int64 `json:"cache_hits"`
+	// requests answered with ErrShuttingDown, see shutdown.go
+	Abandoned int64 `json:"abandoned"`
+	// time spent in the queue by the requests handed to a sender so far
+	QueueWaitCount int64   `json:"queue_wait_count"`
+	QueueWaitP50Ms float64 `json:"queue_wait_p50_ms"`
+	QueueWaitP95Ms float64 `json:"queue_wait_p95_ms"`
+	// the calls to each target, by name
+	Targets map[string]TargetStats `json:"targets"`
+}
+
+// what was sent to a single target, see Config.Targets
+type TargetStats struct {
+	Succeeded              int64   `json:"succeeded"`
+	Failed                 int64   `json:"failed"`
+	Retries                int64   `json:"retries"`
+	UnitsSent              int64   `json:"units_sent"`
+	RateLimitHits          int64   `json:"rate_limit_hits"`
+	EffectiveRatePerMinute float64 `json:"effective_rate_per_minute"`
+	UnitsLastMinute        int     `json:"units_last_minute"`
+	BreakerState           string  `json:"breaker_state"`
+	// the target's limits as last set by UpdateConfig
+	RequestsPerMinute int `json:"requests_per_minute"`
+	Burst             int `json:"burst"`
+}
+
+// counters behind Stats that aren't per target
+type stats struct {
+	cacheHits atomic.Int64
+	queueWait waitHistogram
+}
+
+// upper bounds of the queue wait histogram buckets, anything longer goes into an extra last bucket
+var waitBuckets = [...]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// counts durations per bucket of waitBuckets
+type waitHistogram struct {
+	mu     sync.Mutex
+	counts [len(waitBuckets) + 1]int64
+	total  int64
+	// the longest duration observed, reported for percentiles falling into the last bucket
+	longest time.Duration
+}
+
+func (h *waitHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.Search(len(waitBuckets), func(i int) bool { return d <= waitBuckets[i] })
+	h.counts[i]++
+	h.total++
+	h.longest = max(h.longest, d)
+}
+
+// the upper bound of the bucket holding the q-th quantile (0 < q <= 1), 0 without observations
+func (h *waitHistogram) quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.total))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			if i < len(waitBuckets) {
+				return waitBuckets[i]
+			}
+			break
+		}
+	}
+	return h.longest
+}
+
+func (h *waitHistogram) count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.total
+}
+
+// what the RateLimiter is doing and has done so far
+func (rl *RateLimiter) Stats() Stats {
+	s := Stats{
+		Queued:                 rl.QueueDepth(),
+		Inflight:               rl.inflight.Load(),
+		InflightLimit:          rl.inflightLimit(),
+		Workers:                rl.senders.count(),
+		EffectiveRatePerMinute: rl.EffectiveRate(),
+		Cancelled:              rl.cancelled.Load(),
+		Expired:                rl.expired.Load(),
+		Evicted:                rl.evicted.Load(),
+		CacheHits:              rl.stats.cacheHits.Load(),
+		Abandoned:              rl.abandoned.Load(),
+		QueueWaitCount:         rl.stats.queueWait.count(),
+		QueueWaitP50Ms:         float64(rl.stats.queueWait.quantile(0.5)) / float64(time.Millisecond),
+		QueueWaitP95Ms:         float64(rl.stats.queueWait.quantile(0.95)) / float64(time.Millisecond),
+		Targets:                make(map[string]TargetStats, len(rl.targets)),
+	}
+	now := rl.clock.Now()
+	for name, t := range rl.targets {
+		limits := t.currentLimits()
+		ts := TargetStats{
+			Succeeded:              t.stats.succeeded.Load(),
+			Failed:                 t.stats.failed.Load(),
+			Retries:                t.stats.retries.Load(),
+			UnitsSent:              t.stats.unitsSent.Load(),
+			RateLimitHits:          t.stats.rateLimitHits.Load(),
+			EffectiveRatePerMinute: t.effectiveRate(now),
+			UnitsLastMinute:        t.windowUsage(now),
+			BreakerState:           t.breaker.current().String(),
+			RequestsPerMinute:      limits.requestsPerMinute,
+			Burst:                  limits.burst,
+		}
+		s.Targets[name] = ts
+		s.Succeeded += ts.Succeeded
+		s.Failed += ts.Failed
+		s.Retries += ts.Retries
+		s.UnitsSent += ts.UnitsSent
+		s.RateLimitHits += ts.RateLimitHits
+	}
+	s.UnitsLastMinute = s.Targets[DefaultTarget].UnitsLastMinute
+	return s
+}
+
+// serves Stats as JSON, GET /api/stats
+func statsHandler(rl *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rl.Stats())
+	}
+}
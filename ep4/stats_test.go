@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitHistogram(t *testing.T) {
+	var h waitHistogram
+	if q := h.quantile(0.5); q != 0 {
+		t.Fatalf("p50 of nothing is %s, expected 0", q)
+	}
+	// 90 short waits, 10 long ones, one of them past the last bucket
+	for range 90 {
+		h.observe(3 * time.Millisecond)
+	}
+	for range 9 {
+		h.observe(2 * time.Second)
+	}
+	h.observe(5 * time.Minute)
+
+	for _, tc := range []struct {
+		q        float64
+		expected time.Duration
+	}{{0.5, 5 * time.Millisecond}, {0.9, 5 * time.Millisecond}, {0.95, 2500 * time.Millisecond}, {1, 5 * time.Minute}} {
+		if got := h.quantile(tc.q); got != tc.expected {
+			t.Errorf("p%g is %s, expected %s", tc.q*100, got, tc.expected)
+		}
+	}
+	if count := h.count(); count != 100 {
+		t.Fatalf("%d waits counted, expected 100", count)
+	}
+}
+
+func TestStats(t *testing.T) {
+	// a call a second, one at a time
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 1, Workers: 1})
+	defer shutdownNow(rl)
+	client.Script("user0", RateLimited(2*time.Second))
+	client.Script("user1", FailWith(503))
+	client.Script("user2", RejectWith(400))
+
+	pending := submitRequests(t, rl, 10)
+	if queued := rl.Stats().Queued; queued < 9 {
+		t.Fatalf("%d requests queued, expected all but the one going out", queued)
+	}
+	for _, req := range pending {
+		awaitResponse(t, clock, req)
+	}
+
+	s := rl.Stats()
+	// user2's request is refused, user0's and user1's go through on their retry
+	expected := Stats{Succeeded: 9, Failed: 1, Retries: 2, UnitsSent: 12, RateLimitHits: 1, QueueWaitCount: 10}
+	got := Stats{Succeeded: s.Succeeded, Failed: s.Failed, Retries: s.Retries, UnitsSent: s.UnitsSent,
+		RateLimitHits: s.RateLimitHits, QueueWaitCount: s.QueueWaitCount, Queued: s.Queued, Inflight: s.Inflight}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("stats %+v, expected %+v", got, expected)
+	}
+	// the 10th request waits its turn behind the 9 before it and the 2 retries, a call a second
+	if s.QueueWaitP50Ms <= 0 || s.QueueWaitP50Ms > s.QueueWaitP95Ms || s.QueueWaitP95Ms > 10_000 {
+		t.Fatalf("queue wait p50 %gms, p95 %gms", s.QueueWaitP50Ms, s.QueueWaitP95Ms)
+	}
+
+	server := httptest.NewServer(newMux(rl, newAsyncTracker(&WebhookSender{}, clock), "", ""))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/api/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var served Stats
+	if err := json.NewDecoder(resp.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if served.Succeeded != s.Succeeded || served.Targets[DefaultTarget].Retries != s.Retries {
+		t.Fatalf("GET /api/stats served %+v, expected %+v", served, s)
+	}
+}
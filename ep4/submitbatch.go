@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/**
+A job handing over thousands of requests through SubmitRequest takes the submission lock once per request, and has
+to deal with a full queue itself: wait (one request at a time) or give up on the rest.
+
+SubmitBatch takes the lock once and submits the requests in order, queuing as many as there is room for (in the queue
+and under MaxPendingPerUser). It never waits for room and never evicts anything, whatever Config.Overflow says: a
+batch can't be allowed to push out requests someone is waiting on. Every request that isn't accepted gets a
+BatchRejectedError on its Response channel, so the producer reads one answer per request whatever happened to it, and
+the count of accepted requests tells it where to pick up later.
+
+The requests of a user are queued in the order they come in the batch. Once one of them is refused, the user's
+requests after it in the batch are refused too (with the same cause), even if room opened up meanwhile: otherwise a
+later request could overtake an earlier one that has to be submitted again.
+
+The Response channels need room for the rejection, like for any response (SubmitRequest's requests are answered
+without blocking too).
+*/
+
+// matches a BatchRejectedError with errors.Is
+var ErrBatchRejected = errors.New("request of the batch rejected")
+
+// sent on the Response of a request SubmitBatch didn't accept, Err tells why (e.g ErrQueueFull, a
+// TooManyPendingError)
+type BatchRejectedError struct {
+	// the request's position in the batch
+	Index int
+	Err   error
+}
+
+func (e *BatchRejectedError) Error() string {
+	return fmt.Sprintf("request %d of the batch rejected: %v", e.Index, e.Err)
+}
+
+func (e *BatchRejectedError) Is(target error) bool {
+	return target == ErrBatchRejected
+}
+
+func (e *BatchRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// submits the requests in order without waiting for room, see above. Returns how many were accepted, the others got
+// a BatchRejectedError on their Response. The error is ErrShuttingDown, or ctx's once it is done, when the requests
+// from then on were all rejected for it.
+func (rl *RateLimiter) SubmitBatch(ctx context.Context, reqs []*UserRequest) (accepted int, err error) {
+	rl.submitMu.RLock()
+	defer rl.submitMu.RUnlock()
+
+	// the cause of the first rejection of each user, their later requests get it too
+	refused := make(map[string]error)
+	for i, req := range reqs {
+		submitErr := ctx.Err()
+		if submitErr != nil {
+			err = submitErr
+		} else if cause, exists := refused[req.UserID]; exists {
+			submitErr = cause
+		} else if submitErr = rl.submit(ctx, req, OverflowReject); errors.Is(submitErr, ErrShuttingDown) {
+			err = submitErr
+		}
+
+		if submitErr == nil {
+			accepted++
+			continue
+		}
+		if _, exists := refused[req.UserID]; !exists {
+			refused[req.UserID] = submitErr
+		}
+		req.Response <- &APIResponse{Err: &BatchRejectedError{Index: i, Err: submitErr}}
+	}
+	return accepted, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fails unless the request got a BatchRejectedError for its index in the batch, caused by cause
+func expectBatchRejected(t *testing.T, req *UserRequest, index int, cause error) {
+	t.Helper()
+	var rejected *BatchRejectedError
+	resp := onlyResponse(t, req)
+	if !errors.Is(resp.Err, ErrBatchRejected) || !errors.As(resp.Err, &rejected) || rejected.Index != index ||
+		!errors.Is(rejected.Err, cause) {
+		t.Fatalf("request %d of %s answered %v, expected a BatchRejectedError for it caused by %v", index, req.UserID,
+			resp.Err, cause)
+	}
+}
+
+func TestSubmitBatchAcceptsWhatThereIsRoomFor(t *testing.T) {
+	// user0's request takes the only call of the minute, the others stay queued
+	rl, clock, _ := scriptedLimiter(Config{RequestsPerMinute: 1, Burst: 1, MaxPendingPerUser: 2})
+	defer shutdownNow(rl)
+	submitRequests(t, rl, 1)
+	settle(clock)
+
+	var batch []*UserRequest
+	for _, userID := range []string{"alice", "alice", "alice", "bob", "carol", "carol", "carol"} {
+		batch = append(batch, testRequest(userID, "ping"))
+	}
+	// more than the burst of 1, a request alice can never send
+	batch[1].Cost = 2
+	accepted, err := rl.SubmitBatch(context.Background(), batch)
+	if accepted != 4 || err != nil {
+		t.Fatalf("SubmitBatch accepted %d with %v, expected 4 and no error", accepted, err)
+	}
+	for userID, expected := range map[string]int{"alice": 1, "bob": 1, "carol": 2} {
+		if count := rl.PendingFor(userID); count != expected {
+			t.Fatalf("%s has %d requests pending, expected %d", userID, count, expected)
+		}
+	}
+
+	// the first refused request of a user gives its cause to the ones after it, alice's third would fit otherwise
+	expectBatchRejected(t, batch[1], 1, ErrCostTooHigh)
+	expectBatchRejected(t, batch[2], 2, ErrCostTooHigh)
+	expectBatchRejected(t, batch[6], 6, ErrTooManyPending)
+	for _, i := range []int{0, 3, 4, 5} {
+		if len(batch[i].Response) != 0 {
+			t.Fatalf("accepted request %d of %s answered %v while queued", i, batch[i].UserID, <-batch[i].Response)
+		}
+	}
+}
+
+func TestSubmitBatchRefusesTheRestOnceItCant(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// makes the rate limiter or the ctx refuse every request, returning the ctx to submit with
+		refuse func(rl *RateLimiter) context.Context
+		err    error
+	}{
+		{"shutdown", func(rl *RateLimiter) context.Context {
+			shutdownNow(rl)
+			return context.Background()
+		}, ErrShuttingDown},
+		{"ctx done", func(rl *RateLimiter) context.Context {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx
+		}, context.Canceled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, _, _ := scriptedLimiter(Config{})
+			defer shutdownNow(rl)
+			ctx := tc.refuse(rl)
+
+			batch := []*UserRequest{testRequest("alice", "ping"), testRequest("bob", "ping")}
+			accepted, err := rl.SubmitBatch(ctx, batch)
+			if accepted != 0 || !errors.Is(err, tc.err) {
+				t.Fatalf("SubmitBatch accepted %d with %v, expected none and %v", accepted, err, tc.err)
+			}
+			for i, req := range batch {
+				expectBatchRejected(t, req, i, tc.err)
+			}
+		})
+	}
+}
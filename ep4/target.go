@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+The rate limiter started out in front of a single third-party API with a single limit. Calling a second provider, or
+endpoints of the same provider with limits of their own (search at 100 per minute, lookups at 1000), through the same
+budget means the search limit throttles the lookups, or the lookups eat the search quota.
+
+Config.Targets names the APIs, each with its own pacing: its rate and burst (a token bucket of its own), its backoff,
+its circuit breaker, its pause when the third party says the quota is used up, and its Stats. A request says which
+target it is for with UserRequest.Target, the default target (configured by the top-level fields of Config) takes the
+requests that don't say. SubmitRequest refuses requests for targets it doesn't know with ErrUnknownTarget.
+
+The queue, the per-user limits and the in-flight limit stay shared: they protect us rather than the third parties.
+A user's requests still go out in order, so one of them waiting on a busy target (or an open breaker with
+ParkWhenOpen) holds up the user's requests queued behind it for other targets.
+*/
+
+// the name of the target of requests that don't set UserRequest.Target
+const DefaultTarget = "default"
+
+// returned by SubmitRequest for requests naming a target that isn't configured
+var ErrUnknownTarget = errors.New("unknown target")
+
+// the limits of a single third-party API, see above. Zero fields take the defaults of the top-level Config fields of
+// the same name, except BreakerThreshold: 0 means no circuit breaker.
+type TargetConfig struct {
+	RequestsPerMinute int
+	Burst             int
+	Backoff           BackoffStrategy
+	BreakerThreshold  int
+	BreakerCooldown   time.Duration
+	// nil means Config.Client, which can tell the targets apart by UserRequest.Target
+	Client ThirdPartyClient
+}
+
+// a third-party API and everything pacing the calls to it
+type target struct {
+	name string
+	// the settings in effect for the target
+	cfg    Config
+	client ThirdPartyClient
+	// decides which errors of the client are worth retrying
+	isRetryable func(err error) bool
+
+	// the rate, burst and backoff in effect, changed by UpdateConfig (see reconfig.go)
+	limits atomic.Pointer[targetLimits]
+	// paces the calls to the target, shared by the senders
+	bucketMu sync.Mutex
+	bucket   *tokenBucket
+	// the calls of the last minute, never more units than RequestsPerMinute (see window.go)
+	window callWindow
+	// adjusts the bucket's rate with Config.Adaptive, nil otherwise
+	aimd *aimdController
+	// stops calls to the target while it looks down, nil without one
+	breaker *circuitBreaker
+	// until when (UnixNano) the target told us our quota is used up, no request goes out before then
+	pausedUntil atomic.Int64
+	// the QuotaCoordinator isn't asked again before then after it refused a call (guarded by bucketMu)
+	quotaRetryAt time.Time
+	// turns earned by fresh calls for retries to go out, and when the last fresh call was taken from the queue, see
+	// retryshare.go (guarded by bucketMu)
+	retryTurns float64
+	lastFresh  time.Time
+	// makes the bulk calls, nil unless batching is on and the client is a BatchClient. The batch being put together
+	// for the target and when it goes out, only touched by processQueue (see batch.go).
+	batcher       BatchClient
+	openBatch     *UserRequest
+	batchDeadline time.Time
+
+	stats targetStats
+}
+
+// counters behind TargetStats
+type targetStats struct {
+	succeeded     atomic.Int64
+	failed        atomic.Int64
+	retries       atomic.Int64
+	rateLimitHits atomic.Int64
+	unitsSent     atomic.Int64
+}
+
+// the targets configured in cfg, the default one included (with defaults already applied to cfg)
+func newTargets(cfg Config) map[string]*target {
+	targets := map[string]*target{DefaultTarget: newTarget(DefaultTarget, cfg, cfg.Client)}
+	for name, tc := range cfg.Targets {
+		// adaptive bounds given in requests per minute are meant for the default target's rate
+		targetCfg := cfg
+		targetCfg.MinRequestsPerMinute = 0
+		targetCfg.AdaptiveIncrease = 0
+		targetCfg.RequestsPerMinute = tc.RequestsPerMinute
+		if targetCfg.RequestsPerMinute <= 0 {
+			targetCfg.RequestsPerMinute = MaxRequestsPerMinute
+		}
+		targetCfg.Burst = max(tc.Burst, 1)
+		if tc.Backoff != nil {
+			targetCfg.Backoff = tc.Backoff
+		}
+		targetCfg.BreakerThreshold = tc.BreakerThreshold
+		targetCfg.BreakerCooldown = tc.BreakerCooldown
+
+		client := tc.Client
+		if client == nil {
+			client = cfg.Client
+		}
+		targets[name] = newTarget(name, targetCfg, client)
+	}
+	return targets
+}
+
+func newTarget(name string, cfg Config, client ThirdPartyClient) *target {
+	now := cfg.Clock.Now()
+	t := &target{
+		name:   name,
+		cfg:    cfg,
+		client: client,
+		// the target's own client may know its errors better than the default target's
+		isRetryable: retryClassifier(cfg, client),
+		bucket:      newTokenBucket(cfg.RequestsPerMinute, cfg.Burst, now),
+		aimd:        newAIMDController(cfg, now),
+		breaker:     newCircuitBreaker(name, cfg.BreakerThreshold, cfg.BreakerCooldown, cfg.Clock, cfg.OnBreakerStateChange),
+	}
+	if batcher, ok := client.(BatchClient); ok && cfg.BatchWindow > 0 {
+		t.batcher = batcher
+	}
+	t.limits.Store(&targetLimits{requestsPerMinute: cfg.RequestsPerMinute, burst: cfg.Burst, backoff: cfg.Backoff})
+	return t
+}
+
+// reserves the units of a fresh request's call when it is taken from the queue, see reserveCall
+func (t *target) reserveFirstCall(cost int, now time.Time) (time.Time, bool) {
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	return t.reserveCall(cost, now)
+}
+
+// reserves the units of a call when its request is taken from the queue (or the retries), unless the target has no
+// token left or is paused. The call may go out at the returned time, once the reservation is paid off and the
+// QuotaCoordinator granted it (see RateLimiter.reserveQuota). Must be called with bucketMu held.
+//
+// Taking the units right away (rather than when a sender gets to the call) keeps a busy target from tying up the
+// senders: at most one request per target waits on its reservation, the others stay in the queue where they don't
+// hold up requests for other targets.
+func (t *target) reserveCall(cost int, now time.Time) (time.Time, bool) {
+	if now.Before(time.Unix(0, t.pausedUntil.Load())) || now.Before(t.quotaRetryAt) {
+		return time.Time{}, false
+	}
+	t.recoverRate(now)
+	// pacing alone lets a burst through on top of the rate
+	if !t.window.fits(cost, t.currentLimits().requestsPerMinute, now) {
+		return time.Time{}, false
+	}
+	wait, ok := t.bucket.reserveIfAvailable(cost, now)
+	if !ok {
+		return time.Time{}, false
+	}
+	readyAt := now.Add(wait)
+	t.window.add(cost, readyAt)
+	return readyAt, true
+}
+
+// asks the QuotaCoordinator for the units of a call reserved with reserveCall, without any lock held: the other
+// nodes' calls count too, see quota.go. A refusal gives the units back to the bucket and the window, and the
+// coordinator isn't asked again for the target before it earns its next token. retryTurn tells whether the
+// reservation took a turn of the retries, which is given back too.
+func (t *target) reserveQuota(cost int, readyAt time.Time, retryTurn bool, now time.Time) bool {
+	if t.cfg.Quota.Reserve(t.name, cost, t.currentLimits().requestsPerMinute, readyAt) {
+		return true
+	}
+
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	t.bucket.refund(cost)
+	t.window.remove(cost, readyAt)
+	if retryTurn {
+		t.retryTurns++
+	}
+	t.quotaRetryAt = now.Add(time.Minute / time.Duration(t.currentLimits().requestsPerMinute))
+	return false
+}
+
+// the target the request is for, nil if it isn't configured
+func (rl *RateLimiter) targetOf(req *UserRequest) *target {
+	return rl.targets[req.targetName()]
+}
+
+// the name of the target the request is for
+func (req *UserRequest) targetName() string {
+	if req.Target == "" {
+		return DefaultTarget
+	}
+	return req.Target
+}
+
+// refuses requests for targets that aren't configured
+func (rl *RateLimiter) checkTarget(req *UserRequest) error {
+	if rl.targetOf(req) == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownTarget, req.Target)
+	}
+	return nil
+}
+
+// the names of the configured targets, sorted
+func (rl *RateLimiter) Targets() []string {
+	names := make([]string, 0, len(rl.targets))
+	for name := range rl.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// how often to check on requests waiting for tokens, as often as the fastest target gets a token
+func (rl *RateLimiter) pollInterval() time.Duration {
+	fastest := 0
+	for _, t := range rl.targets {
+		fastest = max(fastest, t.currentLimits().requestsPerMinute)
+	}
+	return time.Minute / time.Duration(fastest)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTargetsHaveBudgetsOfTheirOwn(t *testing.T) {
+	// search is much slower than the default target
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 60, Burst: 1,
+		Targets: map[string]TargetConfig{"search": {RequestsPerMinute: 6, Burst: 1}}})
+	defer shutdownNow(rl)
+
+	// the data of each request is its target, every user has a single request
+	var pending []*UserRequest
+	for i := range 13 {
+		req := testRequest(fmt.Sprintf("user%d", i), DefaultTarget)
+		if i < 3 {
+			req.Data, req.Target = "search", "search"
+		}
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+
+	// the search calls waiting on their budget don't hold up the default target's
+	gaps := map[string]time.Duration{"search": 10 * time.Second, DefaultTarget: time.Second}
+	last := make(map[string]time.Time)
+	for _, call := range client.Calls() {
+		if previous, ok := last[call.Data]; ok && call.At.Sub(previous) != gaps[call.Data] {
+			t.Fatalf("call for %s went out %s after the one before, expected %s", call.Data,
+				call.At.Sub(previous), gaps[call.Data])
+		}
+		last[call.Data] = call.At
+	}
+	if done := last[DefaultTarget].Sub(testStart); done != 9*time.Second {
+		t.Fatalf("the 10 calls for the default target took %s, expected 9s at 60/min", done)
+	}
+	stats := rl.Stats()
+	if search, other := stats.Targets["search"].UnitsSent, stats.Targets[DefaultTarget].UnitsSent; search != 3 ||
+		other != 10 {
+		t.Fatalf("%d units counted for search and %d for the default target, expected 3 and 10", search, other)
+	}
+
+	if err := rl.SubmitRequest(context.Background(), &UserRequest{UserID: "alice", Target: "payments",
+		Response: make(chan *APIResponse, 1)}); !errors.Is(err, ErrUnknownTarget) {
+		t.Fatalf("request for a target not configured: %v, expected ErrUnknownTarget", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// what the tests share. The rate limiter is a main package, a testutil package couldn't import it.
+
+// where the FakeClocks of the tests start
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// a Logger dropping every event, the tests check behavior rather than log lines
+func quietLogger() Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// a request of the user with a Response channel, safe to retry
+func testRequest(userID, data string) *UserRequest {
+	return &UserRequest{UserID: userID, Data: data, Idempotent: true, Response: make(chan *APIResponse, 1)}
+}
+
+// the calls made before the clock reached end
+func callsBefore(client *ScriptedClient, end time.Time) []time.Time {
+	var calls []time.Time
+	for _, call := range client.Calls() {
+		if call.At.Before(end) {
+			calls = append(calls, call.At)
+		}
+	}
+	return calls
+}
+
+// waits until the goroutines the clock woke up wait on it again (or on something else), see simulate_test.go
+func settle(clock *FakeClock) {
+	for stable := 0; stable < 200; {
+		before := clock.Waiters()
+		runtime.Gosched()
+		if clock.Waiters() == before {
+			stable++
+		} else {
+			stable = 0
+		}
+	}
+}
+
+// moves the clock from one timer to the next until it reaches end, or nothing waits on it anymore
+func runUntil(clock *FakeClock, end time.Time) {
+	for settle(clock); clock.Now().Before(end) && clock.AdvanceToNext(); settle(clock) {
+	}
+}
+
+// the response to the request, moving the clock from one timer to the next until it comes
+func awaitResponse(t *testing.T, clock *FakeClock, req *UserRequest) *APIResponse {
+	t.Helper()
+	for {
+		settle(clock)
+		select {
+		case resp := <-req.Response:
+			return resp
+		default:
+		}
+		if !clock.AdvanceToNext() {
+			// nothing waits on the clock, the response has to come without it
+			select {
+			case resp := <-req.Response:
+				return resp
+			case <-time.After(5 * time.Second):
+				t.Fatalf("request of %s was never answered", req.UserID)
+			}
+		}
+	}
+}
+
+// shuts the rate limiter down without waiting, whatever is still queued is answered with ErrShuttingDown
+func shutdownNow(rl *RateLimiter) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rl.Shutdown(ctx)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+/**
+Some third parties want the data in a shape of their own: encrypted, compressed, a JSON document with a given
+schema. Config.Transformer turns the request into what is sent right before every call, the client never sees the
+request as it was submitted.
+
+The transformer returns the request to send in place of the one it is given, which it must leave alone: every call
+for the request transforms it again, the retries included (an encryption's nonce isn't reused). Only the request
+sent changes, the response is delivered to the request submitted.
+
+A transformer failing fails the request with a TransformError right away, without a call and without a retry: the
+same data would fail again. For a bulk call each request is transformed on its own, those failing are answered and
+the call goes out for the others. The call's units were paid for already, like those of a request expiring at the
+last moment.
+
+NoOpTransformer sends the request as is, JSONTransformer checks the data against a schema and sends it compacted.
+*/
+
+// turns the request into the one sent to the third party, see above
+type RequestTransformer func(ctx context.Context, req *UserRequest) (*UserRequest, error)
+
+// matches a TransformError with errors.Is
+var ErrTransformFailed = errors.New("request could not be transformed")
+
+// the response to a request Config.Transformer failed on, it was never sent
+type TransformError struct {
+	Err error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTransformFailed, e.Err)
+}
+
+func (e *TransformError) Is(target error) bool {
+	return target == ErrTransformFailed
+}
+
+func (e *TransformError) Unwrap() error {
+	return e.Err
+}
+
+// sends the request as it is
+func NoOpTransformer(ctx context.Context, req *UserRequest) (*UserRequest, error) {
+	return req, nil
+}
+
+// a transformer requiring the data to be a JSON document of schema's type (a struct or a pointer to one, e.g
+// SearchQuery{}), without fields the type doesn't have. The data is sent compacted, as the type encodes it.
+func JSONTransformer(schema interface{}) RequestTransformer {
+	schemaType := reflect.TypeOf(schema)
+	if schemaType.Kind() == reflect.Pointer {
+		schemaType = schemaType.Elem()
+	}
+	return func(ctx context.Context, req *UserRequest) (*UserRequest, error) {
+		document := reflect.New(schemaType).Interface()
+		decoder := json.NewDecoder(bytes.NewReader([]byte(req.Data)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(document); err != nil {
+			return nil, fmt.Errorf("data doesn't match %s: %w", schemaType, err)
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, fmt.Errorf("data holds more than a single %s", schemaType)
+		}
+
+		data, err := json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		transformed := *req
+		transformed.Data = string(data)
+		return &transformed, nil
+	}
+}
+
+// the request to hand the client in place of req, false if none is left to send: every request failed to transform
+// and was answered
+func (rl *RateLimiter) transform(t *target, req *UserRequest) (*UserRequest, bool) {
+	if rl.cfg.Transformer == nil {
+		return req, true
+	}
+	if req.batch == nil {
+		sent, err := rl.transformOne(req)
+		if err != nil {
+			t.stats.failed.Add(1)
+			rl.respond(req, &APIResponse{Err: err})
+			return nil, false
+		}
+		return sent, true
+	}
+
+	var items []*UserRequest
+	empty := rl.dropFromBatch(req, func(item *UserRequest) bool {
+		sent, err := rl.transformOne(item)
+		if err != nil {
+			t.stats.failed.Add(1)
+			rl.respond(item, &APIResponse{Err: err})
+			return true
+		}
+		items = append(items, sent)
+		return false
+	})
+	if empty {
+		return nil, false
+	}
+	sent := *req
+	sent.batch = items
+	return &sent, true
+}
+
+// runs Config.Transformer on a single request
+func (rl *RateLimiter) transformOne(req *UserRequest) (*UserRequest, error) {
+	sent, err := rl.cfg.Transformer(req.context(), req)
+	if err == nil && sent == nil {
+		err = errors.New("the transformer returned no request")
+	}
+	if err != nil {
+		return nil, &TransformError{Err: err}
+	}
+	return sent, nil
+}
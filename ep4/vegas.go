@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+MaxInflight is a guess. Set too high, a third party slowing down (a GC pause, a noisy neighbour, a deploy) gets even
+more calls piled onto it: they all queue up on its end, every one of them takes longer, and the requests waiting here
+can't be cancelled, reprioritized or expired anymore since they are already sent. Set too low, we leave throughput on
+the table when it is fast.
+
+With Config.AdaptiveConcurrency the in-flight limit follows the latency of the calls instead, like TCP Vegas (and
+Netflix's concurrency-limits): the lowest latency seen is what a call takes without load, anything above it is time
+spent waiting in a queue on the third party's end. After every window of calls (as many as the limit, about a round
+trip's worth) the average latency is compared to that minimum:
+
+	gradient = RTT_measured / RTT_min - 1
+
+- close to 0 (within vegasTolerance): no queue on their end, the limit goes up by one, if the calls actually used it
+- above: the limit is cut towards limit * (1 - gradient), vegasSmoothing of the way. Cutting all the way at once
+  overshoots: with the third party's capacity at 10 calls, a limit of 13 would drop to 9 and leave a slot idle.
+
+The limit stays between MinInflight and MaxInflight (which stays the ceiling, Workers without it). Calls that didn't
+reach the third party or were turned away (rate limited, cancelled) don't tell anything about its queue and aren't
+measured.
+
+Gotchas:
+
+- the minimum is only as good as the calls that set it. A third party that gets slower for good (a bigger payload, a
+  region farther away) would look overloaded forever, so the minimum is forgotten every vegasRTTMinReset and taken
+  from the next window again.
+- the limit is shared by all targets while their latencies are not, a slow target's calls look like queueing next to a
+  fast one's. It works best with a single third party, or similar ones.
+
+TestAdaptiveConcurrency (see vegas_test.go) shows the difference against a third party that handles 10 calls at once.
+*/
+
+const (
+	// how far above the minimum latency the average may be while the limit still goes up (10%)
+	vegasTolerance = 0.1
+	// the largest gradient acted on, a window never aims lower than half the limit
+	vegasMaxDecrease = 0.5
+	// how often the minimum latency is measured again
+	vegasRTTMinReset = time.Minute
+	// the fewest calls in a window, a handful of samples says little
+	vegasMinWindow = 10
+	// how much of the way to limit * (1 - gradient) a window goes
+	vegasSmoothing = 0.3
+)
+
+// adjusts the in-flight limit to the latency of the calls, see above. A nil limiter keeps no limit of its own.
+type VegasConcurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	minLimit float64
+	maxLimit float64
+	// the lowest latency seen since rttMinSince, zero until the first window is over
+	rttMin      time.Duration
+	rttMinSince time.Time
+	// the calls of the current window
+	windowCount int
+	windowSum   time.Duration
+	windowMin   time.Duration
+	// the most calls in flight during the window, the limit only goes up if it was used
+	windowInflight int64
+
+	// the limit rounded down, read by processQueue without the lock
+	current atomic.Int64
+}
+
+// a limiter starting at initial, staying between minLimit and maxLimit
+func NewVegasConcurrencyLimiter(initial, minLimit, maxLimit int) *VegasConcurrencyLimiter {
+	minLimit = max(minLimit, 1)
+	maxLimit = max(maxLimit, minLimit)
+	v := &VegasConcurrencyLimiter{
+		limit:    float64(min(max(initial, minLimit), maxLimit)),
+		minLimit: float64(minLimit),
+		maxLimit: float64(maxLimit),
+	}
+	v.current.Store(int64(v.limit))
+	return v
+}
+
+// the current in-flight limit
+func (v *VegasConcurrencyLimiter) Limit() int {
+	return int(v.current.Load())
+}
+
+// records the latency of a call made with inflight calls in flight (itself included), adjusting the limit at the
+// end of a window
+func (v *VegasConcurrencyLimiter) Observe(rtt time.Duration, inflight int64, now time.Time) {
+	if v == nil || rtt <= 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.windowCount++
+	v.windowSum += rtt
+	if v.windowMin == 0 || rtt < v.windowMin {
+		v.windowMin = rtt
+	}
+	v.windowInflight = max(v.windowInflight, inflight)
+	if v.windowCount < max(int(v.limit), vegasMinWindow) {
+		return
+	}
+
+	if v.rttMin == 0 || v.windowMin < v.rttMin || now.Sub(v.rttMinSince) > vegasRTTMinReset {
+		v.rttMin = v.windowMin
+		v.rttMinSince = now
+	}
+	average := v.windowSum / time.Duration(v.windowCount)
+	gradient := float64(average)/float64(v.rttMin) - 1
+
+	switch {
+	case gradient > vegasTolerance:
+		previous := v.limit
+		target := v.limit * (1 - min(gradient, vegasMaxDecrease))
+		v.limit = max(v.limit*(1-vegasSmoothing)+target*vegasSmoothing, v.minLimit)
+		if int64(v.limit) < int64(previous) {
+			log.Printf("Calls take %s (%s without load), %d calls in flight at most from now on",
+				average.Round(time.Millisecond), v.rttMin.Round(time.Millisecond), int64(v.limit))
+		}
+	case float64(v.windowInflight) >= v.limit/2:
+		// an idle limiter can't tell whether more calls would queue, it only grows while in use
+		v.limit = min(v.limit+1, v.maxLimit)
+	}
+	v.current.Store(int64(v.limit))
+
+	v.windowCount = 0
+	v.windowSum = 0
+	v.windowMin = 0
+	v.windowInflight = 0
+}
+
+// the limiter for Config.AdaptiveConcurrency, nil without it
+func newConcurrencyLimiter(cfg Config) *VegasConcurrencyLimiter {
+	if !cfg.AdaptiveConcurrency {
+		return nil
+	}
+	ceiling := cfg.MaxInflight
+	if ceiling <= 0 {
+		ceiling = cfg.Workers
+	}
+	// starts low, it goes up within a few windows if the third party keeps up
+	return NewVegasConcurrencyLimiter(max(ceiling/4, cfg.MinInflight), cfg.MinInflight, ceiling)
+}
+
+// the current in-flight limit, 0 means no limit
+func (rl *RateLimiter) inflightLimit() int64 {
+	if rl.concurrency != nil {
+		return int64(rl.concurrency.Limit())
+	}
+	return int64(rl.cfg.MaxInflight)
+}
+
+// feeds the latency of a call to the concurrency limiter, unless the call tells nothing about the third party's load
+func (rl *RateLimiter) observeLatency(req *UserRequest, rtt time.Duration, err error) {
+	if rl.concurrency == nil || notActedOn(err) || req.context().Err() != nil {
+		return
+	}
+	rl.concurrency.Observe(rtt, rl.inflight.Load(), rl.clock.Now())
+}
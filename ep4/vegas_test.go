@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a third party handling a fixed number of calls at once, the others wait their turn on its end
+type saturatingClient struct {
+	slots   chan struct{}
+	latency time.Duration
+	// calls waiting for a slot, and the most there were at once
+	waiting     atomic.Int64
+	mostWaiting atomic.Int64
+	// how long the calls took, waiting for a slot included
+	calls waitHistogram
+}
+
+func (c *saturatingClient) Call(ctx context.Context, req *UserRequest) (*APIResponse, error) {
+	start := time.Now()
+	defer func() { c.calls.observe(time.Since(start)) }()
+	waiting := c.waiting.Add(1)
+	for {
+		most := c.mostWaiting.Load()
+		if waiting <= most || c.mostWaiting.CompareAndSwap(most, waiting) {
+			break
+		}
+	}
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		c.waiting.Add(-1)
+		return nil, ctx.Err()
+	}
+	c.waiting.Add(-1)
+	time.Sleep(c.latency)
+	<-c.slots
+	return &APIResponse{Data: "ok"}, nil
+}
+
+// feeds the limiter a whole window of calls taking rtt, with the limit in flight
+func observeWindow(v *VegasConcurrencyLimiter, rtt time.Duration, now time.Time) {
+	for range max(v.Limit(), vegasMinWindow) {
+		v.Observe(rtt, int64(v.Limit()), now)
+	}
+}
+
+func TestVegasLimiterFollowsLatency(t *testing.T) {
+	// its calls queue up on the third party's end once the limit cuts them down, see the log
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := NewVegasConcurrencyLimiter(20, 2, 40)
+
+	observeWindow(v, 10*time.Millisecond, now)
+	if got := v.Limit(); got != 21 {
+		t.Fatalf("limit %d after a window at the minimum latency, expected 21", got)
+	}
+
+	// calls taking three times as long: they wait in a queue on the third party's end
+	for range 5 {
+		previous := v.Limit()
+		observeWindow(v, 30*time.Millisecond, now)
+		if v.Limit() >= previous {
+			t.Fatalf("limit went from %d to %d while calls were queueing", previous, v.Limit())
+		}
+	}
+	lowered := v.Limit()
+
+	// the queue is gone, the limit goes up a call per window
+	observeWindow(v, 10*time.Millisecond, now)
+	if got := v.Limit(); got != lowered+1 {
+		t.Fatalf("limit %d after the latency recovered, expected %d", got, lowered+1)
+	}
+
+	for range 100 {
+		observeWindow(v, time.Second, now)
+	}
+	if got := v.Limit(); got != 2 {
+		t.Fatalf("limit %d under heavy queueing, expected MinInflight 2", got)
+	}
+	for range 100 {
+		observeWindow(v, 10*time.Millisecond, now)
+	}
+	if got := v.Limit(); got != 40 {
+		t.Fatalf("limit %d once the third party kept up, expected MaxInflight 40", got)
+	}
+}
+
+// sends requests to a third party handling 10 calls at once, 20ms each, returning the most calls that waited on its
+// end at once
+func mostQueuedOnThirdParty(t *testing.T, requests int, adaptive bool) int64 {
+	client := &saturatingClient{slots: make(chan struct{}, 10), latency: 20 * time.Millisecond}
+	rl := NewRateLimiter(Config{
+		Client: client, RequestsPerMinute: 600000, Burst: requests, Workers: 100, MaxInflight: 100,
+		AdaptiveConcurrency: adaptive, Logger: quietLogger(),
+	})
+	defer rl.Shutdown(context.Background())
+
+	var pending []*UserRequest
+	for i := range requests {
+		req := &UserRequest{UserID: fmt.Sprintf("user%d", i%20), Data: "ping", Response: make(chan *APIResponse, 1)}
+		if err := rl.SubmitRequest(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+	for _, req := range pending {
+		if resp := <-req.Response; resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+	}
+	return client.mostWaiting.Load()
+}
+
+// a fixed MaxInflight of 100 piles up to 100 calls on a third party handling 10 at once, AdaptiveConcurrency keeps the
+// queue on our end where requests can still be prioritized or expired
+func TestAdaptiveConcurrency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends real calls for a couple of seconds")
+	}
+	// the fixed limit is hit on every call, and the adaptive one changes every few windows
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	fixed := mostQueuedOnThirdParty(t, 500, false)
+	adaptive := mostQueuedOnThirdParty(t, 500, true)
+	if fixed < 50 {
+		t.Fatalf("only %d calls queued on the third party's end with the fixed limit, the test is too gentle", fixed)
+	}
+	if adaptive > fixed/2 {
+		t.Fatalf("%d calls queued on the third party's end with AdaptiveConcurrency, %d with the fixed limit",
+			adaptive, fixed)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+/**
+The handler holds the HTTP connection open for up to 5 seconds waiting on the queue, and with a deep queue it times out
+anyway: the connection was held for nothing and the client retries, queuing the same request again.
+
+With a callback_url the handler doesn't wait: it queues the request, answers 202 Accepted with a request ID right away,
+and once the third party answered, the result is POSTed to the callback URL. Delivery is retried a few times with
+backoff, a receiver being briefly down shouldn't lose the result. GET /api/request/{id} serves the result too, for
+clients whose receiver never got it.
+
+Anyone can POST to the callback URL, so every delivery is signed: the X-Signature-256 header holds
+"sha256=" followed by the hex HMAC-SHA256 of the body, keyed with a secret shared with the receiver. The receiver
+recomputes it (VerifySignature) and drops deliveries that don't match.
+
+The results are kept for an hour after they come in, a client polling later than that gets a 404.
+*/
+
+const (
+	// the header holding the signature of a webhook delivery
+	SignatureHeader = "X-Signature-256"
+
+	// defaults for WebhookSender
+	defaultWebhookAttempts = 3
+	defaultWebhookBackoff  = time.Second
+	defaultWebhookTimeout  = 10 * time.Second
+
+	// how long results of async requests are kept around for polling
+	asyncResultTTL = time.Hour
+)
+
+// the outcome of an async request, POSTed to the callback URL and served by GET /api/request/{id}
+type AsyncResult struct {
+	ID string `json:"id"`
+	// "pending" until the third party answered, then "done"
+	Status string `json:"status"`
+	Data   string `json:"data,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Cached bool   `json:"cached,omitempty"`
+}
+
+const (
+	asyncPending = "pending"
+	asyncDone    = "done"
+)
+
+// signs a webhook body, see above
+func SignPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// whether signature is the signature of body, for receivers of webhooks
+func VerifySignature(secret, body []byte, signature string) bool {
+	// compared in constant time, otherwise how long the comparison takes gives the signature away byte by byte
+	return hmac.Equal([]byte(SignPayload(secret, body)), []byte(signature))
+}
+
+// POSTs signed JSON payloads to callback URLs, retrying failed deliveries
+type WebhookSender struct {
+	Secret []byte
+	// nil means a client with a 10s timeout
+	Client *http.Client
+	// deliveries attempted before giving up (default 3), and the wait before the first retry, doubled after every
+	// retry (default 1s)
+	MaxAttempts int
+	Backoff     time.Duration
+	// what the retries wait on, nil means the real clock
+	Clock Clock
+}
+
+// delivers the payload to url, returns the last error if every attempt failed
+func (s *WebhookSender) Deliver(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	signature := SignPayload(s.Secret, body)
+
+	attempts, backoff := s.MaxAttempts, s.Backoff
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, url, body, signature)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == attempts {
+			return fmt.Errorf("delivering to %s failed after %d attempts: %w", url, attempt, err)
+		}
+
+		select {
+		case <-s.clock().After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *WebhookSender) clock() Clock {
+	if s.Clock == nil {
+		return realClock{}
+	}
+	return s.Clock
+}
+
+// makes a single delivery attempt, retry tells whether trying again may help
+func (s *WebhookSender) post(ctx context.Context, url string, body []byte, signature string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	// drained so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// the receiver rejecting the delivery won't change its mind, unless it is overloaded
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("callback answered %s", resp.Status)
+}
+
+// keeps track of async requests, delivering their results to their callback
+type asyncTracker struct {
+	webhook *WebhookSender
+	clock   Clock
+
+	mu      sync.Mutex
+	results map[string]*trackedResult
+}
+
+type trackedResult struct {
+	result AsyncResult
+	// when the result came in, zero while pending
+	doneAt time.Time
+}
+
+func newAsyncTracker(webhook *WebhookSender, clock Clock) *asyncTracker {
+	// the retries wait on the limiter's clock, unless the sender was given its own
+	if webhook.Clock == nil {
+		webhook.Clock = clock
+	}
+	return &asyncTracker{webhook: webhook, clock: clock, results: make(map[string]*trackedResult)}
+}
+
+// a random ID, unguessable so one client can't poll another's results
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// tracks a submitted request, returning its ID. Its response is delivered to callbackURL once it comes in.
+func (t *asyncTracker) track(req *UserRequest, callbackURL string) string {
+	id := newRequestID()
+
+	t.mu.Lock()
+	t.prune()
+	t.results[id] = &trackedResult{result: AsyncResult{ID: id, Status: asyncPending}}
+	t.mu.Unlock()
+
+	go func() {
+		resp := <-req.Response
+		result := AsyncResult{ID: id, Status: asyncDone, Data: resp.Data, Cached: resp.Cached}
+		if resp.Err != nil {
+			result.Error = resp.Err.Error()
+		}
+
+		t.mu.Lock()
+		t.results[id] = &trackedResult{result: result, doneAt: t.clock.Now()}
+		t.mu.Unlock()
+
+		if err := t.webhook.Deliver(context.Background(), callbackURL, result); err != nil {
+			log.Printf("Callback for request %s: %v", id, err)
+		}
+	}()
+	return id
+}
+
+// forgets results older than asyncResultTTL (must be called with mu held)
+func (t *asyncTracker) prune() {
+	cutoff := t.clock.Now().Add(-asyncResultTTL)
+	for id, tracked := range t.results {
+		if !tracked.doneAt.IsZero() && tracked.doneAt.Before(cutoff) {
+			delete(t.results, id)
+		}
+	}
+}
+
+// the request's result so far
+func (t *asyncTracker) lookup(id string) (AsyncResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, exists := t.results[id]
+	if !exists {
+		return AsyncResult{}, false
+	}
+	return tracked.result, true
+}
+
+// serves the result of an async request, GET /api/request/{id}
+func (t *asyncTracker) statusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, exists := t.lookup(path.Base(r.URL.Path))
+		if !exists {
+			http.Error(w, "Unknown request", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a delivery the receiver got
+type delivery struct {
+	result AsyncResult
+	// whether the signature matched the body
+	signed bool
+}
+
+func TestWebhookDeliversSignedResult(t *testing.T) {
+	secret := []byte("s3cret")
+	deliveries := make(chan delivery, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var d delivery
+		json.Unmarshal(body, &d.result)
+		d.signed = VerifySignature(secret, body, r.Header.Get(SignatureHeader))
+		deliveries <- d
+	}))
+	defer receiver.Close()
+	rl, clock, client := scriptedLimiter(Config{})
+	defer shutdownNow(rl)
+	client.Script("alice", Succeed("pong"))
+	server := httptest.NewServer(newMux(rl, newAsyncTracker(&WebhookSender{Secret: secret}, clock), string(secret), ""))
+	defer server.Close()
+
+	form := url.Values{"callback_url": {receiver.URL}}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/request?"+form.Encode(), nil)
+	req.Header.Set("X-User-ID", "alice")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted AsyncResult
+	json.NewDecoder(resp.Body).Decode(&accepted)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || accepted.Status != asyncPending || accepted.ID == "" {
+		t.Fatalf("answered %d with %+v, expected 202 with the ID of the pending request", resp.StatusCode, accepted)
+	}
+
+	select {
+	case d := <-deliveries:
+		expected := AsyncResult{ID: accepted.ID, Status: asyncDone, Data: "pong"}
+		if d.result != expected || !d.signed {
+			t.Fatalf("delivered %+v, signed %t, expected %+v signed with the secret", d.result, d.signed, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the result was never delivered")
+	}
+
+	// the result can be polled too
+	resp, err = server.Client().Get(server.URL + resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var polled AsyncResult
+	json.NewDecoder(resp.Body).Decode(&polled)
+	resp.Body.Close()
+	if polled.Status != asyncDone || polled.Data != "pong" {
+		t.Fatalf("polled %+v, expected the result delivered", polled)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	secret, body := []byte("s3cret"), []byte(`{"id":"1","status":"done"}`)
+	signature := SignPayload(secret, body)
+	for _, tc := range []struct {
+		name      string
+		secret    []byte
+		body      []byte
+		signature string
+		valid     bool
+	}{
+		{"signed", secret, body, signature, true},
+		{"body changed", secret, []byte(`{"id":"2","status":"done"}`), signature, false},
+		{"other secret", []byte("guess"), body, signature, false},
+		{"no prefix", secret, body, signature[len("sha256="):], false},
+		{"unsigned", secret, body, "", false},
+	} {
+		if valid := VerifySignature(tc.secret, tc.body, tc.signature); valid != tc.valid {
+			t.Fatalf("%s: valid %t, expected %t", tc.name, valid, tc.valid)
+		}
+	}
+}
+
+func TestWebhookRetriesFailedDeliveries(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// what the receiver answers each attempt, 200 once they run out
+		statuses  []int
+		attempts  int
+		delivered bool
+	}{
+		{"delivered", nil, 1, true},
+		{"down for a while", []int{503, 502}, 3, true},
+		{"overloaded", []int{429}, 2, true},
+		{"down", []int{500, 500, 500}, 3, false},
+		// the receiver refusing the delivery won't change its mind
+		{"refused", []int{400}, 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(testStart)
+			var mu sync.Mutex
+			// when each attempt came in
+			var attempts []time.Time
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				attempts = append(attempts, clock.Now())
+				attempt := len(attempts)
+				mu.Unlock()
+				if attempt <= len(tc.statuses) {
+					w.WriteHeader(tc.statuses[attempt-1])
+				}
+			}))
+			defer receiver.Close()
+			sender := &WebhookSender{Secret: []byte("s3cret"), Backoff: time.Second, Clock: clock}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- sender.Deliver(context.Background(), receiver.URL, AsyncResult{ID: "1", Status: asyncDone})
+			}()
+			var err error
+		waiting:
+			for {
+				select {
+				case err = <-done:
+					break waiting
+				case <-time.After(time.Millisecond):
+					// a retry waiting out its backoff
+					if clock.Waiters() > 0 {
+						clock.AdvanceToNext()
+					}
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if (err == nil) != tc.delivered || len(attempts) != tc.attempts {
+				t.Fatalf("delivering: %v after %d attempts, expected delivered %t after %d", err, len(attempts),
+					tc.delivered, tc.attempts)
+			}
+			// the backoff doubles after every retry
+			for i, at := range attempts {
+				if expected := time.Duration(1<<i-1) * time.Second; at.Sub(testStart) != expected {
+					t.Errorf("attempt %d came in at %v, expected %v", i+1, at.Sub(testStart), expected)
+				}
+			}
+		})
+	}
+}
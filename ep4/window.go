@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+/**
+The token bucket paces the calls, it doesn't count them. Over any rolling minute it lets RequestsPerMinute through
+plus a full Burst on top, and more after a change of rate: a rate cut by Config.Adaptive (or a reconfiguration) still
+leaves the tokens saved at the old rate. A third party counting calls per minute sees the difference.
+
+So every target also keeps a sliding window: the calls of the last minute with their units, counted when they go out
+(the time their reservation is paid off). A call whose units don't fit in RequestsPerMinute minus what the window
+holds isn't reserved, whatever the bucket says, and the request waits in the queue until the oldest calls leave the
+window. Stats reports each target's window usage.
+
+The window keeps an entry per call, at most RequestsPerMinute of them, memory the counters of a fixed window would
+save. But a fixed window lets twice the limit through around the turn of the minute, the very burst it is there to
+stop.
+*/
+
+// a call counted by a callWindow
+type windowCall struct {
+	at    time.Time
+	units int
+}
+
+// the calls of the last minute, see above. Guarded by the target's bucketMu.
+type callWindow struct {
+	calls []windowCall
+	// the units of calls
+	used int
+}
+
+// forgets the calls that left the window
+func (w *callWindow) expire(now time.Time) {
+	start := now.Add(-time.Minute)
+	dropped := 0
+	for _, call := range w.calls {
+		if call.at.After(start) {
+			break
+		}
+		w.used -= call.units
+		dropped++
+	}
+	w.calls = w.calls[dropped:]
+}
+
+// whether a call of the given units fits next to the calls of the last minute. A call alone in the window always
+// fits, even one bigger than the limit.
+func (w *callWindow) fits(units, limit int, now time.Time) bool {
+	w.expire(now)
+	return w.used == 0 || w.used+units <= limit
+}
+
+// counts a call going out at the given time
+func (w *callWindow) add(units int, at time.Time) {
+	w.calls = append(w.calls, windowCall{at: at, units: units})
+	w.used += units
+}
+
+// takes back a call counted by add whose units weren't granted after all
+func (w *callWindow) remove(units int, at time.Time) {
+	for i := len(w.calls) - 1; i >= 0; i-- {
+		if w.calls[i].at.Equal(at) && w.calls[i].units == units {
+			w.calls = slices.Delete(w.calls, i, i+1)
+			w.used -= units
+			return
+		}
+	}
+}
+
+// the units of the calls of the last minute (calls reserved to go out later included)
+func (w *callWindow) usage(now time.Time) int {
+	w.expire(now)
+	return w.used
+}
+
+// the units the target sent in the last minute, see above
+func (t *target) windowUsage(now time.Time) int {
+	t.bucketMu.Lock()
+	defer t.bucketMu.Unlock()
+
+	return t.window.usage(now)
+}
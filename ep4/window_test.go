@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDispatchStopsAtThePerMinuteCap(t *testing.T) {
+	// the bucket alone would let the 10 of the burst through, then one more every 6s
+	rl, clock, client := scriptedLimiter(Config{RequestsPerMinute: 10, Burst: 10})
+	defer shutdownNow(rl)
+	pending := submitRequests(t, rl, 25)
+
+	runUntil(clock, testStart.Add(30*time.Second))
+	if calls := callsBefore(client, clock.Now()); len(calls) != 10 {
+		t.Fatalf("%d calls in the first 30s, expected the cap of 10", len(calls))
+	}
+	if s := rl.Stats(); s.UnitsLastMinute != 10 {
+		t.Fatalf("%d units counted in the last minute, expected 10", s.UnitsLastMinute)
+	}
+
+	for _, req := range pending {
+		if resp := awaitResponse(t, clock, req); resp.Err != nil {
+			t.Fatalf("request of %s failed: %v", req.UserID, resp.Err)
+		}
+	}
+	// nothing until the first calls leave the window, then as many again
+	perMinute := make(map[time.Duration]int)
+	for _, call := range client.Calls() {
+		perMinute[call.At.Sub(testStart)]++
+	}
+	expected := map[time.Duration]int{0: 10, time.Minute: 10, 2 * time.Minute: 5}
+	if len(perMinute) != len(expected) {
+		t.Fatalf("calls went out at %v, expected %v", perMinute, expected)
+	}
+	for at, count := range expected {
+		if perMinute[at] != count {
+			t.Fatalf("calls went out at %v, expected %v", perMinute, expected)
+		}
+	}
+}
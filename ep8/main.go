@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**
+
+Back to paying salaries from episode 1, this time without the vault.
+
+In episode 1, managers all pull from one queue, and because two managers could end up with batches of the same client,
+every manager has to go to the vault, pick the client's key and lock the client before doing any work.
+
+Fan-out/fan-in takes a different route: instead of everybody sharing one queue and fighting over locks,
+a dispatcher hands each batch to exactly one of N workers (fan-out), and the results of all workers are merged back
+into a single stream (fan-in).
+
+The gotcha is in how the dispatcher picks the worker. Hand batches out round-robin and two batches of the same client
+can land on two different workers and be processed at the same time, out of order, which is exactly what the vault was
+protecting us from. So batches are partitioned by client: client 7 always goes to worker 7 % N. Each worker processes its
+batches one after the other, so a client's batches are processed in order, by one worker at a time, without a single mutex.
+
+The price: a client with a huge backlog only ever gets one worker, and clients that happen to share a partition wait
+on each other. Episode 1 has the same per-client limit (one manager per client at a time), but any idle manager can pick
+up any other client.
+
+Cancellation: every stage also watches a done channel, closing it tells all the goroutines to stop
+(and not leak, blocked on a send nobody will ever receive).
+
+FanIn is the part that is easy to get wrong: the merged channel may only be closed once ALL input channels are closed
+and drained. Close it after the first one finishes and the other workers panic sending on a closed channel;
+never close it and whoever ranges over it waits forever. A WaitGroup with one count per input channel handles that.
+
+*/
+
+// represents a batch of transactions for a client
+type TransactionBatch struct {
+	clientID      int
+	transactionID int
+	transactions  []string
+}
+
+// represents the outcome of processing a batch
+type Result struct {
+	WorkerID      int
+	ClientID      int
+	TransactionID int
+	Processed     int
+	Duration      time.Duration
+}
+
+// simulated time it takes to process a single transaction
+const transactionCost = 10 * time.Millisecond
+
+// splits the input into n channels, every batch of a client always goes to the same channel so a client's batches
+// stay in order. All returned channels are closed once input is closed (or done is).
+func FanOut(done <-chan struct{}, input <-chan TransactionBatch, n int) []<-chan TransactionBatch {
+	outputs := make([]chan TransactionBatch, n)
+	readOnly := make([]<-chan TransactionBatch, n)
+	for i := range outputs {
+		outputs[i] = make(chan TransactionBatch)
+		readOnly[i] = outputs[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, out := range outputs {
+				close(out)
+			}
+		}()
+
+		for batch := range input {
+			select {
+			case outputs[batch.clientID%n] <- batch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return readOnly
+}
+
+// merges the channels into one, the returned channel is closed once every input channel is closed and drained
+// (or done is closed)
+func FanIn(done <-chan struct{}, channels ...<-chan Result) <-chan Result {
+	var wg sync.WaitGroup
+	merged := make(chan Result)
+
+	// one goroutine per channel, forwarding everything it receives into merged
+	forward := func(ch <-chan Result) {
+		defer wg.Done()
+		for result := range ch {
+			select {
+			case merged <- result:
+			case <-done:
+				return
+			}
+		}
+	}
+
+	wg.Add(len(channels))
+	for _, ch := range channels {
+		go forward(ch)
+	}
+
+	// only once all of them are done is it safe to close merged
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+
+	return merged
+}
+
+// processes the batches it receives one after the other and reports a Result for each
+func worker(done <-chan struct{}, workerID int, batches <-chan TransactionBatch) <-chan Result {
+	results := make(chan Result)
+	go func() {
+		defer close(results)
+		for batch := range batches {
+			start := time.Now()
+			for range batch.transactions {
+				time.Sleep(transactionCost) // Simulate processing time
+			}
+
+			select {
+			case results <- Result{
+				WorkerID:      workerID,
+				ClientID:      batch.clientID,
+				TransactionID: batch.transactionID,
+				Processed:     len(batch.transactions),
+				Duration:      time.Since(start),
+			}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// runs the batches through fan-out/fan-in with n workers, the results come out of the returned channel.
+// Closing done stops every stage, the producer feeding the batches included.
+func fanOutFanIn(done <-chan struct{}, batches []TransactionBatch, n int) <-chan Result {
+	input := make(chan TransactionBatch)
+	go func() {
+		defer close(input)
+		for _, batch := range batches {
+			select {
+			case input <- batch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	partitions := FanOut(done, input, n)
+	results := make([]<-chan Result, n)
+	for i, partition := range partitions {
+		results[i] = worker(done, i+1, partition)
+	}
+	return FanIn(done, results...)
+}
+
+// processes the batches with n workers using fan-out/fan-in and returns how long it took
+func runFanOutFanIn(batches []TransactionBatch, n int) time.Duration {
+	start := time.Now()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	for result := range fanOutFanIn(done, batches, n) {
+		fmt.Printf("Worker %d processed batch %d for client %d (%d transactions) in %s\n",
+			result.WorkerID, result.TransactionID, result.ClientID, result.Processed, result.Duration.Round(time.Millisecond))
+	}
+
+	return time.Since(start)
+}
+
+// processes the batches the episode 1 way: n managers sharing one queue, locking each client through the vault
+func runSharedQueueWithLocks(batches []TransactionBatch, n int) time.Duration {
+	start := time.Now()
+
+	queue := make(chan TransactionBatch, len(batches))
+	for _, batch := range batches {
+		queue <- batch
+	}
+	close(queue)
+
+	vault := make(map[int]*sync.Mutex)
+	var vaultMutex sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				vaultMutex.Lock()
+				clientLock, exists := vault[batch.clientID]
+				if !exists {
+					clientLock = &sync.Mutex{}
+					vault[batch.clientID] = clientLock
+				}
+				vaultMutex.Unlock()
+
+				clientLock.Lock()
+				for range batch.transactions {
+					time.Sleep(transactionCost)
+				}
+				clientLock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return time.Since(start)
+}
+
+// rounds batches of 5 salaries for each of the clients
+func salaryBatches(rounds int, clientIDs ...int) []TransactionBatch {
+	var batches []TransactionBatch
+	transactionID := 1
+	for round := 0; round < rounds; round++ {
+		for _, clientID := range clientIDs {
+			batches = append(batches, TransactionBatch{
+				clientID:      clientID,
+				transactionID: transactionID,
+				transactions:  []string{"Salary A", "Salary B", "Salary C", "Salary D", "Salary E"},
+			})
+			transactionID++
+		}
+	}
+	return batches
+}
+
+func main() {
+	// 6 clients with 4 batches of 5 salaries each
+	batches := salaryBatches(4, 1, 2, 3, 4, 5, 6)
+
+	numWorkers := 3
+	fanOutTook := runFanOutFanIn(batches, numWorkers)
+	sharedQueueTook := runSharedQueueWithLocks(batches, numWorkers)
+
+	// with clients spread evenly across partitions both end up close, skew the clients towards one partition
+	// (e.g all client IDs multiples of 3) and fan-out falls behind since one worker gets all the work,
+	// see the benchmarks in main_test.go
+	fmt.Printf("\n%d batches with %d workers\n", len(batches), numWorkers)
+	fmt.Printf("fan-out/fan-in:             %s\n", fanOutTook.Round(time.Millisecond))
+	fmt.Printf("shared queue + vault (ep1): %s\n", sharedQueueTook.Round(time.Millisecond))
+}
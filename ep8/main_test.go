@@ -0,0 +1,86 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFanOutFanInKeepsClientsInOrder(t *testing.T) {
+	batches := salaryBatches(4, 1, 2, 3, 4, 5, 6, 7)
+	done := make(chan struct{})
+	defer close(done)
+
+	last := make(map[int]int)
+	workers := make(map[int]int)
+	processed := 0
+	for result := range fanOutFanIn(done, batches, 3) {
+		if result.TransactionID < last[result.ClientID] {
+			t.Fatalf("batch %d of client %d processed after batch %d", result.TransactionID, result.ClientID,
+				last[result.ClientID])
+		}
+		last[result.ClientID] = result.TransactionID
+		if worker, seen := workers[result.ClientID]; seen && worker != result.WorkerID {
+			t.Fatalf("client %d processed by workers %d and %d", result.ClientID, worker, result.WorkerID)
+		}
+		workers[result.ClientID] = result.WorkerID
+		processed++
+	}
+	if processed != len(batches) {
+		t.Fatalf("%d results for %d batches", processed, len(batches))
+	}
+}
+
+func TestFanOutFanInStopsOnDone(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	done := make(chan struct{})
+	results := fanOutFanIn(done, salaryBatches(10, 1, 2, 3, 4, 5, 6), 3)
+	<-results
+	// nobody reads the other results, every stage is blocked on a send
+	close(done)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left behind after done was closed\n%s", runtime.NumGoroutine()-before,
+				buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// both approaches with 3 workers, see main
+func benchmarkFanOutFanIn(b *testing.B, batches []TransactionBatch) {
+	for b.Loop() {
+		done := make(chan struct{})
+		for range fanOutFanIn(done, batches, 3) {
+		}
+		close(done)
+	}
+}
+
+func benchmarkSharedQueueWithLocks(b *testing.B, batches []TransactionBatch) {
+	for b.Loop() {
+		runSharedQueueWithLocks(batches, 3)
+	}
+}
+
+// clients spread evenly across the 3 partitions: both keep every worker busy
+func BenchmarkFanOutFanInEven(b *testing.B) {
+	benchmarkFanOutFanIn(b, salaryBatches(4, 1, 2, 3, 4, 5, 6))
+}
+
+func BenchmarkSharedQueueWithLocksEven(b *testing.B) {
+	benchmarkSharedQueueWithLocks(b, salaryBatches(4, 1, 2, 3, 4, 5, 6))
+}
+
+// every client in partition 0: fan-out leaves two workers idle, episode 1's managers share the clients out
+func BenchmarkFanOutFanInSkewed(b *testing.B) {
+	benchmarkFanOutFanIn(b, salaryBatches(4, 3, 6, 9, 12, 15, 18))
+}
+
+func BenchmarkSharedQueueWithLocksSkewed(b *testing.B) {
+	benchmarkSharedQueueWithLocks(b, salaryBatches(4, 3, 6, 9, 12, 15, 18))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/**
+
+Episode 1 again, salaries, clients and account managers, but this time there is no vault and not a single mutex.
+
+In episode 1 the state everybody cares about (which client is being worked on) lives in shared memory,
+so every access has to go through a lock: the vault mutex to find a client's key, the client's own mutex to work on it.
+
+The actor model turns that around: "don't communicate by sharing memory; share memory by communicating".
+
+An actor owns its state and nobody else ever touches it. The only way to get something done is to drop a message in the
+actor's mailbox (a channel), and the actor's own goroutine handles its messages one at a time. Since only one goroutine
+ever reads or writes the state, there is nothing to lock.
+
+- a ClientActor per client owns the client's queue of batches and whether one of its batches is being processed
+  (that flag is what the client's mutex was in episode 1). It only hands out its next batch once the previous one is
+  done, so a client's batches are processed in order and never by two managers at once.
+- a ManagerActor per account manager owns its stats. It processes the batches it is sent and tells the client when it's done.
+
+Gotcha: mailboxes are bounded. A ClientActor blocked sending to a full manager mailbox, while that manager is blocked
+sending "done" to the client's full mailbox, is a deadlock, just without a mutex in sight. Cycles between actors
+need mailboxes big enough for the worst case (or sends that can give up, which is why Send takes a context).
+
+Shutdown is a context: cancel it and every actor stops after the message it's currently handling.
+
+*/
+
+// represents a batch of transactions for a client
+type TransactionBatch struct {
+	clientID      int
+	transactionID int
+	transactions  []string
+}
+
+// simulated time it takes to process a single transaction
+const transactionCost = 5 * time.Millisecond
+
+// owns a State that only its own goroutine touches, everyone else talks to it through its mailbox
+type Actor[State, Msg any] struct {
+	state   State
+	mailbox chan Msg
+	handle  func(ctx context.Context, state *State, msg Msg)
+}
+
+// creates an actor with the given initial state and message handler, it does nothing until Start is called
+func NewActor[State, Msg any](state State, mailboxSize int, handle func(ctx context.Context, state *State, msg Msg)) *Actor[State, Msg] {
+	return &Actor[State, Msg]{
+		state:   state,
+		mailbox: make(chan Msg, mailboxSize),
+		handle:  handle,
+	}
+}
+
+// handles messages one at a time until ctx is cancelled
+func (a *Actor[State, Msg]) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-a.mailbox:
+				a.handle(ctx, &a.state, msg)
+			}
+		}
+	}()
+}
+
+// drops a message in the actor's mailbox, giving up if ctx is cancelled while the mailbox is full
+func (a *Actor[State, Msg]) Send(ctx context.Context, msg Msg) error {
+	select {
+	case a.mailbox <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// messages a ClientActor understands
+type ClientMsg struct {
+	// a new batch was submitted for the client
+	Submitted *TransactionBatch
+	// the batch with this ID finished processing
+	Done int
+}
+
+// what a ClientActor owns
+type ClientState struct {
+	clientID int
+	// true while one of the client's batches is with a manager (episode 1's client lock)
+	busy    bool
+	pending []TransactionBatch
+	// picks the manager for the next batch
+	managers []*ManagerActor
+	// where finished batches are reported
+	completed chan<- int
+	self      *ClientActor
+}
+
+type ClientActor = Actor[ClientState, ClientMsg]
+
+// messages a ManagerActor understands
+type ManagerMsg struct {
+	// a batch to process, and the client to tell once it's done
+	Process *TransactionBatch
+	ReplyTo *ClientActor
+	// asks the manager for its stats
+	StatsReply chan<- ManagerStats
+}
+
+// what a ManagerActor owns
+type ManagerStats struct {
+	ManagerID    int
+	Batches      int
+	Transactions int
+	Failures     int
+}
+
+type ManagerActor = Actor[ManagerStats, ManagerMsg]
+
+func NewClientActor(clientID int, managers []*ManagerActor, completed chan<- int) *ClientActor {
+	client := NewActor(ClientState{clientID: clientID, managers: managers, completed: completed}, 100, handleClientMsg)
+	client.state.self = client
+	return client
+}
+
+func handleClientMsg(ctx context.Context, state *ClientState, msg ClientMsg) {
+	if msg.Submitted != nil {
+		state.pending = append(state.pending, *msg.Submitted)
+	} else {
+		state.busy = false
+		state.completed <- msg.Done
+	}
+
+	// only one batch of the client is ever with a manager
+	if state.busy || len(state.pending) == 0 {
+		return
+	}
+	next := state.pending[0]
+	state.pending = state.pending[1:]
+	state.busy = true
+
+	manager := state.managers[next.transactionID%len(state.managers)]
+	if err := manager.Send(ctx, ManagerMsg{Process: &next, ReplyTo: state.self}); err != nil {
+		fmt.Printf("Client %d could not hand batch %d to a manager: %v\n", state.clientID, next.transactionID, err)
+	}
+}
+
+func NewManagerActor(managerID int) *ManagerActor {
+	return NewActor(ManagerStats{ManagerID: managerID}, 100, handleManagerMsg)
+}
+
+func handleManagerMsg(ctx context.Context, stats *ManagerStats, msg ManagerMsg) {
+	if msg.StatsReply != nil {
+		msg.StatsReply <- *stats
+		return
+	}
+
+	batch := msg.Process
+	for range batch.transactions {
+		time.Sleep(transactionCost) // Simulate processing time
+		if rand.Float32() < 0.1 {
+			stats.Failures++
+			continue
+		}
+		stats.Transactions++
+	}
+	stats.Batches++
+
+	if err := msg.ReplyTo.Send(ctx, ClientMsg{Done: batch.transactionID}); err != nil {
+		fmt.Printf("Manager %d could not report batch %d: %v\n", stats.ManagerID, batch.transactionID, err)
+	}
+}
+
+// processes the batches with actors and returns how long it took
+func runActors(batches []TransactionBatch, numManagers int) time.Duration {
+	start := time.Now()
+	for _, stats := range processWithActors(batches, numManagers) {
+		fmt.Printf("Manager %d processed %d batches (%d transactions, %d failures)\n",
+			stats.ManagerID, stats.Batches, stats.Transactions, stats.Failures)
+	}
+	return time.Since(start)
+}
+
+// processes the batches with a ClientActor per client and numManagers ManagerActors, returning the managers' stats
+func processWithActors(batches []TransactionBatch, numManagers int) []ManagerStats {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	managers := make([]*ManagerActor, numManagers)
+	for i := range managers {
+		managers[i] = NewManagerActor(i + 1)
+		managers[i].Start(ctx)
+	}
+
+	completed := make(chan int, len(batches))
+	clients := make(map[int]*ClientActor)
+	for _, batch := range batches {
+		client, exists := clients[batch.clientID]
+		if !exists {
+			client = NewClientActor(batch.clientID, managers, completed)
+			client.Start(ctx)
+			clients[batch.clientID] = client
+		}
+		if err := client.Send(ctx, ClientMsg{Submitted: &batch}); err != nil {
+			fmt.Printf("Could not submit batch %d: %v\n", batch.transactionID, err)
+		}
+	}
+
+	for range batches {
+		<-completed
+	}
+
+	// stats are read by asking, not by peeking into the manager's memory
+	var stats []ManagerStats
+	for _, manager := range managers {
+		reply := make(chan ManagerStats, 1)
+		if err := manager.Send(ctx, ManagerMsg{StatsReply: reply}); err == nil {
+			stats = append(stats, <-reply)
+		}
+	}
+	return stats
+}
+
+// processes the batches the episode 1 way: managers sharing one queue, locking each client through the vault
+func runSharedMemory(batches []TransactionBatch, numManagers int) time.Duration {
+	start := time.Now()
+
+	queue := make(chan TransactionBatch, len(batches))
+	for _, batch := range batches {
+		queue <- batch
+	}
+	close(queue)
+
+	vault := make(map[int]*sync.Mutex)
+	var vaultMutex sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < numManagers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				vaultMutex.Lock()
+				clientLock, exists := vault[batch.clientID]
+				if !exists {
+					clientLock = &sync.Mutex{}
+					vault[batch.clientID] = clientLock
+				}
+				vaultMutex.Unlock()
+
+				clientLock.Lock()
+				for range batch.transactions {
+					time.Sleep(transactionCost)
+				}
+				clientLock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return time.Since(start)
+}
+
+// rounds batches of 4 salaries for each of the clients
+func salaryBatches(rounds, clients int) []TransactionBatch {
+	var batches []TransactionBatch
+	transactionID := 1
+	for round := 0; round < rounds; round++ {
+		for clientID := 1; clientID <= clients; clientID++ {
+			batches = append(batches, TransactionBatch{
+				clientID:      clientID,
+				transactionID: transactionID,
+				transactions:  []string{"Salary A", "Salary B", "Salary C", "Salary D"},
+			})
+			transactionID++
+		}
+	}
+	return batches
+}
+
+func main() {
+	// 5 clients with 6 batches of 4 salaries each
+	batches := salaryBatches(6, 5)
+
+	numManagers := 3
+	actorsTook := runActors(batches, numManagers)
+	sharedMemoryTook := runSharedMemory(batches, numManagers)
+
+	fmt.Printf("\n%d batches with %d managers\n", len(batches), numManagers)
+	fmt.Printf("actors:                       %s\n", actorsTook.Round(time.Millisecond))
+	fmt.Printf("shared memory + vault (ep1):  %s\n", sharedMemoryTook.Round(time.Millisecond))
+	// go test -bench . ./ep9 times both over more runs
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestActorsProcessEveryBatch(t *testing.T) {
+	batches := salaryBatches(6, 5)
+	stats := processWithActors(batches, 3)
+	if len(stats) != 3 {
+		t.Fatalf("stats of %d managers, expected 3", len(stats))
+	}
+
+	processed, transactions := 0, 0
+	for _, manager := range stats {
+		processed += manager.Batches
+		transactions += manager.Transactions + manager.Failures
+	}
+	if processed != len(batches) || transactions != 4*len(batches) {
+		t.Fatalf("%d batches and %d transactions processed, expected %d and %d", processed, transactions,
+			len(batches), 4*len(batches))
+	}
+}
+
+// the same batches and managers as main
+func BenchmarkActors(b *testing.B) {
+	batches := salaryBatches(6, 5)
+	for b.Loop() {
+		processWithActors(batches, 3)
+	}
+}
+
+func BenchmarkSharedMemory(b *testing.B) {
+	batches := salaryBatches(6, 5)
+	for b.Loop() {
+		runSharedMemory(batches, 3)
+	}
+}
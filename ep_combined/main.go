@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+/**
+Episode 2's rate limiter and episode 3's aggregator, running together: every request episode 2 turns away is counted
+by episode 3 (see ep2/analytics.go).
+
+Each episode is a program of its own, so this builds both and runs them side by side, episode 3's API on :8090 and
+episode 2 told where to find it with ANALYTICS_URL. It then sends a user more requests than RequestLimit allows and
+asks the aggregator for the user's windows: their value is the number of requests turned away.
+
+Run it from the root of the repository (or point -root at it): go run ./ep_combined. The episodes are built with the
+repository's go.mod, like go run ./ep2 would.
+*/
+
+const (
+	// where episode 2 serves the API it rate limits
+	rateLimitedAPI = "http://localhost:8080/api"
+	// episode 3's API
+	analyticsAddr = "localhost:8090"
+)
+
+// the ID episode 3 knows a user by, the same as ep2's analyticsUserID
+func analyticsUserID(userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return int(h.Sum32()&0x7fffffff) + 1
+}
+
+// builds the episode in dir into binDir and starts it with the given environment, its output going to a log file
+// next to the binary
+func start(ctx context.Context, binDir, dir string, env ...string) (*exec.Cmd, error) {
+	bin := filepath.Join(binDir, filepath.Base(dir))
+	build := exec.CommandContext(ctx, "go", "build", "-o", bin, ".")
+	build.Dir = dir
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		return nil, fmt.Errorf("building %s: %w", dir, err)
+	}
+
+	logFile, err := os.Create(bin + ".log")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(bin)
+	// episode 3 writes its exports next to itself
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", dir, err)
+	}
+	return cmd, nil
+}
+
+// stops an episode started by start
+func stop(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// waits until something listens on addr
+func waitForPort(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nothing listening on %s after %s", addr, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func run(root string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	binDir, err := os.MkdirTemp("", "ep_combined")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(binDir)
+
+	aggregator, err := start(ctx, binDir, filepath.Join(root, "ep3"), "API_ADDR="+analyticsAddr)
+	if err != nil {
+		return err
+	}
+	defer stop(aggregator)
+	if err := waitForPort(analyticsAddr, 30*time.Second); err != nil {
+		return err
+	}
+
+	limiter, err := start(ctx, binDir, filepath.Join(root, "ep2"), "ANALYTICS_URL=http://"+analyticsAddr+"/events")
+	if err != nil {
+		return err
+	}
+	defer stop(limiter)
+	if err := waitForPort("localhost:8080", 30*time.Second); err != nil {
+		return err
+	}
+
+	// twice what RequestLimit allows
+	userID := "alice"
+	turnedAway := 0
+	for range 10 {
+		req, _ := http.NewRequest(http.MethodGet, rateLimitedAPI, nil)
+		req.Header.Set("X-User-ID", userID)
+		// Go's default user agent would get the bot limit, see ep2/bot.go
+		req.Header.Set("User-Agent", "Mozilla/5.0 (ep_combined)")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			turnedAway++
+		}
+	}
+	fmt.Printf("Episode 2 turned away %d of 10 requests of user %s\n", turnedAway, userID)
+
+	// the events are sent in the background
+	time.Sleep(time.Second)
+	id := analyticsUserID(userID)
+	resp, err := http.Get(fmt.Sprintf("http://%s/aggregates/%d", analyticsAddr, id))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("episode 3 answered %d: %s", resp.StatusCode, body)
+	}
+	var windows []struct {
+		StartTime time.Time `json:"start_time"`
+		Value     int       `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&windows); err != nil {
+		return err
+	}
+	for _, window := range windows {
+		fmt.Printf("Episode 3, user %d (%s), window %s: %d requests rate limited\n",
+			id, userID, window.StartTime.Format(time.RFC822), window.Value)
+	}
+	return nil
+}
+
+func main() {
+	root := flag.String("root", ".", "the root of the repository, holding ep2 and ep3")
+	flag.Parse()
+
+	if err := run(*root); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
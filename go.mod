@@ -0,0 +1,14 @@
+module github.com/Blazingkevin/engineering-gotchas
+
+go 1.25
+
+require (
+	github.com/alicebob/miniredis/v2 v2.37.0
+	github.com/bits-and-blooms/bloom/v3 v3.7.1
+	github.com/graphql-go/graphql v0.8.1
+)
+
+require (
+	github.com/bits-and-blooms/bitset v1.24.2 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+)